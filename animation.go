@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"io/ioutil"
+)
+
+// Animation is an image with multiple frames (an animated GIF). Frames are composited, each of them
+// is a whole picture of the size of the animation. The first frame is used where a still image is expected.
+type Animation struct {
+	image.Image
+	frames []image.Image
+	// Delays after frames in 100ths of a second
+	delays    []int
+	loopCount int
+}
+
+func newAnimation(frames []image.Image, delays []int, loopCount int) *Animation {
+	return &Animation{frames[0], frames, delays, loopCount}
+}
+
+// decodeGIF reads all frames of a GIF image, images with a single frame are returned as still images.
+// The number of frames and the size are checked before the frames are decoded.
+func decodeGIF(reader io.Reader) (image.Image, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	config, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	err = checkAnimationSize(countGIFFrames(data), config.Width, config.Height)
+	if err != nil {
+		return nil, err
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(g.Image) == 0 {
+		return nil, fmt.Errorf("gif: no frames")
+	}
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+
+	// Frames can cover just a part of the image and depend on the previous ones
+	canvas := image.NewRGBA(bounds)
+	frames := make([]image.Image, len(g.Image))
+	for i, frame := range g.Image {
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = cloneRGBA(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		frames[i] = cloneRGBA(canvas)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.ZP, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	if len(frames) == 1 {
+		return frames[0], nil
+	}
+	return newAnimation(frames, g.Delay, g.LoopCount), nil
+}
+
+// countGIFFrames counts the image descriptors of a GIF image by skipping over its blocks without decompressing
+// them. Invalid data stops the count, the decoder reports the error then.
+func countGIFFrames(data []byte) int {
+	const (
+		headerSize           = 6 + 7
+		imageDescriptorSize  = 10
+		blockExtension       = 0x21
+		blockImageDescriptor = 0x2c
+		flagColorTable       = 0x80
+	)
+	// Skips a colour table given its flags and then a sequence of data sub-blocks ending with an empty one
+	colorTableSize := func(flags byte) int {
+		if flags&flagColorTable == 0 {
+			return 0
+		}
+		return 3 << (flags&0x07 + 1)
+	}
+	skipSubBlocks := func(i int) int {
+		for i < len(data) && data[i] != 0 {
+			i += int(data[i]) + 1
+		}
+		return i + 1
+	}
+
+	if len(data) < headerSize {
+		return 0
+	}
+	frames := 0
+	i := headerSize + colorTableSize(data[10])
+	for i < len(data) {
+		switch data[i] {
+		case blockExtension:
+			i = skipSubBlocks(i + 2)
+		case blockImageDescriptor:
+			if i+imageDescriptorSize > len(data) {
+				return frames
+			}
+			frames++
+			// The descriptor is followed by an optional colour table, the LZW code size and the image data
+			i = skipSubBlocks(i + imageDescriptorSize + colorTableSize(data[i+9]) + 1)
+		default:
+			// The trailer or invalid data
+			return frames
+		}
+	}
+	return frames
+}
+
+// encodeGIF writes a still image or an animation as GIF, each frame gets a palette of at most the given number of colours
+func encodeGIF(w io.Writer, img image.Image, colors int) error {
+	frames, delays, loopCount := []image.Image{img}, []int{0}, 0
+	if animation, ok := img.(*Animation); ok {
+		frames, delays, loopCount = animation.frames, animation.delays, animation.loopCount
+	}
+
+	g := &gif.GIF{LoopCount: loopCount}
+	for i, frame := range frames {
+		paletted := quantiseImage(thresholdAlpha(frame), colors)
+		paletted.Rect = paletted.Rect.Sub(paletted.Rect.Min)
+		g.Image = append(g.Image, paletted)
+		g.Delay = append(g.Delay, delays[i])
+		// Frames are whole pictures, nothing from the previous frame should show through transparent pixels
+		g.Disposal = append(g.Disposal, gif.DisposalBackground)
+	}
+	return gif.EncodeAll(w, g)
+}
+
+// GIF pixels are either opaque or fully transparent, semi-transparent pixels are turned into one of these
+func thresholdAlpha(img image.Image) image.Image {
+	if opaque, ok := img.(interface {
+		Opaque() bool
+	}); ok && opaque.Opaque() {
+		return img
+	}
+	bounds := img.Bounds()
+	result := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A < 128 {
+				c = color.NRGBA{}
+			} else {
+				c.A = 255
+			}
+			result.SetNRGBA(x, y, c)
+		}
+	}
+	return result
+}
+
+func cloneRGBA(img *image.RGBA) *image.RGBA {
+	clone := image.NewRGBA(img.Bounds())
+	copy(clone.Pix, img.Pix)
+	return clone
+}
+
+// checkAnimationSize returns an error if an animation has more frames or all of its frames together
+// have more pixels than allowed by the configuration
+func checkAnimationSize(frames, width, height int) error {
+	if Config.maxFrames > 0 && frames > Config.maxFrames {
+		return fmt.Errorf("too many frames: %d, allowed: %d", frames, Config.maxFrames)
+	}
+	pixels := frames * width * height
+	if Config.maxAnimationPixels > 0 && pixels > Config.maxAnimationPixels {
+		return fmt.Errorf("too many pixels in all frames: %d, allowed: %d", pixels, Config.maxAnimationPixels)
+	}
+	return nil
+}
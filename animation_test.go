@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+var (
+	red  = color.RGBA{255, 0, 0, 255}
+	blue = color.RGBA{0, 0, 255, 255}
+)
+
+// Red background, a blue square disposed of after the second frame and an empty third frame
+func createAnimatedGIF() []byte {
+	palette := color.Palette{color.Transparent, red, blue}
+	background := image.NewPaletted(image.Rect(0, 0, 20, 10), palette)
+	for i := range background.Pix {
+		background.Pix[i] = 1
+	}
+	square := image.NewPaletted(image.Rect(5, 2, 10, 7), palette)
+	for i := range square.Pix {
+		square.Pix[i] = 2
+	}
+	empty := image.NewPaletted(image.Rect(0, 0, 1, 1), palette)
+
+	var buffer bytes.Buffer
+	gif.EncodeAll(&buffer, &gif.GIF{
+		Image:     []*image.Paletted{background, square, empty},
+		Delay:     []int{10, 20, 30},
+		Disposal:  []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalNone},
+		LoopCount: 2,
+	})
+	return buffer.Bytes()
+}
+
+func TestDecodeGIF(t *testing.T) {
+	img, format, err := decodeImage(bytes.NewReader(createAnimatedGIF()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	animation, ok := img.(*Animation)
+	if !ok || format != "gif" {
+		t.Fatalf("Expected an animated gif, actual: %T %s", img, format)
+	}
+	if len(animation.frames) != 3 || animation.delays[1] != 20 || animation.loopCount != 2 {
+		t.Errorf("Expected 3 frames with delays and loop count, actual: %d %v %d", len(animation.frames), animation.delays, animation.loopCount)
+	}
+
+	cases := []struct {
+		frame int
+		point image.Point
+		exp   color.Color
+	}{
+		{0, image.Point{6, 3}, red},
+		{1, image.Point{6, 3}, blue},
+		{1, image.Point{0, 0}, red},
+		{2, image.Point{6, 3}, color.RGBA{}},
+		{2, image.Point{15, 3}, red},
+	}
+	for _, c := range cases {
+		frame := animation.frames[c.frame]
+		if frame.Bounds() != image.Rect(0, 0, 20, 10) {
+			t.Errorf("Expected frame %d to be a whole picture, actual: %v", c.frame, frame.Bounds())
+		}
+		if act := color.RGBAModel.Convert(frame.At(c.point.X, c.point.Y)); act != c.exp {
+			t.Errorf("Frame %d at %v failed, expected: %v, actual: %v", c.frame, c.point, c.exp, act)
+		}
+	}
+}
+
+func TestEncodeGIF(t *testing.T) {
+	img, _, _ := decodeImage(bytes.NewReader(createAnimatedGIF()))
+	params, _ := parseParameters("w_10,h_5")
+	imgNew, err := transformImage(img, &Transformation{params: &params, metadata: MetadataStrip})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	var buffer bytes.Buffer
+	err = writeImage(imgNew, "gif", &buffer)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	g, err := gif.DecodeAll(&buffer)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(g.Image) != 3 || g.Delay[2] != 30 || g.LoopCount != 2 {
+		t.Errorf("Expected 3 frames with delays and loop count, actual: %d %v %d", len(g.Image), g.Delay, g.LoopCount)
+	}
+	for i, frame := range g.Image {
+		if frame.Bounds() != image.Rect(0, 0, 10, 5) {
+			t.Errorf("Expected frame %d to be resized, actual: %v", i, frame.Bounds())
+		}
+	}
+	if _, _, _, a := g.Image[2].At(3, 2).RGBA(); a != 0 {
+		t.Errorf("Expected transparent pixels to stay transparent")
+	}
+
+	// Still images are written as a single frame
+	buffer.Reset()
+	writeImage(createGradientImage(30, 20), "gif", &buffer)
+	g, err = gif.DecodeAll(&buffer)
+	if err != nil || len(g.Image) != 1 {
+		t.Errorf("Expected a still gif, actual: %v", err)
+	}
+}
+
+func TestTransformImageFrame(t *testing.T) {
+	img, _, _ := decodeImage(bytes.NewReader(createAnimatedGIF()))
+
+	params, _ := parseParameters("w_20,h_10,frame_2")
+	imgNew, err := transformImage(img, &Transformation{params: &params, metadata: MetadataStrip})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, ok := imgNew.(*Animation); ok {
+		t.Errorf("Expected a still image")
+	}
+	if act := color.RGBAModel.Convert(imgNew.At(6, 3)); act != blue {
+		t.Errorf("Expected the second frame, actual colour: %v", act)
+	}
+
+	params, _ = parseParameters("w_20,frame_4")
+	_, err = transformImage(img, &Transformation{params: &params, metadata: MetadataStrip})
+	if err == nil {
+		t.Errorf("Expected an error for a missing frame")
+	}
+	params, _ = parseParameters("w_20,frame_2")
+	_, err = transformImage(createGradientImage(20, 10), &Transformation{params: &params, metadata: MetadataStrip})
+	if err == nil {
+		t.Errorf("Expected an error for a missing frame of a still image")
+	}
+}
+
+func TestCountGIFFrames(t *testing.T) {
+	data := createAnimatedGIF()
+	if act := countGIFFrames(data); act != 3 {
+		t.Errorf("Expected 3 frames, actual: %d", act)
+	}
+
+	// A still image with a local colour table and no global one
+	var buffer bytes.Buffer
+	gif.Encode(&buffer, createGradientImage(30, 20), nil)
+	if act := countGIFFrames(buffer.Bytes()); act != 1 {
+		t.Errorf("Expected 1 frame, actual: %d", act)
+	}
+	if act := countGIFFrames(data[:20]); act != 0 {
+		t.Errorf("Expected no frames in cut data, actual: %d", act)
+	}
+}
+
+func TestAnimationLimits(t *testing.T) {
+	defer func() {
+		Config.maxFrames, Config.maxAnimationPixels = 0, 0
+	}()
+
+	Config.maxFrames, Config.maxAnimationPixels = 2, 0
+	_, _, err := decodeImage(bytes.NewReader(createAnimatedGIF()))
+	if err == nil {
+		t.Errorf("Expected an error for too many frames")
+	}
+
+	Config.maxFrames, Config.maxAnimationPixels = 0, 3*20*10
+	img, _, err := decodeImage(bytes.NewReader(createAnimatedGIF()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	params, _ := parseParameters("w_40,h_20,c_pad")
+	_, err = transformImage(img, &Transformation{params: &params, metadata: MetadataStrip})
+	if err == nil {
+		t.Errorf("Expected an error for too many pixels in all frames")
+	}
+}
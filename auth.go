@@ -7,6 +7,8 @@ import (
 	"errors"
 	"fmt"
 	"sort"
+	"strconv"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 	"github.com/twinj/uuid"
@@ -17,6 +19,8 @@ const (
 	GetPermission = "get"
 	// UploadPermission = permission to upload images
 	UploadPermission = "upload"
+	// OverlayPermission = permission to add overlays specified in the URL to images
+	OverlayPermission = "overlay"
 )
 
 var (
@@ -40,6 +44,7 @@ func authInit() error {
 	permissionsByKey[""] = make(map[string]bool)
 	permissionsByKey[""][GetPermission] = !Config.authorisedGet
 	permissionsByKey[""][UploadPermission] = !Config.authorisedUpload
+	permissionsByKey[""][OverlayPermission] = !Config.authorisedOverlay
 
 	// Set up permissions for API keys
 	for _, key := range keys {
@@ -119,8 +124,8 @@ func modifyKey(key, op, permission string) error {
 	if op != "add" && op != "remove" {
 		return errors.New("modifier needs to be 'add' or 'remove'")
 	}
-	if permission != GetPermission && permission != UploadPermission {
-		return fmt.Errorf("modifier needs to end with a valid permission: %s or %s", GetPermission, UploadPermission)
+	if permission != GetPermission && permission != UploadPermission && permission != OverlayPermission {
+		return fmt.Errorf("modifier needs to end with a valid permission: %s, %s or %s", GetPermission, UploadPermission, OverlayPermission)
 	}
 	if op == "add" {
 		_, err = Conn.Do("SADD", "key:"+key+":permissions", permission)
@@ -158,7 +163,7 @@ func getSecretForKey(key string) (string, error) {
 }
 
 func authPermissionsOptions() string {
-	return fmt.Sprintf("%s/%s", GetPermission, UploadPermission)
+	return fmt.Sprintf("%s/%s/%s", GetPermission, UploadPermission, OverlayPermission)
 }
 
 func checkKeyExists(key string) error {
@@ -200,3 +205,24 @@ func signQueryString(queryString, secret string) []byte {
 	mac.Write([]byte(queryString))
 	return mac.Sum(nil)
 }
+
+// checkSignature checks that a request is recent and signed using the secret for a given API key.
+// The timestamp is added to the signed query parameters.
+func checkSignature(key string, timestamp int64, signature string, queryParams map[string]string) error {
+	requestTime := time.Unix(timestamp, 0)
+	delta := time.Since(requestTime).Minutes()
+	if delta < 0 || delta > 5 {
+		return errors.New("invalid timestamp")
+	}
+
+	queryParams["timestamp"] = strconv.FormatInt(timestamp, 10)
+
+	secret, err := getSecretForKey(key)
+	if err != nil {
+		return errors.New("authorization error")
+	}
+	if !isValidSignature(signature, secret, queryParams) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
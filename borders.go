@@ -0,0 +1,92 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strconv"
+
+	"github.com/ReshNesh/go-colorful"
+)
+
+const (
+	// RadiusMax rounds the shorter sides of an image completely, square images become circles
+	RadiusMax = "max"
+
+	// MaxBorderWidth is the widest border in pixels (before scaling)
+	MaxBorderWidth = 100
+
+	DefaultBorderColor = "000000"
+)
+
+// hasRoundedCorners checks if the corners of transformed images are transparent
+func (p Params) hasRoundedCorners() bool {
+	return p.radius > 0 || p.maxRadius
+}
+
+// radiusString returns the radius or max if the corners are rounded completely
+func (p Params) radiusString() string {
+	if p.maxRadius {
+		return RadiusMax
+	}
+	return strconv.Itoa(p.radius)
+}
+
+// applyBorderAndRadius draws a border inside the edges of an image and makes its corners transparent,
+// the border follows the rounded corners. Edges are anti-aliased.
+func applyBorderAndRadius(img image.Image, parameters *Params, scale float64) image.Image {
+	if parameters.borderWidth == 0 && !parameters.hasRoundedCorners() {
+		return img
+	}
+
+	bounds := img.Bounds()
+	width, height := float64(bounds.Dx()), float64(bounds.Dy())
+	radius := float64(scaleInt(parameters.radius, scale))
+	if parameters.maxRadius || radius > math.Min(width, height)/2 {
+		radius = math.Min(width, height) / 2
+	}
+	borderWidth := float64(scaleInt(parameters.borderWidth, scale))
+	borderColor, _ := colorful.Hex("#" + parameters.borderColor)
+	border := color.RGBAModel.Convert(borderColor).(color.RGBA)
+
+	result := image.NewRGBA(bounds)
+	draw.Draw(result, bounds, img, bounds.Min, draw.Src)
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			// Distance of the centre of the pixel from the edge of the shape (negative inside)
+			distance := roundedRectDistance(float64(x)+0.5, float64(y)+0.5, width, height, radius)
+			shape := coverage(distance)
+			inner := shape
+			if borderWidth > 0 {
+				inner = coverage(distance + borderWidth)
+			}
+			if shape == 1 && inner == 1 {
+				continue
+			}
+
+			pt := image.Pt(bounds.Min.X+x, bounds.Min.Y+y)
+			c := result.RGBAAt(pt.X, pt.Y)
+			mix := func(value, borderValue uint8) uint8 {
+				return uint8(float64(value)*inner + float64(borderValue)*(shape-inner) + 0.5)
+			}
+			result.SetRGBA(pt.X, pt.Y, color.RGBA{mix(c.R, border.R), mix(c.G, border.G), mix(c.B, border.B), mix(c.A, border.A)})
+		}
+	}
+	return result
+}
+
+// Signed distance of a point from the edge of a rectangle with rounded corners starting at 0, 0
+func roundedRectDistance(x, y, width, height, radius float64) float64 {
+	// Distance from the centre, all quarters of the rectangle are the same
+	px, py := math.Abs(x-width/2), math.Abs(y-height/2)
+	qx, qy := px-(width/2-radius), py-(height/2-radius)
+	outside := math.Hypot(math.Max(qx, 0), math.Max(qy, 0))
+	inside := math.Min(math.Max(qx, qy), 0)
+	return outside + inside - radius
+}
+
+// Part of a pixel covered by a shape given the distance of its centre from the edge
+func coverage(distance float64) float64 {
+	return math.Min(math.Max(0.5-distance, 0), 1)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestApplyBorderAndRadius(t *testing.T) {
+	green := color.RGBA{0, 255, 0, 255}
+	img := createFilledImage(100, 100, green)
+
+	params, _ := parseParameters("w_100,h_100,rad_max")
+	circle := applyBorderAndRadius(img, &params, 1).(*image.RGBA)
+	if act := circle.RGBAAt(0, 0); act.A != 0 {
+		t.Errorf("Expected a transparent corner, actual: %v", act)
+	}
+	if act := circle.RGBAAt(50, 50); act != green {
+		t.Errorf("Expected the image in the middle, actual: %v", act)
+	}
+	// The edge of the circle is anti-aliased (the centre of the pixel at 85, 15 is 49.5 pixels from the centre)
+	if act := circle.RGBAAt(85, 14); act.A == 0 || act.A == 255 {
+		t.Errorf("Expected a semi-transparent edge, actual: %v", act)
+	}
+	if act := circle.RGBAAt(50, 0); act.A < 127 {
+		t.Errorf("Expected the top of the circle, actual: %v", act)
+	}
+
+	// Borders follow the rounded corners
+	params, _ = parseParameters("w_100,h_100,bo_5_ff0000,rad_20")
+	framed := applyBorderAndRadius(img, &params, 1).(*image.RGBA)
+	red := color.RGBA{255, 0, 0, 255}
+	cases := []struct {
+		pt  image.Point
+		exp color.RGBA
+	}{
+		{image.Pt(50, 2), red},
+		{image.Pt(97, 50), red},
+		{image.Pt(50, 6), green},
+		{image.Pt(0, 0), color.RGBA{}},
+		{image.Pt(8, 8), red},
+		{image.Pt(12, 12), green},
+	}
+	for _, c := range cases {
+		if act := framed.RGBAAt(c.pt.X, c.pt.Y); act != c.exp {
+			t.Errorf("Expected %v at %v, actual: %v", c.exp, c.pt, act)
+		}
+	}
+
+	// Sizes are scaled, borders without a radius keep the corners
+	params, _ = parseParameters("w_100,h_100,bo_5_ff0000")
+	scaled := applyBorderAndRadius(img, &params, 2).(*image.RGBA)
+	if scaled.RGBAAt(0, 0) != red || scaled.RGBAAt(9, 50) != red || scaled.RGBAAt(10, 50) != green {
+		t.Errorf("Expected a 10 pixel border with square corners")
+	}
+
+	params, _ = parseParameters("w_100,h_100")
+	if applyBorderAndRadius(img, &params, 1) != img {
+		t.Errorf("Expected the image to be unchanged")
+	}
+}
+
+func TestRoundedOutputFormat(t *testing.T) {
+	rounded, _ := parseParameters("w_100,rad_10")
+	bordered, _ := parseParameters("w_100,bo_2")
+	canvas := Canvas{200, 100, color.White, "", GravityCenter, 0, 0, nil}
+	cases := []struct {
+		transformation Transformation
+		format, exp    string
+	}{
+		{Transformation{params: &rounded, metadata: MetadataStrip}, "jpg", "png"},
+		{Transformation{params: &rounded, metadata: MetadataStrip}, "tiff", "png"},
+		{Transformation{params: &rounded, metadata: MetadataStrip}, "gif", "gif"},
+		{Transformation{params: &bordered, metadata: MetadataStrip}, "jpg", "jpg"},
+		// Corners on an opaque canvas aren't transparent
+		{Transformation{params: &rounded, metadata: MetadataStrip, canvas: &canvas}, "jpg", "jpg"},
+	}
+	for _, c := range cases {
+		if act := c.transformation.outputFormat(c.format); act != c.exp {
+			t.Errorf("%s with %s failed, expected: %s, actual: %s", c.format, c.transformation.params.ToString(), c.exp, act)
+		}
+	}
+
+	path, _ := cases[0].transformation.createFilePath("cat.jpg")
+	if path != "cat--"+rounded.ToString()+"--.png" {
+		t.Errorf("Expected a PNG file, actual: %s", path)
+	}
+}
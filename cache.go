@@ -3,7 +3,6 @@ package main
 import (
 	"errors"
 	"fmt"
-	"image"
 	"log"
 	"strings"
 	"time"
@@ -15,17 +14,29 @@ const (
 	candidatesToRemove = 5
 )
 
-// Adds the given file to the cache.
-func addToCache(filePath string, img image.Image, format string) error {
+var (
+	errOutdatedHint = errors.New("the crop hint of the image changed during the transformation")
+)
+
+// Adds the given file (a transformation of the original image at imagePath) to the cache, the encoded image
+// is stored as it is so that it can be served without encoding it again (with the quality and other encoding
+// options it was requested with). Transformations started before the crop hint of the image changed
+// (with an older hint version) aren't cached.
+func addToCache(filePath, imagePath string, hintVersion int, data []byte, format string) error {
+	if loadHintVersion(imagePath) != hintVersion {
+		return errOutdatedHint
+	}
 	log.Println("Adding to cache:", filePath)
 
 	// Save the image
-	size, err := saveImage(img, format, filePath)
+	size, err := storageImpl.saveData(data, format, filePath)
 	if err == nil {
 		key := fmt.Sprintf("image:%s", filePath)
 
 		// Add a record to the cache
 		Conn.Do("HSET", key, "size", size)
+		Conn.Do("HSET", key, "original", imagePath)
+		Conn.Do("SADD", transformationsKey(imagePath), key)
 
 		Conn.Do("SETNX", "totalcachesize", 0)
 		Conn.Do("INCRBY", "totalcachesize", size)
@@ -35,6 +46,12 @@ func addToCache(filePath string, img image.Image, format string) error {
 		// Update queue of last accesses
 		cacheUpdateLastAccess(key)
 
+		// The hint could have changed while the file was being saved
+		if loadHintVersion(imagePath) != hintVersion {
+			removeFromCache(key)
+			return errOutdatedHint
+		}
+
 		pruneCache()
 	}
 
@@ -46,6 +63,7 @@ func removeFromCache(key string) {
 	if err != nil {
 		return
 	}
+	imagePath, _ := redis.String(Conn.Do("HGET", key, "original"))
 
 	err = deleteImage(strings.Replace(key, "image:", "", 1))
 	if err != nil {
@@ -55,28 +73,68 @@ func removeFromCache(key string) {
 
 	log.Printf("Removing from cache: %s", key)
 	Conn.Do("DEL", key)
+	Conn.Do("SREM", transformationsKey(imagePath), key)
 	Conn.Do("ZREM", "imageaccesstimestamps", key)
 	Conn.Do("ZREM", "imageaccesscounts", key)
 	Conn.Do("DECRBY", "totalcachesize", size)
 }
 
-// Loads a file specified by its path from the cache.
-func loadFromCache(filePath string) (image.Image, string, error) {
+// Removes all cached transformations of an original image.
+func removeTransformationsFromCache(imagePath string) error {
+	keys, err := redis.Strings(Conn.Do("SMEMBERS", transformationsKey(imagePath)))
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		removeFromCache(key)
+	}
+	return nil
+}
+
+// Key of the set of cache keys of all cached transformations of an original image.
+func transformationsKey(imagePath string) string {
+	return "transformations:" + imagePath
+}
+
+// Returns the version of the crop hint of an original image, it changes each time the hint is saved.
+func loadHintVersion(imagePath string) int {
+	version, _ := redis.Int(Conn.Do("GET", "hintversion:"+imagePath))
+	return version
+}
+
+// Changes the version of the crop hint of an original image.
+func increaseHintVersion(imagePath string) error {
+	_, err := Conn.Do("INCR", "hintversion:"+imagePath)
+	return err
+}
+
+// Records the JPEG quality chosen automatically for a cached file.
+func saveCachedQuality(filePath string, quality int) {
+	Conn.Do("HSET", fmt.Sprintf("image:%s", filePath), "quality", quality)
+}
+
+// Returns the JPEG quality chosen automatically for a cached file.
+func loadCachedQuality(filePath string) (int, error) {
+	return redis.Int(Conn.Do("HGET", fmt.Sprintf("image:%s", filePath), "quality"))
+}
+
+// Loads an encoded file specified by its path from the cache.
+func loadFromCache(filePath string) ([]byte, error) {
 	log.Println("Cache lookup for:", filePath)
 
 	exists, err := redis.Bool(Conn.Do("EXISTS", fmt.Sprintf("image:%s", filePath)))
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
 
 	if exists {
 		key := fmt.Sprintf("image:%s", filePath)
 		cacheUpdateLastAccess(key)
 
-		return loadImage(filePath)
+		return loadData(filePath)
 	}
 
-	return nil, "", errors.New("image not found")
+	return nil, errors.New("image not found")
 }
 
 func cacheUpdateLastAccess(key string) {
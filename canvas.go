@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"log"
+)
+
+const (
+	DefaultCanvasGravity = GravityCenter
+)
+
+// Canvas composes an image from layers: a background colour and image, the transformed image and logos.
+// The watermark and texts of a transformation are drawn on the canvas, so an Open Graph image can be made
+// by placing a photo next to a title.
+type Canvas struct {
+	width, height int
+	// Background colour (nil means transparent) and an image covering the whole canvas ("" means none)
+	background          color.Color
+	backgroundImagePath string
+	// Position of the transformed image
+	gravity string
+	x, y    int
+	logos   []*Watermark
+}
+
+// Composes the layers of a canvas with a transformed image, sizes and offsets are multiplied by the scale
+func (c *Canvas) compose(img image.Image, scale float64, resize func(uint, uint, image.Image, string) image.Image, resampling string, layers layerCache) image.Image {
+	width, height := scaleInt(c.width, scale), scaleInt(c.height, scale)
+	bounds := image.Rect(0, 0, width, height)
+	canvas := image.NewRGBA(bounds)
+	if c.background != nil {
+		draw.Draw(canvas, bounds, image.NewUniform(c.background), image.ZP, draw.Src)
+	}
+	if c.backgroundImagePath != "" {
+		key := fmt.Sprintf("background:%s:%d:%d", c.backgroundImagePath, width, height)
+		background := layers.load(key, func() image.Image {
+			return loadCanvasBackground(c.backgroundImagePath, width, height, resize, resampling)
+		})
+		if background != nil {
+			draw.Draw(canvas, bounds, background, background.Bounds().Min, draw.Over)
+		}
+	}
+
+	size := img.Bounds().Size()
+	pt := calculateTopLeftPointFromGravity(c.gravity, size.X, size.Y, width, height)
+	pt = pt.Add(getTranslation(c.gravity, scaleInt(c.x, scale), scaleInt(c.y, scale)))
+	draw.Draw(canvas, image.Rectangle{pt, pt.Add(size)}, img, img.Bounds().Min, draw.Over)
+
+	// Logos are positioned and sized like watermarks
+	var composed image.Image = canvas
+	for _, logo := range c.logos {
+		composed = applyWatermark(composed, logo, scale, resize, resampling, layers)
+	}
+	return composed
+}
+
+// Loads a background image cropped to the proportions of a canvas and resized to cover it,
+// nil is returned if the image can't be loaded
+func loadCanvasBackground(imagePath string, width, height int, resize func(uint, uint, image.Image, string) image.Image, resampling string) image.Image {
+	img, _, err := loadImage(imagePath)
+	if err != nil {
+		log.Println("Error: could not load a canvas background", err)
+		return nil
+	}
+	img, _ = splitMetadata(img)
+	return resize(uint(width), uint(height), cropToProportions(img, width, height), resampling)
+}
+
+// Size of the canvas with the parameters of the transformed image, used for checking the output size
+func (c *Canvas) withSize(parameters *Params) *Params {
+	params := *parameters
+	params.width, params.height = c.width, c.height
+	return &params
+}
+
+func (c *Canvas) hash() []byte {
+	h := sha1.New()
+	// Numbers have a fixed width and strings end with a zero byte, so that neighbouring values can't run together
+	writeUint := func(i uint32) {
+		bs := make([]byte, 4)
+		binary.BigEndian.PutUint32(bs, i)
+		h.Write(bs)
+	}
+
+	writeUint(uint32(c.width))
+	writeUint(uint32(c.height))
+	if c.background != nil {
+		r, g, b, a := c.background.RGBA()
+		h.Write([]byte{1})
+		writeUint(r)
+		writeUint(g)
+		writeUint(b)
+		writeUint(a)
+	} else {
+		h.Write([]byte{0})
+	}
+	io.WriteString(h, c.backgroundImagePath+"\x00")
+	io.WriteString(h, c.gravity+"\x00")
+	writeUint(uint32(c.x))
+	writeUint(uint32(c.y))
+	for _, logo := range c.logos {
+		h.Write(logo.hash())
+	}
+
+	return h.Sum(nil)
+}
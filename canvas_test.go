@@ -0,0 +1,107 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestComposeCanvas(t *testing.T) {
+	defer useTemporaryStorage(t)()
+	red, green, blue := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 255, 0, 255}, color.RGBA{0, 0, 255, 255}
+	saveImage(createFilledImage(10, 10, red), "png", "logo.png")
+	saveImage(createFilledImage(30, 20, blue), "png", "background.png")
+
+	logo := Watermark{"logo.png", GravityNorthEast, 5, 5, 100, 0, false, 0, 0, BlendNormal}
+	canvas := Canvas{120, 60, color.RGBA{255, 255, 255, 255}, "", GravityWest, 10, 0, []*Watermark{&logo}}
+	img := createFilledImage(40, 20, green)
+
+	for _, scale := range []float64{1, 2} {
+		at := func(x, y int) image.Point {
+			return image.Pt(scaleInt(x, scale), scaleInt(y, scale))
+		}
+		composed := canvas.compose(createFilledImage(scaleInt(40, scale), scaleInt(20, scale), green), scale, resizeImage, ResamplingLanczos3, nil).(*image.RGBA)
+		if act := composed.Bounds().Size(); act != at(120, 60) {
+			t.Errorf("Scale %g failed, expected the size of the canvas: %v, actual: %v", scale, at(120, 60), act)
+		}
+		cases := []struct {
+			pt  image.Point
+			exp color.RGBA
+		}{
+			// The image is placed at the left edge with an offset, vertically centred
+			{at(10, 20), green},
+			{at(49, 39), green},
+			{at(5, 30), color.RGBA{255, 255, 255, 255}},
+			{at(50, 30), color.RGBA{255, 255, 255, 255}},
+			// The logo is in the top right corner
+			{at(106, 6), red},
+			{at(114, 14), red},
+			{at(104, 4), color.RGBA{255, 255, 255, 255}},
+		}
+		for _, c := range cases {
+			if act := composed.RGBAAt(c.pt.X, c.pt.Y); act != c.exp {
+				t.Errorf("Scale %g failed, expected %v at %v, actual: %v", scale, c.exp, c.pt, act)
+			}
+		}
+	}
+
+	// The background image covers the whole canvas, a missing one is left out
+	canvas.backgroundImagePath = "background.png"
+	composed := canvas.compose(img, 1, resizeImage, ResamplingLanczos3, nil).(*image.RGBA)
+	if act := composed.RGBAAt(0, 0); act != blue {
+		t.Errorf("Expected the background image in the corner, actual: %v", act)
+	}
+	if act := composed.RGBAAt(119, 59); act != blue {
+		t.Errorf("Expected the background image in the corner, actual: %v", act)
+	}
+	canvas.backgroundImagePath = "missing.png"
+	composed = canvas.compose(img, 1, resizeImage, ResamplingLanczos3, nil).(*image.RGBA)
+	if act := composed.RGBAAt(0, 0); act != (color.RGBA{255, 255, 255, 255}) {
+		t.Errorf("Expected the background colour, actual: %v", act)
+	}
+}
+
+func TestTransformCanvas(t *testing.T) {
+	params, _ := parseParameters("w_40,h_40,c_p")
+	blue := color.RGBA{0, 0, 255, 255}
+	canvas := Canvas{100, 50, blue, "", GravityEast, 0, 0, make([]*Watermark, 0)}
+	text := createTestText(t, "I", 30, defaultTextStyle)
+	transformation := Transformation{params: &params, texts: []*Text{text}, metadata: MetadataStrip, canvas: &canvas}
+
+	imgNew := transformCropAndResize(createFilledImage(80, 60, color.White), &transformation).(*image.RGBA)
+	if act := imgNew.Bounds().Size(); act != image.Pt(100, 50) {
+		t.Errorf("Expected the size of the canvas, actual: %v", act)
+	}
+	// The image is at the right edge, texts are drawn on the canvas rather than on the image
+	if act := imgNew.RGBAAt(80, 25); act != (color.RGBA{255, 255, 255, 255}) {
+		t.Errorf("Expected the image at the right edge, actual: %v", act)
+	}
+	if act := imgNew.RGBAAt(59, 49); act != blue {
+		t.Errorf("Expected the background next to the image, actual: %v", act)
+	}
+	if letter := findColor(imgNew, color.RGBA{0, 0, 0, 255}, 0); letter.Empty() || letter.Max.X > 60 {
+		t.Errorf("Expected the text in the top left corner of the canvas, actual: %v", letter)
+	}
+
+	plain, _ := (&Transformation{params: &params, metadata: MetadataStrip}).createFilePath("cat.jpg")
+	a, _ := transformation.createFilePath("cat.jpg")
+	canvas.background = color.RGBA{255, 255, 255, 255}
+	b, _ := transformation.createFilePath("cat.jpg")
+	if a == plain || a == b {
+		t.Errorf("Expected different paths for different canvases, actual: %s %s", a, b)
+	}
+	// Sizes written next to each other can't be mistaken for other sizes
+	narrow, wide := Canvas{12, 630, nil, "", GravityWest, 0, 0, nil}, Canvas{126, 30, nil, "", GravityWest, 0, 0, nil}
+	if string(narrow.hash()) == string(wide.hash()) {
+		t.Errorf("Expected different hashes for canvases of 12x630 and 126x30")
+	}
+
+	// The canvas is bigger than the image
+	Config.maxOutputWidth = 80
+	defer func() {
+		Config.maxOutputWidth = 0
+	}()
+	if checkOutputSize(&params, 0, 0) != nil || checkOutputSize(canvas.withSize(&params), 0, 0) == nil {
+		t.Errorf("Expected only the canvas to be too wide")
+	}
+}
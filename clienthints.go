@@ -0,0 +1,116 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	headerDPR           = "Sec-CH-DPR"
+	headerWidth         = "Sec-CH-Width"
+	headerViewportWidth = "Sec-CH-Viewport-Width"
+	headerSaveData      = "Save-Data"
+)
+
+// Client hints a browser is asked to send in the Accept-CH header
+var acceptedClientHints = []string{headerDPR, headerWidth, headerViewportWidth}
+
+// applyClientHints resolves auto values of parameters (w_auto, dpr_auto, q_auto) using
+// client hints sent in request headers. Hints are ignored when they are disabled in the configuration
+// (header can be nil too), in which case the largest breakpoint and scale 1 are used.
+// Automatic quality stays unresolved unless Save-Data is sent, it's chosen later using findAutoQuality.
+// Widths are rounded up to a breakpoint and scales are limited so that the number of cached images stays small.
+func applyClientHints(params Params, header http.Header) Params {
+	if !Config.clientHints {
+		header = nil
+	}
+	saveData := strings.ToLower(strings.TrimSpace(header.Get(headerSaveData))) == "on"
+
+	if params.autoScale {
+		params.scale = DefaultScale
+		dpr, err := strconv.ParseFloat(header.Get(headerDPR), 64)
+		if err == nil {
+			scale, ok := normaliseScale(math.Min(dpr, Config.clientHintsMaxDPR))
+			if ok {
+				params.scale = scale
+			}
+		}
+		// Users saving data get images for standard displays
+		if saveData && params.scale > DefaultScale {
+			params.scale = DefaultScale
+		}
+		params.autoScale = false
+	}
+
+	if params.autoWidth {
+		// Width is in device pixels, viewport width in CSS pixels
+		width := 0
+		if value, err := strconv.Atoi(header.Get(headerWidth)); err == nil && value > 0 {
+			dpr, err := strconv.ParseFloat(header.Get(headerDPR), 64)
+			if err != nil || !(dpr > 0) {
+				dpr = DefaultScale
+			}
+			width = int(math.Ceil(float64(value) / dpr))
+		} else if value, err := strconv.Atoi(header.Get(headerViewportWidth)); err == nil && value > 0 {
+			width = value
+		}
+		params.width = roundUpToBreakpoint(width)
+		params.autoWidth = false
+	}
+
+	if params.autoQuality && saveData {
+		params.quality = Config.saveDataQuality
+		params.autoQuality = false
+	}
+
+	return params
+}
+
+// roundUpToBreakpoint returns the smallest configured breakpoint not smaller than the given width,
+// the largest breakpoint is returned for larger widths and when the width is unknown (0)
+func roundUpToBreakpoint(width int) int {
+	breakpoints := Config.clientHintsBreakpoints
+	if len(breakpoints) == 0 {
+		return width
+	}
+	if width > 0 {
+		for _, breakpoint := range breakpoints {
+			if breakpoint >= width {
+				return breakpoint
+			}
+		}
+	}
+	return breakpoints[len(breakpoints)-1]
+}
+
+// clientHintsVary returns the request headers which a response for the given parameters depends on
+func clientHintsVary(params Params) []string {
+	vary := make([]string, 0)
+	if !Config.clientHints {
+		return vary
+	}
+	if params.autoScale || params.autoWidth {
+		vary = append(vary, headerDPR)
+	}
+	if params.autoWidth {
+		vary = append(vary, headerWidth, headerViewportWidth)
+	}
+	if params.autoScale || params.autoQuality {
+		vary = append(vary, headerSaveData)
+	}
+	return vary
+}
+
+// setClientHintsHeaders asks browsers to send client hints and marks responses depending on them
+func setClientHintsHeaders(res http.ResponseWriter, params Params) {
+	if !Config.clientHints {
+		return
+	}
+	res.Header().Set("Accept-CH", strings.Join(acceptedClientHints, ", "))
+	vary := clientHintsVary(params)
+	if len(vary) > 0 {
+		res.Header().Add("Vary", strings.Join(vary, ", "))
+	}
+}
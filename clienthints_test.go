@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func setUpClientHints() func() {
+	Config.clientHints, Config.clientHintsMaxDPR, Config.saveDataQuality = true, 3, 50
+	Config.clientHintsBreakpoints = []int{320, 640, 1280}
+	return func() {
+		Config.clientHints, Config.clientHintsMaxDPR, Config.saveDataQuality = false, 0, 0
+		Config.clientHintsBreakpoints = nil
+	}
+}
+
+func TestApplyClientHints(t *testing.T) {
+	defer setUpClientHints()()
+
+	cases := []struct {
+		parameters string
+		header     map[string]string
+		expWidth   int
+		expScale   float64
+		expQuality int
+		expAuto    bool
+	}{
+		{"w_auto", nil, 1280, 1, 0, false},
+		{"w_auto", map[string]string{"Sec-CH-Viewport-Width": "500"}, 640, 1, 0, false},
+		{"w_auto", map[string]string{"Sec-CH-Width": "600", "Sec-CH-DPR": "2"}, 320, 1, 0, false},
+		{"w_auto", map[string]string{"Sec-CH-Width": "5000"}, 1280, 1, 0, false},
+		{"w_auto,dpr_auto", map[string]string{"Sec-CH-Width": "1000", "Sec-CH-DPR": "2.6"}, 640, 2.625, 0, false},
+		{"w_400,dpr_auto", map[string]string{"Sec-CH-DPR": "4"}, 400, 3, 0, false},
+		{"w_400,dpr_auto", map[string]string{"Sec-CH-DPR": "2", "Save-Data": "on"}, 400, 1, 0, false},
+		{"w_400,dpr_auto", map[string]string{"Sec-CH-DPR": "abc"}, 400, 1, 0, false},
+		{"w_400,q_auto", map[string]string{"Save-Data": "on"}, 400, 1, 50, false},
+		{"w_400,q_auto", nil, 400, 1, 0, true},
+	}
+	for _, c := range cases {
+		params, err := parseParameters(c.parameters)
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", c.parameters, err)
+		}
+		header := make(http.Header)
+		for key, value := range c.header {
+			header.Set(key, value)
+		}
+		act := applyClientHints(params, header)
+		if act.width != c.expWidth || act.scale != c.expScale || act.quality != c.expQuality {
+			t.Errorf("%s %v failed, expected: %d %g %d, actual: %d %g %d", c.parameters, c.header, c.expWidth, c.expScale, c.expQuality, act.width, act.scale, act.quality)
+		}
+		// Automatic quality is only resolved for Save-Data, otherwise it's found by comparing encoded images
+		if act.autoWidth || act.autoScale || act.autoQuality != c.expAuto {
+			t.Errorf("%s failed, auto values should be resolved: %v", c.parameters, act)
+		}
+	}
+}
+
+func TestApplyClientHintsDisabled(t *testing.T) {
+	defer setUpClientHints()()
+	Config.clientHints = false
+
+	params, _ := parseParameters("w_auto,dpr_auto,q_auto")
+	header := make(http.Header)
+	header.Set("Sec-CH-Width", "300")
+	header.Set("Sec-CH-DPR", "2")
+	header.Set("Save-Data", "on")
+	act := applyClientHints(params, header)
+	if act.width != 1280 || act.scale != 1 || act.quality != 0 || !act.autoQuality {
+		t.Errorf("Expected client hints to be ignored, actual: %v", act)
+	}
+}
+
+func TestApplyClientHintsSharedCache(t *testing.T) {
+	defer setUpClientHints()()
+
+	auto, _ := parseParameters("w_auto")
+	header := make(http.Header)
+	header.Set("Sec-CH-Viewport-Width", "600")
+	a := applyClientHints(auto, header)
+	header.Set("Sec-CH-Viewport-Width", "620")
+	b := applyClientHints(auto, header)
+	explicit, _ := parseParameters("w_640")
+	if a.ToString() != b.ToString() || a.ToString() != explicit.ToString() {
+		t.Errorf("Expected widths rounded to a breakpoint to share a string, actual: %s, %s and %s", a.ToString(), b.ToString(), explicit.ToString())
+	}
+}
+
+func TestClientHintsVary(t *testing.T) {
+	defer setUpClientHints()()
+
+	cases := map[string][]string{
+		"w_400":          {},
+		"w_auto":         {"Sec-CH-DPR", "Sec-CH-Width", "Sec-CH-Viewport-Width"},
+		"w_400,dpr_auto": {"Sec-CH-DPR", "Save-Data"},
+		"w_400,q_auto":   {"Save-Data"},
+	}
+	for str, exp := range cases {
+		params, _ := parseParameters(str)
+		act := clientHintsVary(params)
+		if !reflect.DeepEqual(act, exp) {
+			t.Errorf("%s failed, expected: %v, actual: %v", str, exp, act)
+		}
+	}
+}
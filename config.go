@@ -2,11 +2,13 @@ package main
 
 import (
 	"fmt"
+	"image"
+	"image/color"
 	"io/ioutil"
-	"os"
 	"regexp"
-
-	"code.google.com/p/freetype-go/freetype"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/ReshNesh/go-colorful"
 	"gopkg.in/yaml.v1"
@@ -25,33 +27,66 @@ const (
 	defaultJpegQuality                = 75
 	defaultUploadMaxFileSize          = 5 * 1024 * 1024 // No. of bytes
 	defaultUploadMaxPixels            = 5000000         // 5 megapixels
+	defaultMaxOutputWidth             = 5000
+	defaultMaxOutputHeight            = 5000
+	defaultMaxOutputPixels            = 10000000 // 10 megapixels
+	defaultMaxFrames                  = 300
+	defaultMaxAnimationPixels         = 50000000 // All frames together
 	defaultAllowCustomTransformations = true
 	defaultAllowCustomScale           = true
 	defaultAsyncUploads               = false
 	defaultAuthorisedGet              = false
 	defaultAuthorisedUpload           = false
+	defaultAuthorisedOverlay          = true
+	defaultUpscale                    = true
+	defaultLinearLight                = false
+	defaultAllowUnknownParameters     = false
+	defaultAllowDuplicateParameters   = false
+	defaultClientHints                = false
+	defaultUploadStripGPS             = true
+	defaultConvertToSRGB              = false
+	defaultAllowURLOverlays           = false
+	defaultClientHintsMaxDPR          = 3.0
+	defaultSaveDataQuality            = 50
+	defaultAutoQualityTarget          = 0.98 // SSIM
+	defaultAutoQualityMin             = 30
+	defaultAutoQualityMax             = 95
 	defaultLocalPath                  = "local-images"
 	defaultCacheStrategy              = LRU
 	defaultFontPath                   = "fonts/DejaVuSans.ttf"
+	defaultResampling                 = DefaultResampling
+	defaultMetadata                   = DefaultMetadata
 )
 
 var (
 	// Config is a global configuration object
 	Config Configuration
+
+	// Widths (in CSS pixels) requested by client hints are rounded up to one of these
+	defaultClientHintsBreakpoints = []int{320, 480, 640, 768, 1024, 1280, 1600, 1920}
 )
 
 // Configuration specifies server configuration options
 type Configuration struct {
-	throttlingRate, cacheLimit, jpegQuality, uploadMaxFileSize, uploadMaxPixels                 int
-	allowCustomTransformations, allowCustomScale, asyncUploads, authorisedGet, authorisedUpload bool
-	localPath, cacheStrategy                                                                    string
-	corsAllowOrigins                                                                            []string
-	transformations                                                                             map[string]Transformation
-	eagerTransformations                                                                        []Transformation
+	throttlingRate, cacheLimit, jpegQuality, uploadMaxFileSize, uploadMaxPixels                          int
+	maxOutputWidth, maxOutputHeight, maxOutputPixels, saveDataQuality                                    int
+	maxFrames, maxAnimationPixels                                                                        int
+	autoQualityMin, autoQualityMax                                                                       int
+	autoQualityTarget                                                                                    float64
+	allowCustomTransformations, allowCustomScale, asyncUploads, authorisedGet, authorisedUpload, upscale bool
+	linearLight, authorisedOverlay, allowURLOverlays                                                     bool
+	allowUnknownParameters, allowDuplicateParameters, clientHints, uploadStripGPS, convertToSRGB         bool
+	clientHintsMaxDPR                                                                                    float64
+	clientHintsBreakpoints                                                                               []int
+	localPath, cacheStrategy, resampling, metadata                                                       string
+	corsAllowOrigins, uploadFormats                                                                      []string
+	allowedSizes                                                                                         []image.Point
+	transformations                                                                                      map[string]Transformation
+	eagerTransformations                                                                                 []Transformation
 }
 
 func configInit(configFilePath string) error {
-	Config = Configuration{defaultThrottlingRate, defaultCacheLimit, defaultJpegQuality, defaultUploadMaxFileSize, defaultUploadMaxPixels, defaultAllowCustomTransformations, defaultAllowCustomScale, defaultAsyncUploads, defaultAuthorisedGet, defaultAuthorisedUpload, defaultLocalPath, defaultCacheStrategy, nil, make(map[string]Transformation), make([]Transformation, 0)}
+	Config = Configuration{defaultThrottlingRate, defaultCacheLimit, defaultJpegQuality, defaultUploadMaxFileSize, defaultUploadMaxPixels, defaultMaxOutputWidth, defaultMaxOutputHeight, defaultMaxOutputPixels, defaultSaveDataQuality, defaultMaxFrames, defaultMaxAnimationPixels, defaultAutoQualityMin, defaultAutoQualityMax, defaultAutoQualityTarget, defaultAllowCustomTransformations, defaultAllowCustomScale, defaultAsyncUploads, defaultAuthorisedGet, defaultAuthorisedUpload, defaultUpscale, defaultLinearLight, defaultAuthorisedOverlay, defaultAllowURLOverlays, defaultAllowUnknownParameters, defaultAllowDuplicateParameters, defaultClientHints, defaultUploadStripGPS, defaultConvertToSRGB, defaultClientHintsMaxDPR, defaultClientHintsBreakpoints, defaultLocalPath, defaultCacheStrategy, defaultResampling, defaultMetadata, nil, supportedFormats, nil, make(map[string]Transformation), make([]Transformation, 0)}
 
 	if configFilePath == "" {
 		return nil
@@ -88,6 +123,153 @@ func configInit(configFilePath string) error {
 		Config.uploadMaxPixels = uploadMaxPixels
 	}
 
+	maxOutputWidth, ok := m["max-output-width"].(int)
+	if ok && maxOutputWidth >= 0 {
+		Config.maxOutputWidth = maxOutputWidth
+	}
+
+	maxOutputHeight, ok := m["max-output-height"].(int)
+	if ok && maxOutputHeight >= 0 {
+		Config.maxOutputHeight = maxOutputHeight
+	}
+
+	maxOutputPixels, ok := m["max-output-pixels"].(int)
+	if ok && maxOutputPixels >= 0 {
+		Config.maxOutputPixels = maxOutputPixels
+	}
+
+	maxFrames, ok := m["max-frames"].(int)
+	if ok && maxFrames >= 0 {
+		Config.maxFrames = maxFrames
+	}
+
+	maxAnimationPixels, ok := m["max-animation-pixels"].(int)
+	if ok && maxAnimationPixels >= 0 {
+		Config.maxAnimationPixels = maxAnimationPixels
+	}
+
+	uploadFormats, ok := m["upload-formats"].([]interface{})
+	if ok {
+		Config.uploadFormats = make([]string, 0)
+		for _, format := range uploadFormats {
+			formatStr, ok := format.(string)
+			if !ok {
+				return fmt.Errorf("invalid upload format: %v", format)
+			}
+			formatStr = normaliseFormat(formatStr)
+			if !isSupportedFormat(formatStr) {
+				return fmt.Errorf("invalid upload format: %s, supported: %s", formatStr, strings.Join(supportedFormats, ", "))
+			}
+			Config.uploadFormats = append(Config.uploadFormats, formatStr)
+		}
+	}
+
+	uploadStripGPS, ok := m["upload-strip-gps"].(bool)
+	if ok {
+		Config.uploadStripGPS = uploadStripGPS
+	}
+
+	convertToSRGB, ok := m["convert-to-srgb"].(bool)
+	if ok {
+		Config.convertToSRGB = convertToSRGB
+	}
+
+	metadata, ok := m["metadata"].(string)
+	if ok {
+		if !isValidMetadataPolicy(metadata) {
+			return fmt.Errorf("invalid metadata policy: %s", metadata)
+		}
+		Config.metadata = metadata
+	}
+
+	upscale, ok := m["upscale"].(bool)
+	if ok {
+		Config.upscale = upscale
+	}
+
+	linearLight, ok := m["linear-light"].(bool)
+	if ok {
+		Config.linearLight = linearLight
+	}
+
+	allowedSizes, ok := m["allowed-sizes"].([]interface{})
+	if ok {
+		Config.allowedSizes = make([]image.Point, 0)
+		for _, size := range allowedSizes {
+			sizeStr, ok := size.(string)
+			if !ok {
+				return fmt.Errorf("invalid allowed size: %v", size)
+			}
+			width, height, err := parseSize(sizeStr)
+			if err != nil {
+				return fmt.Errorf("invalid allowed size: %s (%s)", sizeStr, err)
+			}
+			Config.allowedSizes = append(Config.allowedSizes, image.Point{width, height})
+		}
+	}
+
+	autoQuality, ok := m["auto-quality"].(map[interface{}]interface{})
+	if ok {
+		target, ok := autoQuality["ssim"].(float64)
+		if ok {
+			if target <= 0 || target > 1 {
+				return fmt.Errorf("auto-quality ssim needs to be between 0 and 1")
+			}
+			Config.autoQualityTarget = target
+		}
+
+		min, ok := autoQuality["min-quality"].(int)
+		if ok {
+			Config.autoQualityMin = min
+		}
+		max, ok := autoQuality["max-quality"].(int)
+		if ok {
+			Config.autoQualityMax = max
+		}
+		if Config.autoQualityMin < 1 || Config.autoQualityMax > 100 || Config.autoQualityMin > Config.autoQualityMax {
+			return fmt.Errorf("auto-quality limits need to be between 1 and 100, min-quality can't be higher than max-quality")
+		}
+	}
+
+	clientHints, ok := m["client-hints"].(map[interface{}]interface{})
+	if ok {
+		enabled, ok := clientHints["enabled"].(bool)
+		if ok {
+			Config.clientHints = enabled
+		}
+
+		switch maxDPR := clientHints["max-dpr"].(type) {
+		case int:
+			Config.clientHintsMaxDPR = float64(maxDPR)
+		case float64:
+			Config.clientHintsMaxDPR = maxDPR
+		}
+		if _, ok := normaliseScale(Config.clientHintsMaxDPR); !ok {
+			return fmt.Errorf("max-dpr needs to be between %g and %g", ScaleStep, MaxScale)
+		}
+
+		saveDataQuality, ok := clientHints["save-data-quality"].(int)
+		if ok && saveDataQuality >= 1 && saveDataQuality <= 100 {
+			Config.saveDataQuality = saveDataQuality
+		}
+
+		breakpoints, ok := clientHints["breakpoints"].([]interface{})
+		if ok {
+			Config.clientHintsBreakpoints = make([]int, 0)
+			for _, breakpoint := range breakpoints {
+				width, ok := breakpoint.(int)
+				if !ok || width <= 0 {
+					return fmt.Errorf("invalid breakpoint: %v", breakpoint)
+				}
+				Config.clientHintsBreakpoints = append(Config.clientHintsBreakpoints, width)
+			}
+			if len(Config.clientHintsBreakpoints) == 0 {
+				return fmt.Errorf("at least one breakpoint is needed")
+			}
+			sort.Ints(Config.clientHintsBreakpoints)
+		}
+	}
+
 	allowCustomTransformations, ok := m["allow-custom-transformations"].(bool)
 	if ok {
 		Config.allowCustomTransformations = allowCustomTransformations
@@ -98,6 +280,21 @@ func configInit(configFilePath string) error {
 		Config.allowCustomScale = allowCustomScale
 	}
 
+	allowUnknownParameters, ok := m["allow-unknown-parameters"].(bool)
+	if ok {
+		Config.allowUnknownParameters = allowUnknownParameters
+	}
+
+	allowDuplicateParameters, ok := m["allow-duplicate-parameters"].(bool)
+	if ok {
+		Config.allowDuplicateParameters = allowDuplicateParameters
+	}
+
+	allowURLOverlays, ok := m["allow-url-overlays"].(bool)
+	if ok {
+		Config.allowURLOverlays = allowURLOverlays
+	}
+
 	asyncUploads, ok := m["async-uploads"].(bool)
 	if ok {
 		Config.asyncUploads = asyncUploads
@@ -113,6 +310,10 @@ func configInit(configFilePath string) error {
 		if ok {
 			Config.authorisedUpload = upload
 		}
+		overlay, ok := authorisation["overlay"].(bool)
+		if ok {
+			Config.authorisedOverlay = overlay
+		}
 	}
 
 	localPath, ok := m["local-path"].(string)
@@ -120,6 +321,11 @@ func configInit(configFilePath string) error {
 		Config.localPath = localPath
 	}
 
+	resampling, ok := m["resampling"].(string)
+	if ok && isValidResampling(resampling) {
+		Config.resampling = resampling
+	}
+
 	cache, ok := m["cache"].(map[interface{}]interface{})
 	if ok {
 		limit, ok := cache["limit"].(int)
@@ -165,6 +371,10 @@ func configInit(configFilePath string) error {
 		if err != nil {
 			return fmt.Errorf("invalid transformation parameters: %s (%s)", parametersStr, err)
 		}
+		// Named transformations use the watermark and text settings instead
+		if hasOverlays(parametersStr) {
+			return fmt.Errorf("invalid transformation parameters: %s (overlays can only be used in URLs)", parametersStr)
+		}
 
 		name, ok := transformation["name"].(string)
 		if !ok {
@@ -174,31 +384,51 @@ func configInit(configFilePath string) error {
 			return fmt.Errorf("invalid transformation name: %s", name)
 		}
 
-		t := Transformation{&params, nil, make([]*Text, 0)}
+		t := Transformation{params: &params, texts: make([]*Text, 0), metadata: Config.metadata}
+
+		metadata, ok := transformation["metadata"].(string)
+		if ok {
+			if !isValidMetadataPolicy(metadata) {
+				return fmt.Errorf("invalid metadata policy: %s", metadata)
+			}
+			t.metadata = metadata
+		}
 
 		watermarkMap, ok := transformation["watermark"].(map[interface{}]interface{})
 		if ok {
-			imagePath, ok := watermarkMap["source"].(string)
-			if !ok {
-				return fmt.Errorf("a watermark needs to have a source specified")
+			t.watermark, err = parseWatermark(watermarkMap)
+			if err != nil {
+				return err
 			}
+		}
 
-			gravity, ok := watermarkMap["gravity"].(string)
-			if !ok || !isValidGravity(gravity) {
-				return fmt.Errorf("missing or invalid gravity: %s", gravity)
+		canvasMap, ok := transformation["canvas"].(map[interface{}]interface{})
+		if ok {
+			t.canvas, err = parseCanvas(canvasMap)
+			if err != nil {
+				return err
 			}
+		}
 
-			// x and y will default to 0 if not found in config
-			x, ok := watermarkMap["x-pos"].(int)
-			if x < 0 {
-				return fmt.Errorf("x-pos must be at least 0")
+		// Redactions given as parameters (rd_) and listed separately are all applied
+		t.redactions, err = parseRedactions(parametersStr)
+		if err != nil {
+			return fmt.Errorf("invalid transformation parameters: %s (%s)", parametersStr, err)
+		}
+		redactions, _ := transformation["redactions"].([]interface{})
+		for _, redactionMap := range redactions {
+			redaction, ok := redactionMap.(map[interface{}]interface{})
+			if !ok {
+				return fmt.Errorf("invalid redaction: %v", redactionMap)
 			}
-			y, ok := watermarkMap["y-pos"].(int)
-			if y < 0 {
-				return fmt.Errorf("y-pos must be at least 0")
+			r, err := parseRedactionConfig(redaction)
+			if err != nil {
+				return err
 			}
-
-			t.watermark = &Watermark{imagePath, gravity, x, y}
+			t.redactions = append(t.redactions, r)
+		}
+		if len(t.redactions) > MaxRedactions {
+			return fmt.Errorf("a transformation can have at most %d redactions", MaxRedactions)
 		}
 
 		texts, ok := transformation["text"].([]interface{})
@@ -240,27 +470,41 @@ func configInit(configFilePath string) error {
 				if !ok {
 					fontFilePath = defaultFontPath
 				}
-				if _, err := os.Stat(fontFilePath); os.IsNotExist(err) {
-					return fmt.Errorf("font does not exist: %s", fontFilePath)
+				// Fonts used for characters which the font doesn't have (e.g. CJK or emoji)
+				fontFilePaths := []string{fontFilePath}
+				fallbackFonts, ok := text["fallback-fonts"].([]interface{})
+				for _, fallbackFont := range fallbackFonts {
+					path, ok := fallbackFont.(string)
+					if !ok {
+						return fmt.Errorf("invalid fallback font: %v", fallbackFont)
+					}
+					fontFilePaths = append(fontFilePaths, path)
 				}
-				fontBytes, err := ioutil.ReadFile(fontFilePath)
+				fonts, err := loadFonts(fontFilePaths)
 				if err != nil {
-					return fmt.Errorf("loading font failed: %s", err)
-				}
-				font, err := freetype.ParseFont(fontBytes)
-				if err != nil {
-					return fmt.Errorf("loading font failed: %s", err)
+					return err
 				}
 
 				size, ok := text["size"].(int)
 				if !ok {
-					return fmt.Errorf("%v is not a valid size %s", text["size"])
+					return fmt.Errorf("%v is not a valid size", text["size"])
 				}
 				if size < 1 {
 					return fmt.Errorf("size needs to be at least 1")
 				}
 
-				t.texts = append(t.texts, &Text{content, gravity, fontFilePath, x, y, size, font, color})
+				style, err := parseTextStyle(text)
+				if err != nil {
+					return err
+				}
+
+				// Content with variables filled in for each request (e.g. {{.name}})
+				contentTemplate, err := parseTextTemplate(content)
+				if err != nil {
+					return fmt.Errorf("invalid text template: %s", err)
+				}
+
+				t.texts = append(t.texts, &Text{content, gravity, fontFilePaths, x, y, size, fonts, color, style, contentTemplate})
 			}
 		}
 
@@ -275,6 +519,228 @@ func configInit(configFilePath string) error {
 	return nil
 }
 
+// Reads a watermark (or a logo of a canvas) from its configuration
+func parseWatermark(watermarkMap map[interface{}]interface{}) (*Watermark, error) {
+	imagePath, ok := watermarkMap["source"].(string)
+	if !ok {
+		return nil, fmt.Errorf("a watermark needs to have a source specified")
+	}
+
+	// Tiled watermarks cover the whole image, gravity isn't needed
+	tiled, _ := watermarkMap["tile"].(bool)
+
+	gravity, ok := watermarkMap["gravity"].(string)
+	if !ok && tiled {
+		gravity = GravityNorthWest
+	} else if !ok || !isValidGravity(gravity) {
+		return nil, fmt.Errorf("missing or invalid gravity: %s", gravity)
+	}
+
+	// x and y will default to 0 if not found in config
+	x, ok := watermarkMap["x-pos"].(int)
+	if x < 0 {
+		return nil, fmt.Errorf("x-pos must be at least 0")
+	}
+	y, ok := watermarkMap["y-pos"].(int)
+	if y < 0 {
+		return nil, fmt.Errorf("y-pos must be at least 0")
+	}
+
+	opacity, ok := watermarkMap["opacity"].(int)
+	if !ok {
+		opacity = DefaultWatermarkOpacity
+	}
+	if opacity < 0 || opacity > 100 {
+		return nil, fmt.Errorf("opacity needs to be between 0 and 100")
+	}
+
+	// Width in percent of the image width, 0 keeps the size of the watermark file
+	width, ok := watermarkMap["width"].(int)
+	_, hasWidth := watermarkMap["width"]
+	if (hasWidth && !ok) || width < 0 || width > 100 {
+		return nil, fmt.Errorf("width needs to be between 0 and 100 (percent of the image width, 0 keeps the size)")
+	}
+
+	spacing, ok := watermarkMap["spacing"].(int)
+	if spacing < 0 {
+		return nil, fmt.Errorf("spacing must be at least 0")
+	}
+
+	var rotation float64
+	switch value := watermarkMap["rotation"].(type) {
+	case int:
+		rotation = float64(value)
+	case float64:
+		rotation = value
+	}
+
+	blend, ok := watermarkMap["blend"].(string)
+	if !ok {
+		blend = DefaultBlend
+	}
+	if !isValidBlend(blend) {
+		return nil, fmt.Errorf("invalid blend mode: %s, allowed: %s, %s, %s", blend, BlendNormal, BlendMultiply, BlendScreen)
+	}
+
+	return &Watermark{imagePath, gravity, x, y, opacity, width, tiled, spacing, rotation, blend}, nil
+}
+
+// Reads the size, background, position of the image and logos of a canvas from its configuration
+func parseCanvas(canvasMap map[interface{}]interface{}) (*Canvas, error) {
+	width, _ := canvasMap["width"].(int)
+	height, _ := canvasMap["height"].(int)
+	if width < 1 || height < 1 {
+		return nil, fmt.Errorf("a canvas needs to have a width and height of at least 1")
+	}
+
+	canvas := &Canvas{width, height, nil, "", DefaultCanvasGravity, 0, 0, make([]*Watermark, 0)}
+	colorStr, ok := canvasMap["background"].(string)
+	if ok {
+		background, err := colorful.Hex(colorStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid background: %s", colorStr)
+		}
+		canvas.background = background
+	}
+	canvas.backgroundImagePath, _ = canvasMap["background-image"].(string)
+
+	gravity, ok := canvasMap["gravity"].(string)
+	if ok {
+		if !isValidGravity(gravity) {
+			return nil, fmt.Errorf("invalid gravity: %s", gravity)
+		}
+		canvas.gravity = gravity
+	}
+	canvas.x, _ = canvasMap["x-pos"].(int)
+	canvas.y, _ = canvasMap["y-pos"].(int)
+	if canvas.x < 0 || canvas.y < 0 {
+		return nil, fmt.Errorf("x-pos and y-pos must be at least 0")
+	}
+
+	logos, _ := canvasMap["logos"].([]interface{})
+	for _, logoMap := range logos {
+		logo, ok := logoMap.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid logo: %v", logoMap)
+		}
+		watermark, err := parseWatermark(logo)
+		if err != nil {
+			return nil, err
+		}
+		canvas.logos = append(canvas.logos, watermark)
+	}
+	return canvas, nil
+}
+
+// Reads a redacted rectangle from its configuration
+func parseRedactionConfig(redactionMap map[interface{}]interface{}) (*Redaction, error) {
+	rect, ok := redactionMap["rect"].(string)
+	if !ok {
+		return nil, fmt.Errorf("a redaction needs to have a rect specified")
+	}
+	r, err := parseRedactionRect(strings.Split(rect, ","))
+	if err != nil {
+		return nil, fmt.Errorf("invalid rect: %s (expected %s)", rect, err)
+	}
+
+	method, ok := redactionMap["method"].(string)
+	if ok {
+		if !isValidRedactionMethod(method) {
+			return nil, fmt.Errorf("invalid redaction method: %s, allowed: %s, %s, %s", method, RedactionBlur, RedactionPixelate, RedactionFill)
+		}
+		r.method = method
+	}
+
+	strength, ok := redactionMap["strength"].(int)
+	if ok {
+		if strength < 2 || strength > MaxRedactionStrength {
+			return nil, fmt.Errorf("strength must be between 2 and %d", MaxRedactionStrength)
+		}
+		r.strength = strength
+	}
+
+	colorStr, ok := redactionMap["color"].(string)
+	if ok {
+		colorStr = strings.TrimPrefix(colorStr, "#")
+		if !hexColorRe.MatchString(colorStr) {
+			return nil, fmt.Errorf("invalid color: %s", colorStr)
+		}
+		r.color = strings.ToLower(colorStr)
+	}
+	return r, nil
+}
+
+// Reads the layout and decorations of a text overlay from its configuration
+func parseTextStyle(text map[interface{}]interface{}) (TextStyle, error) {
+	style := defaultTextStyle
+
+	maxWidth, _ := text["max-width"].(int)
+	if maxWidth < 0 {
+		return style, fmt.Errorf("max-width must be at least 0")
+	}
+	style.maxWidth = maxWidth
+
+	align, ok := text["align"].(string)
+	if ok {
+		if !isValidAlign(align) {
+			return style, fmt.Errorf("invalid align: %s, allowed: %s, %s, %s", align, AlignLeft, AlignCenter, AlignRight)
+		}
+		style.align = align
+	}
+
+	switch value := text["line-spacing"].(type) {
+	case int:
+		style.lineSpacing = float64(value)
+	case float64:
+		style.lineSpacing = value
+	}
+	if style.lineSpacing <= 0 {
+		return style, fmt.Errorf("line-spacing must be greater than 0")
+	}
+
+	colors := map[string]*color.Color{"stroke-color": &style.strokeColor, "shadow-color": &style.shadowColor, "background": &style.background}
+	for key, c := range colors {
+		colorStr, ok := text[key].(string)
+		if !ok {
+			continue
+		}
+		value, err := colorful.Hex(colorStr)
+		if err != nil {
+			return style, fmt.Errorf("invalid %s: %s", key, colorStr)
+		}
+		*c = value
+	}
+
+	style.strokeWidth, _ = text["stroke-width"].(int)
+	if style.strokeWidth < 0 || style.strokeWidth > MaxStrokeWidth {
+		return style, fmt.Errorf("stroke-width needs to be between 0 and %d", MaxStrokeWidth)
+	}
+	if style.strokeWidth > 0 && style.strokeColor == nil {
+		return style, fmt.Errorf("a stroke needs to have a stroke-color specified")
+	}
+
+	// Shadows can be cast in any direction
+	style.shadowX, _ = text["shadow-x"].(int)
+	style.shadowY, _ = text["shadow-y"].(int)
+
+	backgroundOpacity, ok := text["background-opacity"].(int)
+	if ok {
+		if backgroundOpacity < 0 || backgroundOpacity > 100 {
+			return style, fmt.Errorf("background-opacity needs to be between 0 and 100")
+		}
+		style.backgroundOpacity = backgroundOpacity
+	}
+
+	style.padding, _ = text["padding"].(int)
+	if style.padding < 0 {
+		return style, fmt.Errorf("padding must be at least 0")
+	}
+
+	style.shrink, _ = text["shrink-to-fit"].(bool)
+
+	return style, nil
+}
+
 var (
 	transformationNameConfigRe = regexp.MustCompile("^([0-9A-Za-z-]+)$")
 )
@@ -282,3 +748,59 @@ var (
 func isValidTransformationName(name string) bool {
 	return transformationNameConfigRe.MatchString(name)
 }
+
+// Parses a size like 400x300, either of the dimensions can be left out (e.g. 400x)
+func parseSize(str string) (int, int, error) {
+	dimensions := strings.Split(str, "x")
+	if len(dimensions) != 2 || str == "x" {
+		return 0, 0, fmt.Errorf("size needs to be in the form WIDTHxHEIGHT")
+	}
+	values := make([]int, 2)
+	for i, dimension := range dimensions {
+		if dimension == "" {
+			continue
+		}
+		value, err := strconv.Atoi(dimension)
+		if err != nil || value <= 0 {
+			return 0, 0, fmt.Errorf("dimensions need to be positive integers")
+		}
+		values[i] = value
+	}
+	return values[0], values[1], nil
+}
+
+// Checks if images of the given format can be uploaded
+func isAllowedUploadFormat(format string) bool {
+	for _, allowed := range Config.uploadFormats {
+		if allowed == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks if custom transformations can have the given width and height (0 if not specified)
+func isAllowedSize(width, height int) bool {
+	if Config.allowedSizes == nil {
+		return true
+	}
+	for _, size := range Config.allowedSizes {
+		if size.X == width && size.Y == height {
+			return true
+		}
+	}
+	return false
+}
+
+// isAllowedHeight checks if any allowed size has the given height, for widths which aren't known yet (w_auto)
+func isAllowedHeight(height int) bool {
+	if Config.allowedSizes == nil {
+		return true
+	}
+	for _, size := range Config.allowedSizes {
+		if size.Y == height {
+			return true
+		}
+	}
+	return false
+}
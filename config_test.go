@@ -0,0 +1,64 @@
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	cases := map[string]image.Point{
+		"400x300": {400, 300},
+		"400x":    {400, 0},
+		"x300":    {0, 300},
+	}
+	for str, exp := range cases {
+		width, height, err := parseSize(str)
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %s", str, err)
+		}
+		if act := (image.Point{width, height}); act != exp {
+			t.Errorf("Expected: %v, actual: %v", exp, act)
+		}
+	}
+
+	for _, str := range []string{"x", "400", "400x300x200", "ax300", "-400x300"} {
+		_, _, err := parseSize(str)
+		if err == nil {
+			t.Errorf("Expected an error for %s", str)
+		}
+	}
+}
+
+func TestIsAllowedSize(t *testing.T) {
+	if !isAllowedSize(1234, 0) {
+		t.Errorf("Any size should be allowed without a list of allowed sizes")
+	}
+
+	Config.allowedSizes = []image.Point{{400, 300}, {200, 0}}
+	defer func() {
+		Config.allowedSizes = nil
+	}()
+	if !isAllowedSize(400, 300) || !isAllowedSize(200, 0) {
+		t.Errorf("Listed sizes should be allowed")
+	}
+	if isAllowedSize(200, 150) || isAllowedSize(400, 0) {
+		t.Errorf("Sizes which are not listed should not be allowed")
+	}
+	if !isAllowedHeight(300) || !isAllowedHeight(0) || isAllowedHeight(150) {
+		t.Errorf("Only listed heights should be allowed for automatic widths")
+	}
+}
+
+func TestParseWatermarkWidth(t *testing.T) {
+	for _, width := range []interface{}{0, 1, 100} {
+		watermark, err := parseWatermark(map[interface{}]interface{}{"source": "logo.png", "gravity": "se", "width": width})
+		if err != nil || watermark.width != width {
+			t.Errorf("Expected a width of %v, actual: %v %v", width, watermark, err)
+		}
+	}
+	for _, width := range []interface{}{-1, 101, "20%", 2.5} {
+		if _, err := parseWatermark(map[interface{}]interface{}{"source": "logo.png", "gravity": "se", "width": width}); err == nil {
+			t.Errorf("Expected an error for a width of %v", width)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	// Separates the path of a font collection and the index of a font in it (fonts/NotoSansCJK.ttc#1)
+	fontIndexSeparator = "#"
+)
+
+var (
+	// Fonts by path, each font file is only read once
+	fontCache      = make(map[string]*sfnt.Font)
+	fontCacheMutex sync.Mutex
+)
+
+// loadFont loads a TrueType or OpenType (.ttf, .otf) font or a font of a collection (.ttc, .otc),
+// the first font of a collection is used unless the path ends with its index (fonts/NotoSansCJK.ttc#1)
+func loadFont(fontFilePath string) (*sfnt.Font, error) {
+	fontCacheMutex.Lock()
+	defer fontCacheMutex.Unlock()
+
+	if f, ok := fontCache[fontFilePath]; ok {
+		return f, nil
+	}
+
+	path, index := fontFilePath, 0
+	if i := strings.LastIndex(fontFilePath, fontIndexSeparator); i != -1 {
+		var err error
+		path = fontFilePath[:i]
+		index, err = strconv.Atoi(fontFilePath[i+1:])
+		if err != nil || index < 0 {
+			return nil, fmt.Errorf("invalid font index: %s", fontFilePath)
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("font does not exist: %s", path)
+	} else if err != nil {
+		return nil, fmt.Errorf("loading font failed: %s", err)
+	}
+	collection, err := opentype.ParseCollection(data)
+	if err != nil {
+		return nil, fmt.Errorf("loading font failed: %s", err)
+	}
+	if index >= collection.NumFonts() {
+		return nil, fmt.Errorf("loading font failed: %s has %d fonts", path, collection.NumFonts())
+	}
+	f, err := collection.Font(index)
+	if err != nil {
+		return nil, fmt.Errorf("loading font failed: %s", err)
+	}
+
+	fontCache[fontFilePath] = f
+	return f, nil
+}
+
+// Loads a font and its fallbacks
+func loadFonts(fontFilePaths []string) ([]*sfnt.Font, error) {
+	fonts := make([]*sfnt.Font, len(fontFilePaths))
+	for i, path := range fontFilePaths {
+		f, err := loadFont(path)
+		if err != nil {
+			return nil, err
+		}
+		fonts[i] = f
+	}
+	return fonts, nil
+}
+
+// textFonts measures and draws text in a font and its fallbacks at a size, each character is drawn
+// using the first font which has it. Sizes are in points, the DPI turns them into pixels.
+type textFonts struct {
+	fonts  []*sfnt.Font
+	faces  []font.Face
+	ppem   fixed.Int26_6
+	buffer sfnt.Buffer
+}
+
+func newTextFonts(fonts []*sfnt.Font, size, dpi float64) (*textFonts, error) {
+	f := &textFonts{fonts, make([]font.Face, len(fonts)), fixed.Int26_6(0.5 + size*dpi*64/72), sfnt.Buffer{}}
+	for i, sfntFont := range fonts {
+		face, err := opentype.NewFace(sfntFont, &opentype.FaceOptions{Size: size, DPI: dpi, Hinting: font.HintingNone})
+		if err != nil {
+			return nil, fmt.Errorf("loading font face failed: %s", err)
+		}
+		f.faces[i] = face
+	}
+	return f, nil
+}
+
+// Finds the first font which has a character, characters missing in all fonts use the first font
+func (f *textFonts) glyph(r rune) (int, sfnt.GlyphIndex) {
+	for i, sfntFont := range f.fonts {
+		index, err := sfntFont.GlyphIndex(&f.buffer, r)
+		if err == nil && index != 0 {
+			return i, index
+		}
+	}
+	return 0, 0
+}
+
+// Goes through the characters of a line calling draw (unless nil) with the position of each of them
+// and the face to draw it with, returns the width of the line. Characters of the same font are kerned.
+func (f *textFonts) walk(line string, draw func(x fixed.Int26_6, face font.Face, r rune)) fixed.Int26_6 {
+	x := fixed.Int26_6(0)
+	previousFont, previousIndex := -1, sfnt.GlyphIndex(0)
+	for _, r := range line {
+		i, index := f.glyph(r)
+		if i == previousFont {
+			kern, err := f.fonts[i].Kern(&f.buffer, previousIndex, index, f.ppem, font.HintingNone)
+			if err == nil {
+				x += kern
+			}
+		}
+		if draw != nil {
+			draw(x, f.faces[i], r)
+		}
+		advance, err := f.fonts[i].GlyphAdvance(&f.buffer, index, f.ppem, font.HintingNone)
+		if err == nil {
+			x += advance
+		}
+		previousFont, previousIndex = i, index
+	}
+	return x
+}
+
+// Width of a line in pixels
+func (f *textFonts) width(line string) float64 {
+	return fixedToFloat(f.walk(line, nil))
+}
+
+// Metrics of the first font in pixels (width is 0), lines are as high as all its glyphs together
+func (f *textFonts) metrics() FontMetrics {
+	bounds, _ := f.fonts[0].Bounds(&f.buffer, f.ppem, font.HintingNone)
+	ascent, descent := fixedToFloat(-bounds.Min.Y), fixedToFloat(-bounds.Max.Y)
+	return FontMetrics{0, ascent - descent, ascent, descent}
+}
+
+func fixedToFloat(x fixed.Int26_6) float64 {
+	return float64(x) / 64
+}
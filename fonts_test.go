@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/sfnt"
+)
+
+func createTextFonts(t *testing.T, fonts []*sfnt.Font, size, dpi float64) *textFonts {
+	textFonts, err := newTextFonts(fonts, size, dpi)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return textFonts
+}
+
+// Writes font data to a temporary directory, returns the path of the file
+func writeTestFont(t *testing.T, name string, data []byte) string {
+	dir, err := ioutil.TempDir("", "pixlserv")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	path := filepath.Join(dir, name)
+	err = ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return path
+}
+
+// A collection of copies of a font (all fonts share the same tables)
+func createFontCollection(ttf []byte, count int) []byte {
+	headerSize := 12 + 4*count
+	collection := make([]byte, headerSize+len(ttf))
+	copy(collection, "ttcf")
+	binary.BigEndian.PutUint32(collection[4:], 0x00010000)
+	binary.BigEndian.PutUint32(collection[8:], uint32(count))
+	for i := 0; i < count; i++ {
+		binary.BigEndian.PutUint32(collection[12+4*i:], uint32(headerSize))
+	}
+	copy(collection[headerSize:], ttf)
+
+	// Tables are found using offsets from the start of the file
+	font := collection[headerSize:]
+	tables := int(binary.BigEndian.Uint16(font[4:]))
+	for i := 0; i < tables; i++ {
+		entry := font[12+16*i:]
+		binary.BigEndian.PutUint32(entry[8:], binary.BigEndian.Uint32(entry[8:])+uint32(headerSize))
+	}
+	return collection
+}
+
+func TestLoadFont(t *testing.T) {
+	a, err := loadFont(defaultFontPath)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if b, _ := loadFont(defaultFontPath); a != b {
+		t.Errorf("Expected the font to be loaded only once")
+	}
+
+	path := writeTestFont(t, "collection.ttc", createFontCollection(goregular.TTF, 2))
+	defer os.RemoveAll(filepath.Dir(path))
+	for _, fontPath := range []string{path, path + "#1"} {
+		f, err := loadFont(fontPath)
+		if err != nil {
+			t.Fatalf("%s failed: %s", fontPath, err)
+		}
+		if name, _ := f.Name(nil, 1); name != "Go" {
+			t.Errorf("%s failed, expected the Go font, actual: %s", fontPath, name)
+		}
+	}
+
+	for _, fontPath := range []string{path + "#2", path + "#x", "fonts/missing.ttf", "README.md"} {
+		if _, err := loadFont(fontPath); err == nil {
+			t.Errorf("Expected an error for %s", fontPath)
+		}
+	}
+}
+
+func TestTextFontsFallback(t *testing.T) {
+	path := writeTestFont(t, "Go-Regular.ttf", goregular.TTF)
+	defer os.RemoveAll(filepath.Dir(path))
+	fonts, err := loadFonts([]string{path, defaultFontPath})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	textFonts := createTextFonts(t, fonts, 20, 72)
+
+	// The Go font has no snowman and no Arabic letters, neither font has Chinese characters
+	for r, exp := range map[rune]int{'A': 0, '€': 0, '☃': 1, 'ب': 1, '漢': 0} {
+		if act, _ := textFonts.glyph(r); act != exp {
+			t.Errorf("%c failed, expected font %d, actual: %d", r, exp, act)
+		}
+	}
+
+	// The snowman is drawn using the fallback font rather than as a missing character
+	withoutFallback := createTextFonts(t, fonts[:1], 20, 72)
+	if textFonts.width("☃") == withoutFallback.width("☃") {
+		t.Errorf("Expected a different width of the snowman in the fallback font")
+	}
+	if act, exp := textFonts.width("A☃"), withoutFallback.width("A")+createTextFonts(t, fonts[1:], 20, 72).width("☃"); act != exp {
+		t.Errorf("Expected the widths of both fonts to add up: %g, actual: %g", exp, act)
+	}
+}
+
+func TestDrawTextScale(t *testing.T) {
+	black := color.RGBA{0, 0, 0, 255}
+	text := createTestText(t, "HiDPI", 20, defaultTextStyle)
+	text.x, text.y = 10, 10
+	normal := findColor(drawTexts(createFilledImage(200, 100, color.White), []*Text{text}, 1).(*image.RGBA), black, 127)
+	retina := findColor(drawTexts(createFilledImage(400, 200, color.White), []*Text{text}, 2).(*image.RGBA), black, 127)
+
+	// Twice the size at the same relative position
+	if d := retina.Dx() - 2*normal.Dx(); d < -2 || d > 2 {
+		t.Errorf("Expected twice the width of %v, actual: %v", normal, retina)
+	}
+	if d := retina.Min.X - 2*normal.Min.X; d < -2 || d > 2 {
+		t.Errorf("Expected twice the offset of %v, actual: %v", normal, retina)
+	}
+	if layout := text.layout(createTextFonts(t, text.fonts, 20, 144), 0); int(layout.lineHeight+0.5) != int(2*text.layout(createTextFonts(t, text.fonts, 20, 72), 0).lineHeight+0.5) {
+		t.Errorf("Expected lines twice as high at 144 DPI")
+	}
+}
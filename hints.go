@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// CropHint specifies which part of an original image matters the most.
+// All coordinates are relative to the size of the image (0-1).
+type CropHint struct {
+	focusX, focusY float64
+	hasFocus       bool
+	x1, y1, x2, y2 float64
+	hasRect        bool
+}
+
+// focalPoint returns the focal point of a hint, the centre of the preferred crop rectangle
+// is used if there is no focal point
+func (h *CropHint) focalPoint() (float64, float64) {
+	if h.hasFocus || !h.hasRect {
+		return h.focusX, h.focusY
+	}
+	return (h.x1 + h.x2) / 2, (h.y1 + h.y2) / 2
+}
+
+// calculateCropRectangle returns the smallest rectangle with proportions of the given dimensions
+// which contains the preferred crop rectangle, centred on it and moved to fit in the image
+func (h *CropHint) calculateCropRectangle(width, height, imgWidth, imgHeight int) image.Rectangle {
+	rectWidth := (h.x2 - h.x1) * float64(imgWidth)
+	rectHeight := (h.y2 - h.y1) * float64(imgHeight)
+	ratio := float64(width) / float64(height)
+
+	if rectWidth < rectHeight*ratio {
+		rectWidth = rectHeight * ratio
+	} else {
+		rectHeight = rectWidth / ratio
+	}
+	if rectWidth > float64(imgWidth) {
+		rectWidth = float64(imgWidth)
+		rectHeight = rectWidth / ratio
+	}
+	if rectHeight > float64(imgHeight) {
+		rectHeight = float64(imgHeight)
+		rectWidth = rectHeight * ratio
+	}
+
+	cropWidth := clampInt(int(rectWidth+0.5), 1, imgWidth)
+	cropHeight := clampInt(int(rectHeight+0.5), 1, imgHeight)
+	focusX, focusY := h.focalPoint()
+	topLeftPoint := calculateTopLeftPointFromFocalPoint(focusX, focusY, cropWidth, cropHeight, imgWidth, imgHeight)
+	return image.Rect(0, 0, cropWidth, cropHeight).Add(topLeftPoint)
+}
+
+// within returns a hint for a part of an image (e.g. after trimming borders), relative coordinates
+// are moved into the part and clamped to its edges
+func (h *CropHint) within(bounds, part image.Rectangle) *CropHint {
+	toPartX := func(x float64) float64 {
+		value := (float64(bounds.Min.X) + x*float64(bounds.Dx()) - float64(part.Min.X)) / float64(part.Dx())
+		return math.Min(math.Max(value, 0), 1)
+	}
+	toPartY := func(y float64) float64 {
+		value := (float64(bounds.Min.Y) + y*float64(bounds.Dy()) - float64(part.Min.Y)) / float64(part.Dy())
+		return math.Min(math.Max(value, 0), 1)
+	}
+	hint := *h
+	hint.focusX, hint.focusY = toPartX(h.focusX), toPartY(h.focusY)
+	hint.x1, hint.y1, hint.x2, hint.y2 = toPartX(h.x1), toPartY(h.y1), toPartX(h.x2), toPartY(h.y2)
+	return &hint
+}
+
+// format returns the hint in the same format as accepted by parseCropHint
+func (h *CropHint) format() (focus, crop string) {
+	formatFloat := func(f float64) string {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	if h.hasFocus {
+		focus = formatFloat(h.focusX) + "," + formatFloat(h.focusY)
+	}
+	if h.hasRect {
+		crop = strings.Join([]string{formatFloat(h.x1), formatFloat(h.y1), formatFloat(h.x2), formatFloat(h.y2)}, ",")
+	}
+	return
+}
+
+// Parses a crop hint from a focal point like "0.3,0.7" and a crop rectangle like "0.1,0.1,0.6,0.9"
+// (left, top, right and bottom edge), either of them can be empty
+func parseCropHint(focus, crop string) (CropHint, error) {
+	var hint CropHint
+	if focus != "" {
+		x, y, err := parseFocalPoint(focus)
+		if err != nil {
+			return hint, err
+		}
+		hint.focusX, hint.focusY, hint.hasFocus = x, y, true
+	}
+	if crop != "" {
+		coordinates := strings.Split(crop, ",")
+		if len(coordinates) != 4 {
+			return hint, fmt.Errorf("crop rectangle needs to be in the form x1,y1,x2,y2")
+		}
+		values := make([]float64, 4)
+		for i, coordinate := range coordinates {
+			value, err := strconv.ParseFloat(coordinate, 64)
+			if err != nil || !(value >= 0 && value <= 1) {
+				return hint, fmt.Errorf("crop rectangle coordinates need to be numbers between 0 and 1")
+			}
+			values[i] = value
+		}
+		if values[0] >= values[2] || values[1] >= values[3] {
+			return hint, fmt.Errorf("crop rectangle needs to have a positive width and height")
+		}
+		hint.x1, hint.y1, hint.x2, hint.y2, hint.hasRect = values[0], values[1], values[2], values[3], true
+	}
+	return hint, nil
+}
+
+// Loads a crop hint for an original image, returns nil if there isn't one
+func loadCropHint(imagePath string) (*CropHint, error) {
+	values, err := redis.StringMap(Conn.Do("HGETALL", "hint:"+imagePath))
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+	hint, err := parseCropHint(values["focus"], values["crop"])
+	if err != nil {
+		return nil, err
+	}
+	return &hint, nil
+}
+
+// Saves a crop hint for an original image and removes all cached transformations of the image
+func saveCropHint(imagePath string, hint CropHint) error {
+	focus, crop := hint.format()
+	_, err := Conn.Do("DEL", "hint:"+imagePath)
+	if err != nil {
+		return err
+	}
+	if focus != "" {
+		_, err = Conn.Do("HSET", "hint:"+imagePath, "focus", focus)
+		if err != nil {
+			return err
+		}
+	}
+	if crop != "" {
+		_, err = Conn.Do("HSET", "hint:"+imagePath, "crop", crop)
+		if err != nil {
+			return err
+		}
+	}
+	// Transformations which are still running with the old hint won't be cached
+	err = increaseHintVersion(imagePath)
+	if err != nil {
+		return err
+	}
+	return removeTransformationsFromCache(imagePath)
+}
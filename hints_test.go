@@ -0,0 +1,78 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestParseCropHint(t *testing.T) {
+	act, err := parseCropHint("0.25,0.5", "0.1,0.2,0.5,0.6")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	exp := CropHint{0.25, 0.5, true, 0.1, 0.2, 0.5, 0.6, true}
+	if act != exp {
+		t.Errorf("Expected: %v, actual: %v", exp, act)
+	}
+
+	focus, crop := act.format()
+	if focus != "0.25,0.5" || crop != "0.1,0.2,0.5,0.6" {
+		t.Errorf("Formatting failed: %s, %s", focus, crop)
+	}
+
+	for _, c := range [][]string{{"0.5", ""}, {"", "0.1,0.2,0.5"}, {"", "0.5,0.2,0.1,0.6"}, {"", "0,0,1,1.5"}} {
+		_, err = parseCropHint(c[0], c[1])
+		if err == nil {
+			t.Errorf("Expected an error for %v", c)
+		}
+	}
+}
+
+func TestCalculateCropRectangle(t *testing.T) {
+	// A tall rectangle in the left half of the image widened to a square
+	hint, _ := parseCropHint("", "0.1,0.25,0.3,0.75")
+	exp := image.Rect(50, 150, 350, 450)
+	act := hint.calculateCropRectangle(100, 100, 1000, 600)
+	if act != exp {
+		t.Errorf("Expected: %v, actual: %v", exp, act)
+	}
+
+	// A wide rectangle can't be made taller than the image
+	hint, _ = parseCropHint("", "0,0.4,1,0.6")
+	exp = image.Rect(200, 0, 800, 600)
+	act = hint.calculateCropRectangle(100, 100, 1000, 600)
+	if act != exp {
+		t.Errorf("Expected: %v, actual: %v", exp, act)
+	}
+}
+
+func TestTransformCropAndResizeCropHint(t *testing.T) {
+	img := createImageWithDetail(400, 100, image.Rect(0, 0, 200, 100))
+	hint, _ := parseCropHint("1,0.5", "")
+
+	// Stored focal point is used when gravity is not specified
+	params, _ := parseParameters("w_100,h_100,c_k")
+	imgNew := transformCropAndResize(img, &Transformation{params: &params, metadata: MetadataStrip, cropHint: &hint})
+	if c := color.GrayModel.Convert(imgNew.At(0, 0)).(color.Gray); c.Y != 128 {
+		t.Errorf("Expected flat grey on the right side of the image, actual: %v", c)
+	}
+
+	// Explicit gravity wins over a stored focal point
+	params, _ = parseParameters("w_100,h_100,c_k,g_w")
+	imgNew = transformCropAndResize(img, &Transformation{params: &params, metadata: MetadataStrip, cropHint: &hint})
+	if c := color.GrayModel.Convert(imgNew.At(0, 0)).(color.Gray); c.Y != 255 {
+		t.Errorf("Expected the checkerboard on the left side of the image, actual: %v", c)
+	}
+
+	// Preferred crop rectangle is zoomed in on
+	hint, _ = parseCropHint("", "0.5,0,1,1")
+	params, _ = parseParameters("w_100,h_50,c_p,g_auto")
+	imgNew = transformCropAndResize(img, &Transformation{params: &params, metadata: MetadataStrip, cropHint: &hint})
+	if imgNew.Bounds().Size() != (image.Point{100, 50}) {
+		t.Fatalf("Expected a 100x50 image, actual: %v", imgNew.Bounds().Size())
+	}
+	if c := color.GrayModel.Convert(imgNew.At(50, 25)).(color.Gray); c.Y != 128 {
+		t.Errorf("Expected flat grey in the crop rectangle, actual: %v", c)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+const (
+	// Number of linear values the sRGB tone curve is precomputed for
+	srgbEncodeSteps = 4096
+)
+
+var (
+	// sRGB primaries adapted to the D50 white point of the profile connection space, columns are red, green and blue
+	srgbMatrix = [3][3]float64{
+		{0.4360747, 0.3850649, 0.1430804},
+		{0.2225045, 0.7168786, 0.0606169},
+		{0.0139322, 0.0971045, 0.7141733},
+	}
+	srgbInverseMatrix = invertMatrix(srgbMatrix)
+)
+
+// iccProfile is an RGB colour profile described by primaries and tone curves (a matrix/TRC profile),
+// profiles using lookup tables only (e.g. CMYK profiles) aren't supported
+type iccProfile struct {
+	// Converts linear RGB values to XYZ (D50), columns are red, green and blue
+	matrix [3][3]float64
+	// Tone curves of red, green and blue turning encoded values into linear ones
+	curves [3]func(float64) float64
+}
+
+// Reads a matrix/TRC profile from ICC data
+func parseICCProfile(data []byte) (*iccProfile, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" {
+		return nil, fmt.Errorf("invalid icc profile")
+	}
+	if string(data[16:20]) != "RGB " || string(data[20:24]) != "XYZ " {
+		return nil, fmt.Errorf("unsupported icc profile colour space: %q", data[16:20])
+	}
+
+	tags := make(map[string][]byte)
+	count := int(binary.BigEndian.Uint32(data[128:]))
+	for i := 0; i < count && 132+12*i+12 <= len(data); i++ {
+		entry := data[132+12*i:]
+		offset, size := binary.BigEndian.Uint32(entry[4:]), binary.BigEndian.Uint32(entry[8:])
+		if uint64(offset)+uint64(size) <= uint64(len(data)) {
+			tags[string(entry[:4])] = data[offset : offset+size]
+		}
+	}
+
+	profile := &iccProfile{}
+	for i, channel := range []string{"r", "g", "b"} {
+		xyz, ok := tags[channel+"XYZ"]
+		if !ok || len(xyz) < 20 || string(xyz[:4]) != "XYZ " {
+			return nil, fmt.Errorf("icc profile without %sXYZ colorant", channel)
+		}
+		for j := 0; j < 3; j++ {
+			profile.matrix[j][i] = s15Fixed16(xyz[8+4*j:])
+		}
+
+		curve, err := parseICCCurve(tags[channel+"TRC"])
+		if err != nil {
+			return nil, err
+		}
+		profile.curves[i] = curve
+	}
+	return profile, nil
+}
+
+// Reads a curve or parametric curve tag
+func parseICCCurve(data []byte) (func(float64) float64, error) {
+	if len(data) < 12 {
+		return nil, fmt.Errorf("invalid icc tone curve")
+	}
+	switch string(data[:4]) {
+	case "curv":
+		count := int(binary.BigEndian.Uint32(data[8:]))
+		if len(data) < 12+2*count {
+			return nil, fmt.Errorf("invalid icc tone curve")
+		}
+		switch count {
+		case 0:
+			return func(x float64) float64 { return x }, nil
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(data[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, gamma) }, nil
+		}
+		table := make([]float64, count)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(data[12+2*i:])) / 65535
+		}
+		return func(x float64) float64 {
+			// Linear interpolation between evenly spaced values
+			position := x * float64(count-1)
+			i := int(position)
+			if i >= count-1 {
+				return table[count-1]
+			}
+			return table[i] + (table[i+1]-table[i])*(position-float64(i))
+		}, nil
+	case "para":
+		functionType := binary.BigEndian.Uint16(data[8:])
+		counts := map[uint16]int{0: 1, 1: 3, 2: 4, 3: 5, 4: 7}
+		n, ok := counts[functionType]
+		if !ok || len(data) < 12+4*n {
+			return nil, fmt.Errorf("invalid icc parametric curve")
+		}
+		// g, a, b, c, d, e, f with the missing ones giving the simpler functions
+		p := []float64{1, 1, 0, 0, 0, 0, 0}
+		for i := 0; i < n; i++ {
+			p[i] = s15Fixed16(data[12+4*i:])
+		}
+		switch functionType {
+		case 1:
+			p[4] = -p[2] / p[1]
+		case 2:
+			p[4], p[5], p[6] = -p[2]/p[1], p[3], p[3]
+			p[3] = 0
+		}
+		return func(x float64) float64 {
+			if x >= p[4] {
+				return math.Pow(math.Max(p[1]*x+p[2], 0), p[0]) + p[5]
+			}
+			return p[3]*x + p[6]
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported icc tone curve: %q", data[:4])
+}
+
+func s15Fixed16(data []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(data))) / 65536
+}
+
+// Checks if a profile describes sRGB so that images using it don't need converting
+func (p *iccProfile) isSRGB() bool {
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			if math.Abs(p.matrix[i][j]-srgbMatrix[i][j]) > 0.002 {
+				return false
+			}
+		}
+		for _, x := range []float64{0.02, 0.2, 0.5, 0.8} {
+			if math.Abs(p.curves[i](x)-srgbToLinear(x)) > 0.002 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Converts an image with an embedded colour profile to sRGB, the profile is removed from its metadata.
+// Images without a profile, with an sRGB profile or with an unsupported profile are returned as they are.
+func convertToSRGB(img image.Image) image.Image {
+	original, metadata := splitMetadata(img)
+	if metadata == nil || metadata.icc == nil {
+		return img
+	}
+	profile, err := parseICCProfile(metadata.icc)
+	if err != nil || profile.isSRGB() {
+		return img
+	}
+
+	// Linear values of all 8-bit values of each channel and the combined matrix to linear sRGB
+	var linear [3][256]float64
+	for i := 0; i < 3; i++ {
+		for v := 0; v < 256; v++ {
+			linear[i][v] = profile.curves[i](float64(v) / 255)
+		}
+	}
+	matrix := multiplyMatrices(srgbInverseMatrix, profile.matrix)
+	encode := make([]uint8, srgbEncodeSteps+1)
+	for i := range encode {
+		encode[i] = uint8(linearToSRGB(float64(i)/srgbEncodeSteps)*255 + 0.5)
+	}
+
+	bounds := original.Bounds()
+	converted := image.NewNRGBA(bounds)
+	ycbcr, isYCbCr := original.(*image.YCbCr)
+	var c color.NRGBA
+	channels := [3]*uint8{&c.R, &c.G, &c.B}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if isYCbCr {
+				yc := ycbcr.YCbCrAt(x, y)
+				c.R, c.G, c.B = color.YCbCrToRGB(yc.Y, yc.Cb, yc.Cr)
+				c.A = 255
+			} else {
+				c = color.NRGBAModel.Convert(original.At(x, y)).(color.NRGBA)
+			}
+			r, g, b := linear[0][c.R], linear[1][c.G], linear[2][c.B]
+			for i, channel := range channels {
+				v := matrix[i][0]*r + matrix[i][1]*g + matrix[i][2]*b
+				// Colours outside of sRGB are clipped
+				v = math.Min(math.Max(v, 0), 1)
+				*channel = encode[int(v*srgbEncodeSteps+0.5)]
+			}
+			converted.SetNRGBA(x, y, c)
+		}
+	}
+	return withMetadata(converted, &Metadata{metadata.exif, metadata.xmp, nil})
+}
+
+func srgbToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+func multiplyMatrices(a, b [3][3]float64) [3][3]float64 {
+	var result [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				result[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return result
+}
+
+func invertMatrix(m [3][3]float64) [3][3]float64 {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	var result [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			// Cofactors of the transposed matrix
+			a, b := m[(j+1)%3], m[(j+2)%3]
+			result[i][j] = (a[(i+1)%3]*b[(i+2)%3] - a[(i+2)%3]*b[(i+1)%3]) / det
+		}
+	}
+	return result
+}
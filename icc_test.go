@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+var (
+	// Display P3 and Adobe RGB (1998) primaries adapted to D50 like in their ICC profiles
+	displayP3Matrix = [3][3]float64{
+		{0.5151, 0.2919, 0.1571},
+		{0.2412, 0.6922, 0.0666},
+		{-0.0011, 0.0419, 0.7841},
+	}
+	adobeRGBMatrix = [3][3]float64{
+		{0.6097, 0.2053, 0.1492},
+		{0.3111, 0.6257, 0.0632},
+		{0.0195, 0.0609, 0.7446},
+	}
+)
+
+// Parametric curve of sRGB (and Display P3)
+func createSRGBCurveTag() []byte {
+	tag := make([]byte, 12+4*5)
+	copy(tag, "para")
+	binary.BigEndian.PutUint16(tag[8:], 3)
+	for i, p := range []float64{2.4, 1 / 1.055, 0.055 / 1.055, 1 / 12.92, 0.04045} {
+		binary.BigEndian.PutUint32(tag[12+4*i:], uint32(int32(p*65536+0.5)))
+	}
+	return tag
+}
+
+// Gamma curve of Adobe RGB (2.2)
+func createGammaCurveTag() []byte {
+	tag := make([]byte, 14)
+	copy(tag, "curv")
+	binary.BigEndian.PutUint32(tag[8:], 1)
+	binary.BigEndian.PutUint16(tag[12:], 563)
+	return tag
+}
+
+// A matrix/TRC profile with the same tone curve for all channels
+func createICCProfile(colorSpace string, matrix [3][3]float64, curve []byte) []byte {
+	tags := make([][]byte, 0)
+	for i := 0; i < 3; i++ {
+		xyz := make([]byte, 20)
+		copy(xyz, "XYZ ")
+		for j := 0; j < 3; j++ {
+			binary.BigEndian.PutUint32(xyz[8+4*j:], uint32(int32(matrix[j][i]*65536)))
+		}
+		tags = append(tags, xyz)
+	}
+
+	var data bytes.Buffer
+	header := make([]byte, 128)
+	copy(header[16:], colorSpace)
+	copy(header[20:], "XYZ ")
+	copy(header[36:], "acsp")
+	data.Write(header)
+	table := make([]byte, 4+12*6)
+	binary.BigEndian.PutUint32(table, 6)
+	offset := 128 + len(table)
+	for i, signature := range []string{"rXYZ", "gXYZ", "bXYZ", "rTRC", "gTRC", "bTRC"} {
+		tag := curve
+		if i < 3 {
+			tag = tags[i]
+		}
+		copy(table[4+12*i:], signature)
+		binary.BigEndian.PutUint32(table[8+12*i:], uint32(offset))
+		binary.BigEndian.PutUint32(table[12+12*i:], uint32(len(tag)))
+		offset += len(tag)
+	}
+	data.Write(table)
+	for _, tag := range tags {
+		data.Write(tag)
+	}
+	for i := 0; i < 3; i++ {
+		data.Write(curve)
+	}
+	return data.Bytes()
+}
+
+func closeColors(a, b color.NRGBA, tolerance int) bool {
+	diff := func(x, y uint8) bool {
+		d := int(x) - int(y)
+		return d <= tolerance && d >= -tolerance
+	}
+	return diff(a.R, b.R) && diff(a.G, b.G) && diff(a.B, b.B) && a.A == b.A
+}
+
+// Golden values are sRGB colours expressed in the other colour spaces
+func TestConvertToSRGB(t *testing.T) {
+	profiles := map[string][]byte{
+		"p3":    createICCProfile("RGB ", displayP3Matrix, createSRGBCurveTag()),
+		"adobe": createICCProfile("RGB ", adobeRGBMatrix, createGammaCurveTag()),
+	}
+	cases := []struct {
+		profile string
+		src     color.NRGBA
+		exp     color.NRGBA
+	}{
+		{"p3", color.NRGBA{234, 51, 35, 255}, color.NRGBA{255, 0, 0, 255}},
+		{"p3", color.NRGBA{117, 251, 76, 255}, color.NRGBA{0, 255, 0, 255}},
+		{"p3", color.NRGBA{128, 128, 128, 128}, color.NRGBA{128, 128, 128, 128}},
+		// Outside of sRGB
+		{"p3", color.NRGBA{255, 0, 0, 255}, color.NRGBA{255, 0, 0, 255}},
+		{"adobe", color.NRGBA{219, 0, 0, 255}, color.NRGBA{255, 0, 0, 255}},
+		{"adobe", color.NRGBA{144, 255, 60, 255}, color.NRGBA{0, 255, 0, 255}},
+		{"adobe", color.NRGBA{255, 255, 255, 255}, color.NRGBA{255, 255, 255, 255}},
+	}
+	for _, c := range cases {
+		img := withMetadata(createFilledImage(8, 8, c.src), &Metadata{[]byte("exif"), nil, profiles[c.profile]})
+		converted, metadata := splitMetadata(convertToSRGB(img))
+		if metadata == nil || metadata.icc != nil || string(metadata.exif) != "exif" {
+			t.Errorf("%s %v failed, expected the profile to be removed, actual: %v", c.profile, c.src, metadata)
+		}
+		act := color.NRGBAModel.Convert(converted.At(3, 3)).(color.NRGBA)
+		if !closeColors(act, c.exp, 3) {
+			t.Errorf("%s %v failed, expected: %v, actual: %v", c.profile, c.src, c.exp, act)
+		}
+
+		// Thumbnails match the originals
+		params, _ := parseParameters("w_4")
+		thumbnail := transformCropAndResize(converted, &Transformation{params: &params, metadata: MetadataStrip})
+		if act := color.NRGBAModel.Convert(thumbnail.At(1, 1)).(color.NRGBA); !closeColors(act, c.exp, 3) {
+			t.Errorf("%s %v failed, expected a thumbnail: %v, actual: %v", c.profile, c.src, c.exp, act)
+		}
+	}
+}
+
+// Photos with Display P3 and Adobe RGB (1998) profiles embedded the way cameras and editors do (JPEG APP2
+// segment, PNG iCCP chunk). Their top halves are the colours of TestConvertToSRGB, the bottom halves gradients.
+func TestConvertToSRGBGolden(t *testing.T) {
+	previous, previousConvert := storageImpl, Config.convertToSRGB
+	storageImpl, Config.convertToSRGB = &localStorage{"testdata"}, true
+	defer func() {
+		storageImpl, Config.convertToSRGB = previous, previousConvert
+	}()
+
+	red, green := color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 255, 0, 255}
+	cases := []struct {
+		path, golden string
+		patches      []color.NRGBA
+	}{
+		{"display-p3.jpg", "icc-display-p3", []color.NRGBA{red, green, red}},
+		{"adobe-rgb.png", "icc-adobe-rgb", []color.NRGBA{red, green, {255, 255, 255, 255}}},
+	}
+	for _, c := range cases {
+		img, _, err := loadImage(c.path)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if _, metadata := splitMetadata(img); metadata != nil && metadata.icc != nil {
+			t.Errorf("%s failed, expected the profile to be removed", c.path)
+		}
+		params, _ := parseParameters("w_24")
+		thumbnail := transformCropAndResize(img, &Transformation{params: &params, metadata: MetadataStrip})
+		rgba := image.NewRGBA(thumbnail.Bounds())
+		draw.Draw(rgba, rgba.Bounds(), thumbnail, thumbnail.Bounds().Min, draw.Src)
+		for i, exp := range c.patches {
+			if act := color.NRGBAModel.Convert(rgba.At(8*i+4, 4)).(color.NRGBA); !closeColors(act, exp, 4) {
+				t.Errorf("%s failed, expected patch %d: %v, actual: %v", c.path, i, exp, act)
+			}
+		}
+		compareGolden(t, c.golden, rgba)
+	}
+}
+
+func TestConvertToSRGBUnchanged(t *testing.T) {
+	src := createFilledImage(8, 8, color.NRGBA{200, 100, 50, 255})
+	profiles := [][]byte{
+		nil,
+		createICCProfile("RGB ", srgbMatrix, createSRGBCurveTag()),
+		createICCProfile("CMYK", adobeRGBMatrix, createGammaCurveTag()),
+		[]byte("invalid profile"),
+	}
+	for i, profile := range profiles {
+		img := withMetadata(src, &Metadata{nil, nil, profile})
+		if convertToSRGB(img) != img {
+			t.Errorf("Profile %d failed, expected the image to be unchanged", i)
+		}
+	}
+}
+
+func TestParseICCCurve(t *testing.T) {
+	table := []byte("curv\x00\x00\x00\x00\x00\x00\x00\x03\x00\x00\x40\x00\xff\xff")
+	cases := []struct {
+		tag []byte
+		x   float64
+		exp float64
+	}{
+		{[]byte("curv\x00\x00\x00\x00\x00\x00\x00\x00"), 0.3, 0.3},
+		{createGammaCurveTag(), 0.5, 0.2180},
+		{table, 0.25, 0.125},
+		{table, 0.75, 0.6250},
+		{createSRGBCurveTag(), 0.5, 0.2140},
+		{createSRGBCurveTag(), 0.02, 0.0015},
+	}
+	for i, c := range cases {
+		curve, err := parseICCCurve(c.tag)
+		if err != nil {
+			t.Errorf("Case %d failed: %s", i, err)
+			continue
+		}
+		if act := curve(c.x); act < c.exp-0.001 || act > c.exp+0.001 {
+			t.Errorf("Case %d failed, expected: %f, actual: %f", i, c.exp, act)
+		}
+	}
+
+	if _, err := parseICCCurve([]byte("mAB \x00\x00\x00\x00\x00\x00\x00\x00")); err == nil {
+		t.Errorf("Expected an error for an unsupported curve")
+	}
+}
@@ -1,52 +1,218 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"image"
+	"image/color"
+	"image/draw"
 	"image/jpeg"
 	"image/png"
 	"io"
+	"io/ioutil"
 	"regexp"
 	"strconv"
+	"strings"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
 )
 
 var (
-	scaledPathRe    = regexp.MustCompile("(.+)@(\\d+)x\\.([^\\.]+)$")
+	scaledPathRe    = regexp.MustCompile("(.+)@(\\d+(?:\\.\\d+)?)x\\.([^\\.]+)$")
 	notScaledPathRe = regexp.MustCompile("(.+)\\.([^\\.]+)$")
 )
 
+// EncodingOptions specify how images are written
+type EncodingOptions struct {
+	// JPEG quality (1-100) and max. number of colours of PNG images (0 = no palette)
+	quality, paletteColors      int
+	subsampling, pngCompression string
+	progressive                 bool
+}
+
+// Formats of images which can be read and uploaded
+var supportedFormats = []string{"jpeg", "png", "gif", "bmp", "tiff", "svg"}
+
+// Other names of formats, e.g. from file extensions
+var formatAliases = map[string]string{
+	"jpg": "jpeg",
+	"tif": "tiff",
+}
+
+// Transformed images of formats which browsers can't display are written in these formats
+var transformedFormats = map[string]string{
+	"bmp":  "png",
+	"tiff": "jpg",
+	"svg":  "png",
+}
+
+var pngCompressionLevels = map[string]png.CompressionLevel{
+	PNGCompressionNone:    png.NoCompression,
+	PNGCompressionFast:    png.BestSpeed,
+	PNGCompressionDefault: png.DefaultCompression,
+	PNGCompressionBest:    png.BestCompression,
+}
+
+// Returns the options used for images without any encoding parameters
+func defaultEncodingOptions() EncodingOptions {
+	return EncodingOptions{Config.jpegQuality, 0, DefaultSubsampling, DefaultPNGCompression, false}
+}
+
 // Writes a given image of the given format to the given destination.
 // Returns error.
 func writeImage(img image.Image, format string, w io.Writer) error {
-	if format == "png" {
-		return png.Encode(w, img)
+	return writeImageWithOptions(img, format, defaultEncodingOptions(), w)
+}
+
+// Writes a given image like writeImage using the given encoding options.
+func writeImageWithOptions(img image.Image, format string, options EncodingOptions, w io.Writer) error {
+	img, metadata := splitMetadata(img)
+	switch format {
+	case "png":
+		if options.paletteColors > 0 {
+			img = quantiseImage(img, options.paletteColors)
+		}
+		var buffer bytes.Buffer
+		encoder := png.Encoder{CompressionLevel: pngCompressionLevels[options.pngCompression]}
+		err := encoder.Encode(&buffer, img)
+		if err != nil {
+			return err
+		}
+		return writeWithMetadata(w, buffer.Bytes(), format, metadata)
+	case "gif":
+		colors := options.paletteColors
+		if colors == 0 {
+			colors = MaxPaletteColors
+		}
+		return encodeGIF(w, img, colors)
+	case "bmp":
+		return bmp.Encode(w, img)
+	case "tiff", "tif":
+		return tiff.Encode(w, img, &tiff.Options{Compression: tiff.Deflate, Predictor: true})
+	case "svg":
+		// Vector images are kept as they were uploaded
+		vector, ok := img.(*VectorImage)
+		if !ok {
+			return fmt.Errorf("only vector images can be written as svg")
+		}
+		_, err := w.Write(vector.data)
+		return err
+	}
+	var buffer bytes.Buffer
+	err := encodeJPEG(&buffer, flattenImage(img), options.quality, options.subsampling, options.progressive)
+	if err != nil {
+		return err
 	}
-	return jpeg.Encode(w, img, &jpeg.Options{Config.jpegQuality})
+	return writeWithMetadata(w, buffer.Bytes(), format, metadata)
+}
+
+// Images in formats other than PNG and GIF are written as JPEG
+func isJPEGFormat(format string) bool {
+	return format != "png" && format != "gif"
+}
+
+// Returns the name of a format used in supportedFormats (e.g. jpeg for jpg)
+func normaliseFormat(format string) string {
+	format = strings.ToLower(format)
+	if alias, ok := formatAliases[format]; ok {
+		return alias
+	}
+	return format
+}
+
+func isSupportedFormat(format string) bool {
+	for _, supported := range supportedFormats {
+		if supported == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the format which transformed images of the given format are written in
+func transformedFormat(format string) string {
+	if transformed, ok := transformedFormats[normaliseFormat(format)]; ok {
+		return transformed
+	}
+	return format
+}
+
+// JPEG doesn't support transparency, transparent areas of images are turned white
+func flattenImage(img image.Image) image.Image {
+	if opaque, ok := img.(interface {
+		Opaque() bool
+	}); !ok || opaque.Opaque() {
+		return img
+	}
+	bounds := img.Bounds()
+	flattened := image.NewRGBA(bounds)
+	draw.Draw(flattened, bounds, image.NewUniform(color.White), image.ZP, draw.Src)
+	draw.Draw(flattened, bounds, img, bounds.Min, draw.Over)
+	return flattened
 }
 
 func readImage(reader io.Reader, format string) (image.Image, error) {
-	if format == "png" {
-		return png.Decode(reader)
+	switch format {
+	case "png":
+		return decodeWithMetadata(reader, png.Decode)
+	case "gif":
+		return decodeGIF(reader)
+	case "bmp":
+		return bmp.Decode(reader)
+	case "tiff", "tif":
+		return tiff.Decode(reader)
+	case "svg":
+		return decodeSVG(reader)
 	}
-	return jpeg.Decode(reader)
+	return decodeWithMetadata(reader, jpeg.Decode)
 }
 
-// Returns image@2x.jpg if image.jpg, 2 is passed in
-func constructScaledPath(path string, scale int) (string, error) {
+// Reads an image detecting its format, all frames of animated GIF images and metadata
+// of JPEG and PNG images are read. Returns the image and its format.
+func decodeImage(reader io.Reader) (image.Image, string, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, "", err
+	}
+	_, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if format == "gif" {
+		img, err := decodeGIF(bytes.NewReader(data))
+		return img, format, err
+	}
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	return withMetadata(img, readMetadata(data)), format, nil
+}
+
+// Returns image@2x.jpg if image.jpg, 2 is passed in (image@1.5x.jpg for 1.5)
+func constructScaledPath(path string, scale float64) (string, error) {
 	matches := notScaledPathRe.FindStringSubmatch(path)
 	if len(matches) == 0 {
 		return "", fmt.Errorf("can't parse path: %s", path)
 	}
-	return fmt.Sprintf("%s@%dx.%s", matches[1], scale, matches[2]), nil
+	return fmt.Sprintf("%s@%sx.%s", matches[1], strconv.FormatFloat(scale, 'f', -1, 64), matches[2]), nil
 }
 
-// Gets (image.jpg, 2) from image@2x.jpg
-func parseBasePathAndScale(path string) (string, int) {
+// Gets (image.jpg, 2) from image@2x.jpg, scale is normalised (e.g. image@1.3x.jpg gives 1.25)
+// Paths with invalid scales (like image@0x.jpg) are returned as they are with the default scale
+func parseBasePathAndScale(path string) (string, float64) {
 	matches := scaledPathRe.FindStringSubmatch(path)
 	if len(matches) == 0 {
-		return path, 1
+		return path, DefaultScale
+	}
+	scale, err := strconv.ParseFloat(matches[2], 64)
+	if err != nil {
+		return path, DefaultScale
+	}
+	scale, ok := normaliseScale(scale)
+	if !ok {
+		return path, DefaultScale
 	}
-	path = matches[1] + "." + matches[3]
-	scale, _ := strconv.Atoi(matches[2])
-	return path, scale
+	return matches[1] + "." + matches[3], scale
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	_ "image/png"
+	"strings"
+	"testing"
+)
+
+func TestParseBasePathAndScale(t *testing.T) {
+	cases := []struct {
+		path, expPath string
+		expScale      float64
+	}{
+		{"image.jpg", "image.jpg", 1},
+		{"image@2x.jpg", "image.jpg", 2},
+		{"dir/image@3x.png", "dir/image.png", 3},
+		{"image@0x.jpg", "image@0x.jpg", 1},
+		{"image@99999999999999999999x.jpg", "image@99999999999999999999x.jpg", 1},
+		{"image@1.5x.jpg", "image.jpg", 1.5},
+		{"image@2.625x.jpg", "image.jpg", 2.625},
+		{"image@2.6x.jpg", "image.jpg", 2.625},
+		{"image@0.01x.jpg", "image@0.01x.jpg", 1},
+		{"image@11x.jpg", "image@11x.jpg", 1},
+		{"image@1.x.jpg", "image@1.x.jpg", 1},
+	}
+	for _, c := range cases {
+		path, scale := parseBasePathAndScale(c.path)
+		if path != c.expPath || scale != c.expScale {
+			t.Errorf("%s failed, expected: %s %g, actual: %s %g", c.path, c.expPath, c.expScale, path, scale)
+		}
+	}
+}
+
+func FuzzParseBasePathAndScale(f *testing.F) {
+	for _, seed := range []string{"image.jpg", "image@2x.jpg", "a@0x.b", "@1x.", "x@-1x.png", "a@1.5x.b"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, path string) {
+		basePath, scale := parseBasePathAndScale(path)
+		if scale < ScaleStep || scale > MaxScale {
+			t.Errorf("Invalid scale for %q: %g", path, scale)
+		}
+		if basePath != path && !scaledPathRe.MatchString(path) {
+			t.Errorf("Path %q changed to %q without scaling", path, basePath)
+		}
+		if len(basePath) > len(path) {
+			t.Errorf("Path %q got longer: %q", path, basePath)
+		}
+	})
+}
+
+func TestWriteImageWithOptions(t *testing.T) {
+	img := createGradientImage(200, 200)
+	sizes := make(map[string]int)
+	options := map[string]EncodingOptions{
+		"png":          {75, 0, Subsampling420, PNGCompressionDefault, false},
+		"png-none":     {75, 0, Subsampling420, PNGCompressionNone, false},
+		"png-palette":  {75, 64, Subsampling420, PNGCompressionDefault, false},
+		"jpeg":         {75, 0, Subsampling420, PNGCompressionDefault, false},
+		"jpeg-quality": {30, 0, Subsampling420, PNGCompressionDefault, false},
+		"jpeg-444":     {75, 0, Subsampling444, PNGCompressionDefault, false},
+	}
+	for name, o := range options {
+		var buffer bytes.Buffer
+		err := writeImageWithOptions(img, strings.Split(name, "-")[0], o, &buffer)
+		if err != nil {
+			t.Fatalf("%s failed: %s", name, err)
+		}
+		sizes[name] = buffer.Len()
+
+		if o.paletteColors > 0 {
+			decoded, _, err := image.Decode(&buffer)
+			if err != nil {
+				t.Fatalf("%s failed, decoding: %s", name, err)
+			}
+			if _, ok := decoded.(*image.Paletted); !ok {
+				t.Errorf("Expected an image with a palette, actual: %T", decoded)
+			}
+		}
+	}
+
+	if sizes["png-none"] <= sizes["png"] {
+		t.Errorf("Expected uncompressed PNG to be bigger: %v", sizes)
+	}
+	if sizes["jpeg-quality"] >= sizes["jpeg"] || sizes["jpeg-444"] <= sizes["jpeg"] {
+		t.Errorf("Unexpected JPEG sizes: %v", sizes)
+	}
+}
+
+func TestReadWriteImageFormats(t *testing.T) {
+	img := createGradientImage(30, 20)
+	for _, format := range []string{"bmp", "tiff", "tif"} {
+		var buffer bytes.Buffer
+		err := writeImage(img, format, &buffer)
+		if err != nil {
+			t.Fatalf("%s failed: %s", format, err)
+		}
+		data := buffer.Bytes()
+		decoded, err := readImage(bytes.NewReader(data), format)
+		if err != nil {
+			t.Fatalf("%s failed, reading: %s", format, err)
+		}
+		if decoded.Bounds() != img.Bounds() || decoded.At(10, 10) != img.At(10, 10) {
+			t.Errorf("%s failed, expected the same image", format)
+		}
+		_, detected, err := decodeImage(bytes.NewReader(data))
+		if err != nil || detected != normaliseFormat(format) {
+			t.Errorf("%s failed, detected: %s %v", format, detected, err)
+		}
+	}
+
+	// SVG images are written as uploaded
+	data := `<svg width="10" height="10"><rect width="5" height="5"/></svg>`
+	vector, format, _ := decodeImage(strings.NewReader(data))
+	var buffer bytes.Buffer
+	err := writeImage(vector, format, &buffer)
+	if err != nil || buffer.String() != data {
+		t.Errorf("Expected the original SVG, actual: %q %v", buffer.String(), err)
+	}
+}
+
+func TestTransformedFormat(t *testing.T) {
+	cases := map[string]string{"jpeg": "jpeg", "jpg": "jpg", "png": "png", "gif": "gif", "bmp": "png", "TIF": "jpg", "tiff": "jpg", "svg": "png"}
+	for format, exp := range cases {
+		if act := transformedFormat(format); act != exp {
+			t.Errorf("%s failed, expected: %s, actual: %s", format, exp, act)
+		}
+	}
+
+	params, _ := parseParameters("w_100")
+	path, _ := (&Transformation{params: &params, metadata: MetadataStrip}).createFilePath("logo.svg")
+	if !strings.HasPrefix(path, "logo--") || !strings.HasSuffix(path, "--.png") {
+		t.Errorf("Expected a cached PNG file, actual: %s", path)
+	}
+}
+
+func TestSaveImageWithOptions(t *testing.T) {
+	defer useTemporaryStorage(t)()
+	img := createGradientImage(100, 100)
+
+	// Stored files are read back as they were encoded, not with the default quality
+	for _, quality := range []int{30, 95} {
+		options := EncodingOptions{quality, 0, Subsampling420, PNGCompressionDefault, false}
+		var buffer bytes.Buffer
+		writeImageWithOptions(img, "jpeg", options, &buffer)
+		size, err := saveImageWithOptions(img, "jpeg", options, "cat.jpg")
+		if err != nil || size != buffer.Len() {
+			t.Fatalf("Expected %d bytes to be saved, actual: %d %v", buffer.Len(), size, err)
+		}
+		data, err := loadData("cat.jpg")
+		if err != nil || !bytes.Equal(data, buffer.Bytes()) {
+			t.Errorf("Expected the stored file with quality %d to be the same as the encoded image", quality)
+		}
+	}
+}
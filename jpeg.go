@@ -0,0 +1,727 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"math"
+)
+
+// image/jpeg only writes baseline JPEG images with 4:2:0 chroma subsampling, images with other
+// subsampling or progressive images are written by the encoder in this file. It uses the example
+// quantisation and Huffman tables from the JPEG specification (sections K.1 and K.3) just like image/jpeg,
+// progressive images need Huffman tables optimised for each scan (section K.2).
+
+const (
+	jpegMarkerSOF0 = 0xc0 // Start of frame (baseline)
+	jpegMarkerSOF2 = 0xc2 // Start of frame (progressive)
+	jpegMarkerDHT  = 0xc4 // Define Huffman tables
+	jpegMarkerSOI  = 0xd8 // Start of image
+	jpegMarkerEOI  = 0xd9 // End of image
+	jpegMarkerSOS  = 0xda // Start of scan
+	jpegMarkerDQT  = 0xdb // Define quantisation tables
+
+	jpegBlockSize = 64
+)
+
+// Natural (row by row) index of each coefficient in zig-zag order
+var jpegUnzig = [jpegBlockSize]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// Luminance and chrominance quantisation tables for quality 50 in zig-zag order
+var jpegUnscaledQuant = [2][jpegBlockSize]int{
+	{
+		16, 11, 12, 14, 12, 10, 16, 14,
+		13, 14, 18, 17, 16, 19, 24, 40,
+		26, 24, 22, 22, 24, 49, 35, 37,
+		29, 40, 58, 51, 61, 60, 57, 51,
+		56, 55, 64, 72, 92, 78, 64, 68,
+		87, 69, 55, 56, 80, 109, 81, 87,
+		95, 98, 103, 104, 103, 62, 77, 113,
+		121, 112, 100, 120, 92, 101, 103, 99,
+	},
+	{
+		17, 18, 18, 24, 21, 24, 47, 26,
+		26, 47, 99, 66, 56, 66, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// jpegHuffmanSpec is a Huffman table as stored in a DHT marker
+type jpegHuffmanSpec struct {
+	// Number of codes of each length (1-16 bits)
+	counts [16]byte
+	// Symbols ordered by their codes
+	symbols []byte
+}
+
+// Luminance DC, luminance AC, chrominance DC and chrominance AC tables
+var jpegHuffmanSpecs = [4]jpegHuffmanSpec{
+	{
+		[16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+		[]byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+			0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+			0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+			0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+			0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+			0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+			0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+			0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+			0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+			0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+			0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+	{
+		[16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+		[]byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+			0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+			0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+			0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+			0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+			0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+			0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+			0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+			0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+			0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+			0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+}
+
+// Code of each symbol of a Huffman table, the length of the code is in the top 8 bits
+type jpegHuffmanCodes [256]uint32
+
+var (
+	jpegStandardHuffmanCodes [4]jpegHuffmanCodes
+	// DCT basis functions, jpegCosines[u][x] = C(u) / 2 * cos((2x + 1) * u * pi / 16)
+	jpegCosines [8][8]float64
+)
+
+func init() {
+	for i, spec := range jpegHuffmanSpecs {
+		jpegStandardHuffmanCodes[i] = spec.codes()
+	}
+	for u := 0; u < 8; u++ {
+		c := 0.5
+		if u == 0 {
+			c = 0.5 / math.Sqrt2
+		}
+		for x := 0; x < 8; x++ {
+			jpegCosines[u][x] = c * math.Cos(float64(2*x+1)*float64(u)*math.Pi/16)
+		}
+	}
+}
+
+// codes assigns codes to the symbols of a Huffman table
+func (spec *jpegHuffmanSpec) codes() jpegHuffmanCodes {
+	var codes jpegHuffmanCodes
+	code, k := uint32(0), 0
+	for length, count := range spec.counts {
+		for j := 0; j < int(count); j++ {
+			codes[spec.symbols[k]] = uint32(length+1)<<24 | code
+			code++
+			k++
+		}
+		code <<= 1
+	}
+	return codes
+}
+
+// optimalJPEGHuffmanSpec creates a Huffman table for symbols with given frequencies
+// using the algorithm from section K.2 of the JPEG specification
+func optimalJPEGHuffmanSpec(frequencies *[256]int) jpegHuffmanSpec {
+	// One extra symbol with the lowest frequency makes sure that no code consists of only 1 bits
+	var freq [257]int
+	copy(freq[:], frequencies[:])
+	freq[256] = 1
+	var codeSize [257]int
+	var others [257]int
+	for i := range others {
+		others[i] = -1
+	}
+
+	for {
+		// Find the two least frequent symbols, the one with a higher value first
+		c1, c2 := -1, -1
+		for i := range freq {
+			if freq[i] > 0 && (c1 == -1 || freq[i] <= freq[c1]) {
+				c1 = i
+			}
+		}
+		for i := range freq {
+			if freq[i] > 0 && i != c1 && (c2 == -1 || freq[i] <= freq[c2]) {
+				c2 = i
+			}
+		}
+		if c2 == -1 {
+			break
+		}
+
+		freq[c1] += freq[c2]
+		freq[c2] = 0
+		codeSize[c1]++
+		for others[c1] != -1 {
+			c1 = others[c1]
+			codeSize[c1]++
+		}
+		others[c1] = c2
+		codeSize[c2]++
+		for others[c2] != -1 {
+			c2 = others[c2]
+			codeSize[c2]++
+		}
+	}
+
+	var counts [33]int
+	for _, size := range codeSize {
+		if size > 0 {
+			counts[size]++
+		}
+	}
+	// Codes can be at most 16 bits long
+	for i := 32; i > 16; i-- {
+		for counts[i] > 0 {
+			j := i - 2
+			for counts[j] == 0 {
+				j--
+			}
+			counts[i] -= 2
+			counts[i-1]++
+			counts[j+1] += 2
+			counts[j]--
+		}
+	}
+	// Remove the extra symbol
+	i := 16
+	for counts[i] == 0 {
+		i--
+	}
+	counts[i]--
+
+	var spec jpegHuffmanSpec
+	for i := 0; i < 16; i++ {
+		spec.counts[i] = byte(counts[i+1])
+	}
+	for size := 1; size <= 32; size++ {
+		for symbol := 0; symbol < 256; symbol++ {
+			if codeSize[symbol] == size {
+				spec.symbols = append(spec.symbols, byte(symbol))
+			}
+		}
+	}
+	return spec
+}
+
+// jpegComponent is a colour component (Y, Cb or Cr) of an image being encoded
+type jpegComponent struct {
+	// Sampling factors
+	h, v int
+	// 0 for luminance tables, 1 for chrominance tables
+	table int
+	// Number of blocks per line and column including the padding to whole MCUs
+	blocksPerLine, blocksPerColumn int
+	// Number of blocks covering the component without the padding
+	width, height int
+	// Quantised DCT coefficients in zig-zag order, one block after another
+	coefficients []int16
+}
+
+// jpegScan is a part of a progressive image, a band of coefficients of some components
+type jpegScan struct {
+	components []int
+	start, end int
+}
+
+// jpegEncoder writes an image in the JPEG format
+type jpegEncoder struct {
+	w   *bufio.Writer
+	err error
+	// Bits waiting to be written, aligned to the left
+	bits, nBits uint32
+	quant       [2][jpegBlockSize]int32
+	// Number of blocks in a row whose band ends with zeros, only used in progressive AC scans
+	eobRun int
+	// Huffman tables in use: luminance DC, luminance AC, chrominance DC and chrominance AC
+	huffmanCodes [4]jpegHuffmanCodes
+	// Symbols are only counted instead of written when set
+	frequencies *[4][256]int
+}
+
+// encodeJPEG writes an image in the JPEG format with given quality (1-100), chroma subsampling
+// (one of Subsampling420, Subsampling422 and Subsampling444) and optionally as a progressive image
+func encodeJPEG(w io.Writer, img image.Image, quality int, subsampling string, progressive bool) error {
+	if !progressive && subsampling == Subsampling420 {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	}
+
+	bounds := img.Bounds()
+	if bounds.Dx() < 1 || bounds.Dy() < 1 || bounds.Dx() >= 1<<16 || bounds.Dy() >= 1<<16 {
+		return errors.New("jpeg: invalid image size")
+	}
+
+	e := jpegEncoder{w: bufio.NewWriter(w), huffmanCodes: jpegStandardHuffmanCodes}
+	e.initQuant(quality)
+	components := e.transform(img, subsampling)
+
+	e.writeMarker(jpegMarkerSOI, nil)
+	e.writeDQT(len(components))
+	e.writeSOF(bounds.Size(), components, progressive)
+	if progressive {
+		for _, scan := range jpegProgressiveScans(len(components)) {
+			e.writeOptimalDHT(components, scan)
+			e.writeScan(components, scan)
+		}
+	} else {
+		e.writeStandardDHT(len(components))
+		all := make([]int, len(components))
+		for i := range all {
+			all[i] = i
+		}
+		e.writeScan(components, jpegScan{all, 0, jpegBlockSize - 1})
+	}
+	e.writeMarker(jpegMarkerEOI, nil)
+
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+// jpegProgressiveScans returns the scans of a progressive image: DC coefficients of all components,
+// the first few luminance AC coefficients, chrominance AC coefficients and the rest of luminance ones
+func jpegProgressiveScans(nComponents int) []jpegScan {
+	if nComponents == 1 {
+		return []jpegScan{{[]int{0}, 0, 0}, {[]int{0}, 1, 5}, {[]int{0}, 6, 63}}
+	}
+	return []jpegScan{{[]int{0, 1, 2}, 0, 0}, {[]int{0}, 1, 5}, {[]int{1}, 1, 63}, {[]int{2}, 1, 63}, {[]int{0}, 6, 63}}
+}
+
+// initQuant scales the quantisation tables for the given quality like libjpeg does
+func (e *jpegEncoder) initQuant(quality int) {
+	if quality < 1 {
+		quality = 1
+	} else if quality > 100 {
+		quality = 100
+	}
+	scale := 200 - quality*2
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	for i := range e.quant {
+		for j := range e.quant[i] {
+			e.quant[i][j] = int32(clampInt((jpegUnscaledQuant[i][j]*scale+50)/100, 1, 255))
+		}
+	}
+}
+
+// transform converts an image to YCbCr (or only Y for grey images), subsamples the chroma
+// and calculates the quantised DCT coefficients of all blocks of each component
+func (e *jpegEncoder) transform(img image.Image, subsampling string) []*jpegComponent {
+	var components []*jpegComponent
+	if _, ok := img.(*image.Gray); ok {
+		components = []*jpegComponent{{h: 1, v: 1}}
+	} else {
+		h, v := 2, 2
+		if subsampling == Subsampling422 {
+			v = 1
+		} else if subsampling == Subsampling444 {
+			h, v = 1, 1
+		}
+		components = []*jpegComponent{{h: h, v: v}, {h: 1, v: 1, table: 1}, {h: 1, v: 1, table: 1}}
+	}
+
+	bounds := img.Bounds()
+	hMax, vMax := components[0].h, components[0].v
+	mcusPerLine := (bounds.Dx() + 8*hMax - 1) / (8 * hMax)
+	mcusPerColumn := (bounds.Dy() + 8*vMax - 1) / (8 * vMax)
+
+	// Full resolution planes padded to whole MCUs by repeating the last row and column
+	planeWidth := mcusPerLine * 8 * hMax
+	planeHeight := mcusPerColumn * 8 * vMax
+	planes := make([][]uint8, len(components))
+	for i := range planes {
+		planes[i] = make([]uint8, planeWidth*planeHeight)
+	}
+	for y := 0; y < planeHeight; y++ {
+		srcY := bounds.Min.Y + clampInt(y, 0, bounds.Dy()-1)
+		for x := 0; x < planeWidth; x++ {
+			srcX := bounds.Min.X + clampInt(x, 0, bounds.Dx()-1)
+			i := y*planeWidth + x
+			switch img := img.(type) {
+			case *image.Gray:
+				planes[0][i] = img.GrayAt(srcX, srcY).Y
+			case *image.YCbCr:
+				c := img.YCbCrAt(srcX, srcY)
+				planes[0][i], planes[1][i], planes[2][i] = c.Y, c.Cb, c.Cr
+			default:
+				r, g, b, _ := img.At(srcX, srcY).RGBA()
+				planes[0][i], planes[1][i], planes[2][i] = color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+			}
+		}
+	}
+
+	for i, c := range components {
+		c.blocksPerLine = mcusPerLine * c.h
+		c.blocksPerColumn = mcusPerColumn * c.v
+		c.width = ((bounds.Dx()*c.h+hMax-1)/hMax + 7) / 8
+		c.height = ((bounds.Dy()*c.v+vMax-1)/vMax + 7) / 8
+		c.coefficients = make([]int16, c.blocksPerLine*c.blocksPerColumn*jpegBlockSize)
+
+		// Each sample of a subsampled component is the average of the covered full resolution samples
+		stepX, stepY := hMax/c.h, vMax/c.v
+		var block [jpegBlockSize]float64
+		for by := 0; by < c.blocksPerColumn; by++ {
+			for bx := 0; bx < c.blocksPerLine; bx++ {
+				for y := 0; y < 8; y++ {
+					for x := 0; x < 8; x++ {
+						sum := 0
+						for dy := 0; dy < stepY; dy++ {
+							row := ((by*8+y)*stepY + dy) * planeWidth
+							for dx := 0; dx < stepX; dx++ {
+								sum += int(planes[i][row+(bx*8+x)*stepX+dx])
+							}
+						}
+						block[y*8+x] = float64(sum)/float64(stepX*stepY) - 128
+					}
+				}
+				e.quantiseBlock(&block, c.table, c.coefficients[(by*c.blocksPerLine+bx)*jpegBlockSize:])
+			}
+		}
+	}
+	return components
+}
+
+// quantiseBlock calculates the DCT of a block of samples (row by row) and writes
+// the quantised coefficients in zig-zag order to dst
+func (e *jpegEncoder) quantiseBlock(block *[jpegBlockSize]float64, table int, dst []int16) {
+	var rows, dct [jpegBlockSize]float64
+	for y := 0; y < 8; y++ {
+		for u := 0; u < 8; u++ {
+			sum := 0.0
+			for x := 0; x < 8; x++ {
+				sum += jpegCosines[u][x] * block[y*8+x]
+			}
+			rows[y*8+u] = sum
+		}
+	}
+	for u := 0; u < 8; u++ {
+		for v := 0; v < 8; v++ {
+			sum := 0.0
+			for y := 0; y < 8; y++ {
+				sum += jpegCosines[v][y] * rows[y*8+u]
+			}
+			dct[v*8+u] = sum
+		}
+	}
+	for zig := 0; zig < jpegBlockSize; zig++ {
+		dst[zig] = int16(math.Floor(dct[jpegUnzig[zig]]/float64(e.quant[table][zig]) + 0.5))
+	}
+}
+
+func (e *jpegEncoder) write(p []byte) {
+	if e.err != nil {
+		return
+	}
+	_, e.err = e.w.Write(p)
+}
+
+func (e *jpegEncoder) writeByte(b byte) {
+	if e.err != nil {
+		return
+	}
+	e.err = e.w.WriteByte(b)
+}
+
+func (e *jpegEncoder) writeMarker(marker byte, data []byte) {
+	e.write([]byte{0xff, marker})
+	if marker == jpegMarkerSOI || marker == jpegMarkerEOI {
+		return
+	}
+	length := len(data) + 2
+	e.write([]byte{byte(length >> 8), byte(length)})
+	e.write(data)
+}
+
+func (e *jpegEncoder) writeDQT(nComponents int) {
+	data := make([]byte, 0)
+	for i := 0; i < nComponents && i < len(e.quant); i++ {
+		data = append(data, byte(i))
+		for _, q := range e.quant[i] {
+			data = append(data, byte(q))
+		}
+	}
+	e.writeMarker(jpegMarkerDQT, data)
+}
+
+func (e *jpegEncoder) writeSOF(size image.Point, components []*jpegComponent, progressive bool) {
+	data := []byte{8, byte(size.Y >> 8), byte(size.Y), byte(size.X >> 8), byte(size.X), byte(len(components))}
+	for i, c := range components {
+		data = append(data, byte(i+1), byte(c.h<<4|c.v), byte(c.table))
+	}
+	marker := byte(jpegMarkerSOF0)
+	if progressive {
+		marker = jpegMarkerSOF2
+	}
+	e.writeMarker(marker, data)
+}
+
+// writeDHT writes Huffman tables given by their index (luminance DC, luminance AC, chrominance DC, chrominance AC)
+func (e *jpegEncoder) writeDHT(specs map[int]jpegHuffmanSpec) {
+	data := make([]byte, 0)
+	for i := 0; i < len(e.huffmanCodes); i++ {
+		spec, ok := specs[i]
+		if !ok {
+			continue
+		}
+		// Table class (0 = DC, 1 = AC) and destination
+		data = append(data, byte((i%2)<<4|i/2))
+		data = append(data, spec.counts[:]...)
+		data = append(data, spec.symbols...)
+		e.huffmanCodes[i] = spec.codes()
+	}
+	e.writeMarker(jpegMarkerDHT, data)
+}
+
+func (e *jpegEncoder) writeStandardDHT(nComponents int) {
+	specs := map[int]jpegHuffmanSpec{0: jpegHuffmanSpecs[0], 1: jpegHuffmanSpecs[1]}
+	if nComponents > 1 {
+		specs[2], specs[3] = jpegHuffmanSpecs[2], jpegHuffmanSpecs[3]
+	}
+	e.writeDHT(specs)
+}
+
+// writeOptimalDHT writes Huffman tables for the symbols of a scan, the scan is encoded
+// without writing anything to count the symbols
+func (e *jpegEncoder) writeOptimalDHT(components []*jpegComponent, scan jpegScan) {
+	e.frequencies = new([4][256]int)
+	e.encodeScan(components, scan)
+	frequencies := e.frequencies
+	e.frequencies = nil
+
+	specs := make(map[int]jpegHuffmanSpec)
+	for _, i := range scan.components {
+		table := 2 * components[i].table
+		if scan.start > 0 {
+			table++
+		}
+		specs[table] = optimalJPEGHuffmanSpec(&frequencies[table])
+	}
+	e.writeDHT(specs)
+}
+
+// writeScan writes a scan of an image, baseline images have a single scan of all coefficients
+func (e *jpegEncoder) writeScan(components []*jpegComponent, scan jpegScan) {
+	// DC and AC table selectors, progressive scans only use one of them
+	data := []byte{byte(len(scan.components))}
+	for _, i := range scan.components {
+		dcTable, acTable := byte(components[i].table), byte(components[i].table)
+		if scan.start > 0 {
+			dcTable = 0
+		}
+		if scan.end == 0 {
+			acTable = 0
+		}
+		data = append(data, byte(i+1), dcTable<<4|acTable)
+	}
+	data = append(data, byte(scan.start), byte(scan.end), 0)
+	e.writeMarker(jpegMarkerSOS, data)
+	e.encodeScan(components, scan)
+}
+
+// encodeScan writes the entropy coded data of a scan
+func (e *jpegEncoder) encodeScan(components []*jpegComponent, scan jpegScan) {
+	// AC coefficients start at index 1
+	acStart := scan.start
+	if acStart == 0 {
+		acStart = 1
+	}
+	predictions := make([]int32, len(components))
+	encodeBlock := func(c *jpegComponent, i int, bx, by int) {
+		coefficients := c.coefficients[(by*c.blocksPerLine+bx)*jpegBlockSize:]
+		if scan.start == 0 {
+			e.emitValue(2*c.table, 0, int32(coefficients[0])-predictions[i])
+			predictions[i] = int32(coefficients[0])
+		}
+		if scan.end > 0 {
+			e.emitBand(2*c.table+1, coefficients[acStart:scan.end+1], scan.start > 0)
+		}
+	}
+
+	if len(scan.components) == 1 {
+		// Blocks of a single component are in raster order without the padding to whole MCUs
+		c := components[scan.components[0]]
+		for by := 0; by < c.height; by++ {
+			for bx := 0; bx < c.width; bx++ {
+				encodeBlock(c, scan.components[0], bx, by)
+			}
+		}
+	} else {
+		hMax, vMax := components[0].h, components[0].v
+		for my := 0; my < components[0].blocksPerColumn/vMax; my++ {
+			for mx := 0; mx < components[0].blocksPerLine/hMax; mx++ {
+				for _, i := range scan.components {
+					c := components[i]
+					for y := 0; y < c.v; y++ {
+						for x := 0; x < c.h; x++ {
+							encodeBlock(c, i, mx*c.h+x, my*c.v+y)
+						}
+					}
+				}
+			}
+		}
+	}
+	if scan.start > 0 {
+		e.emitEOBRun(2*components[scan.components[0]].table + 1)
+	}
+	e.padBits()
+}
+
+// emitBand writes AC coefficients as runs of zeros followed by a value, the end of the band
+// is marked by an end of block symbol. Progressive scans count such blocks and write
+// the number of them when a block with non-zero coefficients follows.
+func (e *jpegEncoder) emitBand(table int, coefficients []int16, progressive bool) {
+	run := int32(0)
+	for _, value := range coefficients {
+		if value == 0 {
+			run++
+			continue
+		}
+		if progressive {
+			e.emitEOBRun(table)
+		}
+		for run > 15 {
+			e.emitHuffman(table, 0xf0)
+			run -= 16
+		}
+		e.emitValue(table, run, int32(value))
+		run = 0
+	}
+	if run > 0 {
+		if !progressive {
+			e.emitHuffman(table, 0x00)
+			return
+		}
+		// 0x7fff is the longest run which can be written
+		e.eobRun++
+		if e.eobRun == 0x7fff {
+			e.emitEOBRun(table)
+		}
+	}
+}
+
+// emitEOBRun writes the number of blocks ending with zeros if there are any
+func (e *jpegEncoder) emitEOBRun(table int) {
+	if e.eobRun == 0 {
+		return
+	}
+	size := uint32(0)
+	for run := e.eobRun; run > 1; run >>= 1 {
+		size++
+	}
+	e.emitHuffman(table, byte(size<<4))
+	if size > 0 {
+		e.emit(uint32(e.eobRun)&(1<<size-1), size)
+	}
+	e.eobRun = 0
+}
+
+// emitValue writes the run length and size category of a value using a Huffman table
+// followed by the bits of the value
+func (e *jpegEncoder) emitValue(table int, run, value int32) {
+	magnitude, bits := value, value
+	if value < 0 {
+		magnitude, bits = -value, value-1
+	}
+	size := uint32(0)
+	for magnitude > 0 {
+		size++
+		magnitude >>= 1
+	}
+	e.emitHuffman(table, byte(run<<4|int32(size)))
+	if size > 0 {
+		e.emit(uint32(bits)&(1<<size-1), size)
+	}
+}
+
+func (e *jpegEncoder) emitHuffman(table int, symbol byte) {
+	if e.frequencies != nil {
+		e.frequencies[table][symbol]++
+		return
+	}
+	code := e.huffmanCodes[table][symbol]
+	e.emit(code&(1<<24-1), code>>24)
+}
+
+// emit writes the lowest nBits of bits to the entropy coded data, 0xff bytes are followed by 0x00
+func (e *jpegEncoder) emit(bits, nBits uint32) {
+	if e.frequencies != nil {
+		return
+	}
+	nBits += e.nBits
+	bits <<= 32 - nBits
+	bits |= e.bits
+	for nBits >= 8 {
+		b := byte(bits >> 24)
+		e.writeByte(b)
+		if b == 0xff {
+			e.writeByte(0x00)
+		}
+		bits <<= 8
+		nBits -= 8
+	}
+	e.bits, e.nBits = bits, nBits
+}
+
+// padBits fills the last byte of a scan with 1 bits
+func (e *jpegEncoder) padBits() {
+	if e.nBits > 0 {
+		e.emit(1<<(8-e.nBits)-1, 8-e.nBits)
+	}
+}
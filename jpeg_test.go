@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"testing"
+)
+
+// Smooth colourful image with an odd size so that blocks and MCUs are padded
+func createGradientImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 255 / width), uint8(y * 255 / height), uint8((x + y) * 127 / (width + height)), 255})
+		}
+	}
+	return img
+}
+
+// Peak signal-to-noise ratio of two images of the same size in dB
+func psnr(a, b image.Image) float64 {
+	bounds := a.Bounds()
+	sum := 0.0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r1, g1, b1, _ := a.At(x, y).RGBA()
+			r2, g2, b2, _ := b.At(x, y).RGBA()
+			for _, d := range []float64{float64(r1>>8) - float64(r2>>8), float64(g1>>8) - float64(g2>>8), float64(b1>>8) - float64(b2>>8)} {
+				sum += d * d
+			}
+		}
+	}
+	mse := sum / float64(3*bounds.Dx()*bounds.Dy())
+	return 10 * math.Log10(255*255/mse)
+}
+
+func TestEncodeJPEG(t *testing.T) {
+	img := createGradientImage(77, 53)
+	gray := image.NewGray(img.Bounds())
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i % 251)
+	}
+
+	cases := []struct {
+		img         image.Image
+		subsampling string
+		progressive bool
+	}{
+		{img, Subsampling420, false},
+		{img, Subsampling422, false},
+		{img, Subsampling444, false},
+		{img, Subsampling420, true},
+		{img, Subsampling422, true},
+		{img, Subsampling444, true},
+		{gray, Subsampling444, true},
+	}
+	for _, c := range cases {
+		var buffer bytes.Buffer
+		err := encodeJPEG(&buffer, c.img, 90, c.subsampling, c.progressive)
+		if err != nil {
+			t.Fatalf("%s %t failed: %s", c.subsampling, c.progressive, err)
+		}
+		progressive := bytes.Contains(buffer.Bytes(), []byte{0xff, jpegMarkerSOF2})
+		if progressive != c.progressive {
+			t.Errorf("%s %t failed, progressive: %t", c.subsampling, c.progressive, progressive)
+		}
+		decoded, err := jpeg.Decode(&buffer)
+		if err != nil {
+			t.Fatalf("%s %t failed, decoding: %s", c.subsampling, c.progressive, err)
+		}
+		if decoded.Bounds() != c.img.Bounds() {
+			t.Errorf("%s %t failed, size: %v", c.subsampling, c.progressive, decoded.Bounds())
+		}
+		if p := psnr(c.img, decoded); p < 30 {
+			t.Errorf("%s %t failed, PSNR too low: %f", c.subsampling, c.progressive, p)
+		}
+	}
+}
+
+func TestEncodeJPEGEdgeCases(t *testing.T) {
+	// Noise produces large coefficients and long runs of zeros at quality 100
+	noise := createNoiseImage(40, 24)
+	for i := range noise.Pix {
+		if i%16 < 8 {
+			noise.Pix[i] = 255
+		}
+	}
+	tiny := createGradientImage(1, 1)
+
+	for _, img := range []image.Image{noise, tiny} {
+		for _, subsampling := range []string{Subsampling420, Subsampling422, Subsampling444} {
+			var buffer bytes.Buffer
+			err := encodeJPEG(&buffer, img, 100, subsampling, true)
+			if err != nil {
+				t.Fatalf("%v %s failed: %s", img.Bounds(), subsampling, err)
+			}
+			decoded, err := jpeg.Decode(&buffer)
+			if err != nil {
+				t.Fatalf("%v %s failed, decoding: %s", img.Bounds(), subsampling, err)
+			}
+			if decoded.Bounds() != img.Bounds() {
+				t.Errorf("%v %s failed, size: %v", img.Bounds(), subsampling, decoded.Bounds())
+			}
+		}
+	}
+
+	if err := encodeJPEG(&bytes.Buffer{}, image.NewRGBA(image.Rect(0, 0, 0, 10)), 75, Subsampling444, false); err == nil {
+		t.Errorf("Expected an error for an empty image")
+	}
+}
+
+func TestEncodeJPEGQuality(t *testing.T) {
+	img := createGradientImage(64, 64)
+	sizes := make([]int, 0)
+	for _, quality := range []int{10, 50, 95} {
+		var buffer bytes.Buffer
+		encodeJPEG(&buffer, img, quality, Subsampling444, true)
+		sizes = append(sizes, buffer.Len())
+	}
+	if !(sizes[0] < sizes[1] && sizes[1] < sizes[2]) {
+		t.Errorf("Expected sizes to grow with quality, actual: %v", sizes)
+	}
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+const (
+	// MetadataStrip removes all metadata from transformed images
+	MetadataStrip = "strip"
+	// MetadataICC keeps only the colour profile
+	MetadataICC = "icc"
+	// MetadataCopyright keeps the colour profile and the author and copyright Exif fields
+	MetadataCopyright = "copyright"
+	// MetadataAll keeps Exif, XMP and the colour profile
+	MetadataAll = "all"
+
+	DefaultMetadata = MetadataStrip
+
+	// Largest payloads of JPEG segments with headers left out
+	jpegMaxExifSize = 65533 - 6
+	jpegMaxXMPSize  = 65533 - 29
+	jpegMaxICCChunk = 65533 - 14
+
+	// Limit for decompressed colour profiles and XMP packets of PNG images
+	pngMaxInflatedSize = 16 * 1024 * 1024
+
+	tiffTypeASCII = 2
+
+	exifTagDescription = 0x010e
+	exifTagArtist      = 0x013b
+	exifTagCopyright   = 0x8298
+	exifTagGPSPointer  = 0x8825
+)
+
+var (
+	jpegExifHeader = []byte("Exif\x00\x00")
+	jpegXMPHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	jpegICCHeader  = []byte("ICC_PROFILE\x00")
+
+	pngSignature  = []byte("\x89PNG\r\n\x1a\n")
+	pngXMPKeyword = "XML:com.adobe.xmp"
+
+	// GPS properties in XMP packets, either as attributes or as elements
+	xmpGPSAttributeRe = regexp.MustCompile(`\s+exif:GPS\w+\s*=\s*("[^"]*"|'[^']*')`)
+	xmpGPSElementRe   = regexp.MustCompile(`(?s)<exif:GPS\w+(\s[^>]*)?/>|<exif:GPS\w+(\s[^>]*)?>.*?</exif:GPS\w+>`)
+
+	// Sizes of Exif (TIFF) value types in bytes
+	tiffTypeSizes = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+)
+
+// Metadata of an image which can be kept in transformed images
+type Metadata struct {
+	// Exif data (a TIFF structure without the JPEG header), an XMP packet and an ICC colour profile
+	exif, xmp, icc []byte
+}
+
+// MetadataImage is a JPEG or PNG image with the metadata read from its file,
+// the metadata is written to files of the image too
+type MetadataImage struct {
+	image.Image
+	metadata *Metadata
+}
+
+func isValidMetadataPolicy(policy string) bool {
+	return policy == MetadataStrip || policy == MetadataICC || policy == MetadataCopyright || policy == MetadataAll
+}
+
+// Wraps an image with metadata, images without any metadata are returned as they are
+func withMetadata(img image.Image, metadata *Metadata) image.Image {
+	if metadata == nil || metadata.isEmpty() {
+		return img
+	}
+	return &MetadataImage{img, metadata}
+}
+
+// Returns an image without its metadata and the metadata (nil if there is none)
+func splitMetadata(img image.Image) (image.Image, *Metadata) {
+	if m, ok := img.(*MetadataImage); ok {
+		return m.Image, m.metadata
+	}
+	return img, nil
+}
+
+func (m *Metadata) isEmpty() bool {
+	return len(m.exif) == 0 && len(m.xmp) == 0 && len(m.icc) == 0
+}
+
+// Returns the metadata which the given policy keeps
+func (m *Metadata) filter(policy string) *Metadata {
+	if m == nil {
+		return nil
+	}
+	switch policy {
+	case MetadataICC:
+		return &Metadata{nil, nil, m.icc}
+	case MetadataCopyright:
+		return &Metadata{copyrightExif(m.exif), nil, m.icc}
+	case MetadataAll:
+		return m
+	}
+	return nil
+}
+
+// Returns the metadata without GPS coordinates in Exif and XMP
+func (m *Metadata) withoutGPS() *Metadata {
+	if m == nil {
+		return nil
+	}
+	xmp := m.xmp
+	if xmp != nil {
+		xmp = xmpGPSElementRe.ReplaceAll(xmpGPSAttributeRe.ReplaceAll(xmp, nil), nil)
+	}
+	return &Metadata{removeExifGPS(m.exif), xmp, m.icc}
+}
+
+// Reads metadata from the data of a JPEG or PNG file, returns nil for other formats
+func readMetadata(data []byte) *Metadata {
+	if bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		return readJPEGMetadata(data)
+	}
+	if bytes.HasPrefix(data, pngSignature) {
+		return readPNGMetadata(data)
+	}
+	return nil
+}
+
+// Reads a JPEG or PNG image together with its metadata
+func decodeWithMetadata(reader io.Reader, decode func(io.Reader) (image.Image, error)) (image.Image, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	img, err := decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return withMetadata(img, readMetadata(data)), nil
+}
+
+func readJPEGMetadata(data []byte) *Metadata {
+	metadata := &Metadata{}
+	iccChunks := make(map[byte][]byte)
+	i := 2
+	for i+4 <= len(data) && data[i] == 0xff {
+		marker := data[i+1]
+		if marker == 0xff {
+			// Fill byte
+			i++
+			continue
+		}
+		// Metadata is stored before the image data (start of scan)
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			break
+		}
+		payload := data[i+4 : i+2+length]
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(payload, jpegExifHeader):
+			metadata.exif = copyBytes(payload[len(jpegExifHeader):])
+		case marker == 0xe1 && bytes.HasPrefix(payload, jpegXMPHeader):
+			metadata.xmp = copyBytes(payload[len(jpegXMPHeader):])
+		case marker == 0xe2 && bytes.HasPrefix(payload, jpegICCHeader) && len(payload) >= len(jpegICCHeader)+2:
+			// Profiles are split into numbered chunks
+			iccChunks[payload[len(jpegICCHeader)]] = payload[len(jpegICCHeader)+2:]
+		}
+		i += 2 + length
+	}
+
+	for seq := byte(1); int(seq) <= len(iccChunks); seq++ {
+		chunk, ok := iccChunks[seq]
+		if !ok {
+			metadata.icc = nil
+			break
+		}
+		metadata.icc = append(metadata.icc, chunk...)
+	}
+	return metadata
+}
+
+func readPNGMetadata(data []byte) *Metadata {
+	metadata := &Metadata{}
+	i := len(pngSignature)
+	for i+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		chunkType := string(data[i+4 : i+8])
+		if length < 0 || i+12+length > len(data) || chunkType == "IDAT" || chunkType == "IEND" {
+			break
+		}
+		chunk := data[i+8 : i+8+length]
+		switch chunkType {
+		case "iCCP":
+			// Profile name, compression method and a zlib stream
+			n := bytes.IndexByte(chunk, 0)
+			if n >= 0 && n+2 <= len(chunk) {
+				metadata.icc = inflate(chunk[n+2:], pngMaxInflatedSize)
+			}
+		case "eXIf":
+			metadata.exif = copyBytes(bytes.TrimPrefix(chunk, jpegExifHeader))
+		case "iTXt":
+			metadata.xmp = readPNGXMP(chunk, metadata.xmp)
+		}
+		i += 12 + length
+	}
+	return metadata
+}
+
+// Returns the XMP packet from an iTXt chunk or the given value for other iTXt chunks
+func readPNGXMP(chunk []byte, xmp []byte) []byte {
+	// Keyword, compression flag and method, language tag and translated keyword
+	parts := bytes.SplitN(chunk, []byte{0}, 2)
+	if len(parts) != 2 || string(parts[0]) != pngXMPKeyword || len(parts[1]) < 2 {
+		return xmp
+	}
+	compressed := parts[1][0] == 1
+	rest := bytes.SplitN(parts[1][2:], []byte{0}, 3)
+	if len(rest) != 3 {
+		return xmp
+	}
+	if compressed {
+		return inflate(rest[2], pngMaxInflatedSize)
+	}
+	return copyBytes(rest[2])
+}
+
+func inflate(data []byte, limit int64) []byte {
+	reader, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	defer reader.Close()
+	result, err := ioutil.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil || int64(len(result)) > limit {
+		return nil
+	}
+	return result
+}
+
+func deflate(data []byte) []byte {
+	var buffer bytes.Buffer
+	writer := zlib.NewWriter(&buffer)
+	writer.Write(data)
+	writer.Close()
+	return buffer.Bytes()
+}
+
+func copyBytes(data []byte) []byte {
+	return append([]byte(nil), data...)
+}
+
+// Writes encoded JPEG or PNG data with the given metadata added, metadata too big for JPEG segments is left out
+func writeWithMetadata(w io.Writer, data []byte, format string, metadata *Metadata) error {
+	if metadata == nil || metadata.isEmpty() {
+		_, err := w.Write(data)
+		return err
+	}
+
+	var result bytes.Buffer
+	if format == "png" {
+		// Metadata chunks have to come before the image data, they are put straight after the header chunk
+		headerEnd := len(pngSignature) + 8 + 13 + 4
+		if len(data) < headerEnd {
+			return fmt.Errorf("invalid png data")
+		}
+		result.Write(data[:headerEnd])
+		if len(metadata.icc) > 0 {
+			writePNGChunk(&result, "iCCP", append([]byte("ICC profile\x00\x00"), deflate(metadata.icc)...))
+		}
+		if len(metadata.exif) > 0 {
+			writePNGChunk(&result, "eXIf", metadata.exif)
+		}
+		if len(metadata.xmp) > 0 {
+			writePNGChunk(&result, "iTXt", append([]byte(pngXMPKeyword+"\x00\x00\x00\x00\x00"), metadata.xmp...))
+		}
+		result.Write(data[headerEnd:])
+	} else {
+		if len(data) < 2 {
+			return fmt.Errorf("invalid jpeg data")
+		}
+		// Segments go straight after the start of image marker
+		result.Write(data[:2])
+		if len(metadata.exif) > 0 && len(metadata.exif) <= jpegMaxExifSize {
+			writeJPEGSegment(&result, 0xe1, jpegExifHeader, metadata.exif)
+		}
+		if len(metadata.xmp) > 0 && len(metadata.xmp) <= jpegMaxXMPSize {
+			writeJPEGSegment(&result, 0xe1, jpegXMPHeader, metadata.xmp)
+		}
+		chunks := (len(metadata.icc) + jpegMaxICCChunk - 1) / jpegMaxICCChunk
+		for i := 0; i < chunks && chunks < 256; i++ {
+			end := (i + 1) * jpegMaxICCChunk
+			if end > len(metadata.icc) {
+				end = len(metadata.icc)
+			}
+			header := append(copyBytes(jpegICCHeader), byte(i+1), byte(chunks))
+			writeJPEGSegment(&result, 0xe2, header, metadata.icc[i*jpegMaxICCChunk:end])
+		}
+		result.Write(data[2:])
+	}
+	_, err := w.Write(result.Bytes())
+	return err
+}
+
+func writeJPEGSegment(buffer *bytes.Buffer, marker byte, header, payload []byte) {
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(2+len(header)+len(payload)))
+	buffer.Write([]byte{0xff, marker})
+	buffer.Write(length)
+	buffer.Write(header)
+	buffer.Write(payload)
+}
+
+func writePNGChunk(buffer *bytes.Buffer, chunkType string, data []byte) {
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(data)))
+	buffer.Write(length)
+	typeAndData := append([]byte(chunkType), data...)
+	buffer.Write(typeAndData)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(typeAndData))
+	buffer.Write(crc)
+}
+
+// tiffEntry is an entry of an Exif directory (IFD), position is where the entry starts in the data
+type tiffEntry struct {
+	tag, kind       uint16
+	count, position uint32
+}
+
+// Returns the byte order of Exif data and the offset of the first directory
+func readTIFFHeader(exif []byte) (binary.ByteOrder, uint32, error) {
+	if len(exif) < 8 {
+		return nil, 0, fmt.Errorf("exif data too short")
+	}
+	var order binary.ByteOrder
+	switch string(exif[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, 0, fmt.Errorf("invalid exif byte order")
+	}
+	return order, order.Uint32(exif[4:]), nil
+}
+
+// Reads entries of the directory at the given offset
+func readTIFFDirectory(exif []byte, order binary.ByteOrder, offset uint32) ([]tiffEntry, error) {
+	if uint64(offset)+2 > uint64(len(exif)) {
+		return nil, fmt.Errorf("exif directory out of bounds")
+	}
+	count := uint32(order.Uint16(exif[offset:]))
+	if uint64(offset)+2+uint64(count)*12+4 > uint64(len(exif)) {
+		return nil, fmt.Errorf("exif directory out of bounds")
+	}
+	entries := make([]tiffEntry, count)
+	for i := range entries {
+		position := offset + 2 + uint32(i)*12
+		entries[i] = tiffEntry{order.Uint16(exif[position:]), order.Uint16(exif[position+2:]), order.Uint32(exif[position+4:]), position}
+	}
+	return entries, nil
+}
+
+// Returns the value of an entry, values of up to 4 bytes are stored in the entry itself
+func (e tiffEntry) value(exif []byte, order binary.ByteOrder) ([]byte, uint32, bool) {
+	size := uint64(tiffTypeSizes[e.kind]) * uint64(e.count)
+	offset := e.position + 8
+	if size > 4 {
+		offset = order.Uint32(exif[e.position+8:])
+	}
+	if size == 0 || uint64(offset)+size > uint64(len(exif)) {
+		return nil, 0, false
+	}
+	return exif[offset : uint64(offset)+size], offset, true
+}
+
+// Returns the text of an ASCII field of the first directory, an empty string if there is none
+func exifString(exif []byte, tag uint16) string {
+	order, offset, err := readTIFFHeader(exif)
+	if err != nil {
+		return ""
+	}
+	entries, err := readTIFFDirectory(exif, order, offset)
+	if err != nil {
+		return ""
+	}
+	for _, entry := range entries {
+		if entry.tag != tag || entry.kind != tiffTypeASCII {
+			continue
+		}
+		value, _, ok := entry.value(exif, order)
+		if !ok {
+			return ""
+		}
+		return strings.TrimSpace(string(bytes.TrimRight(value, "\x00")))
+	}
+	return ""
+}
+
+// Returns Exif data with only the author and copyright fields, nil if there are none
+func copyrightExif(exif []byte) []byte {
+	order, offset, err := readTIFFHeader(exif)
+	if err != nil {
+		return nil
+	}
+	entries, err := readTIFFDirectory(exif, order, offset)
+	if err != nil {
+		return nil
+	}
+
+	kept := make([]tiffEntry, 0)
+	for _, entry := range entries {
+		if entry.tag == exifTagArtist || entry.tag == exifTagCopyright {
+			kept = append(kept, entry)
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+
+	// A header, one directory and values which don't fit in the entries
+	result := make([]byte, 8+2+12*len(kept)+4)
+	copy(result, exif[:4])
+	order.PutUint32(result[4:], 8)
+	order.PutUint16(result[8:], uint16(len(kept)))
+	for i, entry := range kept {
+		value, _, ok := entry.value(exif, order)
+		if !ok {
+			return nil
+		}
+		position := 10 + 12*i
+		order.PutUint16(result[position:], entry.tag)
+		order.PutUint16(result[position+2:], entry.kind)
+		order.PutUint32(result[position+4:], entry.count)
+		if len(value) <= 4 {
+			copy(result[position+8:], value)
+		} else {
+			order.PutUint32(result[position+8:], uint32(len(result)))
+			result = append(result, value...)
+		}
+	}
+	return result
+}
+
+// Returns Exif data with the GPS directory cleared and the pointer to it removed,
+// data which can't be read is dropped as GPS coordinates can't be found in it
+func removeExifGPS(exif []byte) []byte {
+	if len(exif) == 0 {
+		return nil
+	}
+	exif = copyBytes(exif)
+	order, offset, err := readTIFFHeader(exif)
+	if err != nil {
+		return nil
+	}
+	entries, err := readTIFFDirectory(exif, order, offset)
+	if err != nil {
+		return nil
+	}
+
+	for _, entry := range entries {
+		if entry.tag != exifTagGPSPointer {
+			continue
+		}
+		gpsOffset := order.Uint32(exif[entry.position+8:])
+		gpsEntries, err := readTIFFDirectory(exif, order, gpsOffset)
+		if err != nil {
+			return nil
+		}
+		for _, gpsEntry := range gpsEntries {
+			if value, _, ok := gpsEntry.value(exif, order); ok {
+				clearBytes(value)
+			}
+		}
+		clearBytes(exif[gpsOffset : gpsOffset+2+12*uint32(len(gpsEntries))+4])
+
+		// Following entries and the offset of the next directory move over the pointer
+		end := offset + 2 + 12*uint32(len(entries)) + 4
+		copy(exif[entry.position:], exif[entry.position+12:end])
+		clearBytes(exif[end-12 : end])
+		order.PutUint16(exif[offset:], uint16(len(entries)-1))
+		break
+	}
+	return exif
+}
+
+func clearBytes(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+}
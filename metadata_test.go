@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Exif data with author and copyright fields and a GPS latitude of 0xabcdef01/1 degrees
+func createTestExif() []byte {
+	order := binary.LittleEndian
+	exif := make([]byte, 106)
+	copy(exif, "II*\x00")
+	order.PutUint32(exif[4:], 8)
+
+	entry := func(position int, tag, kind uint16, count, value uint32) {
+		order.PutUint16(exif[position:], tag)
+		order.PutUint16(exif[position+2:], kind)
+		order.PutUint32(exif[position+4:], count)
+		order.PutUint32(exif[position+8:], value)
+	}
+	order.PutUint16(exif[8:], 3)
+	entry(10, exifTagArtist, 2, 5, 50)
+	entry(22, 0x0110, 2, 4, 0x41424300) // Camera model stored in the entry
+	entry(34, exifTagGPSPointer, 4, 1, 64)
+	copy(exif[50:], "Jane\x00")
+
+	order.PutUint16(exif[64:], 1)
+	entry(66, 2, 5, 3, 82)
+	for i := 0; i < 3; i++ {
+		order.PutUint32(exif[82+8*i:], 0xabcdef01)
+		order.PutUint32(exif[86+8*i:], 1)
+	}
+	return exif
+}
+
+func createTestMetadata() *Metadata {
+	xmp := []byte(`<x:xmpmeta><rdf:Description exif:GPSLatitude="51,30N" dc:format="image/jpeg"><exif:GPSLongitude>0,7W</exif:GPSLongitude></rdf:Description></x:xmpmeta>`)
+	// Bigger than a single JPEG segment
+	icc := bytes.Repeat([]byte("icc profile "), 7000)
+	return &Metadata{createTestExif(), xmp, icc}
+}
+
+func TestWriteReadMetadata(t *testing.T) {
+	metadata := createTestMetadata()
+	for _, format := range []string{"jpeg", "png"} {
+		var buffer bytes.Buffer
+		err := writeImage(withMetadata(createGradientImage(30, 20), metadata), format, &buffer)
+		if err != nil {
+			t.Fatalf("%s failed: %s", format, err)
+		}
+		img, _, err := decodeImage(&buffer)
+		if err != nil {
+			t.Fatalf("%s failed, decoding: %s", format, err)
+		}
+		img, act := splitMetadata(img)
+		if !reflect.DeepEqual(act, metadata) {
+			t.Errorf("%s failed, expected the same metadata, actual: %v", format, act)
+		}
+		if img.Bounds().Dx() != 30 {
+			t.Errorf("%s failed, expected the same image, actual bounds: %v", format, img.Bounds())
+		}
+	}
+
+	// Images without metadata aren't wrapped
+	var buffer bytes.Buffer
+	writeImage(createGradientImage(30, 20), "jpeg", &buffer)
+	img, _, _ := decodeImage(&buffer)
+	if _, ok := img.(*MetadataImage); ok {
+		t.Errorf("Expected an image without metadata")
+	}
+}
+
+func TestFilterMetadata(t *testing.T) {
+	metadata := createTestMetadata()
+	if metadata.filter(MetadataStrip) != nil || metadata.filter(MetadataAll) != metadata {
+		t.Errorf("Expected nothing for strip and everything for all")
+	}
+	if act := metadata.filter(MetadataICC); act.exif != nil || act.xmp != nil || !bytes.Equal(act.icc, metadata.icc) {
+		t.Errorf("Expected just the colour profile, actual: %v", act)
+	}
+
+	act := metadata.filter(MetadataCopyright)
+	if act.xmp != nil || !bytes.Equal(act.icc, metadata.icc) {
+		t.Errorf("Expected the colour profile without XMP, actual: %v", act)
+	}
+	order, offset, err := readTIFFHeader(act.exif)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	entries, err := readTIFFDirectory(act.exif, order, offset)
+	if err != nil || len(entries) != 1 || entries[0].tag != exifTagArtist {
+		t.Fatalf("Expected just the author, actual: %v %v", entries, err)
+	}
+	if value, _, _ := entries[0].value(act.exif, order); string(value) != "Jane\x00" {
+		t.Errorf("Expected the author's name, actual: %q", value)
+	}
+
+	if copyrightExif(nil) != nil || copyrightExif([]byte("MM\x00*\x00\x00\x00\x08\x00\x00\x00\x00\x00\x00")) != nil {
+		t.Errorf("Expected no Exif data without author and copyright fields")
+	}
+}
+
+func TestRemoveGPS(t *testing.T) {
+	metadata := createTestMetadata().withoutGPS()
+
+	latitude := []byte{0x01, 0xef, 0xcd, 0xab}
+	if bytes.Contains(metadata.exif, latitude) {
+		t.Errorf("Expected GPS values to be removed")
+	}
+	order, offset, _ := readTIFFHeader(metadata.exif)
+	entries, err := readTIFFDirectory(metadata.exif, order, offset)
+	if err != nil || len(entries) != 2 || entries[0].tag != exifTagArtist || entries[1].tag != 0x0110 {
+		t.Fatalf("Expected other fields to be kept, actual: %v %v", entries, err)
+	}
+	if value, _, _ := entries[1].value(metadata.exif, order); string(value) != "\x00CBA" {
+		t.Errorf("Expected the camera model, actual: %q", value)
+	}
+	if strings.Contains(string(metadata.xmp), "GPS") || !strings.Contains(string(metadata.xmp), `dc:format="image/jpeg"`) {
+		t.Errorf("Expected XMP without GPS, actual: %s", metadata.xmp)
+	}
+
+	// Exif data which can't be read is dropped
+	if removeExifGPS([]byte("invalid exif data")) != nil {
+		t.Errorf("Expected invalid Exif data to be dropped")
+	}
+}
+
+func TestTransformImageMetadata(t *testing.T) {
+	img := withMetadata(createGradientImage(30, 20), createTestMetadata())
+	params, _ := parseParameters("w_10")
+	imgNew, err := transformImage(img, &Transformation{params: &params, metadata: MetadataICC})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_, metadata := splitMetadata(imgNew)
+	if metadata == nil || metadata.exif != nil || metadata.icc == nil {
+		t.Errorf("Expected just the colour profile, actual: %v", metadata)
+	}
+
+	imgNew, _ = transformImage(img, &Transformation{params: &params, metadata: MetadataStrip})
+	if _, ok := imgNew.(*MetadataImage); ok {
+		t.Errorf("Expected metadata to be stripped")
+	}
+
+	// Images with different metadata are cached separately
+	stripped, _ := (&Transformation{params: &params, metadata: MetadataStrip}).createFilePath("photo.jpg")
+	kept, _ := (&Transformation{params: &params, metadata: MetadataAll}).createFilePath("photo.jpg")
+	if stripped == kept || stripped != "photo--"+params.ToString()+"--.jpg" {
+		t.Errorf("Expected different paths, actual: %s %s", stripped, kept)
+	}
+}
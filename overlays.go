@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ReshNesh/go-colorful"
+)
+
+const (
+	// Overlays specified in the URL: l_<image path>:<options> and tx_<text>:<options>
+	parameterOverlayImage = "l"
+	parameterOverlayText  = "tx"
+
+	// Separates the options of an overlay (e.g. l_badge.png:g_se:o_50)
+	overlayOptionSeparator = ":"
+
+	// MaxTextOverlays is the max. number of text overlays in a URL
+	MaxTextOverlays = 10
+	// MaxOverlayTextSize is the largest font size of a text overlay in a URL
+	MaxOverlayTextSize = 500
+
+	DefaultOverlayGravity   = GravityCenter
+	DefaultOverlayTextSize  = 24
+	DefaultOverlayTextColor = "000000"
+	DefaultOverlayFont      = "DejaVuSans"
+)
+
+var (
+	// Text overlays in URLs can only use fonts from the fonts directory (f_DejaVuSans means fonts/DejaVuSans.ttf,
+	// OpenType fonts and collections can be used too)
+	overlayFontsPath  = filepath.Dir(defaultFontPath)
+	overlayFontNameRe = regexp.MustCompile("^[0-9A-Za-z-]+$")
+	hexColorRe        = regexp.MustCompile("^[0-9A-Fa-f]{6}$")
+)
+
+func isOverlayParameter(key string) bool {
+	return key == parameterOverlayImage || key == parameterOverlayText
+}
+
+// Parses an image overlay like "badge.png:g_se:x_10:y_10:o_50:w_20" into a watermark.
+// The path (URL-encoded if it contains slashes, commas or colons) is followed by options:
+// g = gravity, x and y = offsets, o = opacity in percent, w = width in percent of the image width
+func parseImageOverlay(value string) (*Watermark, error) {
+	parts := strings.Split(value, overlayOptionSeparator)
+	imagePath, err := url.QueryUnescape(parts[0])
+	if err != nil || !isValidOverlayPath(imagePath) {
+		return nil, fmt.Errorf("a URL-encoded path of a stored image")
+	}
+
+	w := &Watermark{imagePath: imagePath, gravity: DefaultOverlayGravity, opacity: DefaultWatermarkOpacity, blend: DefaultBlend}
+	err = parseOverlayOptions(parts[1:], func(key, value string) error {
+		switch key {
+		case "g", "x", "y":
+			return parseOverlayPosition(key, value, &w.gravity, &w.x, &w.y)
+		case "o":
+			opacity, err := strconv.Atoi(value)
+			if err != nil || opacity < 0 || opacity > 100 {
+				return fmt.Errorf("opacity (o_) between 0 and 100")
+			}
+			w.opacity = opacity
+		case "w":
+			width, err := strconv.Atoi(value)
+			if err != nil || width < 1 || width > 100 {
+				return fmt.Errorf("width (w_) between 1 and 100 (percent of the image width)")
+			}
+			w.width = width
+		default:
+			return fmt.Errorf("image overlay options g_, x_, y_, o_ or w_")
+		}
+		return nil
+	})
+	return w, err
+}
+
+// Parses a text overlay like "Hello%20world:s_32:co_ff0000:f_DejaVuSans:g_s" into a text.
+// The URL-encoded text is followed by options: g = gravity, x and y = offsets,
+// s = font size, co = hexadecimal colour, f = name of a font in the fonts directory.
+// The font isn't loaded, see loadFont.
+func parseTextOverlay(value string) (*Text, error) {
+	parts := strings.Split(value, overlayOptionSeparator)
+	content, err := url.QueryUnescape(parts[0])
+	if err != nil || content == "" {
+		return nil, fmt.Errorf("a URL-encoded text")
+	}
+
+	t := &Text{content: content, gravity: DefaultOverlayGravity, fontFilePaths: []string{defaultFontPath}, size: DefaultOverlayTextSize,
+		style: defaultTextStyle}
+	colorStr := DefaultOverlayTextColor
+	err = parseOverlayOptions(parts[1:], func(key, value string) error {
+		switch key {
+		case "g", "x", "y":
+			return parseOverlayPosition(key, value, &t.gravity, &t.x, &t.y)
+		case "s":
+			size, err := strconv.Atoi(value)
+			if err != nil || size < 1 || size > MaxOverlayTextSize {
+				return fmt.Errorf("font size (s_) between 1 and %d", MaxOverlayTextSize)
+			}
+			t.size = size
+		case "co":
+			if !hexColorRe.MatchString(value) {
+				return fmt.Errorf("a hexadecimal colour (co_)")
+			}
+			colorStr = strings.ToLower(value)
+		case "f":
+			if !overlayFontNameRe.MatchString(value) {
+				return fmt.Errorf("a font name (f_) like %s", DefaultOverlayFont)
+			}
+			path, ok := findOverlayFont(value)
+			if !ok {
+				return fmt.Errorf("an available font (f_), %s not found", value)
+			}
+			t.fontFilePaths = []string{path}
+		default:
+			return fmt.Errorf("text overlay options g_, x_, y_, s_, co_ or f_")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.color, _ = colorful.Hex("#" + colorStr)
+	return t, nil
+}
+
+// Calls set with the key and value of each option, each option can only be used once
+func parseOverlayOptions(options []string, set func(key, value string) error) error {
+	seen := make(map[string]bool)
+	for _, option := range options {
+		i := strings.Index(option, "_")
+		if i <= 0 || i == len(option)-1 {
+			return fmt.Errorf("overlay options in the form key_value")
+		}
+		key := option[:i]
+		if seen[key] {
+			return fmt.Errorf("each overlay option only once")
+		}
+		seen[key] = true
+		err := set(key, option[i+1:])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseOverlayPosition(key, value string, gravity *string, x, y *int) error {
+	if key == "g" {
+		value = strings.ToLower(value)
+		if !isValidGravity(value) {
+			return fmt.Errorf("overlay gravity (g_) one of n, ne, e, se, s, sw, w, nw, c")
+		}
+		*gravity = value
+		return nil
+	}
+	offset, err := strconv.Atoi(value)
+	if err != nil || offset < 0 {
+		return fmt.Errorf("overlay offset (%s_) of at least 0", key)
+	}
+	if key == "x" {
+		*x = offset
+	} else {
+		*y = offset
+	}
+	return nil
+}
+
+// Stored image paths can't lead outside of the storage
+func isValidOverlayPath(path string) bool {
+	if path == "" || strings.HasPrefix(path, "/") || strings.Contains(path, "\\") {
+		return false
+	}
+	for _, part := range strings.Split(path, "/") {
+		if part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// Finds a font file in the fonts directory by its name
+func findOverlayFont(name string) (string, bool) {
+	for _, extension := range []string{".ttf", ".otf", ".ttc", ".otc"} {
+		path := filepath.Join(overlayFontsPath, name+extension)
+		if _, err := os.Stat(path); err == nil {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+func hasOverlays(parametersStr string) bool {
+	tokens, _ := tokenizeParameters(parametersStr)
+	for _, token := range tokens {
+		if isOverlayParameter(token.key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads the overlays of a parameters string which has already been validated by parseParameters.
+// Fonts of text overlays are loaded.
+func parseOverlays(parametersStr string) (*Watermark, []*Text, error) {
+	tokens, err := tokenizeParameters(parametersStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	var watermark *Watermark
+	texts := make([]*Text, 0)
+	for _, token := range tokens {
+		switch token.key {
+		case parameterOverlayImage:
+			watermark, err = parseImageOverlay(token.value)
+			if err != nil {
+				return nil, nil, newParameterError(token, err.Error())
+			}
+		case parameterOverlayText:
+			text, err := parseTextOverlay(token.value)
+			if err != nil {
+				return nil, nil, newParameterError(token, err.Error())
+			}
+			text.fonts, err = loadFonts(text.fontFilePaths)
+			if err != nil {
+				return nil, nil, err
+			}
+			texts = append(texts, text)
+		}
+	}
+	return watermark, texts, nil
+}
+
+// Finds the parameters of a request path before it was decoded, overlays can then contain
+// encoded commas and colons (/image/w_400,tx_Hello%2C%20world/cat.jpg)
+func escapedParameters(req *http.Request, apiKey, parameters string) string {
+	// The path is /image/parameters/... or /apikey/image/parameters/...
+	i := 2
+	if apiKey != "" {
+		i = 3
+	}
+	segments := strings.Split(req.URL.EscapedPath(), "/")
+	if i >= len(segments) {
+		return parameters
+	}
+	return segments[i]
+}
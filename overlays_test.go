@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseImageOverlay(t *testing.T) {
+	act, err := parseImageOverlay("logos%2Fbadge.png:g_se:x_10:y_5:o_50:w_20")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	exp := Watermark{"logos/badge.png", GravitySouthEast, 10, 5, 50, 20, false, 0, 0, BlendNormal}
+	if *act != exp {
+		t.Errorf("Expected: %v, actual: %v", exp, *act)
+	}
+
+	act, _ = parseImageOverlay("badge.png")
+	exp = Watermark{"badge.png", DefaultOverlayGravity, 0, 0, DefaultWatermarkOpacity, 0, false, 0, 0, BlendNormal}
+	if *act != exp {
+		t.Errorf("Expected: %v, actual: %v", exp, *act)
+	}
+
+	for _, value := range []string{"", "..%2Fsecret.png", "%2Fetc%2Fpasswd", "badge.png:o_101", "badge.png:w_0", "badge.png:g_x", "badge.png:x_-1", "badge.png:o_5:o_6", "badge.png:s_10", "badge.png:o"} {
+		if _, err := parseImageOverlay(value); err == nil {
+			t.Errorf("Expected an error for %q", value)
+		}
+	}
+}
+
+func TestParseTextOverlay(t *testing.T) {
+	act, err := parseTextOverlay("Hello%2C%20world%3A:s_32:co_FF0000:f_DejaVuSans:g_s:y_20")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if act.content != "Hello, world:" || act.size != 32 || act.gravity != GravitySouth || act.y != 20 || act.fontFilePaths[0] != "fonts/DejaVuSans.ttf" {
+		t.Errorf("Unexpected text overlay: %v", act)
+	}
+	if r, g, b, _ := act.color.RGBA(); r != 0xffff || g != 0 || b != 0 {
+		t.Errorf("Expected a red text, actual: %v", act.color)
+	}
+
+	for _, value := range []string{"", "Hello:s_0", "Hello:s_501", "Hello:co_red", "Hello:f_..%2Fsecret", "Hello:f_Missing", "Hello:o_50"} {
+		if _, err := parseTextOverlay(value); err == nil {
+			t.Errorf("Expected an error for %q", value)
+		}
+	}
+}
+
+func TestParseParametersOverlays(t *testing.T) {
+	params, err := parseParameters("w_400,l_badge.png:g_se,tx_One,tx_Two%2C%20three:co_ffffff")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if params.width != 400 {
+		t.Errorf("Expected the other parameters to be read, actual: %v", params)
+	}
+
+	watermark, texts, err := parseOverlays("w_400,l_badge.png:g_se,tx_One,tx_Two%2C%20three:co_ffffff")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if watermark == nil || watermark.imagePath != "badge.png" || len(texts) != 2 || texts[1].content != "Two, three" || texts[1].fonts == nil {
+		t.Errorf("Expected an image and two text overlays, actual: %v %v", watermark, texts)
+	}
+	if texts[0].fonts == nil {
+		t.Errorf("Expected fonts to be loaded")
+	}
+
+	_, err = parseParameters("w_400,l_badge.png,l_logo.png")
+	if err == nil || !strings.Contains(err.Error(), "only once") {
+		t.Errorf("Expected an error for two image overlays, actual: %v", err)
+	}
+	_, err = parseParameters("w_400,tx_Hi:s_1000")
+	if err == nil || !strings.Contains(err.Error(), "position 7") {
+		t.Errorf("Expected an error for the font size, actual: %v", err)
+	}
+	_, err = parseParameters("w_400" + strings.Repeat(",tx_Hi", MaxTextOverlays+1))
+	if err == nil {
+		t.Errorf("Expected an error for too many text overlays")
+	}
+
+	if !hasOverlays("w_400,tx_Hi") || hasOverlays("w_400,h_300") {
+		t.Errorf("Expected overlays to be found only when present")
+	}
+}
+
+func TestOverlaysFilePath(t *testing.T) {
+	params, _ := parseParameters("w_400,tx_Hi")
+	plain, _ := (&Transformation{params: &params, metadata: MetadataStrip}).createFilePath("cat.jpg")
+
+	paths := make(map[string]bool)
+	for _, parametersStr := range []string{"w_400,tx_Hi", "w_400,tx_Hello", "w_400,tx_Hi:co_ff0000", "w_400,l_badge.png", "w_400,l_badge.png:o_50"} {
+		watermark, texts, err := parseOverlays(parametersStr)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		path, _ := (&Transformation{params: &params, watermark: watermark, texts: texts, metadata: MetadataStrip}).createFilePath("cat.jpg")
+		if path == plain || paths[path] {
+			t.Errorf("Expected a unique path for %s, actual: %s", parametersStr, path)
+		}
+		paths[path] = true
+	}
+}
+
+func TestEscapedParameters(t *testing.T) {
+	cases := []struct {
+		url, apiKey, exp string
+	}{
+		{"/image/w_400,tx_Hello%2C%20world/cat.jpg", "", "w_400,tx_Hello%2C%20world"},
+		{"/ABC123/image/w_400,tx_A%3AB/cat.jpg", "ABC123", "w_400,tx_A%3AB"},
+		{"/image/w_400/cat.jpg", "", "w_400"},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", c.url, nil)
+		if act := escapedParameters(req, c.apiKey, "decoded"); act != c.exp {
+			t.Errorf("%s failed, expected: %s, actual: %s", c.url, c.exp, act)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+)
+
+const (
+	// At most this many pixels are sampled when choosing a palette
+	paletteMaxSamples = 1 << 16
+)
+
+// quantiseImage reduces the colours of an image to a palette of at most the given size
+// chosen using the median cut algorithm, the image is dithered unless it has few enough colours
+func quantiseImage(img image.Image, colors int) *image.Paletted {
+	bounds := img.Bounds()
+	pixels := bounds.Dx() * bounds.Dy()
+
+	// Sample evenly spread pixels, all of them for small images
+	step := 1
+	if pixels > paletteMaxSamples {
+		step = pixels / paletteMaxSamples
+	}
+	samples := make([]color.RGBA, 0, pixels/step+1)
+	unique := make(map[color.RGBA]bool)
+	for i := 0; i < pixels; i += step {
+		c := color.RGBAModel.Convert(img.At(bounds.Min.X+i%bounds.Dx(), bounds.Min.Y+i/bounds.Dx())).(color.RGBA)
+		samples = append(samples, c)
+		if len(unique) <= colors {
+			unique[c] = true
+		}
+	}
+
+	// Images with few colours keep them exactly
+	if step == 1 && len(unique) <= colors {
+		palette := make(color.Palette, 0, len(unique))
+		for c := range unique {
+			palette = append(palette, c)
+		}
+		sortPalette(palette)
+		paletted := image.NewPaletted(bounds, palette)
+		draw.Draw(paletted, bounds, img, bounds.Min, draw.Src)
+		return paletted
+	}
+
+	paletted := image.NewPaletted(bounds, medianCut(samples, colors))
+	draw.FloydSteinberg.Draw(paletted, bounds, img, bounds.Min)
+	return paletted
+}
+
+// colorBox is a set of colours with the channel with the widest range of values
+type colorBox struct {
+	colors              []color.RGBA
+	channel, valueRange int
+}
+
+func newColorBox(colors []color.RGBA) colorBox {
+	channel, valueRange := widestColorChannel(colors)
+	return colorBox{colors, channel, valueRange}
+}
+
+// medianCut splits colours into boxes, always halving the box with the widest range of a channel
+// at its median, and returns the average colour of each box
+func medianCut(samples []color.RGBA, colors int) color.Palette {
+	boxes := []colorBox{newColorBox(samples)}
+	for len(boxes) < colors {
+		widest := -1
+		for i, box := range boxes {
+			if len(box.colors) > 1 && box.valueRange > 0 && (widest == -1 || box.valueRange > boxes[widest].valueRange) {
+				widest = i
+			}
+		}
+		if widest == -1 {
+			break
+		}
+
+		box := boxes[widest]
+		sort.Slice(box.colors, func(i, j int) bool {
+			return colorChannel(box.colors[i], box.channel) < colorChannel(box.colors[j], box.channel)
+		})
+		median := len(box.colors) / 2
+		boxes[widest] = newColorBox(box.colors[:median])
+		boxes = append(boxes, newColorBox(box.colors[median:]))
+	}
+
+	palette := make(color.Palette, 0, len(boxes))
+	for _, box := range boxes {
+		var r, g, b, a int
+		for _, c := range box.colors {
+			r += int(c.R)
+			g += int(c.G)
+			b += int(c.B)
+			a += int(c.A)
+		}
+		n := len(box.colors)
+		palette = append(palette, color.RGBA{uint8((r + n/2) / n), uint8((g + n/2) / n), uint8((b + n/2) / n), uint8((a + n/2) / n)})
+	}
+	sortPalette(palette)
+	return palette
+}
+
+// sortPalette orders the colours of a palette so that the same image is always encoded the same way
+// (and gets the same ETag), palettes built from maps would have a random order otherwise
+func sortPalette(palette color.Palette) {
+	sort.Slice(palette, func(i, j int) bool {
+		a, b := palette[i].(color.RGBA), palette[j].(color.RGBA)
+		for channel := 0; channel < 4; channel++ {
+			if colorChannel(a, channel) != colorChannel(b, channel) {
+				return colorChannel(a, channel) < colorChannel(b, channel)
+			}
+		}
+		return false
+	})
+}
+
+// widestColorChannel returns the index of the RGBA channel with the widest range of values and the range
+func widestColorChannel(box []color.RGBA) (int, int) {
+	widest, widestRange := 0, -1
+	for channel := 0; channel < 4; channel++ {
+		min, max := 255, 0
+		for _, c := range box {
+			value := colorChannel(c, channel)
+			if value < min {
+				min = value
+			}
+			if value > max {
+				max = value
+			}
+		}
+		if max-min > widestRange {
+			widest, widestRange = channel, max-min
+		}
+	}
+	return widest, widestRange
+}
+
+func colorChannel(c color.RGBA, channel int) int {
+	switch channel {
+	case 0:
+		return int(c.R)
+	case 1:
+		return int(c.G)
+	case 2:
+		return int(c.B)
+	}
+	return int(c.A)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestQuantiseImageFewColors(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	colors := []color.RGBA{{255, 0, 0, 255}, {0, 0, 255, 255}, {0, 0, 0, 0}}
+	for i := 0; i < 100; i++ {
+		img.SetRGBA(i%10, i/10, colors[i%3])
+	}
+
+	paletted := quantiseImage(img, 16)
+	if len(paletted.Palette) != 3 {
+		t.Errorf("Expected 3 colours, actual: %d", len(paletted.Palette))
+	}
+	for i := 0; i < 100; i++ {
+		if c := color.RGBAModel.Convert(paletted.At(i%10, i/10)); c != colors[i%3] {
+			t.Errorf("Expected colours to be kept, expected: %v, actual: %v", colors[i%3], c)
+			break
+		}
+	}
+
+	// The palette has the same order each time
+	exp := color.Palette{color.RGBA{0, 0, 0, 0}, color.RGBA{0, 0, 255, 255}, color.RGBA{255, 0, 0, 255}}
+	for i := 0; i < 10; i++ {
+		palette := quantiseImage(img, 16).Palette
+		for j := range exp {
+			if palette[j] != exp[j] {
+				t.Fatalf("Expected a sorted palette %v, actual: %v", exp, palette)
+			}
+		}
+	}
+}
+
+func TestQuantiseImage(t *testing.T) {
+	img := createGradientImage(300, 300)
+	for _, n := range []int{2, 16, 256} {
+		paletted := quantiseImage(img, n)
+		if len(paletted.Palette) > n {
+			t.Errorf("Expected at most %d colours, actual: %d", n, len(paletted.Palette))
+		}
+		if paletted.Bounds() != img.Bounds() {
+			t.Errorf("Expected the same size, actual: %v", paletted.Bounds())
+		}
+	}
+
+	// More colours should be closer to the original
+	if psnr(img, quantiseImage(img, 16)) >= psnr(img, quantiseImage(img, 256)) {
+		t.Errorf("Expected 256 colours to be more accurate than 16")
+	}
+}
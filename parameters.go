@@ -2,18 +2,43 @@ package main
 
 import (
 	"fmt"
+	"math"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
+
+	"github.com/ReshNesh/go-colorful"
 )
 
 const (
-	parameterWidth    = "w"
-	parameterHeight   = "h"
-	parameterCropping = "c"
-	parameterGravity  = "g"
-	parameterFilter   = "f"
-	parameterScale    = "s"
+	parameterWidth          = "w"
+	parameterHeight         = "h"
+	parameterCropping       = "c"
+	parameterGravity        = "g"
+	parameterFilter         = "f"
+	parameterScale          = "s"
+	parameterResampling     = "r"
+	parameterBackground     = "bg"
+	parameterUpscale        = "upscale"
+	parameterLinear         = "linear"
+	parameterDPR            = "dpr"
+	parameterQuality        = "q"
+	parameterProgressive    = "progressive"
+	parameterSubsampling    = "cs"
+	parameterPNGCompression = "pc"
+	parameterPalette        = "pal"
+	parameterFrame          = "frame"
+	parameterBorder         = "bo"
+	parameterRadius         = "rad"
+	parameterTrim           = "trim"
+	parameterRegionX        = "x"
+	parameterRegionY        = "y"
+	parameterRegionWidth    = "cw"
+	parameterRegionHeight   = "ch"
+
+	// ParameterValueAuto lets client hints decide the value of a parameter (w_auto, dpr_auto, q_auto)
+	ParameterValueAuto = "auto"
 
 	// CroppingModeExact crops an image exactly to given dimensions
 	CroppingModeExact = "e"
@@ -23,6 +48,8 @@ const (
 	CroppingModePart = "p"
 	// CroppingModeKeepScale crops an image so that it fills a frame of given dimensions, keeps scale
 	CroppingModeKeepScale = "k"
+	// CroppingModePad fits the whole image in a frame of given dimensions and fills the rest with a background
+	CroppingModePad = "pad"
 
 	GravityNorth     = "n"
 	GravityNorthEast = "ne"
@@ -33,13 +60,51 @@ const (
 	GravityWest      = "w"
 	GravityNorthWest = "nw"
 	GravityCenter    = "c"
+	// GravityAuto chooses the most interesting part of an image
+	GravityAuto = "auto"
+	// GravityFocalPoint keeps a point given in relative coordinates (fp:x,y) as close to the centre as possible
+	GravityFocalPoint = "fp"
+	// GravityNone means that gravity was not specified, a stored crop hint or the default gravity will be used
+	GravityNone = ""
 
 	FilterGrayScale = "grayscale"
 
-	DefaultScale        = 1
-	DefaultCroppingMode = CroppingModeExact
-	DefaultGravity      = GravityNorthWest
-	DefaultFilter       = "none"
+	ResamplingNearest  = "nearest"
+	ResamplingBilinear = "bilinear"
+	ResamplingBicubic  = "bicubic"
+	ResamplingMitchell = "mitchell"
+	ResamplingLanczos2 = "lanczos2"
+	ResamplingLanczos3 = "lanczos3"
+
+	BackgroundTransparent = "transparent"
+	BackgroundBlur        = "blur"
+
+	// Chroma subsampling of JPEG images
+	Subsampling420 = "420"
+	Subsampling422 = "422"
+	Subsampling444 = "444"
+
+	PNGCompressionNone    = "none"
+	PNGCompressionFast    = "fast"
+	PNGCompressionDefault = "default"
+	PNGCompressionBest    = "best"
+
+	// MaxPaletteColors is the max. number of colours of a PNG image with a palette
+	MaxPaletteColors = 256
+
+	// MaxScale is the largest allowed scale (device pixel ratio)
+	MaxScale = 10.0
+	// ScaleStep is the precision of scales, similar device pixel ratios share cached images
+	ScaleStep = 0.125
+
+	DefaultScale          = 1.0
+	DefaultCroppingMode   = CroppingModeExact
+	DefaultGravity        = GravityNorthWest
+	DefaultFilter         = "none"
+	DefaultResampling     = ResamplingBilinear // the kernel used before kernels could be chosen
+	DefaultBackground     = "ffffff"
+	DefaultSubsampling    = Subsampling420
+	DefaultPNGCompression = PNGCompressionDefault
 )
 
 var (
@@ -48,81 +113,436 @@ var (
 
 // Params is a struct of parameters specifying an image transformation
 type Params struct {
-	width, height, scale      int
-	cropping, gravity, filter string
+	width, height                         int
+	scale                                 float64
+	cropping, gravity, filter, resampling string
+	background                            string
+	focusX, focusY                        float64
+	// Quality 0 means the JPEG quality from the configuration, 0 palette colours means no palette,
+	// frame 0 means all frames of an animation
+	quality, paletteColors, frame     int
+	subsampling, pngCompression       string
+	upscale, linear, progressive      bool
+	autoWidth, autoScale, autoQuality bool
+	// Border inside the edges and radius of rounded corners in pixels (before scaling)
+	borderWidth, radius int
+	borderColor         string
+	maxRadius           bool
+	// Uniform borders are removed before cropping, tolerance in percent
+	trim          bool
+	trimTolerance int
+	// Region of the original image extracted before cropping, a size of 0 means up to the edge of the image
+	regionX, regionY, regionWidth, regionHeight regionValue
 }
 
 // ToString turns parameters into a unique string for each possible assignment of parameters
 func (p Params) ToString() string {
 	// 0 as a value for width or height means that it will be calculated
-	return fmt.Sprintf("%s_%s,%s_%s,%s_%d,%s_%d,%s_%s,%s_%d", parameterCropping, p.cropping, parameterGravity, p.gravity, parameterHeight, p.height, parameterWidth, p.width, parameterFilter, p.filter, parameterScale, p.scale)
+	return fmt.Sprintf("%s_%s,%s_%s,%s_%d,%s_%d,%s_%s,%s_%s,%s_%s,%s_%s,%s_%t,%s_%t,%s_%s,%s_%t,%s_%s,%s_%s,%s_%d,%s_%d,%s_%d_%s,%s_%s,%s_%s,%s_%s,%s_%s,%s_%s,%s_%s", parameterCropping, p.cropping, parameterGravity, p.gravityString(), parameterHeight, p.height, parameterWidth, p.width, parameterFilter, p.filter, parameterScale, strconv.FormatFloat(p.scale, 'f', -1, 64), parameterResampling, p.resampling, parameterBackground, p.background, parameterUpscale, p.upscale, parameterLinear, p.linear, parameterQuality, p.qualityString(), parameterProgressive, p.progressive, parameterSubsampling, p.subsampling, parameterPNGCompression, p.pngCompression, parameterPalette, p.paletteColors, parameterFrame, p.frame, parameterBorder, p.borderWidth, p.borderColor, parameterRadius, p.radiusString(), parameterTrim, p.trimString(), parameterRegionX, p.regionX, parameterRegionY, p.regionY, parameterRegionWidth, p.regionWidth, parameterRegionHeight, p.regionHeight)
+}
+
+// qualityString returns the quality or auto if it's chosen automatically
+func (p Params) qualityString() string {
+	if p.autoQuality {
+		return ParameterValueAuto
+	}
+	return strconv.Itoa(p.quality)
+}
+
+// encodingOptions returns the options to write transformed images with
+func (p Params) encodingOptions() EncodingOptions {
+	options := EncodingOptions{p.quality, p.paletteColors, p.subsampling, p.pngCompression, p.progressive}
+	if options.quality == 0 {
+		options.quality = Config.jpegQuality
+	}
+	return options
+}
+
+// gravityString returns gravity including the coordinates of a focal point
+func (p Params) gravityString() string {
+	if p.gravity == GravityFocalPoint {
+		return fmt.Sprintf("%s:%s,%s", p.gravity, strconv.FormatFloat(p.focusX, 'f', -1, 64), strconv.FormatFloat(p.focusY, 'f', -1, 64))
+	}
+	return p.gravity
 }
 
 // WithScale returns a copy of a Params struct with the scale set to the given value
-func (p Params) WithScale(scale int) Params {
-	return Params{p.width, p.height, scale, p.cropping, p.gravity, p.filter}
+func (p Params) WithScale(scale float64) Params {
+	p.scale = scale
+	return p
+}
+
+// parameterToken is a single key_value pair of a parameters string
+type parameterToken struct {
+	key, value string
+	// Position of the first character of the pair in the parameters string (starting at 1)
+	position int
+}
+
+// parameterError describes an invalid part of a parameters string
+type parameterError struct {
+	position      int
+	key, expected string
+}
+
+func (e *parameterError) Error() string {
+	if e.key == "" {
+		return fmt.Sprintf("invalid parameter at position %d: expected %s", e.position, e.expected)
+	}
+	return fmt.Sprintf("invalid parameter %q at position %d: expected %s", e.key, e.position, e.expected)
+}
+
+func newParameterError(token parameterToken, expected string) error {
+	return &parameterError{token.position, token.key, expected}
+}
+
+// defaultParams returns parameters with default values (and 0 as width and height), fields left out are empty
+func defaultParams() Params {
+	return Params{
+		scale:          DefaultScale,
+		cropping:       DefaultCroppingMode,
+		gravity:        GravityNone,
+		filter:         DefaultFilter,
+		resampling:     Config.resampling,
+		background:     DefaultBackground,
+		subsampling:    DefaultSubsampling,
+		pngCompression: DefaultPNGCompression,
+		upscale:        Config.upscale,
+		linear:         Config.linearLight,
+		borderColor:    DefaultBorderColor,
+	}
 }
 
 // Turns a string like "w_400,h_300" and an image path into a Params struct
 // The second return value is an error message
 // Also validates the parameters to make sure they have valid values
 // w = width, h = height
+// Resampling, upscaling and resizing in linear light default to the ones set in the configuration
+// Auto values (w_auto, dpr_auto, q_auto) are resolved later using client hints, see applyClientHints
+// Unknown and duplicate parameters are rejected unless allowed in the configuration
+// Overlays (l_, tx_) are only validated, see parseOverlays, and so are redactions (rd_), see parseRedactions
 func parseParameters(parametersStr string) (Params, error) {
-	params := Params{0, 0, DefaultScale, DefaultCroppingMode, DefaultGravity, DefaultFilter}
-	parts := strings.Split(parametersStr, ",")
-	for _, part := range parts {
-		keyAndValue := strings.SplitN(part, "_", 2)
-		key := keyAndValue[0]
-		value := keyAndValue[1]
+	params := defaultParams()
+	tokens, err := tokenizeParameters(parametersStr)
+	if err != nil {
+		return params, err
+	}
+
+	seen := make(map[string]bool)
+	texts, redactions := 0, 0
+	for _, token := range tokens {
+		key := token.key
+		value := token.value
+
+		// An image can have several text overlays and redacted rectangles
+		if seen[key] && !Config.allowDuplicateParameters && key != parameterOverlayText && key != parameterRedaction {
+			return params, newParameterError(token, "each parameter only once")
+		}
+		seen[key] = true
 
 		switch key {
 		case parameterWidth, parameterHeight:
-			value, err := strconv.Atoi(value)
-			if err != nil {
-				return params, fmt.Errorf("could not parse value for parameter: %q", key)
+			if key == parameterWidth && strings.ToLower(value) == ParameterValueAuto {
+				params.width = 0
+				params.autoWidth = true
+				continue
 			}
-			if value <= 0 {
-				return params, fmt.Errorf("value %d must be > 0: %q", value, key)
+			value, err := strconv.Atoi(value)
+			if err != nil || value <= 0 {
+				if key == parameterWidth {
+					return params, newParameterError(token, "a positive integer or auto")
+				}
+				return params, newParameterError(token, "a positive integer")
 			}
 			if key == parameterWidth {
 				params.width = value
+				params.autoWidth = false
 			} else {
 				params.height = value
 			}
 		case parameterCropping:
 			value = strings.ToLower(value)
-			if len(value) > 1 {
-				return params, fmt.Errorf("value %q must have only 1 character", key)
-			}
 			if !isValidCroppingMode(value) {
-				return params, fmt.Errorf("invalid value for %q", key)
+				return params, newParameterError(token, "one of e, a, p, k, pad")
 			}
 			params.cropping = value
 		case parameterGravity:
 			value = strings.ToLower(value)
-			if len(value) > 2 {
-				return params, fmt.Errorf("value %q must have at most 2 characters", key)
-			}
-			if !isValidGravity(value) {
-				return params, fmt.Errorf("invalid value for %q", key)
+			if strings.HasPrefix(value, GravityFocalPoint+":") {
+				x, y, err := parseFocalPoint(strings.TrimPrefix(value, GravityFocalPoint+":"))
+				if err != nil {
+					return params, newParameterError(token, "fp:x,y where "+err.Error())
+				}
+				params.gravity = GravityFocalPoint
+				params.focusX, params.focusY = x, y
+			} else if isValidGravity(value) || value == GravityAuto {
+				params.gravity = value
+			} else {
+				return params, newParameterError(token, "one of n, ne, e, se, s, sw, w, nw, c, auto, fp:x,y")
 			}
-			params.gravity = value
 		case parameterFilter:
 			value = strings.ToLower(value)
 			if !isValidFilter(value) {
-				return params, fmt.Errorf("invalid value for %q", key)
+				return params, newParameterError(token, "grayscale")
 			}
 			params.filter = value
+		case parameterResampling:
+			value = strings.ToLower(value)
+			if !isValidResampling(value) {
+				return params, newParameterError(token, "one of nearest, bilinear, bicubic, mitchell, lanczos2, lanczos3")
+			}
+			params.resampling = value
+		case parameterBackground:
+			value = strings.ToLower(value)
+			if !isValidBackground(value) {
+				return params, newParameterError(token, "a hexadecimal colour, transparent or blur")
+			}
+			params.background = value
+		case parameterDPR:
+			if strings.ToLower(value) == ParameterValueAuto {
+				params.scale = DefaultScale
+				params.autoScale = true
+				continue
+			}
+			value, err := strconv.ParseFloat(value, 64)
+			scale, ok := normaliseScale(value)
+			if err != nil || !ok {
+				return params, newParameterError(token, fmt.Sprintf("a number between %g and %g or auto", ScaleStep, MaxScale))
+			}
+			params.scale = scale
+			params.autoScale = false
+		case parameterQuality:
+			if strings.ToLower(value) == ParameterValueAuto {
+				params.quality = 0
+				params.autoQuality = true
+				continue
+			}
+			value, err := strconv.Atoi(value)
+			if err != nil || value < 1 || value > 100 {
+				return params, newParameterError(token, "a number between 1 and 100 or auto")
+			}
+			params.quality = value
+			params.autoQuality = false
+		case parameterProgressive:
+			value, err := strconv.ParseBool(value)
+			if err != nil {
+				return params, newParameterError(token, "true or false")
+			}
+			params.progressive = value
+		case parameterSubsampling:
+			if value != Subsampling420 && value != Subsampling422 && value != Subsampling444 {
+				return params, newParameterError(token, "one of 420, 422, 444")
+			}
+			params.subsampling = value
+		case parameterPNGCompression:
+			value = strings.ToLower(value)
+			if _, ok := pngCompressionLevels[value]; !ok {
+				return params, newParameterError(token, "one of none, fast, default, best")
+			}
+			params.pngCompression = value
+		case parameterPalette:
+			value, err := strconv.Atoi(value)
+			if err != nil || value < 2 || value > MaxPaletteColors {
+				return params, newParameterError(token, fmt.Sprintf("a number between 2 and %d", MaxPaletteColors))
+			}
+			params.paletteColors = value
+		case parameterFrame:
+			value, err := strconv.Atoi(value)
+			if err != nil || value <= 0 {
+				return params, newParameterError(token, "a positive integer")
+			}
+			params.frame = value
+		case parameterBorder:
+			// Width and an optional colour (bo_4 or bo_4_ff0000)
+			parts := strings.SplitN(value, "_", 2)
+			width, err := strconv.Atoi(parts[0])
+			if err != nil || width < 1 || width > MaxBorderWidth {
+				return params, newParameterError(token, fmt.Sprintf("a width between 1 and %d followed by an optional hexadecimal colour", MaxBorderWidth))
+			}
+			params.borderWidth = width
+			params.borderColor = DefaultBorderColor
+			if len(parts) == 2 {
+				borderColor := strings.ToLower(parts[1])
+				if _, err := colorful.Hex("#" + borderColor); err != nil {
+					return params, newParameterError(token, "a hexadecimal colour after the width")
+				}
+				params.borderColor = borderColor
+			}
+		case parameterRadius:
+			if strings.ToLower(value) == RadiusMax {
+				params.radius = 0
+				params.maxRadius = true
+				continue
+			}
+			value, err := strconv.Atoi(value)
+			if err != nil || value <= 0 {
+				return params, newParameterError(token, "a positive integer or max")
+			}
+			params.radius = value
+			params.maxRadius = false
+		case parameterRegionX, parameterRegionY, parameterRegionWidth, parameterRegionHeight:
+			isSize := key == parameterRegionWidth || key == parameterRegionHeight
+			value, err := parseRegionValue(value, isSize)
+			if err != nil {
+				return params, newParameterError(token, err.Error())
+			}
+			switch key {
+			case parameterRegionX:
+				params.regionX = value
+			case parameterRegionY:
+				params.regionY = value
+			case parameterRegionWidth:
+				params.regionWidth = value
+			default:
+				params.regionHeight = value
+			}
+		case parameterTrim:
+			// A tolerance or true/false (trim_10, trim_true)
+			tolerance, err := strconv.Atoi(value)
+			if err == nil {
+				if tolerance < 0 || tolerance > MaxTrimTolerance {
+					return params, newParameterError(token, fmt.Sprintf("a tolerance between 0 and %d or true or false", MaxTrimTolerance))
+				}
+				params.trim, params.trimTolerance = true, tolerance
+				continue
+			}
+			trim, err := strconv.ParseBool(value)
+			if err != nil {
+				return params, newParameterError(token, fmt.Sprintf("a tolerance between 0 and %d or true or false", MaxTrimTolerance))
+			}
+			params.trim, params.trimTolerance = trim, 0
+			if trim {
+				params.trimTolerance = DefaultTrimTolerance
+			}
+		case parameterUpscale:
+			value, err := strconv.ParseBool(value)
+			if err != nil {
+				return params, newParameterError(token, "true or false")
+			}
+			params.upscale = value
+		case parameterLinear:
+			value, err := strconv.ParseBool(value)
+			if err != nil {
+				return params, newParameterError(token, "true or false")
+			}
+			params.linear = value
+		case parameterOverlayImage:
+			if _, err := parseImageOverlay(value); err != nil {
+				return params, newParameterError(token, err.Error())
+			}
+		case parameterOverlayText:
+			if _, err := parseTextOverlay(value); err != nil {
+				return params, newParameterError(token, err.Error())
+			}
+			texts++
+			if texts > MaxTextOverlays {
+				return params, newParameterError(token, fmt.Sprintf("at most %d text overlays", MaxTextOverlays))
+			}
+		case parameterRedaction:
+			if _, err := parseRedaction(value); err != nil {
+				return params, newParameterError(token, err.Error())
+			}
+			redactions++
+			if redactions > MaxRedactions {
+				return params, newParameterError(token, fmt.Sprintf("at most %d redactions", MaxRedactions))
+			}
+		default:
+			if !Config.allowUnknownParameters {
+				return params, newParameterError(token, "a known parameter")
+			}
 		}
 	}
 
-	if params.width == 0 && params.height == 0 {
+	if params.width == 0 && params.height == 0 && !params.autoWidth {
 		return params, fmt.Errorf("both width and height can't be 0")
 	}
+	if params.cropping == CroppingModePad && ((params.width == 0 && !params.autoWidth) || params.height == 0) {
+		return params, fmt.Errorf("both width and height need to be set for cropping mode %q", CroppingModePad)
+	}
+	if isSmartGravity(params.gravity) && params.cropping == CroppingModePad {
+		return params, fmt.Errorf("gravity %q can't be used with cropping mode %q", params.gravity, CroppingModePad)
+	}
 
 	return params, nil
 }
 
+// Splits a parameters string into key_value tokens separated by commas.
+// Values of some parameters can contain commas (e.g. g_fp:0.5,0.5), a part without
+// a key following such a parameter is joined with it. Values are URL-decoded.
+func tokenizeParameters(parametersStr string) ([]parameterToken, error) {
+	tokens := make([]parameterToken, 0)
+	position := 1
+	for _, part := range strings.Split(parametersStr, ",") {
+		token := parameterToken{"", "", position}
+		position += len(part) + 1
+
+		i := strings.Index(part, "_")
+		if i == -1 {
+			if len(tokens) > 0 && part != "" && allowsCommaInValue(tokens[len(tokens)-1]) {
+				tokens[len(tokens)-1].value += "," + part
+				continue
+			}
+			token.key = part
+			return nil, newParameterError(token, "key_value")
+		}
+
+		token.key = part[:i]
+		token.value = part[i+1:]
+		if token.key == "" {
+			return nil, newParameterError(token, "a key before _")
+		}
+		if token.value == "" {
+			return nil, newParameterError(token, "a value after _")
+		}
+		tokens = append(tokens, token)
+	}
+
+	// Overlays decode their parts separately so that texts can contain encoded commas and colons
+	for i, token := range tokens {
+		if isOverlayParameter(token.key) || !strings.Contains(token.value, "%") {
+			continue
+		}
+		value, err := url.QueryUnescape(token.value)
+		if err != nil {
+			return nil, newParameterError(token, "a URL-encoded value")
+		}
+		tokens[i].value = value
+	}
+	return tokens, nil
+}
+
+// Checks if the value of a token could continue after a comma
+func allowsCommaInValue(token parameterToken) bool {
+	return token.key == parameterGravity && strings.HasPrefix(strings.ToLower(token.value), GravityFocalPoint+":")
+}
+
+// Parses a focal point like "0.3,0.7", both coordinates need to be between 0 and 1
+func parseFocalPoint(str string) (float64, float64, error) {
+	coordinates := strings.Split(str, ",")
+	if len(coordinates) != 2 {
+		return 0, 0, fmt.Errorf("focal point needs to have 2 coordinates")
+	}
+	x, err := strconv.ParseFloat(coordinates[0], 64)
+	if err != nil || !(x >= 0 && x <= 1) {
+		return 0, 0, fmt.Errorf("x needs to be a number between 0 and 1")
+	}
+	y, err := strconv.ParseFloat(coordinates[1], 64)
+	if err != nil || !(y >= 0 && y <= 1) {
+		return 0, 0, fmt.Errorf("y needs to be a number between 0 and 1")
+	}
+	return x, y, nil
+}
+
+// Rounds a scale to the nearest multiple of ScaleStep, the second return value
+// is false if the rounded scale is not between ScaleStep and MaxScale
+func normaliseScale(scale float64) (float64, bool) {
+	scale = math.Floor(scale/ScaleStep+0.5) * ScaleStep
+	if !(scale >= ScaleStep && scale <= MaxScale) {
+		return DefaultScale, false
+	}
+	return scale, true
+}
+
 // Parses transformation name from a parameters string (e.g. photo from t_photo).
 // Returns "" if there is no transformation name.
 func parseTransformationName(parametersStr string) string {
@@ -134,17 +554,40 @@ func parseTransformationName(parametersStr string) string {
 }
 
 func isValidCroppingMode(str string) bool {
-	return str == CroppingModeExact || str == CroppingModeAll || str == CroppingModePart || str == CroppingModeKeepScale
+	return str == CroppingModeExact || str == CroppingModeAll || str == CroppingModePart || str == CroppingModeKeepScale || str == CroppingModePad
 }
 
 func isValidGravity(str string) bool {
 	return str == GravityNorth || str == GravityNorthEast || str == GravityEast || str == GravitySouthEast || str == GravitySouth || str == GravitySouthWest || str == GravityWest || str == GravityNorthWest || str == GravityCenter
 }
 
+// Smart gravities depend on the content of an image rather than on a fixed position
+func isSmartGravity(str string) bool {
+	return str == GravityAuto || str == GravityFocalPoint
+}
+
+// Stored crop hints are only used when gravity is auto or not specified
+func usesCropHint(str string) bool {
+	return str == GravityAuto || str == GravityNone
+}
+
 func isValidFilter(str string) bool {
 	return str == FilterGrayScale
 }
 
+func isValidResampling(str string) bool {
+	return str == ResamplingNearest || str == ResamplingBilinear || str == ResamplingBicubic || str == ResamplingMitchell || str == ResamplingLanczos2 || str == ResamplingLanczos3
+}
+
+// Background can be transparent, a blurred copy of the image or a hexadecimal colour without the leading hash
+func isValidBackground(str string) bool {
+	if str == BackgroundTransparent || str == BackgroundBlur {
+		return true
+	}
+	_, err := colorful.Hex("#" + str)
+	return err == nil
+}
+
 func isEasternGravity(str string) bool {
 	return str == GravityNorthEast || str == GravityEast || str == GravitySouthEast
 }
@@ -1,19 +1,358 @@
 package main
 
 import (
+	"strings"
 	"testing"
 )
 
 func TestParseParameters(t *testing.T) {
 	act, _ := parseParameters("w_400,h_300")
-	exp := Params{400, 300, DefaultScale, DefaultCroppingMode, DefaultGravity, DefaultFilter}
+	exp := defaultParams()
+	exp.width, exp.height = 400, 300
 	if act != exp {
 		t.Errorf("Expected: %v, actual: %v", exp, act)
 	}
 
 	act, _ = parseParameters("w_200,h_300,c_k,g_c")
-	exp = Params{200, 300, DefaultScale, CroppingModeKeepScale, GravityCenter, DefaultFilter}
+	exp = defaultParams()
+	exp.width, exp.height, exp.cropping, exp.gravity = 200, 300, CroppingModeKeepScale, GravityCenter
 	if act != exp {
 		t.Errorf("Expected: %v, actual: %v", exp, act)
 	}
+
+	act, _ = parseParameters("w_200,r_Mitchell")
+	exp = defaultParams()
+	exp.width, exp.resampling = 200, ResamplingMitchell
+	if act != exp {
+		t.Errorf("Expected: %v, actual: %v", exp, act)
+	}
+
+	_, err := parseParameters("w_200,r_sinc")
+	if err == nil {
+		t.Errorf("Expected an error for an invalid resampling kernel")
+	}
+}
+
+func TestParseParametersPad(t *testing.T) {
+	act, err := parseParameters("w_400,h_300,c_pad,g_c,bg_FF0000")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if act.cropping != CroppingModePad || act.background != "ff0000" {
+		t.Errorf("Expected pad cropping with a red background, actual: %v", act)
+	}
+
+	for _, background := range []string{BackgroundTransparent, BackgroundBlur, "fff"} {
+		_, err = parseParameters("w_400,h_300,c_pad,bg_" + background)
+		if err != nil {
+			t.Errorf("Unexpected error for background %q: %s", background, err)
+		}
+	}
+
+	_, err = parseParameters("w_400,h_300,c_pad,bg_red")
+	if err == nil {
+		t.Errorf("Expected an error for an invalid background")
+	}
+
+	_, err = parseParameters("w_400,c_pad")
+	if err == nil {
+		t.Errorf("Expected an error for pad cropping without height")
+	}
+}
+
+func TestParseParametersGravity(t *testing.T) {
+	act, err := parseParameters("w_400,g_fp:0.25,0.75,h_300,c_p")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if act.gravity != GravityFocalPoint || act.focusX != 0.25 || act.focusY != 0.75 || act.height != 300 {
+		t.Errorf("Expected a focal point at 0.25,0.75, actual: %v", act)
+	}
+	if act.gravityString() != "fp:0.25,0.75" {
+		t.Errorf("Expected gravity to be fp:0.25,0.75, actual: %s", act.gravityString())
+	}
+
+	act, _ = parseParameters("w_400,h_300,c_p,g_auto")
+	if act.gravity != GravityAuto {
+		t.Errorf("Expected auto gravity, actual: %v", act)
+	}
+
+	for _, str := range []string{"w_400,g_fp:0.5", "w_400,g_fp:1.5,0.5", "w_400,g_fp:a,b", "w_400,g_middle", "w_400,h_300,c_pad,g_auto"} {
+		_, err = parseParameters(str)
+		if err == nil {
+			t.Errorf("Expected an error for %q", str)
+		}
+	}
+}
+
+func TestParseParametersUpscale(t *testing.T) {
+	act, _ := parseParameters("w_400,upscale_false")
+	if act.upscale {
+		t.Errorf("Expected upscaling to be disabled")
+	}
+
+	act, _ = parseParameters("w_400,upscale_true")
+	if !act.upscale {
+		t.Errorf("Expected upscaling to be enabled")
+	}
+
+	_, err := parseParameters("w_400,upscale_maybe")
+	if err == nil {
+		t.Errorf("Expected an error for an invalid upscale value")
+	}
+}
+
+func TestParseParametersLinear(t *testing.T) {
+	act, _ := parseParameters("w_400,linear_true")
+	if !act.linear || !strings.Contains(act.ToString(), "linear_true") {
+		t.Errorf("Expected resizing in linear light, actual: %s", act.ToString())
+	}
+
+	_, err := parseParameters("w_400,linear_yes")
+	if err == nil {
+		t.Errorf("Expected an error for an invalid linear value")
+	}
+}
+
+func TestParseParametersDPR(t *testing.T) {
+	cases := map[string]float64{
+		"w_400":           1,
+		"w_400,dpr_2":     2,
+		"w_400,dpr_1.5":   1.5,
+		"w_400,dpr_2.6":   2.625,
+		"w_400,dpr_3.5":   3.5,
+		"w_400,dpr_0.125": 0.125,
+	}
+	for str, exp := range cases {
+		act, err := parseParameters(str)
+		if err != nil {
+			t.Errorf("%s failed: %s", str, err)
+		} else if act.scale != exp {
+			t.Errorf("%s failed, expected: %g, actual: %g", str, exp, act.scale)
+		}
+	}
+
+	a, _ := parseParameters("w_400,dpr_2.6")
+	b, _ := parseParameters("w_400,dpr_2.625")
+	if a.ToString() != b.ToString() {
+		t.Errorf("Expected normalised scales to share a string, actual: %s and %s", a.ToString(), b.ToString())
+	}
+}
+
+func TestParseParametersAuto(t *testing.T) {
+	act, err := parseParameters("w_auto,dpr_auto,q_auto")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !act.autoWidth || !act.autoScale || !act.autoQuality {
+		t.Errorf("Expected auto values, actual: %v", act)
+	}
+
+	act, _ = parseParameters("w_auto,h_300,c_pad")
+	if !act.autoWidth || act.height != 300 {
+		t.Errorf("Expected auto width with a height, actual: %v", act)
+	}
+
+	_, err = parseParameters("h_auto")
+	if err == nil {
+		t.Errorf("Expected an error for an auto height")
+	}
+}
+
+func TestParseParametersEncoding(t *testing.T) {
+	act, err := parseParameters("w_400,q_60,progressive_true,cs_444,pc_best,pal_64")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	exp := EncodingOptions{60, 64, Subsampling444, PNGCompressionBest, true}
+	if act.encodingOptions() != exp {
+		t.Errorf("Expected: %v, actual: %v", exp, act.encodingOptions())
+	}
+
+	act, _ = parseParameters("w_400")
+	if act.encodingOptions() != defaultEncodingOptions() {
+		t.Errorf("Expected default options, actual: %v", act.encodingOptions())
+	}
+
+	a, _ := parseParameters("w_400,q_60")
+	b, _ := parseParameters("w_400,q_61")
+	if a.ToString() == b.ToString() {
+		t.Errorf("Expected different qualities to have different strings: %s", a.ToString())
+	}
+	auto, _ := parseParameters("w_400,q_auto")
+	if !strings.Contains(auto.ToString(), "q_auto") {
+		t.Errorf("Expected automatic quality in the string: %s", auto.ToString())
+	}
+}
+
+func TestParseParametersBorder(t *testing.T) {
+	act, err := parseParameters("w_100,h_100,bo_4_FF0000,rad_max")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if act.borderWidth != 4 || act.borderColor != "ff0000" || !act.maxRadius || !strings.Contains(act.ToString(), "bo_4_ff0000,rad_max") {
+		t.Errorf("Expected a red border and round corners, actual: %s", act.ToString())
+	}
+
+	act, _ = parseParameters("w_100,bo_2,rad_16")
+	if act.borderColor != DefaultBorderColor || act.radius != 16 || act.maxRadius {
+		t.Errorf("Expected the default border colour and a radius of 16, actual: %s", act.ToString())
+	}
+	plain, _ := parseParameters("w_100")
+	if plain.ToString() == act.ToString() || plain.hasRoundedCorners() {
+		t.Errorf("Expected a different string without a border and radius")
+	}
+
+	for _, parametersStr := range []string{"w_100,bo_0", "w_100,bo_101", "w_100,bo_2_red", "w_100,bo_x", "w_100,rad_0", "w_100,rad_-5", "w_100,rad_half"} {
+		if _, err := parseParameters(parametersStr); err == nil {
+			t.Errorf("Expected an error for %s", parametersStr)
+		}
+	}
+}
+
+func TestParseParametersTrim(t *testing.T) {
+	cases := map[string]int{"trim_true": DefaultTrimTolerance, "trim_0": 0, "trim_25": 25}
+	for parametersStr, exp := range cases {
+		act, err := parseParameters("w_100," + parametersStr)
+		if err != nil || !act.trim || act.trimTolerance != exp {
+			t.Errorf("%s failed, expected a tolerance of %d, actual: %v %v", parametersStr, exp, act, err)
+		}
+	}
+	a, _ := parseParameters("w_100,trim_false")
+	b, _ := parseParameters("w_100,trim_0")
+	if a.trim || a.ToString() == b.ToString() {
+		t.Errorf("Expected trimming with no tolerance to differ from no trimming: %s", a.ToString())
+	}
+
+	for _, parametersStr := range []string{"w_100,trim_101", "w_100,trim_-1", "w_100,trim_yes"} {
+		if _, err := parseParameters(parametersStr); err == nil {
+			t.Errorf("Expected an error for %s", parametersStr)
+		}
+	}
+}
+
+func TestParseParametersRedactions(t *testing.T) {
+	parametersStr := "w_100,rd_0.1:0.6:0.4:0.7,rd_10:20:110:70:m_fill"
+	if _, err := parseParameters(parametersStr); err != nil {
+		t.Errorf("Expected several redactions to be allowed, actual: %v", err)
+	}
+	redactions, err := parseRedactions(parametersStr)
+	if err != nil || len(redactions) != 2 || !redactions[0].relative || redactions[1].method != RedactionFill {
+		t.Errorf("Expected 2 redactions, actual: %v %v", redactions, err)
+	}
+
+	tooMany := "w_100"
+	for i := 0; i <= MaxRedactions; i++ {
+		tooMany += ",rd_0:0:10:10"
+	}
+	for _, parametersStr := range []string{tooMany, "w_100,rd_0.5:0.5", "w_100,rd_0:0:10:10:m_smudge"} {
+		if _, err := parseParameters(parametersStr); err == nil {
+			t.Errorf("Expected an error for %s", parametersStr)
+		}
+	}
+}
+
+func TestParseParametersRegion(t *testing.T) {
+	act, err := parseParameters("w_100,x_120,y_0.25,cw_400,ch_1.0")
+	if err != nil || act.regionX != (regionValue{120, false}) || act.regionY != (regionValue{0.25, true}) ||
+		act.regionWidth != (regionValue{400, false}) || act.regionHeight != (regionValue{1, true}) {
+		t.Errorf("Expected a region, actual: %v %v", act, err)
+	}
+	if !strings.Contains(act.ToString(), "x_120,y_0.25,cw_400,ch_1.0") {
+		t.Errorf("Expected the region in the string, actual: %s", act.ToString())
+	}
+	a, _ := parseParameters("w_100,cw_1")
+	b, _ := parseParameters("w_100,cw_1.0")
+	if a.ToString() == b.ToString() {
+		t.Errorf("Expected relative and pixel sizes to differ: %s", a.ToString())
+	}
+
+	for _, parametersStr := range []string{"w_100,x_-1", "w_100,y_1.5", "w_100,cw_0", "w_100,ch_0.0", "w_100,x_1.5px", "w_100,cw_10.5"} {
+		if _, err := parseParameters(parametersStr); err == nil {
+			t.Errorf("Expected an error for %s", parametersStr)
+		}
+	}
+}
+
+func TestParseParametersErrors(t *testing.T) {
+	cases := map[string]string{
+		"w":                 `invalid parameter "w" at position 1: expected key_value`,
+		"w_400,h":           `invalid parameter "h" at position 7: expected key_value`,
+		"w_400,,h_300":      `invalid parameter at position 7: expected key_value`,
+		"w_400,_300":        `invalid parameter at position 7: expected a key before _`,
+		"w_":                `invalid parameter "w" at position 1: expected a value after _`,
+		"w_400,h_-3":        `invalid parameter "h" at position 7: expected a positive integer`,
+		"w_400,c_x":         `invalid parameter "c" at position 7: expected one of e, a, p, k, pad`,
+		"w_400,z_1":         `invalid parameter "z" at position 7: expected a known parameter`,
+		"w_400,h_300,w_200": `invalid parameter "w" at position 13: expected each parameter only once`,
+		"w_400,dpr_0":       `invalid parameter "dpr" at position 7: expected a number between 0.125 and 10 or auto`,
+		"w_400,dpr_NaN":     `invalid parameter "dpr" at position 7: expected a number between 0.125 and 10 or auto`,
+		"w_400,q_high":      `invalid parameter "q" at position 7: expected a number between 1 and 100 or auto`,
+		"w_400,q_101":       `invalid parameter "q" at position 7: expected a number between 1 and 100 or auto`,
+		"w_400,cs_411":      `invalid parameter "cs" at position 7: expected one of 420, 422, 444`,
+		"w_400,pal_1":       `invalid parameter "pal" at position 7: expected a number between 2 and 256`,
+		"w_400,frame_0":     `invalid parameter "frame" at position 7: expected a positive integer`,
+		"w_0":               `invalid parameter "w" at position 1: expected a positive integer or auto`,
+		"h_300":             "",
+	}
+	for str, exp := range cases {
+		_, err := parseParameters(str)
+		act := ""
+		if err != nil {
+			act = err.Error()
+		}
+		if act != exp {
+			t.Errorf("%s failed, expected: %q, actual: %q", str, exp, act)
+		}
+	}
+}
+
+func TestParseParametersTolerance(t *testing.T) {
+	Config.allowUnknownParameters, Config.allowDuplicateParameters = true, true
+	defer func() {
+		Config.allowUnknownParameters, Config.allowDuplicateParameters = false, false
+	}()
+
+	act, err := parseParameters("w_400,x_1,w_200")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if act.width != 200 {
+		t.Errorf("Expected the last width to be used, actual: %d", act.width)
+	}
+}
+
+func TestParseParametersCanonical(t *testing.T) {
+	a, _ := parseParameters("w_400,h_300,c_P,g_fp:0.50,0.5,r_Lanczos2")
+	b, _ := parseParameters("r_lanczos2,g_FP:0.5,0.500,c_p,h_300,w_400")
+	if a.ToString() != b.ToString() {
+		t.Errorf("Expected equivalent parameters to share a string, actual: %s and %s", a.ToString(), b.ToString())
+	}
+}
+
+func FuzzParseParameters(f *testing.F) {
+	for _, seed := range []string{"w_400,h_300", "w_200,h_300,c_k,g_c", "w_100,h_100,c_pad,bg_fff", "w_1,g_fp:0.5,0.5,upscale_false", "w", "w_400,,h", "g_fp:1,", "_,_", "w_100,dpr_1.5", "w_auto,dpr_auto,q_auto", "w_1,q_50,progressive_true,cs_422,pc_fast,pal_16", "w_1,frame_2", "w_1,linear_true"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, str string) {
+		params, err := parseParameters(str)
+		if err != nil {
+			return
+		}
+		if params.width < 0 || params.height < 0 || (params.width == 0 && params.height == 0 && !params.autoWidth) {
+			t.Errorf("Invalid dimensions for %q: %v", str, params)
+		}
+		if !isValidCroppingMode(params.cropping) {
+			t.Errorf("Invalid cropping mode for %q: %v", str, params)
+		}
+		if params.gravity != GravityNone && !isValidGravity(params.gravity) && !isSmartGravity(params.gravity) {
+			t.Errorf("Invalid gravity for %q: %v", str, params)
+		}
+		if !(params.focusX >= 0 && params.focusX <= 1 && params.focusY >= 0 && params.focusY <= 1) {
+			t.Errorf("Invalid focal point for %q: %v", str, params)
+		}
+		if params.scale < ScaleStep || params.scale > MaxScale {
+			t.Errorf("Invalid scale for %q: %v", str, params)
+		}
+	})
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+)
+
+const (
+	// Response header with the JPEG quality chosen by q_auto
+	headerQuality = "X-Pixlserv-Quality"
+
+	// Size of windows in which the similarity of images is compared and the distance between them
+	ssimWindowSize = 8
+	ssimWindowStep = 4
+)
+
+var (
+	// Constants stabilising the SSIM division for 8-bit values
+	ssimC1 = (0.01 * 255) * (0.01 * 255)
+	ssimC2 = (0.03 * 255) * (0.03 * 255)
+)
+
+// findAutoQuality returns the lowest JPEG quality between the configured limits for which the encoded image
+// is at least as similar to the original as the configured SSIM target, the max. quality if none is
+func findAutoQuality(img image.Image, options EncodingOptions) (int, error) {
+	img, _ = splitMetadata(img)
+	img = flattenImage(img)
+	reference := luminance(img)
+	low, high := Config.autoQualityMin, Config.autoQualityMax
+	for low < high {
+		options.quality = (low + high) / 2
+		var buffer bytes.Buffer
+		err := encodeJPEG(&buffer, img, options.quality, options.subsampling, options.progressive)
+		if err != nil {
+			return 0, err
+		}
+		encoded, err := jpeg.Decode(&buffer)
+		if err != nil {
+			return 0, err
+		}
+		if calculateSSIM(reference, luminance(encoded)) >= Config.autoQualityTarget {
+			high = options.quality
+		} else {
+			low = options.quality + 1
+		}
+	}
+	return low, nil
+}
+
+// luminanceImage is the luminance channel of an image
+type luminanceImage struct {
+	width, height int
+	pix           []float64
+}
+
+func luminance(img image.Image) luminanceImage {
+	bounds := img.Bounds()
+	result := luminanceImage{bounds.Dx(), bounds.Dy(), make([]float64, bounds.Dx()*bounds.Dy())}
+	for y := 0; y < result.height; y++ {
+		for x := 0; x < result.width; x++ {
+			gray := color.GrayModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray)
+			result.pix[y*result.width+x] = float64(gray.Y)
+		}
+	}
+	return result
+}
+
+// calculateSSIM returns the mean structural similarity index of the luminance of two images of the same size,
+// 1 means that the images are identical. Images smaller than a window are compared as a whole.
+func calculateSSIM(a, b luminanceImage) float64 {
+	windowWidth, windowHeight := ssimWindowSize, ssimWindowSize
+	if a.width < windowWidth {
+		windowWidth = a.width
+	}
+	if a.height < windowHeight {
+		windowHeight = a.height
+	}
+
+	sum, windows := 0.0, 0
+	for top := 0; top+windowHeight <= a.height; top += ssimWindowStep {
+		for left := 0; left+windowWidth <= a.width; left += ssimWindowStep {
+			var sumA, sumB, sumAA, sumBB, sumAB float64
+			for y := top; y < top+windowHeight; y++ {
+				for x := left; x < left+windowWidth; x++ {
+					valueA, valueB := a.pix[y*a.width+x], b.pix[y*b.width+x]
+					sumA += valueA
+					sumB += valueB
+					sumAA += valueA * valueA
+					sumBB += valueB * valueB
+					sumAB += valueA * valueB
+				}
+			}
+			n := float64(windowWidth * windowHeight)
+			meanA, meanB := sumA/n, sumB/n
+			varianceA := sumAA/n - meanA*meanA
+			varianceB := sumBB/n - meanB*meanB
+			covariance := sumAB/n - meanA*meanB
+			sum += ((2*meanA*meanB + ssimC1) * (2*covariance + ssimC2)) / ((meanA*meanA + meanB*meanB + ssimC1) * (varianceA + varianceB + ssimC2))
+			windows++
+		}
+	}
+	if windows == 0 {
+		return 1
+	}
+	return sum / float64(windows)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math/rand"
+	"testing"
+)
+
+func setUpAutoQuality(target float64) func() {
+	Config.autoQualityTarget, Config.autoQualityMin, Config.autoQualityMax = target, 30, 95
+	return func() {
+		Config.autoQualityTarget, Config.autoQualityMin, Config.autoQualityMax = 0, 0, 0
+	}
+}
+
+func createNoiseImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	random := rand.New(rand.NewSource(1))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(random.Intn(256))
+		if i%4 == 3 {
+			img.Pix[i] = 255
+		}
+	}
+	return img
+}
+
+func TestCalculateSSIM(t *testing.T) {
+	img := createGradientImage(64, 48)
+	if act := calculateSSIM(luminance(img), luminance(img)); act != 1 {
+		t.Errorf("Expected identical images to have SSIM 1, actual: %f", act)
+	}
+
+	var buffer bytes.Buffer
+	encodeJPEG(&buffer, createNoiseImage(64, 48), 10, Subsampling420, false)
+	decoded, _ := jpeg.Decode(&buffer)
+	if act := calculateSSIM(luminance(createNoiseImage(64, 48)), luminance(decoded)); act > 0.9 {
+		t.Errorf("Expected a degraded image to have a low SSIM, actual: %f", act)
+	}
+
+	tiny := image.NewGray(image.Rect(0, 0, 3, 2))
+	if act := calculateSSIM(luminance(tiny), luminance(tiny)); act != 1 {
+		t.Errorf("Expected identical tiny images to have SSIM 1, actual: %f", act)
+	}
+}
+
+func TestFindAutoQuality(t *testing.T) {
+	defer setUpAutoQuality(0.98)()
+
+	flat := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for i := range flat.Pix {
+		flat.Pix[i] = 200
+	}
+	noise := createNoiseImage(64, 48)
+	// Transparent images are compared on white like they're encoded
+	transparent := image.NewNRGBA(image.Rect(0, 0, 64, 48))
+	transparent.Set(10, 10, color.NRGBA{255, 0, 0, 128})
+
+	qualities := make(map[string]int)
+	for name, img := range map[string]image.Image{"flat": flat, "noise": noise, "transparent": transparent} {
+		quality, err := findAutoQuality(img, defaultEncodingOptions())
+		if err != nil {
+			t.Fatalf("%s failed: %s", name, err)
+		}
+		if quality < 30 || quality > 95 {
+			t.Errorf("%s failed, quality out of limits: %d", name, quality)
+		}
+		qualities[name] = quality
+	}
+	if qualities["flat"] >= qualities["noise"] {
+		t.Errorf("Expected a flat image to need a lower quality than noise, actual: %v", qualities)
+	}
+
+	img := createGradientImage(64, 48)
+	low, _ := findAutoQuality(img, defaultEncodingOptions())
+	Config.autoQualityTarget = 0.999
+	high, _ := findAutoQuality(img, defaultEncodingOptions())
+	if low > high {
+		t.Errorf("Expected a higher target to need a higher quality, actual: %d and %d", low, high)
+	}
+}
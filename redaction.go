@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ReshNesh/go-colorful"
+)
+
+const (
+	// Redactions specified in the URL: rd_<x1>:<y1>:<x2>:<y2>:<options>
+	parameterRedaction = "rd"
+
+	// RedactionBlur blurs a rectangle heavily
+	RedactionBlur = "blur"
+	// RedactionPixelate replaces a rectangle with big blocks of its average colours
+	RedactionPixelate = "pixelate"
+	// RedactionFill fills a rectangle with a colour
+	RedactionFill = "fill"
+
+	// MaxRedactions is the max. number of redacted rectangles of an image
+	MaxRedactions = 10
+	// MaxRedactionStrength is the largest blur factor and pixelate block size in pixels
+	MaxRedactionStrength = 200
+
+	DefaultRedactionMethod   = RedactionPixelate
+	DefaultRedactionStrength = 16
+	DefaultRedactionColor    = "000000"
+)
+
+// Redaction obscures a rectangle of an original image before it's resized
+type Redaction struct {
+	// Left, top, right and bottom edge in pixels of the original image or relative to its size (0-1)
+	x1, y1, x2, y2 float64
+	relative       bool
+	method         string
+	// Blur factor (how much the rectangle is shrunk) or pixelate block size in pixels
+	strength int
+	color    string
+}
+
+func isValidRedactionMethod(method string) bool {
+	return method == RedactionBlur || method == RedactionPixelate || method == RedactionFill
+}
+
+// Parses the edges of a rectangle (left, top, right, bottom). Coordinates with a decimal point are relative
+// to the size of the image (0.1, 0.25, 0.6, 0.5), otherwise they are in pixels (120, 300, 380, 360).
+func parseRedactionRect(coordinates []string) (*Redaction, error) {
+	if len(coordinates) != 4 {
+		return nil, fmt.Errorf("4 coordinates of a rectangle")
+	}
+	r := &Redaction{method: DefaultRedactionMethod, strength: DefaultRedactionStrength, color: DefaultRedactionColor}
+	for _, coordinate := range coordinates {
+		if strings.Contains(coordinate, ".") {
+			r.relative = true
+		}
+	}
+	edges := []*float64{&r.x1, &r.y1, &r.x2, &r.y2}
+	for i, coordinate := range coordinates {
+		value, err := strconv.ParseFloat(strings.TrimSpace(coordinate), 64)
+		if r.relative && (err != nil || !(value >= 0 && value <= 1)) {
+			return nil, fmt.Errorf("relative coordinates between 0 and 1")
+		}
+		if !r.relative && (err != nil || value < 0 || value != float64(int(value))) {
+			return nil, fmt.Errorf("pixel coordinates of at least 0 or relative ones between 0 and 1")
+		}
+		*edges[i] = value
+	}
+	if r.x1 >= r.x2 || r.y1 >= r.y2 {
+		return nil, fmt.Errorf("the right and bottom edges after the left and top ones")
+	}
+	return r, nil
+}
+
+// Parses a redaction like "0.1:0.6:0.4:0.7:m_blur:s_20". The edges of the rectangle are followed by options:
+// m = method (blur, pixelate or fill), s = strength, co = hexadecimal colour of a fill.
+func parseRedaction(value string) (*Redaction, error) {
+	parts := strings.Split(value, overlayOptionSeparator)
+	if len(parts) < 4 {
+		return nil, fmt.Errorf("a rectangle x1:y1:x2:y2 followed by options")
+	}
+	r, err := parseRedactionRect(parts[:4])
+	if err != nil {
+		return nil, err
+	}
+	err = parseOverlayOptions(parts[4:], func(key, value string) error {
+		switch key {
+		case "m":
+			value = strings.ToLower(value)
+			if !isValidRedactionMethod(value) {
+				return fmt.Errorf("redaction method (m_) one of blur, pixelate, fill")
+			}
+			r.method = value
+		case "s":
+			strength, err := strconv.Atoi(value)
+			if err != nil || strength < 2 || strength > MaxRedactionStrength {
+				return fmt.Errorf("strength (s_) between 2 and %d", MaxRedactionStrength)
+			}
+			r.strength = strength
+		case "co":
+			if !hexColorRe.MatchString(value) {
+				return fmt.Errorf("a hexadecimal colour (co_)")
+			}
+			r.color = strings.ToLower(value)
+		default:
+			return fmt.Errorf("redaction options m_, s_ or co_")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reads the redactions of a parameters string which has already been validated by parseParameters
+func parseRedactions(parametersStr string) ([]*Redaction, error) {
+	tokens, err := tokenizeParameters(parametersStr)
+	if err != nil {
+		return nil, err
+	}
+	redactions := make([]*Redaction, 0)
+	for _, token := range tokens {
+		if token.key != parameterRedaction {
+			continue
+		}
+		r, err := parseRedaction(token.value)
+		if err != nil {
+			return nil, newParameterError(token, err.Error())
+		}
+		redactions = append(redactions, r)
+	}
+	return redactions, nil
+}
+
+// Rectangle of an image with the given bounds, pixel coordinates are multiplied by the scale
+// (for images rasterised at a different size than their original size)
+func (r *Redaction) rectangle(bounds image.Rectangle, scale float64) image.Rectangle {
+	var rect image.Rectangle
+	if r.relative {
+		width, height := float64(bounds.Dx()), float64(bounds.Dy())
+		rect = image.Rect(int(r.x1*width), int(r.y1*height), int(r.x2*width+0.5), int(r.y2*height+0.5))
+	} else {
+		rect = image.Rect(int(r.x1*scale), int(r.y1*scale), int(r.x2*scale+0.5), int(r.y2*scale+0.5))
+	}
+	return rect.Add(bounds.Min).Intersect(bounds)
+}
+
+// redactImageFrames obscures the same rectangles of all frames of an animation
+func redactImageFrames(img image.Image, redactions []*Redaction, scale float64) image.Image {
+	animation, ok := img.(*Animation)
+	if !ok {
+		return redactImage(img, redactions, scale)
+	}
+	frames := make([]image.Image, len(animation.frames))
+	for i, frame := range animation.frames {
+		frames[i] = redactImage(frame, redactions, scale)
+	}
+	return newAnimation(frames, animation.delays, animation.loopCount)
+}
+
+// redactImage obscures rectangles of an image, pixel coordinates are multiplied by the scale
+func redactImage(img image.Image, redactions []*Redaction, scale float64) image.Image {
+	bounds := img.Bounds()
+	redacted := image.NewRGBA(bounds)
+	draw.Draw(redacted, bounds, img, bounds.Min, draw.Src)
+	for _, r := range redactions {
+		rect := r.rectangle(bounds, scale)
+		if rect.Empty() {
+			continue
+		}
+		switch r.method {
+		case RedactionFill:
+			c, _ := colorful.Hex("#" + r.color)
+			draw.Draw(redacted, rect, image.NewUniform(c), image.ZP, draw.Src)
+		case RedactionBlur:
+			width, height := rect.Dx()/r.strength, rect.Dy()/r.strength
+			if width < 1 {
+				width = 1
+			}
+			if height < 1 {
+				height = 1
+			}
+			small := resizeImage(uint(width), uint(height), cropImage(redacted, rect), ResamplingBilinear)
+			draw.Draw(redacted, rect, resizeImage(uint(rect.Dx()), uint(rect.Dy()), small, ResamplingBicubic), image.ZP, draw.Src)
+		default:
+			pixelate(redacted, rect, r.strength)
+		}
+	}
+	return redacted
+}
+
+// Replaces blocks of a rectangle of an image with their average colours
+func pixelate(img *image.RGBA, rect image.Rectangle, blockSize int) {
+	for y := rect.Min.Y; y < rect.Max.Y; y += blockSize {
+		for x := rect.Min.X; x < rect.Max.X; x += blockSize {
+			block := image.Rect(x, y, x+blockSize, y+blockSize).Intersect(rect)
+			var sum [4]int
+			for by := block.Min.Y; by < block.Max.Y; by++ {
+				for bx := block.Min.X; bx < block.Max.X; bx++ {
+					c := img.RGBAAt(bx, by)
+					sum[0] += int(c.R)
+					sum[1] += int(c.G)
+					sum[2] += int(c.B)
+					sum[3] += int(c.A)
+				}
+			}
+			count := block.Dx() * block.Dy()
+			average := color.RGBA{uint8(sum[0] / count), uint8(sum[1] / count), uint8(sum[2] / count), uint8(sum[3] / count)}
+			draw.Draw(img, block, image.NewUniform(average), image.ZP, draw.Src)
+		}
+	}
+}
+
+func (r *Redaction) hash() []byte {
+	h := sha1.New()
+
+	for _, edge := range []float64{r.x1, r.y1, r.x2, r.y2} {
+		io.WriteString(h, strconv.FormatFloat(edge, 'f', -1, 64)+",")
+	}
+	io.WriteString(h, strconv.FormatBool(r.relative))
+	io.WriteString(h, r.method)
+	io.WriteString(h, strconv.Itoa(r.strength))
+	io.WriteString(h, r.color)
+
+	return h.Sum(nil)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestParseRedaction(t *testing.T) {
+	cases := map[string]Redaction{
+		"10:20:110:70":                {10, 20, 110, 70, false, DefaultRedactionMethod, DefaultRedactionStrength, DefaultRedactionColor},
+		"0.1:0.6:0.4:1.0:m_blur:s_20": {0.1, 0.6, 0.4, 1, true, RedactionBlur, 20, DefaultRedactionColor},
+		"0:0.5:1:1:m_fill:co_FF0000":  {0, 0.5, 1, 1, true, RedactionFill, DefaultRedactionStrength, "ff0000"},
+		"0:0:50:50:s_8:m_PIXELATE":    {0, 0, 50, 50, false, RedactionPixelate, 8, DefaultRedactionColor},
+	}
+	for value, exp := range cases {
+		act, err := parseRedaction(value)
+		if err != nil || *act != exp {
+			t.Errorf("%s failed, expected: %v, actual: %v %v", value, exp, act, err)
+		}
+	}
+
+	for _, value := range []string{"10:20:110", "0.1:0.6:1.4:0.7", "10:20:5:70", "10.5:20:110:70x", "-1:0:10:10",
+		"0:0:10:10:m_smudge", "0:0:10:10:s_1", "0:0:10:10:co_red", "0:0:10:10:g_n", "0:0:10:10:s_8:s_9"} {
+		if _, err := parseRedaction(value); err == nil {
+			t.Errorf("Expected an error for %s", value)
+		}
+	}
+}
+
+func TestRedactImage(t *testing.T) {
+	white, red := color.RGBA{255, 255, 255, 255}, color.RGBA{255, 0, 0, 255}
+	// Red and white stripes
+	img := createFilledImage(40, 20, white)
+	for x := 0; x < 40; x += 2 {
+		for y := 0; y < 20; y++ {
+			img.SetRGBA(x, y, red)
+		}
+	}
+
+	pixelated := redactImage(img, []*Redaction{{x2: 0.5, y2: 1, relative: true, method: RedactionPixelate, strength: 4}}, 1).(*image.RGBA)
+	if act := pixelated.RGBAAt(0, 0); act != pixelated.RGBAAt(1, 0) || act.G < 100 || act.G > 155 {
+		t.Errorf("Expected blocks of the average colour, actual: %v %v", act, pixelated.RGBAAt(1, 0))
+	}
+	if act := pixelated.RGBAAt(20, 0); act != red {
+		t.Errorf("Expected the right half to be kept, actual: %v", act)
+	}
+
+	blurred := redactImage(img, []*Redaction{{x1: 10, y1: 5, x2: 30, y2: 15, method: RedactionBlur, strength: 10}}, 1).(*image.RGBA)
+	if act := blurred.RGBAAt(20, 10); act == red || act == white {
+		t.Errorf("Expected the stripes to be blurred, actual: %v", act)
+	}
+	if act := blurred.RGBAAt(20, 4); act != red {
+		t.Errorf("Expected the stripes above the rectangle to be kept, actual: %v", act)
+	}
+
+	// Pixel coordinates are scaled, the rectangle is clamped to the image
+	filled := redactImage(img, []*Redaction{{x1: 15, y1: 5, x2: 100, y2: 10, method: RedactionFill, color: "0000ff"}}, 2).(*image.RGBA)
+	blue := color.RGBA{0, 0, 255, 255}
+	if filled.RGBAAt(30, 10) != blue || filled.RGBAAt(39, 19) != blue || filled.RGBAAt(29, 10) != white || filled.RGBAAt(39, 9) == blue {
+		t.Errorf("Expected a blue rectangle from 30, 10 to the bottom right corner")
+	}
+	if img.RGBAAt(30, 10) != red {
+		t.Errorf("Expected the original image to be kept")
+	}
+}
+
+func TestTransformRedactions(t *testing.T) {
+	params, _ := parseParameters("w_20")
+	redaction := Redaction{x2: 20, y2: 20, method: RedactionFill, color: "0000ff"}
+	transformation := Transformation{params: &params, metadata: MetadataStrip, redactions: []*Redaction{&redaction}}
+
+	// Redactions are applied before resizing, to all frames of an animation
+	white := color.RGBA{255, 255, 255, 255}
+	img := newAnimation([]image.Image{createFilledImage(40, 40, white), createFilledImage(40, 40, white)}, []int{10, 10}, 0)
+	imgNew, err := transformFrames(img, &transformation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, frame := range imgNew.(*Animation).frames {
+		rgba := frame.(*image.RGBA)
+		if rgba.RGBAAt(2, 2) != (color.RGBA{0, 0, 255, 255}) || rgba.RGBAAt(15, 15) != white {
+			t.Errorf("Expected the top left quarter of frame %d to be filled, actual: %v %v", i, rgba.RGBAAt(2, 2), rgba.RGBAAt(15, 15))
+		}
+	}
+
+	plain, _ := (&Transformation{params: &params, metadata: MetadataStrip}).createFilePath("cat.jpg")
+	a, _ := transformation.createFilePath("cat.jpg")
+	redaction.method = RedactionBlur
+	b, _ := transformation.createFilePath("cat.jpg")
+	if a == plain || a == b {
+		t.Errorf("Expected different paths for different redactions, actual: %s %s", a, b)
+	}
+}
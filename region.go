@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+)
+
+// regionValue is an edge or a size of a region in pixels of the original image or relative to its size
+type regionValue struct {
+	value    float64
+	relative bool
+}
+
+// Parses a value of a region parameter, values with a decimal point are relative to the size of the image
+// (0.0-1.0), other ones are pixels. Sizes (cw_, ch_) need to be more than 0.
+func parseRegionValue(str string, isSize bool) (regionValue, error) {
+	value, err := strconv.ParseFloat(str, 64)
+	if strings.Contains(str, ".") {
+		if err != nil || !(value >= 0 && value <= 1) || (isSize && value == 0) {
+			return regionValue{}, fmt.Errorf("pixels or a fraction of the image size between 0.0 and 1.0")
+		}
+		return regionValue{value, true}, nil
+	}
+	if err != nil || value < 0 || value != float64(int(value)) || (isSize && value == 0) {
+		if isSize {
+			return regionValue{}, fmt.Errorf("a positive integer (pixels) or a fraction of the image size between 0.0 and 1.0")
+		}
+		return regionValue{}, fmt.Errorf("an integer of at least 0 (pixels) or a fraction of the image size between 0.0 and 1.0")
+	}
+	return regionValue{value, false}, nil
+}
+
+// String returns the value so that relative and pixel values differ (0.5, 1.0, 120)
+func (v regionValue) String() string {
+	str := strconv.FormatFloat(v.value, 'f', -1, 64)
+	if v.relative && !strings.Contains(str, ".") {
+		str += ".0"
+	}
+	return str
+}
+
+// pixels converts the value to pixels of an image of the given size, pixel values are multiplied by the scale
+// (for images rasterised at a different size than their original size)
+func (v regionValue) pixels(size int, scale float64) int {
+	if v.relative {
+		return int(v.value*float64(size) + 0.5)
+	}
+	return int(v.value*scale + 0.5)
+}
+
+// hasRegion checks if a region of the original image is extracted before cropping
+func (p Params) hasRegion() bool {
+	return p.regionX != (regionValue{}) || p.regionY != (regionValue{}) || p.regionWidth != (regionValue{}) ||
+		p.regionHeight != (regionValue{})
+}
+
+// region returns the rectangle of an image with the given bounds extracted by the region parameters,
+// it's clamped to the image
+func (p Params) region(bounds image.Rectangle, scale float64) image.Rectangle {
+	x, y := p.regionX.pixels(bounds.Dx(), scale), p.regionY.pixels(bounds.Dy(), scale)
+	width, height := bounds.Dx()-x, bounds.Dy()-y
+	if p.regionWidth.value > 0 {
+		width = p.regionWidth.pixels(bounds.Dx(), scale)
+	}
+	if p.regionHeight.value > 0 {
+		height = p.regionHeight.pixels(bounds.Dy(), scale)
+	}
+	return image.Rect(x, y, x+width, y+height).Add(bounds.Min).Intersect(bounds)
+}
+
+// extractRegion crops an image to a region given in the parameters before the cropping modes apply,
+// all frames of an animation are cropped alike. Crop hints are moved to the region.
+func extractRegion(img image.Image, transformation *Transformation, scale float64) (image.Image, *Transformation, error) {
+	bounds := img.Bounds()
+	region := transformation.params.region(bounds, scale)
+	if region.Empty() {
+		return nil, nil, fmt.Errorf("the region is outside of the image (%dx%d)", bounds.Dx(), bounds.Dy())
+	}
+	if region == bounds {
+		return img, transformation, nil
+	}
+
+	cropped := *transformation
+	if transformation.cropHint != nil {
+		cropped.cropHint = transformation.cropHint.within(bounds, region)
+	}
+	if animation, ok := img.(*Animation); ok {
+		frames := make([]image.Image, len(animation.frames))
+		for i, frame := range animation.frames {
+			frames[i] = cropImage(frame, region)
+		}
+		return newAnimation(frames, animation.delays, animation.loopCount), &cropped, nil
+	}
+	return cropImage(img, region), &cropped, nil
+}
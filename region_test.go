@@ -0,0 +1,68 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestParamsRegion(t *testing.T) {
+	bounds := image.Rect(0, 0, 200, 100)
+	cases := []struct {
+		parametersStr string
+		scale         float64
+		exp           image.Rectangle
+	}{
+		{"w_10,x_20,y_10,cw_50,ch_40", 1, image.Rect(20, 10, 70, 50)},
+		{"w_10,x_20,y_10,cw_50,ch_40", 2, image.Rect(40, 20, 140, 100)},
+		{"w_10,x_0.5,y_0.25,cw_0.25,ch_0.5", 2, image.Rect(100, 25, 150, 75)},
+		// Sizes left out reach the edge of the image, regions are clamped to the image
+		{"w_10,x_150", 1, image.Rect(150, 0, 200, 100)},
+		{"w_10,x_150,y_50,cw_100,ch_100", 1, image.Rect(150, 50, 200, 100)},
+		{"w_10,x_250", 1, image.Rectangle{}},
+	}
+	for _, c := range cases {
+		params, err := parseParameters(c.parametersStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if act := params.region(bounds, c.scale); act != c.exp && !(act.Empty() && c.exp.Empty()) {
+			t.Errorf("%s at scale %g failed, expected: %v, actual: %v", c.parametersStr, c.scale, c.exp, act)
+		}
+	}
+}
+
+func TestExtractRegion(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	img := createFramedImage(100, 50, color.White, image.Rect(50, 0, 100, 50))
+	params, _ := parseParameters("w_10,x_40,y_10,cw_20,ch_20")
+	hint := CropHint{0.5, 0.5, true, 0, 0, 0, 0, false}
+	transformation := Transformation{params: &params, metadata: MetadataStrip, cropHint: &hint}
+
+	region, regionTransformation, err := extractRegion(img, &transformation, 1)
+	if err != nil || region.Bounds() != image.Rect(0, 0, 20, 20) {
+		t.Fatalf("Expected a 20x20 region, actual: %v %v", region.Bounds(), err)
+	}
+	if moved := regionTransformation.cropHint; math.Abs(moved.focusX-0.5) > 1e-9 || math.Abs(moved.focusY-0.75) > 1e-9 {
+		t.Errorf("Expected the hint to be moved to the region, actual: %v", moved)
+	}
+
+	// The region is extracted before the cropping mode applies
+	imgNew, err := transformFrames(img, &transformation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rgba := imgNew.(*image.RGBA)
+	if act := rgba.Bounds().Size(); act != image.Pt(10, 10) {
+		t.Errorf("Expected the proportions of the region, actual: %v", act)
+	}
+	if rgba.RGBAAt(1, 5) != (color.RGBA{255, 255, 255, 255}) || rgba.RGBAAt(8, 5) != red {
+		t.Errorf("Expected the edge of the red part in the middle, actual: %v %v", rgba.RGBAAt(1, 5), rgba.RGBAAt(8, 5))
+	}
+
+	outside, _ := parseParameters("w_10,x_100")
+	if _, err := transformFrames(img, &Transformation{params: &outside, metadata: MetadataStrip}); err == nil {
+		t.Errorf("Expected an error for a region outside of the image")
+	}
+}
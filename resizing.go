@@ -0,0 +1,131 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"sync"
+
+	"github.com/nfnt/resize"
+)
+
+const (
+	// Reductions by more than this factor are done in multiple steps
+	multiStepDownscaleFactor = 4
+)
+
+var (
+	resamplingFunctions = map[string]resize.InterpolationFunction{
+		ResamplingNearest:  resize.NearestNeighbor,
+		ResamplingBilinear: resize.Bilinear,
+		ResamplingBicubic:  resize.Bicubic,
+		ResamplingMitchell: resize.MitchellNetravali,
+		ResamplingLanczos2: resize.Lanczos2,
+		ResamplingLanczos3: resize.Lanczos3,
+	}
+)
+
+// resizeImage resizes an image to the given dimensions using the given resampling kernel.
+// Like resize.Resize, a width or height of 0 keeps the aspect ratio of the image.
+// Very large reductions are done in steps: the image is repeatedly halved using
+// a cheap kernel and only the last step uses the requested one.
+func resizeImage(width, height uint, img image.Image, resampling string) image.Image {
+	interp, ok := resamplingFunctions[resampling]
+	if !ok {
+		interp = resamplingFunctions[DefaultResampling]
+	}
+
+	imgWidth := uint(img.Bounds().Dx())
+	imgHeight := uint(img.Bounds().Dy())
+	if width == 0 && height == 0 {
+		return img
+	}
+	if width == 0 {
+		width = uint(float64(height)*float64(imgWidth)/float64(imgHeight) + 0.5)
+	} else if height == 0 {
+		height = uint(float64(width)*float64(imgHeight)/float64(imgWidth) + 0.5)
+	}
+	if width == 0 {
+		width = 1
+	}
+	if height == 0 {
+		height = 1
+	}
+
+	if interp != resize.NearestNeighbor {
+		for imgWidth > width*multiStepDownscaleFactor && imgHeight > height*multiStepDownscaleFactor {
+			imgWidth /= 2
+			imgHeight /= 2
+			img = resize.Resize(imgWidth, imgHeight, img, resize.Bilinear)
+		}
+	}
+
+	return resize.Resize(width, height, img, interp)
+}
+
+// resizeImageLinear resizes an image like resizeImage but in linear light: colours are converted
+// from sRGB to linear values before resampling and back afterwards. Averaging sRGB values makes
+// fine detail and high-contrast edges darker than they should be.
+func resizeImageLinear(width, height uint, img image.Image, resampling string) image.Image {
+	return fromLinearLight(resizeImage(width, height, toLinearLight(img), resampling))
+}
+
+// Converts an image to 16-bit linear values, premultiplied by alpha so that transparent pixels don't bleed
+func toLinearLight(img image.Image) *image.RGBA64 {
+	linearTablesOnce.Do(createLinearTables)
+	bounds := img.Bounds()
+	result := image.NewRGBA64(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			a := uint32(c.A)
+			result.SetRGBA64(x, y, color.RGBA64{
+				uint16(uint32(srgbToLinearTable[c.R]) * a / 0xffff),
+				uint16(uint32(srgbToLinearTable[c.G]) * a / 0xffff),
+				uint16(uint32(srgbToLinearTable[c.B]) * a / 0xffff),
+				c.A,
+			})
+		}
+	}
+	return result
+}
+
+// Converts an image with premultiplied linear values back to sRGB
+func fromLinearLight(img image.Image) *image.NRGBA {
+	linearTablesOnce.Do(createLinearTables)
+	bounds := img.Bounds()
+	result := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			if a == 0 {
+				continue
+			}
+			encode := func(v uint32) uint8 {
+				// Kernels with negative lobes can give values above alpha
+				if v > a {
+					v = a
+				}
+				return linearToSRGBTable[v*0xffff/a]
+			}
+			result.SetNRGBA(x, y, color.NRGBA{encode(r), encode(g), encode(b), uint8(a >> 8)})
+		}
+	}
+	return result
+}
+
+var (
+	// 16-bit sRGB values to 16-bit linear values and back to 8-bit sRGB values
+	srgbToLinearTable []uint16
+	linearToSRGBTable []uint8
+	linearTablesOnce  sync.Once
+)
+
+func createLinearTables() {
+	srgbToLinearTable = make([]uint16, 0x10000)
+	linearToSRGBTable = make([]uint8, 0x10000)
+	for i := range srgbToLinearTable {
+		v := float64(i) / 0xffff
+		srgbToLinearTable[i] = uint16(srgbToLinear(v)*0xffff + 0.5)
+		linearToSRGBTable[i] = uint8(linearToSRGB(v)*0xff + 0.5)
+	}
+}
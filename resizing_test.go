@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// Reference images used for comparing resampling kernels
+var referenceImages = map[string]image.Image{
+	"zoneplate": createZonePlate(1600, 1200),
+	"gradient":  createGradientImage(1600, 1200),
+}
+
+// createZonePlate returns a circular zone plate which makes aliasing clearly visible
+func createZonePlate(width, height int) image.Image {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	cx, cy := float64(width)/2, float64(height)/2
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			dx, dy := float64(x)-cx, float64(y)-cy
+			v := math.Cos((dx*dx + dy*dy) * math.Pi / float64(width))
+			img.SetGray(x, y, color.Gray{uint8(127.5 + 127.5*v)})
+		}
+	}
+	return img
+}
+
+func TestResizeImage(t *testing.T) {
+	img := createGradientImage(800, 600)
+
+	cases := []struct {
+		width, height uint
+		resampling    string
+		exp           image.Point
+	}{
+		{400, 300, ResamplingLanczos3, image.Point{400, 300}},
+		{200, 0, ResamplingBilinear, image.Point{200, 150}},
+		{0, 60, ResamplingNearest, image.Point{80, 60}},
+		{20, 10, ResamplingMitchell, image.Point{20, 10}},
+		{1600, 1200, ResamplingBicubic, image.Point{1600, 1200}},
+		{100, 75, "", image.Point{100, 75}},
+	}
+	for _, c := range cases {
+		act := resizeImage(c.width, c.height, img, c.resampling).Bounds().Size()
+		if act != c.exp {
+			t.Errorf("%dx%d (%s) failed, expected: %v, actual: %v", c.width, c.height, c.resampling, c.exp, act)
+		}
+	}
+}
+
+func TestResizeImageMultiStep(t *testing.T) {
+	img := createZonePlate(1600, 1200)
+
+	// The zone plate averages to mid-grey when downscaled without aliasing
+	imgNew := resizeImage(16, 12, img, ResamplingLanczos3)
+	var sum float64
+	bounds := imgNew.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			sum += float64(color.GrayModel.Convert(imgNew.At(x, y)).(color.Gray).Y)
+		}
+	}
+	mean := sum / float64(bounds.Dx()*bounds.Dy())
+	if math.Abs(mean-127.5) > 20 {
+		t.Errorf("Downscaled zone plate should be close to mid-grey, mean: %f", mean)
+	}
+}
+
+// createStripes returns alternating black and white one pixel wide stripes, they look like 50% grey
+// (sRGB 188) from a distance
+func createStripes(width, height int) image.Image {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x += 2 {
+			img.SetGray(x, y, color.Gray{255})
+		}
+	}
+	return img
+}
+
+func TestResizeImageLinear(t *testing.T) {
+	img := createStripes(64, 64)
+	gray := func(img image.Image) uint8 {
+		return color.GrayModel.Convert(img.At(4, 4)).(color.Gray).Y
+	}
+
+	// Averaging sRGB values makes the stripes too dark
+	if act := gray(resizeImage(8, 8, img, ResamplingLanczos3)); act < 120 || act > 135 {
+		t.Errorf("Expected sRGB resizing to give a dark grey, actual: %d", act)
+	}
+	if act := gray(resizeImageLinear(8, 8, img, ResamplingLanczos3)); act < 184 || act > 192 {
+		t.Errorf("Expected linear resizing to keep the brightness, actual: %d", act)
+	}
+
+	params, _ := parseParameters("w_8,linear_true")
+	imgNew := transformCropAndResize(img, &Transformation{params: &params, metadata: MetadataStrip})
+	if act := gray(imgNew); act < 184 || act > 192 {
+		t.Errorf("Expected the linear_ parameter to resize in linear light, actual: %d", act)
+	}
+
+	// Colours of transparent pixels don't bleed into the opaque ones
+	half := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 32; x++ {
+			half.SetNRGBA(x, y, color.NRGBA{255, 0, 0, 255})
+		}
+	}
+	act := color.NRGBAModel.Convert(resizeImageLinear(8, 8, half, ResamplingLanczos3).At(3, 4)).(color.NRGBA)
+	if act.R != 255 || act.G != 0 || act.B != 0 || act.A < 128 {
+		t.Errorf("Expected red at the edge, actual: %v", act)
+	}
+}
+
+func BenchmarkResizeImage(b *testing.B) {
+	kernels := []string{ResamplingNearest, ResamplingBilinear, ResamplingBicubic, ResamplingMitchell, ResamplingLanczos2, ResamplingLanczos3}
+	sizes := []uint{800, 200, 50}
+
+	for name, img := range referenceImages {
+		for _, kernel := range kernels {
+			for _, size := range sizes {
+				b.Run(fmt.Sprintf("%s/%s/%d", name, kernel, size), func(b *testing.B) {
+					for i := 0; i < b.N; i++ {
+						resizeImage(size, 0, img, kernel)
+					}
+				})
+			}
+		}
+	}
+}
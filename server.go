@@ -35,8 +35,18 @@ type UploadForm struct {
 	Signature   string                `form:"signature" binding:"required"`
 }
 
+// HintForm is a form structure to use when a crop hint for an image is POSTed to the server
+type HintForm struct {
+	Focus     string `form:"focus"`
+	Crop      string `form:"crop"`
+	Timestamp int64  `form:"timestamp" binding:"required"`
+	Signature string `form:"signature" binding:"required"`
+}
+
 var (
 	uploadURLRe = regexp.MustCompile("/upload$")
+	hintURLRe   = regexp.MustCompile("/hint/")
+	infoURLRe   = regexp.MustCompile("/info/")
 )
 
 func init() {
@@ -101,8 +111,8 @@ func main() {
 					m.Use(throttler(Config.throttlingRate))
 				}
 				m.Use(func(res http.ResponseWriter, req *http.Request) {
-					if uploadURLRe.MatchString(req.URL.Path) {
-						// The upload handler returns JSON
+					if uploadURLRe.MatchString(req.URL.Path) || hintURLRe.MatchString(req.URL.Path) || infoURLRe.MatchString(req.URL.Path) {
+						// The upload, hint and info handlers return JSON
 						res.Header().Set("Content-Type", "application/json")
 					}
 				})
@@ -116,6 +126,9 @@ func main() {
 				})
 				m.Get("/((?P<apikey>[A-Z0-9]+)/)?image/:parameters/**", transformationHandler)
 				m.Post("/((?P<apikey>[A-Z0-9]+)/)?upload", binding.MultipartForm(UploadForm{}), uploadHandler)
+				m.Get("/((?P<apikey>[A-Z0-9]+)/)?hint/**", hintHandler)
+				m.Post("/((?P<apikey>[A-Z0-9]+)/)?hint/**", binding.Form(HintForm{}), saveHintHandler)
+				m.Get("/((?P<apikey>[A-Z0-9]+)/)?info/**", infoHandler)
 				go m.Run()
 
 				// Wait for when the program is terminated
@@ -233,7 +246,7 @@ func main() {
 	app.Run(os.Args)
 }
 
-func transformationHandler(params martini.Params) (int, string) {
+func transformationHandler(params martini.Params, res http.ResponseWriter, req *http.Request) (int, string) {
 	if !hasPermission(params["apikey"], GetPermission) {
 		return http.StatusUnauthorized, ""
 	}
@@ -247,29 +260,93 @@ func transformationHandler(params martini.Params) (int, string) {
 			return http.StatusBadRequest, "Unknown transformation: " + transformationName
 		}
 	} else if Config.allowCustomTransformations {
-		parameters, err := parseParameters(params["parameters"])
+		parametersStr := escapedParameters(req, params["apikey"], params["parameters"])
+		parameters, err := parseParameters(parametersStr)
+		if err != nil {
+			return http.StatusBadRequest, err.Error()
+		}
+		// Widths chosen using client hints are checked once they're known, see below
+		if (parameters.autoWidth && !isAllowedHeight(parameters.height)) || (!parameters.autoWidth && !isAllowedSize(parameters.width, parameters.height)) {
+			return http.StatusBadRequest, "Size not allowed"
+		}
+		if (parameters.scale != DefaultScale || parameters.autoScale) && !Config.allowCustomScale {
+			return http.StatusBadRequest, "Custom scale not allowed"
+		}
+		transformation = Transformation{params: &parameters, texts: make([]*Text, 0), metadata: Config.metadata}
+
+		if hasOverlays(parametersStr) {
+			if !Config.allowURLOverlays {
+				return http.StatusBadRequest, "Overlays not allowed"
+			}
+			if !hasPermission(params["apikey"], OverlayPermission) {
+				return http.StatusUnauthorized, ""
+			}
+			// Overlays become a part of the cached file path like watermarks and texts of named transformations
+			transformation.watermark, transformation.texts, err = parseOverlays(parametersStr)
+			if err != nil {
+				return http.StatusBadRequest, err.Error()
+			}
+		}
+		// Redacted rectangles become a part of the cached file path too
+		transformation.redactions, err = parseRedactions(parametersStr)
 		if err != nil {
 			return http.StatusBadRequest, err.Error()
 		}
-		transformation = Transformation{&parameters, nil, make([]*Text, 0)}
 	} else {
 		return http.StatusBadRequest, "Custom transformations not allowed"
 	}
+	// Variables are only read for templated texts, other query parameters are ignored as before
+	if transformation.isTemplated() && req.URL.RawQuery != "" {
+		query := req.URL.Query()
+		variables, err := readVariables(query)
+		if err != nil {
+			return http.StatusBadRequest, err.Error()
+		}
+		// Signing requires an API key, anyone could fill in variables otherwise
+		if params["apikey"] == "" {
+			return http.StatusUnauthorized, "Variables need to be signed"
+		}
+		err = checkVariablesSignature(params["apikey"], params["parameters"]+"/"+params["_1"], query)
+		if err != nil {
+			return http.StatusUnauthorized, err.Error()
+		}
+		transformation.variables = variables
+	}
+	setClientHintsHeaders(res, *transformation.params)
+	customAutoWidth := transformationName == "" && transformation.params.autoWidth
+	parameters := applyClientHints(*transformation.params, req.Header)
+	transformation.params = &parameters
+	if customAutoWidth && !isAllowedSize(parameters.width, parameters.height) {
+		return http.StatusBadRequest, "Size not allowed"
+	}
+
 	baseImagePath, scale := parseBasePathAndScale(params["_1"])
-	if Config.allowCustomScale {
+	// Scale in the file name (image@1.5x.jpg) takes precedence over the dpr_ parameter
+	if Config.allowCustomScale && scale != DefaultScale {
 		parameters := transformation.params.WithScale(scale)
 		transformation.params = &parameters
 	}
+	err := checkOutputSize(transformation.params, 0, 0)
+	if err == nil && transformation.canvas != nil {
+		err = checkOutputSize(transformation.canvas.withSize(transformation.params), 0, 0)
+	}
+	if err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
 
 	// Check if the image with the given parameters already exists
 	// and return it
 	fullImagePath, _ := transformation.createFilePath(baseImagePath)
-	img, format, err := loadFromCache(fullImagePath)
+	data, err := loadFromCache(fullImagePath)
 	if err == nil {
-		var buffer bytes.Buffer
-		writeImage(img, format, &buffer)
-
-		return http.StatusOK, buffer.String()
+		// Cached files were encoded with the options of the request, they're served as they are
+		if transformation.params.autoQuality {
+			quality, err := loadCachedQuality(fullImagePath)
+			if err == nil {
+				res.Header().Set(headerQuality, strconv.Itoa(quality))
+			}
+		}
+		return http.StatusOK, string(data)
 	}
 
 	// Load the original image and process it
@@ -277,24 +354,56 @@ func transformationHandler(params martini.Params) (int, string) {
 		return http.StatusNotFound, "Image not found: " + baseImagePath
 	}
 
-	img, format, err = loadImage(baseImagePath)
+	img, format, err := loadImage(baseImagePath)
 	if err != nil {
 		return http.StatusInternalServerError, err.Error()
 	}
+	err = checkOutputSize(transformation.params, img.Bounds().Dx(), img.Bounds().Dy())
+	if err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+
+	// Read before the hint so that a transformation with a hint changed in the meantime isn't cached
+	hintVersion := loadHintVersion(baseImagePath)
+	if usesCropHint(transformation.params.gravity) {
+		hint, err := loadCropHint(baseImagePath)
+		if err != nil {
+			log.Println("Loading a crop hint failed:", err)
+		}
+		transformation.cropHint = hint
+	}
 
-	imgNew := transformCropAndResize(img, &transformation)
+	imgNew, err := transformImage(img, &transformation)
+	if err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+	format = transformation.outputFormat(format)
+
+	options := transformation.params.encodingOptions()
+	if transformation.params.autoQuality && isJPEGFormat(format) {
+		options.quality, err = findAutoQuality(imgNew, options)
+		if err != nil {
+			return http.StatusInternalServerError, err.Error()
+		}
+		res.Header().Set(headerQuality, strconv.Itoa(options.quality))
+	}
 
 	var buffer bytes.Buffer
-	err = writeImage(imgNew, format, &buffer)
+	err = writeImageWithOptions(imgNew, format, options, &buffer)
 	if err != nil {
 		log.Println("Writing an image to the response failed:", err)
+		return http.StatusInternalServerError, err.Error()
 	}
 
 	// Cache the image asynchronously to speed up the response
 	go func() {
-		err = addToCache(fullImagePath, imgNew, format)
+		err := addToCache(fullImagePath, baseImagePath, hintVersion, buffer.Bytes(), format)
 		if err != nil {
 			log.Println("Saving an image to cache failed:", err)
+			return
+		}
+		if transformation.params.autoQuality && isJPEGFormat(format) {
+			saveCachedQuality(fullImagePath, options.quality)
 		}
 	}()
 
@@ -338,21 +447,9 @@ func uploadHandler(params martini.Params, uf UploadForm) (int, string) {
 	// Note: when no API key is passed in but required for uploads, the above
 	// hasPermission check should fail
 	if params["apikey"] != "" {
-		uploadTime := time.Unix(uf.Timestamp, 0)
-		delta := time.Since(uploadTime).Minutes()
-		if delta < 0 || delta > 5 {
-			return http.StatusBadRequest, uploadError("invalid timestamp")
-		}
-
-		queryParams := make(map[string]string)
-		queryParams["timestamp"] = strconv.FormatInt(uf.Timestamp, 10)
-
-		secret, err := getSecretForKey(params["apikey"])
+		err := checkSignature(params["apikey"], uf.Timestamp, uf.Signature, make(map[string]string))
 		if err != nil {
-			return http.StatusBadRequest, uploadError("authorization error")
-		}
-		if !isValidSignature(uf.Signature, secret, queryParams) {
-			return http.StatusBadRequest, uploadError("invalid signature")
+			return http.StatusBadRequest, uploadError(err.Error())
 		}
 	}
 
@@ -366,12 +463,16 @@ func uploadHandler(params martini.Params, uf UploadForm) (int, string) {
 		return http.StatusBadRequest, uploadError(err.Error())
 	}
 
-	c, _, err := image.DecodeConfig(reader)
+	c, format, err := image.DecodeConfig(reader)
 	if err != nil {
 		return http.StatusBadRequest, uploadError(err.Error())
 	}
 	reader.Seek(0, 0)
 
+	if !isAllowedUploadFormat(format) {
+		return http.StatusBadRequest, uploadError(fmt.Sprintf("format not allowed: %s, allowed: %s", format, strings.Join(Config.uploadFormats, ", ")))
+	}
+
 	pixels := c.Width * c.Height
 	if pixels > Config.uploadMaxPixels {
 		return http.StatusBadRequest, uploadError(fmt.Sprintf("too many pixels: %d, allowed: %d", pixels, Config.uploadMaxPixels))
@@ -386,10 +487,18 @@ func uploadHandler(params martini.Params, uf UploadForm) (int, string) {
 		return http.StatusBadRequest, uploadError("max file size exceeded")
 	}
 
-	img, format, err := image.Decode(bytes.NewReader(data))
+	img, format, err := decodeImage(bytes.NewReader(data))
 	if err != nil {
 		return http.StatusBadRequest, uploadError(err.Error())
 	}
+	// Originals are stored with their metadata, except for the location where photos were taken
+	if Config.uploadStripGPS {
+		original, metadata := splitMetadata(img)
+		img = withMetadata(original, metadata.withoutGPS())
+	}
+	if Config.convertToSRGB {
+		img = convertToSRGB(img)
+	}
 
 	defer file.Close()
 
@@ -403,9 +512,33 @@ func uploadHandler(params martini.Params, uf UploadForm) (int, string) {
 	eagerlyTransform := func() {
 		if len(Config.eagerTransformations) > 0 {
 			for _, transformation := range Config.eagerTransformations {
-				imgNew := transformCropAndResize(img, &transformation)
+				// There are no client hints for eager transformations, fallback values are used
+				parameters := applyClientHints(*transformation.params, nil)
+				transformation.params = &parameters
+				imgNew, err := transformImage(img, &transformation)
+				if err != nil {
+					log.Println("Eager transformation failed:", err)
+					continue
+				}
 				fullImagePath, _ := transformation.createFilePath(baseImagePath)
-				addToCache(fullImagePath, imgNew, format)
+				outputFormat := transformation.outputFormat(format)
+				options := transformation.params.encodingOptions()
+				if transformation.params.autoQuality && isJPEGFormat(outputFormat) {
+					options.quality, err = findAutoQuality(imgNew, options)
+					if err != nil {
+						log.Println("Eager transformation failed:", err)
+						continue
+					}
+				}
+				var buffer bytes.Buffer
+				err = writeImageWithOptions(imgNew, outputFormat, options, &buffer)
+				if err != nil {
+					log.Println("Eager transformation failed:", err)
+					continue
+				}
+				if addToCache(fullImagePath, baseImagePath, loadHintVersion(baseImagePath), buffer.Bytes(), outputFormat) == nil && transformation.params.autoQuality && isJPEGFormat(outputFormat) {
+					saveCachedQuality(fullImagePath, options.quality)
+				}
 			}
 		}
 	}
@@ -430,6 +563,162 @@ func uploadHandler(params martini.Params, uf UploadForm) (int, string) {
 	return http.StatusOK, uploadSuccess(baseImagePath)
 }
 
+// HintResponse is a struct to represent a JSON response for the hint handlers
+type HintResponse struct {
+	Status       string `json:"status"`
+	ErrorMessage string `json:"errorMessage"`
+	ImagePath    string `json:"imagePath"`
+	Focus        string `json:"focus"`
+	Crop         string `json:"crop"`
+}
+
+func hintResponse(response HintResponse) string {
+	str, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("Error constructing JSON response for %v", response)
+		return "{\"status\": \"error\", \"errorMessage\": \"server error\"}"
+	}
+	return string(str[:])
+}
+
+func hintError(errorMessage string) string {
+	return hintResponse(HintResponse{"error", errorMessage, "", "", ""})
+}
+
+func hintSuccess(imagePath string, hint *CropHint) string {
+	response := HintResponse{"ok", "", imagePath, "", ""}
+	if hint != nil {
+		response.Focus, response.Crop = hint.format()
+	}
+	return hintResponse(response)
+}
+
+func hintHandler(params martini.Params) (int, string) {
+	if !hasPermission(params["apikey"], GetPermission) {
+		return http.StatusUnauthorized, hintError("API key invalid or missing")
+	}
+
+	imagePath := params["_1"]
+	if !imageExists(imagePath) {
+		return http.StatusNotFound, hintError("image not found: " + imagePath)
+	}
+
+	hint, err := loadCropHint(imagePath)
+	if err != nil {
+		return http.StatusInternalServerError, hintError(err.Error())
+	}
+
+	return http.StatusOK, hintSuccess(imagePath, hint)
+}
+
+// Saves a crop hint for an image, sending neither focus nor crop removes the hint
+func saveHintHandler(params martini.Params, hf HintForm) (int, string) {
+	if !hasPermission(params["apikey"], UploadPermission) {
+		return http.StatusUnauthorized, hintError("API key invalid or missing")
+	}
+
+	// Check signature only when API key is used, see uploadHandler
+	if params["apikey"] != "" {
+		queryParams := make(map[string]string)
+		if hf.Focus != "" {
+			queryParams["focus"] = hf.Focus
+		}
+		if hf.Crop != "" {
+			queryParams["crop"] = hf.Crop
+		}
+		err := checkSignature(params["apikey"], hf.Timestamp, hf.Signature, queryParams)
+		if err != nil {
+			return http.StatusBadRequest, hintError(err.Error())
+		}
+	}
+
+	imagePath := params["_1"]
+	if !imageExists(imagePath) {
+		return http.StatusNotFound, hintError("image not found: " + imagePath)
+	}
+
+	hint, err := parseCropHint(hf.Focus, hf.Crop)
+	if err != nil {
+		return http.StatusBadRequest, hintError(err.Error())
+	}
+
+	err = saveCropHint(imagePath, hint)
+	if err != nil {
+		return http.StatusInternalServerError, hintError("error saving hint: " + err.Error())
+	}
+	log.Printf("Crop hint saved for %s", imagePath)
+
+	return http.StatusOK, hintSuccess(imagePath, &hint)
+}
+
+// InfoResponse describes an original image, trim is the part of it inside uniform borders
+type InfoResponse struct {
+	Status       string         `json:"status"`
+	ErrorMessage string         `json:"errorMessage"`
+	ImagePath    string         `json:"imagePath"`
+	Format       string         `json:"format"`
+	Width        int            `json:"width"`
+	Height       int            `json:"height"`
+	Trim         *InfoRectangle `json:"trim,omitempty"`
+}
+
+// InfoRectangle is a part of an image in pixels
+type InfoRectangle struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+func infoResponse(response InfoResponse) string {
+	str, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("Error constructing JSON response for %v", response)
+		return "{\"status\": \"error\", \"errorMessage\": \"server error\"}"
+	}
+	return string(str[:])
+}
+
+func infoError(errorMessage string) string {
+	return infoResponse(InfoResponse{"error", errorMessage, "", "", 0, 0, nil})
+}
+
+func infoSuccess(imagePath, format string, img image.Image, trimBox image.Rectangle) string {
+	bounds := img.Bounds()
+	trim := trimBox.Sub(bounds.Min)
+	return infoResponse(InfoResponse{"ok", "", imagePath, format, bounds.Dx(), bounds.Dy(), &InfoRectangle{trim.Min.X, trim.Min.Y, trim.Dx(), trim.Dy()}})
+}
+
+// Returns the size and format of an original image and the part of it which the trim parameter keeps,
+// the tolerance can be given as ?trim=X
+func infoHandler(params martini.Params, req *http.Request) (int, string) {
+	if !hasPermission(params["apikey"], GetPermission) {
+		return http.StatusUnauthorized, infoError("API key invalid or missing")
+	}
+
+	tolerance := DefaultTrimTolerance
+	if value := req.URL.Query().Get("trim"); value != "" {
+		var err error
+		tolerance, err = strconv.Atoi(value)
+		if err != nil || tolerance < 0 || tolerance > MaxTrimTolerance {
+			return http.StatusBadRequest, infoError(fmt.Sprintf("trim needs to be a tolerance between 0 and %d", MaxTrimTolerance))
+		}
+	}
+
+	imagePath := params["_1"]
+	if !imageExists(imagePath) {
+		return http.StatusNotFound, infoError("image not found: " + imagePath)
+	}
+
+	img, format, err := loadImage(imagePath)
+	if err != nil {
+		return http.StatusInternalServerError, infoError(err.Error())
+	}
+	img, _ = splitMetadata(img)
+
+	return http.StatusOK, infoSuccess(imagePath, format, img, findTrimBox(img, tolerance))
+}
+
 func throttler(perMinRate int) http.Handler {
 	t := throttled.RateLimit(throttled.PerMin(perMinRate), &throttled.VaryBy{RemoteAddr: true}, store.NewMemStore(1000))
 	return t.Throttle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"image"
+	"image/color"
+)
+
+const (
+	// Images are analysed at most at this size (in either dimension) when looking for a crop window
+	smartCropAnalysisSize = 256
+)
+
+// calculateCropTopLeftPoint returns the top left point of a crop window of given dimensions,
+// smart gravities (auto and focal point) and stored crop hints take the content of the image into account
+func calculateCropTopLeftPoint(img image.Image, transformation *Transformation, width, height int) image.Point {
+	parameters := transformation.params
+	imgWidth := img.Bounds().Dx()
+	imgHeight := img.Bounds().Dy()
+
+	if transformation.cropHint != nil && usesCropHint(parameters.gravity) {
+		focusX, focusY := transformation.cropHint.focalPoint()
+		return calculateTopLeftPointFromFocalPoint(focusX, focusY, width, height, imgWidth, imgHeight)
+	}
+
+	switch parameters.gravity {
+	case GravityAuto:
+		size := image.Point{width, height}
+		if point, ok := transformation.cropPoints[size]; ok {
+			return point
+		}
+		point := findInterestingCropWindow(img, width, height)
+		if transformation.cropPoints != nil {
+			transformation.cropPoints[size] = point
+		}
+		return point
+	case GravityFocalPoint:
+		return calculateTopLeftPointFromFocalPoint(parameters.focusX, parameters.focusY, width, height, imgWidth, imgHeight)
+	case GravityNone:
+		return calculateTopLeftPointFromGravity(DefaultGravity, width, height, imgWidth, imgHeight)
+	}
+	return calculateTopLeftPointFromGravity(parameters.gravity, width, height, imgWidth, imgHeight)
+}
+
+// calculateTopLeftPointFromFocalPoint centres a crop window on a focal point given in relative
+// coordinates, the window is moved as little as possible to fit in the image
+func calculateTopLeftPointFromFocalPoint(x, y float64, width, height, imgWidth, imgHeight int) image.Point {
+	left := int(x*float64(imgWidth)+0.5) - width/2
+	top := int(y*float64(imgHeight)+0.5) - height/2
+	return image.Point{clampInt(left, 0, imgWidth-width), clampInt(top, 0, imgHeight-height)}
+}
+
+// findInterestingCropWindow returns the top left point of a crop window of given dimensions
+// with the highest edge energy. Windows closer to the centre win when energies are equal.
+func findInterestingCropWindow(img image.Image, width, height int) image.Point {
+	imgWidth := img.Bounds().Dx()
+	imgHeight := img.Bounds().Dy()
+	if width >= imgWidth && height >= imgHeight {
+		return image.ZP
+	}
+
+	// Analyse a smaller copy of the image for speed
+	ratio := 1.0
+	if imgWidth > smartCropAnalysisSize || imgHeight > smartCropAnalysisSize {
+		if imgWidth > imgHeight {
+			ratio = float64(smartCropAnalysisSize) / float64(imgWidth)
+		} else {
+			ratio = float64(smartCropAnalysisSize) / float64(imgHeight)
+		}
+		smallWidth := clampInt(int(float64(imgWidth)*ratio+0.5), 1, smartCropAnalysisSize)
+		smallHeight := clampInt(int(float64(imgHeight)*ratio+0.5), 1, smartCropAnalysisSize)
+		img = resizeImage(uint(smallWidth), uint(smallHeight), img, ResamplingBilinear)
+	}
+
+	energy := calculateEdgeEnergy(img)
+	smallWidth := img.Bounds().Dx()
+	smallHeight := img.Bounds().Dy()
+	windowWidth := clampInt(int(float64(width)*ratio+0.5), 1, smallWidth)
+	windowHeight := clampInt(int(float64(height)*ratio+0.5), 1, smallHeight)
+
+	// Summed-area table so that energy of any window can be calculated in constant time
+	stride := smallWidth + 1
+	sums := make([]int64, stride*(smallHeight+1))
+	for y := 0; y < smallHeight; y++ {
+		var rowSum int64
+		for x := 0; x < smallWidth; x++ {
+			rowSum += energy[y*smallWidth+x]
+			sums[(y+1)*stride+x+1] = sums[y*stride+x+1] + rowSum
+		}
+	}
+
+	centreX := (smallWidth - windowWidth) / 2
+	centreY := (smallHeight - windowHeight) / 2
+	best := image.Point{centreX, centreY}
+	bestEnergy := int64(-1)
+	bestDistance := 0
+	for y := 0; y <= smallHeight-windowHeight; y++ {
+		for x := 0; x <= smallWidth-windowWidth; x++ {
+			windowEnergy := sums[(y+windowHeight)*stride+x+windowWidth] - sums[y*stride+x+windowWidth] - sums[(y+windowHeight)*stride+x] + sums[y*stride+x]
+			distance := absInt(x-centreX) + absInt(y-centreY)
+			if windowEnergy > bestEnergy || (windowEnergy == bestEnergy && distance < bestDistance) {
+				best = image.Point{x, y}
+				bestEnergy = windowEnergy
+				bestDistance = distance
+			}
+		}
+	}
+
+	left := int(float64(best.X)/ratio + 0.5)
+	top := int(float64(best.Y)/ratio + 0.5)
+	return image.Point{clampInt(left, 0, imgWidth-width), clampInt(top, 0, imgHeight-height)}
+}
+
+// calculateEdgeEnergy returns the sum of absolute horizontal and vertical luminance differences
+// for each pixel of an image (row by row)
+func calculateEdgeEnergy(img image.Image) []int64 {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	luminance := make([]int64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			gray := color.GrayModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray)
+			luminance[y*width+x] = int64(gray.Y)
+		}
+	}
+
+	energy := make([]int64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*width + x
+			if x > 0 {
+				energy[i] += absInt64(luminance[i] - luminance[i-1])
+			}
+			if y > 0 {
+				energy[i] += absInt64(luminance[i] - luminance[i-width])
+			}
+		}
+	}
+	return energy
+}
+
+func clampInt(value, min, max int) int {
+	if value > max {
+		value = max
+	}
+	if value < min {
+		value = min
+	}
+	return value
+}
+
+func absInt(value int) int {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
+
+func absInt64(value int64) int64 {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// createImageWithDetail returns a flat grey image with a checkerboard patch in the given rectangle
+func createImageWithDetail(width, height int, detail image.Rectangle) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.Gray{128}), image.ZP, draw.Src)
+	for y := detail.Min.Y; y < detail.Max.Y; y++ {
+		for x := detail.Min.X; x < detail.Max.X; x++ {
+			if (x/4+y/4)%2 == 0 {
+				img.Set(x, y, color.White)
+			} else {
+				img.Set(x, y, color.Black)
+			}
+		}
+	}
+	return img
+}
+
+func TestFindInterestingCropWindow(t *testing.T) {
+	// Detail on the right side of a wide image
+	img := createImageWithDetail(400, 100, image.Rect(300, 20, 380, 80))
+	act := findInterestingCropWindow(img, 100, 100)
+	if act.X > 300 || act.X+100 < 380 || act.Y != 0 {
+		t.Errorf("Crop window at %v does not contain the detail", act)
+	}
+
+	// Detail at the bottom of a tall image which is analysed at a smaller size
+	img = createImageWithDetail(300, 1200, image.Rect(100, 1000, 200, 1100))
+	act = findInterestingCropWindow(img, 300, 300)
+	if act.X != 0 || act.Y > 1000 || act.Y+300 < 1100 {
+		t.Errorf("Crop window at %v does not contain the detail", act)
+	}
+
+	// A flat image is cropped in the centre
+	img = createImageWithDetail(400, 100, image.Rectangle{})
+	act = findInterestingCropWindow(img, 100, 100)
+	exp := image.Point{150, 0}
+	if act != exp {
+		t.Errorf("Expected: %v, actual: %v", exp, act)
+	}
+}
+
+func TestCalculateTopLeftPointFromFocalPoint(t *testing.T) {
+	exp := image.Point{300, 200}
+	act := calculateTopLeftPointFromFocalPoint(0.5, 0.5, 200, 200, 800, 600)
+	if act != exp {
+		t.Errorf("Centre failed, expected: %v, actual: %v", exp, act)
+	}
+
+	exp = image.Point{600, 0}
+	act = calculateTopLeftPointFromFocalPoint(1, 0, 200, 200, 800, 600)
+	if act != exp {
+		t.Errorf("Top right failed, expected: %v, actual: %v", exp, act)
+	}
+
+	exp = image.Point{140, 380}
+	act = calculateTopLeftPointFromFocalPoint(0.3, 0.8, 200, 200, 800, 600)
+	if act != exp {
+		t.Errorf("Inside failed, expected: %v, actual: %v", exp, act)
+	}
+}
+
+func TestTransformCropAndResizeAutoGravity(t *testing.T) {
+	img := createImageWithDetail(400, 100, image.Rect(0, 0, 60, 100))
+
+	params, err := parseParameters("w_50,h_50,c_p,g_auto")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	imgNew := transformCropAndResize(img, &Transformation{params: &params, metadata: MetadataStrip})
+	if imgNew.Bounds().Size() != (image.Point{50, 50}) {
+		t.Fatalf("Expected a 50x50 image, actual: %v", imgNew.Bounds().Size())
+	}
+	// The left side of the crop is the checkerboard, the right side is flat grey
+	if c := color.GrayModel.Convert(imgNew.At(45, 25)).(color.Gray); c.Y < 120 || c.Y > 136 {
+		t.Errorf("Expected flat grey on the right, actual: %v", c)
+	}
+
+	params, _ = parseParameters("w_100,h_100,c_k,g_fp:1,0.5")
+	imgNew = transformCropAndResize(img, &Transformation{params: &params, metadata: MetadataStrip})
+	if c := color.GrayModel.Convert(imgNew.At(0, 0)).(color.Gray); c.Y != 128 {
+		t.Errorf("Expected flat grey on the right side of the image, actual: %v", c)
+	}
+}
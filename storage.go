@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"image"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -36,7 +37,11 @@ type storage interface {
 
 	loadImage(imagePath string) (image.Image, string, error)
 
-	saveImage(img image.Image, format string, imagePath string) (int, error)
+	// Reads an encoded image as it's stored
+	loadData(imagePath string) ([]byte, error)
+
+	// Stores an encoded image, returns its size
+	saveData(data []byte, format string, imagePath string) (int, error)
 
 	deleteImage(imagePath string) error
 
@@ -61,12 +66,31 @@ func storageInit() error {
 func storageCleanUp() {
 }
 
+// Loads an image, converting its colours to sRGB if set up in the configuration
 func loadImage(imagePath string) (image.Image, string, error) {
-	return storageImpl.loadImage(imagePath)
+	img, format, err := storageImpl.loadImage(imagePath)
+	if err != nil || !Config.convertToSRGB {
+		return img, format, err
+	}
+	return convertToSRGB(img), format, nil
 }
 
 func saveImage(img image.Image, format string, imagePath string) (int, error) {
-	return storageImpl.saveImage(img, format, imagePath)
+	return saveImageWithOptions(img, format, defaultEncodingOptions(), imagePath)
+}
+
+// Saves an image like saveImage using the given encoding options.
+func saveImageWithOptions(img image.Image, format string, options EncodingOptions, imagePath string) (int, error) {
+	var buffer bytes.Buffer
+	err := writeImageWithOptions(img, format, options, &buffer)
+	if err != nil {
+		return 0, err
+	}
+	return storageImpl.saveData(buffer.Bytes(), format, imagePath)
+}
+
+func loadData(imagePath string) ([]byte, error) {
+	return storageImpl.loadData(imagePath)
 }
 
 func deleteImage(imagePath string) error {
@@ -95,40 +119,28 @@ func (s *localStorage) loadImage(imagePath string) (image.Image, string, error)
 	if err != nil {
 		return nil, "", fmt.Errorf("image not found: %q", imagePath)
 	}
-	img, format, err := image.Decode(reader)
+	img, format, err := decodeImage(reader)
 	if err != nil {
 		return nil, "", fmt.Errorf("cannot decode image: %q", imagePath)
 	}
 	return img, format, nil
 }
 
-func (s *localStorage) saveImage(img image.Image, format string, imagePath string) (int, error) {
-	// Open file for writing, overwrite if it already exists
-	fullPath := s.path + "/" + imagePath
-	writer, err := os.Create(fullPath)
-	defer writer.Close()
-
+func (s *localStorage) loadData(imagePath string) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.path + "/" + imagePath)
 	if err != nil {
-		return 0, err
+		return nil, fmt.Errorf("image not found: %q", imagePath)
 	}
+	return data, nil
+}
 
-	err = writeImage(img, format, writer)
+func (s *localStorage) saveData(data []byte, format string, imagePath string) (int, error) {
+	// Overwrite the file if it already exists
+	err := ioutil.WriteFile(s.path+"/"+imagePath, data, 0644)
 	if err != nil {
 		return 0, err
 	}
-
-	f, err := os.Open(fullPath)
-	if err != nil {
-		return 0, nil
-	}
-
-	stat, err := f.Stat()
-	if err != nil {
-		return 0, nil
-	}
-	size := stat.Size()
-
-	return int(size), err
+	return len(data), nil
 }
 
 func (s *localStorage) deleteImage(imagePath string) error {
@@ -186,15 +198,16 @@ func (s *s3Storage) loadImage(imagePath string) (image.Image, string, error) {
 	return image, format, nil
 }
 
-func (s *s3Storage) saveImage(img image.Image, format string, imagePath string) (int, error) {
-	var buffer bytes.Buffer
-	err := writeImage(img, format, &buffer)
-	if err != nil {
-		return 0, err
-	}
+func (s *s3Storage) loadData(imagePath string) ([]byte, error) {
+	return s.bucket.Get(imagePath)
+}
 
-	size := buffer.Len()
-	return size, s.bucket.Put(imagePath, buffer.Bytes(), "image/"+format, s3.Private)
+func (s *s3Storage) saveData(data []byte, format string, imagePath string) (int, error) {
+	contentType := "image/" + format
+	if format == "svg" {
+		contentType = "image/svg+xml"
+	}
+	return len(data), s.bucket.Put(imagePath, data, contentType, s3.Private)
 }
 
 func (s *s3Storage) deleteImage(imagePath string) error {
@@ -269,19 +282,27 @@ func (s *gcsStorage) loadImage(imagePath string) (image.Image, string, error) {
 	return image, format, nil
 }
 
-func (s *gcsStorage) saveImage(img image.Image, format string, imagePath string) (int, error) {
-	buffer := &bytes.Buffer{}
-	err := writeImage(img, format, buffer)
+func (s *gcsStorage) loadData(imagePath string) ([]byte, error) {
+	obj, err := s.service.Objects.Get(s.bucket, imagePath).Do()
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+
+	resp, err := s.client.Get(obj.Media.Link)
+	if err != nil {
+		return nil, err
 	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
 
-	size := buffer.Len()
-	_, err = s.service.Objects.Insert(s.bucket, &gcs.Object{Name: imagePath}).Media(buffer).Do()
+func (s *gcsStorage) saveData(data []byte, format string, imagePath string) (int, error) {
+	_, err := s.service.Objects.Insert(s.bucket, &gcs.Object{Name: imagePath}).Media(bytes.NewReader(data)).Do()
 	if err != nil {
 		return 0, err
 	}
-	return size, err
+	return len(data), nil
 }
 
 func (s *gcsStorage) deleteImage(imagePath string) error {
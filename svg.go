@@ -0,0 +1,1036 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/vector"
+)
+
+const (
+	// Size of SVG images without width, height and viewBox
+	svgDefaultWidth  = 300
+	svgDefaultHeight = 150
+	// Max. intrinsic width and height of SVG images
+	svgMaxSize = 1 << 16
+	// Max. number of drawn elements (paths and basic shapes) of SVG images
+	svgMaxShapes = 10000
+
+	// Max. length of line segments curves are split into, in pixels
+	svgCurveTolerance = 3
+	// Number of segments circles of round line joins and caps are drawn with
+	svgJoinSegments = 16
+)
+
+// Elements which aren't drawn directly and whose content is skipped
+var svgSkippedElements = map[string]bool{
+	"defs": true, "symbol": true, "clipPath": true, "mask": true, "pattern": true, "marker": true,
+	"linearGradient": true, "radialGradient": true, "filter": true, "style": true, "script": true,
+	"title": true, "desc": true, "metadata": true, "text": true, "foreignObject": true,
+}
+
+// Colours which can be used by name
+var svgColorNames = map[string]color.NRGBA{
+	"black":       {0, 0, 0, 255},
+	"white":       {255, 255, 255, 255},
+	"red":         {255, 0, 0, 255},
+	"green":       {0, 128, 0, 255},
+	"blue":        {0, 0, 255, 255},
+	"yellow":      {255, 255, 0, 255},
+	"orange":      {255, 165, 0, 255},
+	"purple":      {128, 0, 128, 255},
+	"gray":        {128, 128, 128, 255},
+	"grey":        {128, 128, 128, 255},
+	"silver":      {192, 192, 192, 255},
+	"maroon":      {128, 0, 0, 255},
+	"navy":        {0, 0, 128, 255},
+	"teal":        {0, 128, 128, 255},
+	"olive":       {128, 128, 0, 255},
+	"lime":        {0, 255, 0, 255},
+	"aqua":        {0, 255, 255, 255},
+	"cyan":        {0, 255, 255, 255},
+	"fuchsia":     {255, 0, 255, 255},
+	"magenta":     {255, 0, 255, 255},
+	"transparent": {0, 0, 0, 0},
+}
+
+// Lengths of units in pixels
+var svgUnits = map[string]float64{"px": 1, "pt": 4.0 / 3, "pc": 16, "mm": 96 / 25.4, "cm": 96 / 2.54, "in": 96}
+
+func init() {
+	image.RegisterFormat("svg", "<?xml", decodeSVGImage, decodeSVGConfig)
+	image.RegisterFormat("svg", "<svg", decodeSVGImage, decodeSVGConfig)
+}
+
+// VectorImage is a parsed SVG image which can be rasterised at any size. Used as an image.Image
+// it's rasterised at its intrinsic size when its pixels are needed for the first time.
+type VectorImage struct {
+	// The original SVG document, written when the image is saved
+	data          []byte
+	width, height float64
+	// Area of the drawing shown in the image (min. x, min. y, width, height)
+	viewBox         [4]float64
+	preserveAspect  bool
+	shapes          []svgShape
+	rasteriseOnce   sync.Once
+	intrinsicRaster *image.RGBA
+}
+
+// svgShape is a path in the coordinates of the root element with a fill and a stroke
+type svgShape struct {
+	subpaths                   []svgSubpath
+	fill, stroke               color.NRGBA
+	strokeWidth                float64
+	roundCaps                  bool
+	hasFill, hasStroke         bool
+	fillOpacity, strokeOpacity float64
+}
+
+type svgSubpath struct {
+	from     svgPoint
+	segments []svgSegment
+	closed   bool
+}
+
+// svgSegment is a line or a cubic Bézier curve to a point
+type svgSegment struct {
+	control1, control2, to svgPoint
+	curve                  bool
+}
+
+type svgPoint struct {
+	x, y float64
+}
+
+// svgMatrix is an affine transformation (a, b, c, d, e, f) as in the SVG transform attribute
+type svgMatrix [6]float64
+
+var svgIdentity = svgMatrix{1, 0, 0, 1, 0, 0}
+
+func (m svgMatrix) apply(p svgPoint) svgPoint {
+	return svgPoint{m[0]*p.x + m[2]*p.y + m[4], m[1]*p.x + m[3]*p.y + m[5]}
+}
+
+// multiply returns a transformation applying n first and then m
+func (m svgMatrix) multiply(n svgMatrix) svgMatrix {
+	return svgMatrix{
+		m[0]*n[0] + m[2]*n[1], m[1]*n[0] + m[3]*n[1],
+		m[0]*n[2] + m[2]*n[3], m[1]*n[2] + m[3]*n[3],
+		m[0]*n[4] + m[2]*n[5] + m[4], m[1]*n[4] + m[3]*n[5] + m[5],
+	}
+}
+
+// Average scale of a transformation, used for stroke widths
+func (m svgMatrix) scale() float64 {
+	return math.Sqrt(math.Abs(m[0]*m[3] - m[1]*m[2]))
+}
+
+// svgStyle holds the inherited presentation attributes of an element
+type svgStyle struct {
+	fill, stroke                        string
+	color                               string
+	strokeWidth                         float64
+	opacity, fillOpacity, strokeOpacity float64
+	lineCap                             string
+	transform                           svgMatrix
+}
+
+func (v *VectorImage) ColorModel() color.Model {
+	return color.RGBAModel
+}
+
+func (v *VectorImage) Bounds() image.Rectangle {
+	return image.Rect(0, 0, int(math.Ceil(v.width)), int(math.Ceil(v.height)))
+}
+
+func (v *VectorImage) At(x, y int) color.Color {
+	v.rasteriseOnce.Do(func() {
+		bounds := v.Bounds()
+		v.intrinsicRaster = v.rasterise(bounds.Dx(), bounds.Dy())
+	})
+	return v.intrinsicRaster.At(x, y)
+}
+
+func decodeSVGImage(reader io.Reader) (image.Image, error) {
+	return decodeSVG(reader)
+}
+
+func decodeSVGConfig(reader io.Reader) (image.Config, error) {
+	v, err := decodeSVG(reader)
+	if err != nil {
+		return image.Config{}, err
+	}
+	bounds := v.Bounds()
+	return image.Config{ColorModel: color.RGBAModel, Width: bounds.Dx(), Height: bounds.Dy()}, nil
+}
+
+// decodeSVG parses an SVG document. Paths and basic shapes with solid fills and strokes are supported,
+// gradients, patterns, clipping, masks, filters, text and embedded images are not drawn.
+func decodeSVG(reader io.Reader) (*VectorImage, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	v := &VectorImage{data: data}
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+
+	styles := make([]svgStyle, 0)
+	skipDepth := 0
+	root := true
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("svg: %s", err)
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			if skipDepth > 0 || svgSkippedElements[element.Name.Local] {
+				skipDepth++
+				continue
+			}
+			if root {
+				if element.Name.Local != "svg" {
+					return nil, fmt.Errorf("svg: root element is %s", element.Name.Local)
+				}
+				err = v.parseRoot(element)
+				if err != nil {
+					return nil, err
+				}
+				styles = append(styles, svgStyle{"black", "none", "black", 1, 1, 1, 1, "butt", svgIdentity})
+				root = false
+			}
+
+			attributes := svgAttributes(element)
+			style, visible := styles[len(styles)-1].inherit(attributes)
+			styles = append(styles, style)
+			if !visible {
+				skipDepth++
+				styles = styles[:len(styles)-1]
+				continue
+			}
+			subpaths, err := svgElementSubpaths(element.Name.Local, attributes)
+			if err != nil {
+				return nil, err
+			}
+			if len(subpaths) > 0 {
+				if len(v.shapes) == svgMaxShapes {
+					return nil, fmt.Errorf("svg: more than %d shapes", svgMaxShapes)
+				}
+				v.shapes = append(v.shapes, style.shape(subpaths))
+			}
+		case xml.EndElement:
+			if skipDepth > 0 {
+				skipDepth--
+			} else if len(styles) > 0 {
+				styles = styles[:len(styles)-1]
+			}
+		}
+	}
+	if root {
+		return nil, fmt.Errorf("svg: no svg element")
+	}
+	return v, nil
+}
+
+// parseRoot reads the size and the view box of an image from the root svg element
+func (v *VectorImage) parseRoot(element xml.StartElement) error {
+	attributes := svgAttributes(element)
+	width, hasWidth := parseSVGLength(attributes["width"])
+	height, hasHeight := parseSVGLength(attributes["height"])
+
+	viewBox := parseSVGNumbers(attributes["viewBox"])
+	hasViewBox := len(viewBox) == 4 && viewBox[2] > 0 && viewBox[3] > 0
+	switch {
+	case hasWidth && hasHeight:
+	case hasViewBox && hasWidth:
+		height = width * viewBox[3] / viewBox[2]
+	case hasViewBox && hasHeight:
+		width = height * viewBox[2] / viewBox[3]
+	case hasViewBox:
+		width, height = viewBox[2], viewBox[3]
+	default:
+		width, height = svgDefaultWidth, svgDefaultHeight
+	}
+	if !(width > 0 && height > 0 && width <= svgMaxSize && height <= svgMaxSize) {
+		return fmt.Errorf("svg: invalid size %gx%g", width, height)
+	}
+	v.width, v.height = width, height
+
+	if hasViewBox {
+		copy(v.viewBox[:], viewBox)
+	} else {
+		v.viewBox = [4]float64{0, 0, width, height}
+	}
+	v.preserveAspect = !strings.HasPrefix(strings.TrimSpace(attributes["preserveAspectRatio"]), "none")
+	return nil
+}
+
+// svgAttributes returns the attributes of an element including properties set in its style attribute
+func svgAttributes(element xml.StartElement) map[string]string {
+	attributes := make(map[string]string)
+	for _, attribute := range element.Attr {
+		attributes[attribute.Name.Local] = strings.TrimSpace(attribute.Value)
+	}
+	for _, declaration := range strings.Split(attributes["style"], ";") {
+		parts := strings.SplitN(declaration, ":", 2)
+		if len(parts) == 2 {
+			attributes[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+	return attributes
+}
+
+// inherit returns the style of an element with the given attributes and whether the element is displayed
+func (s svgStyle) inherit(attributes map[string]string) (svgStyle, bool) {
+	if attributes["display"] == "none" || attributes["visibility"] == "hidden" {
+		return s, false
+	}
+	if value, ok := attributes["color"]; ok && value != "inherit" {
+		s.color = value
+	}
+	if value, ok := attributes["fill"]; ok && value != "inherit" {
+		s.fill = value
+	}
+	if value, ok := attributes["stroke"]; ok && value != "inherit" {
+		s.stroke = value
+	}
+	if value, ok := parseSVGLength(attributes["stroke-width"]); ok {
+		s.strokeWidth = value
+	}
+	if value, ok := attributes["stroke-linecap"]; ok && value != "inherit" {
+		s.lineCap = value
+	}
+	// Group opacity is approximated by making each shape more transparent
+	if value, ok := parseSVGOpacity(attributes["opacity"]); ok {
+		s.opacity *= value
+	}
+	if value, ok := parseSVGOpacity(attributes["fill-opacity"]); ok {
+		s.fillOpacity = value
+	}
+	if value, ok := parseSVGOpacity(attributes["stroke-opacity"]); ok {
+		s.strokeOpacity = value
+	}
+	if value, ok := attributes["transform"]; ok {
+		s.transform = s.transform.multiply(parseSVGTransform(value))
+	}
+	return s, true
+}
+
+// shape turns subpaths in the coordinates of an element into a shape drawn with the style
+func (s svgStyle) shape(subpaths []svgSubpath) svgShape {
+	for i := range subpaths {
+		subpaths[i].from = s.transform.apply(subpaths[i].from)
+		for j := range subpaths[i].segments {
+			segment := &subpaths[i].segments[j]
+			segment.control1 = s.transform.apply(segment.control1)
+			segment.control2 = s.transform.apply(segment.control2)
+			segment.to = s.transform.apply(segment.to)
+		}
+	}
+
+	shape := svgShape{subpaths: subpaths, strokeWidth: s.strokeWidth * s.transform.scale(), roundCaps: s.lineCap == "round"}
+	shape.fill, shape.hasFill = parseSVGColor(s.fill, s.color)
+	shape.stroke, shape.hasStroke = parseSVGColor(s.stroke, s.color)
+	shape.hasStroke = shape.hasStroke && shape.strokeWidth > 0
+	shape.fillOpacity = s.opacity * s.fillOpacity
+	shape.strokeOpacity = s.opacity * s.strokeOpacity
+	return shape
+}
+
+// rasterise draws the image at the given size
+func (v *VectorImage) rasterise(width, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	// Map the view box to the image, keeping its proportions unless preserveAspectRatio is none
+	scaleX := float64(width) / v.viewBox[2]
+	scaleY := float64(height) / v.viewBox[3]
+	offsetX, offsetY := 0.0, 0.0
+	if v.preserveAspect {
+		scale := math.Min(scaleX, scaleY)
+		offsetX = (float64(width) - v.viewBox[2]*scale) / 2
+		offsetY = (float64(height) - v.viewBox[3]*scale) / 2
+		scaleX, scaleY = scale, scale
+	}
+	m := svgMatrix{scaleX, 0, 0, scaleY, offsetX - v.viewBox[0]*scaleX, offsetY - v.viewBox[1]*scaleY}
+
+	// Each fill and stroke is rasterised only within its bounds, one rasterizer's buffer is reused for all
+	rasterizer := &vector.Rasterizer{}
+	for _, shape := range v.shapes {
+		polylines, closed := shape.flatten(m)
+		if shape.hasFill && shape.fillOpacity > 0 {
+			rect := polylineBounds(polylines, 0).Intersect(dst.Bounds())
+			if !rect.Empty() {
+				rasterizer.Reset(rect.Dx(), rect.Dy())
+				for _, polyline := range offsetPolylines(polylines, rect.Min) {
+					rasterizer.MoveTo(float32(polyline[0].x), float32(polyline[0].y))
+					for _, p := range polyline[1:] {
+						rasterizer.LineTo(float32(p.x), float32(p.y))
+					}
+					rasterizer.ClosePath()
+				}
+				rasterizer.Draw(dst, rect, image.NewUniform(svgPaint(shape.fill, shape.fillOpacity)), image.ZP)
+			}
+		}
+		if shape.hasStroke && shape.strokeOpacity > 0 {
+			halfWidth := shape.strokeWidth * m.scale() / 2
+			rect := polylineBounds(polylines, halfWidth).Intersect(dst.Bounds())
+			if !rect.Empty() {
+				rasterizer.Reset(rect.Dx(), rect.Dy())
+				for i, polyline := range offsetPolylines(polylines, rect.Min) {
+					strokePolyline(rasterizer, polyline, closed[i], halfWidth, shape.roundCaps)
+				}
+				rasterizer.Draw(dst, rect, image.NewUniform(svgPaint(shape.stroke, shape.strokeOpacity)), image.ZP)
+			}
+		}
+	}
+	return dst
+}
+
+// polylineBounds returns the pixels covered by polylines, grown by a margin on each side (half a stroke width)
+func polylineBounds(polylines [][]svgPoint, margin float64) image.Rectangle {
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, polyline := range polylines {
+		for _, p := range polyline {
+			minX, minY = math.Min(minX, p.x), math.Min(minY, p.y)
+			maxX, maxY = math.Max(maxX, p.x), math.Max(maxY, p.y)
+		}
+	}
+	if minX > maxX || minY > maxY {
+		return image.Rectangle{}
+	}
+	// Clamped so that shapes far outside of the image don't overflow
+	clamp := func(value float64) int {
+		return int(math.Max(-svgMaxSize, math.Min(svgMaxSize, value)))
+	}
+	return image.Rect(clamp(math.Floor(minX-margin)), clamp(math.Floor(minY-margin)),
+		clamp(math.Ceil(maxX+margin)+1), clamp(math.Ceil(maxY+margin)+1))
+}
+
+// offsetPolylines returns copies of polylines in the coordinates of a rectangle starting at the given point
+func offsetPolylines(polylines [][]svgPoint, origin image.Point) [][]svgPoint {
+	offset := make([][]svgPoint, len(polylines))
+	for i, polyline := range polylines {
+		offset[i] = make([]svgPoint, len(polyline))
+		for j, p := range polyline {
+			offset[i][j] = svgPoint{p.x - float64(origin.X), p.y - float64(origin.Y)}
+		}
+	}
+	return offset
+}
+
+func svgPaint(c color.NRGBA, opacity float64) color.NRGBA {
+	c.A = uint8(float64(c.A)*opacity + 0.5)
+	return c
+}
+
+// flatten turns the subpaths of a shape into polylines in the coordinates of the image
+func (s svgShape) flatten(m svgMatrix) ([][]svgPoint, []bool) {
+	polylines := make([][]svgPoint, 0, len(s.subpaths))
+	closed := make([]bool, 0, len(s.subpaths))
+	for _, subpath := range s.subpaths {
+		current := m.apply(subpath.from)
+		polyline := []svgPoint{current}
+		for _, segment := range subpath.segments {
+			to := m.apply(segment.to)
+			if segment.curve {
+				c1, c2 := m.apply(segment.control1), m.apply(segment.control2)
+				length := distance(current, c1) + distance(c1, c2) + distance(c2, to)
+				steps := int(math.Ceil(length / svgCurveTolerance))
+				if steps > 100 {
+					steps = 100
+				}
+				for i := 1; i < steps; i++ {
+					polyline = append(polyline, cubicPoint(current, c1, c2, to, float64(i)/float64(steps)))
+				}
+			}
+			polyline = append(polyline, to)
+			current = to
+		}
+		polylines = append(polylines, polyline)
+		closed = append(closed, subpath.closed)
+	}
+	return polylines, closed
+}
+
+func cubicPoint(p0, p1, p2, p3 svgPoint, t float64) svgPoint {
+	u := 1 - t
+	a, b, c, d := u*u*u, 3*u*u*t, 3*u*t*t, t*t*t
+	return svgPoint{a*p0.x + b*p1.x + c*p2.x + d*p3.x, a*p0.y + b*p1.y + c*p2.y + d*p3.y}
+}
+
+func distance(a, b svgPoint) float64 {
+	return math.Hypot(b.x-a.x, b.y-a.y)
+}
+
+// strokePolyline adds the outline of a stroked polyline to a rasterizer as a quadrilateral for each segment
+// and circles at the joins. All polygons go in the same direction so overlapping parts aren't cancelled out.
+func strokePolyline(rasterizer *vector.Rasterizer, polyline []svgPoint, closed bool, halfWidth float64, roundCaps bool) {
+	if closed && len(polyline) > 1 && polyline[0] != polyline[len(polyline)-1] {
+		polyline = append(polyline, polyline[0])
+	}
+	for i := 0; i+1 < len(polyline); i++ {
+		a, b := polyline[i], polyline[i+1]
+		length := distance(a, b)
+		if length == 0 {
+			continue
+		}
+		nx, ny := -(b.y-a.y)/length*halfWidth, (b.x-a.x)/length*halfWidth
+		rasterizer.MoveTo(float32(a.x+nx), float32(a.y+ny))
+		rasterizer.LineTo(float32(b.x+nx), float32(b.y+ny))
+		rasterizer.LineTo(float32(b.x-nx), float32(b.y-ny))
+		rasterizer.LineTo(float32(a.x-nx), float32(a.y-ny))
+		rasterizer.ClosePath()
+	}
+	for i, p := range polyline {
+		end := i == 0 || i == len(polyline)-1
+		if end && !closed && !roundCaps {
+			continue
+		}
+		rasterizer.MoveTo(float32(p.x+halfWidth), float32(p.y))
+		for j := 1; j < svgJoinSegments; j++ {
+			angle := -2 * math.Pi * float64(j) / svgJoinSegments
+			rasterizer.LineTo(float32(p.x+halfWidth*math.Cos(angle)), float32(p.y+halfWidth*math.Sin(angle)))
+		}
+		rasterizer.ClosePath()
+	}
+}
+
+// svgElementSubpaths returns the outline of a shape element in its own coordinates
+func svgElementSubpaths(name string, attributes map[string]string) ([]svgSubpath, error) {
+	number := func(key string) float64 {
+		value, _ := parseSVGLength(attributes[key])
+		return value
+	}
+
+	switch name {
+	case "path":
+		return parseSVGPath(attributes["d"])
+	case "rect":
+		x, y, width, height := number("x"), number("y"), number("width"), number("height")
+		if width <= 0 || height <= 0 {
+			return nil, nil
+		}
+		rx, hasRX := parseSVGLength(attributes["rx"])
+		ry, hasRY := parseSVGLength(attributes["ry"])
+		if !hasRX {
+			rx = ry
+		}
+		if !hasRY {
+			ry = rx
+		}
+		rx, ry = math.Min(math.Max(rx, 0), width/2), math.Min(math.Max(ry, 0), height/2)
+		if rx == 0 || ry == 0 {
+			return []svgSubpath{svgPolygon([]svgPoint{{x, y}, {x + width, y}, {x + width, y + height}, {x, y + height}}, true)}, nil
+		}
+		path := fmt.Sprintf("M%g,%g H%g A%g,%g 0 0 1 %g,%g V%g A%g,%g 0 0 1 %g,%g H%g A%g,%g 0 0 1 %g,%g V%g A%g,%g 0 0 1 %g,%g Z",
+			x+rx, y, x+width-rx, rx, ry, x+width, y+ry, y+height-ry, rx, ry, x+width-rx, y+height, x+rx, rx, ry, x, y+height-ry, y+ry, rx, ry, x+rx, y)
+		return parseSVGPath(path)
+	case "circle", "ellipse":
+		cx, cy := number("cx"), number("cy")
+		rx, ry := number("rx"), number("ry")
+		if name == "circle" {
+			rx, ry = number("r"), number("r")
+		}
+		if rx <= 0 || ry <= 0 {
+			return nil, nil
+		}
+		path := fmt.Sprintf("M%g,%g A%g,%g 0 0 1 %g,%g A%g,%g 0 0 1 %g,%g Z", cx+rx, cy, rx, ry, cx-rx, cy, rx, ry, cx+rx, cy)
+		return parseSVGPath(path)
+	case "line":
+		return []svgSubpath{svgPolygon([]svgPoint{{number("x1"), number("y1")}, {number("x2"), number("y2")}}, false)}, nil
+	case "polyline", "polygon":
+		numbers := parseSVGNumbers(attributes["points"])
+		points := make([]svgPoint, 0, len(numbers)/2)
+		for i := 0; i+1 < len(numbers); i += 2 {
+			points = append(points, svgPoint{numbers[i], numbers[i+1]})
+		}
+		if len(points) < 2 {
+			return nil, nil
+		}
+		return []svgSubpath{svgPolygon(points, name == "polygon")}, nil
+	}
+	return nil, nil
+}
+
+func svgPolygon(points []svgPoint, closed bool) svgSubpath {
+	subpath := svgSubpath{from: points[0], closed: closed}
+	for _, p := range points[1:] {
+		subpath.segments = append(subpath.segments, svgSegment{to: p})
+	}
+	return subpath
+}
+
+// svgPathScanner reads numbers and commands of path data
+type svgPathScanner struct {
+	data     string
+	position int
+}
+
+func (s *svgPathScanner) skipSeparators() {
+	for s.position < len(s.data) && strings.IndexByte(" \t\r\n,", s.data[s.position]) != -1 {
+		s.position++
+	}
+}
+
+// hasNumber returns whether a number follows (a command letter doesn't)
+func (s *svgPathScanner) hasNumber() bool {
+	s.skipSeparators()
+	return s.position < len(s.data) && strings.IndexByte("0123456789+-.", s.data[s.position]) != -1
+}
+
+func (s *svgPathScanner) number() (float64, error) {
+	s.skipSeparators()
+	start := s.position
+	if s.position < len(s.data) && (s.data[s.position] == '+' || s.data[s.position] == '-') {
+		s.position++
+	}
+	dot, digits := false, false
+	for s.position < len(s.data) {
+		c := s.data[s.position]
+		if c >= '0' && c <= '9' {
+			digits = true
+		} else if c == '.' && !dot {
+			dot = true
+		} else {
+			break
+		}
+		s.position++
+	}
+	// Exponent, unless the e is followed by something else (not possible in path data but be careful)
+	if digits && s.position < len(s.data) && (s.data[s.position] == 'e' || s.data[s.position] == 'E') {
+		end := s.position + 1
+		if end < len(s.data) && (s.data[end] == '+' || s.data[end] == '-') {
+			end++
+		}
+		if end < len(s.data) && s.data[end] >= '0' && s.data[end] <= '9' {
+			for end < len(s.data) && s.data[end] >= '0' && s.data[end] <= '9' {
+				end++
+			}
+			s.position = end
+		}
+	}
+	if !digits {
+		return 0, fmt.Errorf("svg: expected a number at position %d of path data", start+1)
+	}
+	return strconv.ParseFloat(s.data[start:s.position], 64)
+}
+
+// flag reads an arc flag, flags don't need to be separated from the following number
+func (s *svgPathScanner) flag() (bool, error) {
+	s.skipSeparators()
+	if s.position < len(s.data) && (s.data[s.position] == '0' || s.data[s.position] == '1') {
+		s.position++
+		return s.data[s.position-1] == '1', nil
+	}
+	return false, fmt.Errorf("svg: expected a flag at position %d of path data", s.position+1)
+}
+
+func (s *svgPathScanner) numbers(values ...*float64) error {
+	for _, value := range values {
+		number, err := s.number()
+		if err != nil {
+			return err
+		}
+		*value = number
+	}
+	return nil
+}
+
+// parseSVGPath parses path data (the d attribute), curves and arcs are turned into cubic Bézier curves.
+// Like in browsers, an error ends the path but the part before it is kept.
+func parseSVGPath(data string) ([]svgSubpath, error) {
+	subpaths := make([]svgSubpath, 0)
+	s := &svgPathScanner{data: data}
+	var current, start, lastControl svgPoint
+	var command, previous byte
+
+	add := func(segment svgSegment) {
+		if len(subpaths) == 0 {
+			subpaths = append(subpaths, svgSubpath{from: current})
+		}
+		last := &subpaths[len(subpaths)-1]
+		if last.closed {
+			// Drawing after closepath starts a new subpath at the start of the closed one
+			subpaths = append(subpaths, svgSubpath{from: start})
+			last = &subpaths[len(subpaths)-1]
+		}
+		last.segments = append(last.segments, segment)
+		current = segment.to
+	}
+
+	for {
+		s.skipSeparators()
+		if s.position >= len(data) {
+			break
+		}
+		c := data[s.position]
+		if strings.IndexByte("MmLlHhVvCcSsQqTtAaZz", c) != -1 {
+			command = c
+			s.position++
+		} else if command == 0 || command == 'Z' || command == 'z' || !s.hasNumber() {
+			return subpaths, nil
+		}
+		relative := command >= 'a'
+		origin := svgPoint{}
+		if relative {
+			origin = current
+		}
+
+		var err error
+		switch command {
+		case 'M', 'm':
+			var p svgPoint
+			err = s.numbers(&p.x, &p.y)
+			if err != nil {
+				break
+			}
+			current = svgPoint{origin.x + p.x, origin.y + p.y}
+			start = current
+			subpaths = append(subpaths, svgSubpath{from: current})
+			// Further pairs are lines
+			if command == 'M' {
+				command = 'L'
+			} else {
+				command = 'l'
+			}
+		case 'L', 'l':
+			var p svgPoint
+			err = s.numbers(&p.x, &p.y)
+			if err == nil {
+				add(svgSegment{to: svgPoint{origin.x + p.x, origin.y + p.y}})
+			}
+		case 'H', 'h':
+			var x float64
+			err = s.numbers(&x)
+			if err == nil {
+				add(svgSegment{to: svgPoint{origin.x + x, current.y}})
+			}
+		case 'V', 'v':
+			var y float64
+			err = s.numbers(&y)
+			if err == nil {
+				add(svgSegment{to: svgPoint{current.x, origin.y + y}})
+			}
+		case 'C', 'c', 'S', 's':
+			var c1, c2, p svgPoint
+			if command == 'C' || command == 'c' {
+				err = s.numbers(&c1.x, &c1.y, &c2.x, &c2.y, &p.x, &p.y)
+				c1 = svgPoint{origin.x + c1.x, origin.y + c1.y}
+			} else {
+				err = s.numbers(&c2.x, &c2.y, &p.x, &p.y)
+				// Reflection of the previous control point
+				c1 = current
+				if strings.IndexByte("CcSs", previous) != -1 {
+					c1 = svgPoint{2*current.x - lastControl.x, 2*current.y - lastControl.y}
+				}
+			}
+			if err == nil {
+				c2 = svgPoint{origin.x + c2.x, origin.y + c2.y}
+				add(svgSegment{c1, c2, svgPoint{origin.x + p.x, origin.y + p.y}, true})
+				lastControl = c2
+			}
+		case 'Q', 'q', 'T', 't':
+			var q, p svgPoint
+			if command == 'Q' || command == 'q' {
+				err = s.numbers(&q.x, &q.y, &p.x, &p.y)
+				q = svgPoint{origin.x + q.x, origin.y + q.y}
+			} else {
+				err = s.numbers(&p.x, &p.y)
+				q = current
+				if strings.IndexByte("QqTt", previous) != -1 {
+					q = svgPoint{2*current.x - lastControl.x, 2*current.y - lastControl.y}
+				}
+			}
+			if err == nil {
+				p = svgPoint{origin.x + p.x, origin.y + p.y}
+				// Quadratic curves are cubic curves with control points 2/3 of the way to the quadratic one
+				c1 := svgPoint{current.x + 2.0/3*(q.x-current.x), current.y + 2.0/3*(q.y-current.y)}
+				c2 := svgPoint{p.x + 2.0/3*(q.x-p.x), p.y + 2.0/3*(q.y-p.y)}
+				add(svgSegment{c1, c2, p, true})
+				lastControl = q
+			}
+		case 'A', 'a':
+			var rx, ry, rotation float64
+			var large, sweep bool
+			var p svgPoint
+			err = s.numbers(&rx, &ry, &rotation)
+			if err == nil {
+				large, err = s.flag()
+			}
+			if err == nil {
+				sweep, err = s.flag()
+			}
+			if err == nil {
+				err = s.numbers(&p.x, &p.y)
+			}
+			if err == nil {
+				for _, segment := range arcSegments(current, svgPoint{origin.x + p.x, origin.y + p.y}, rx, ry, rotation, large, sweep) {
+					add(segment)
+				}
+			}
+		case 'Z', 'z':
+			if len(subpaths) > 0 {
+				subpaths[len(subpaths)-1].closed = true
+			}
+			current = start
+		}
+		if err != nil {
+			return subpaths, nil
+		}
+		previous = command
+	}
+	return subpaths, nil
+}
+
+// arcSegments approximates an elliptical arc with cubic Bézier curves of at most 90 degrees,
+// following the endpoint to centre conversion from the SVG specification
+func arcSegments(from, to svgPoint, rx, ry, rotation float64, large, sweep bool) []svgSegment {
+	rx, ry = math.Abs(rx), math.Abs(ry)
+	if from == to {
+		return nil
+	}
+	if rx == 0 || ry == 0 {
+		return []svgSegment{{to: to}}
+	}
+
+	phi := rotation * math.Pi / 180
+	cos, sin := math.Cos(phi), math.Sin(phi)
+	dx, dy := (from.x-to.x)/2, (from.y-to.y)/2
+	x1 := cos*dx + sin*dy
+	y1 := -sin*dx + cos*dy
+
+	// Scale up radii which are too small
+	lambda := x1*x1/(rx*rx) + y1*y1/(ry*ry)
+	if lambda > 1 {
+		rx *= math.Sqrt(lambda)
+		ry *= math.Sqrt(lambda)
+	}
+
+	numerator := rx*rx*ry*ry - rx*rx*y1*y1 - ry*ry*x1*x1
+	denominator := rx*rx*y1*y1 + ry*ry*x1*x1
+	coefficient := math.Sqrt(math.Max(numerator, 0) / denominator)
+	if large == sweep {
+		coefficient = -coefficient
+	}
+	cx1 := coefficient * rx * y1 / ry
+	cy1 := -coefficient * ry * x1 / rx
+	cx := cos*cx1 - sin*cy1 + (from.x+to.x)/2
+	cy := sin*cx1 + cos*cy1 + (from.y+to.y)/2
+
+	angle := func(ux, uy, vx, vy float64) float64 {
+		return math.Atan2(ux*vy-uy*vx, ux*vx+uy*vy)
+	}
+	start := angle(1, 0, (x1-cx1)/rx, (y1-cy1)/ry)
+	delta := angle((x1-cx1)/rx, (y1-cy1)/ry, (-x1-cx1)/rx, (-y1-cy1)/ry)
+	if !sweep && delta > 0 {
+		delta -= 2 * math.Pi
+	} else if sweep && delta < 0 {
+		delta += 2 * math.Pi
+	}
+
+	// Point on the ellipse and its derivative at an angle
+	point := func(theta float64) (svgPoint, svgPoint) {
+		x, y := rx*math.Cos(theta), ry*math.Sin(theta)
+		tx, ty := -rx*math.Sin(theta), ry*math.Cos(theta)
+		return svgPoint{cos*x - sin*y + cx, sin*x + cos*y + cy}, svgPoint{cos*tx - sin*ty, sin*tx + cos*ty}
+	}
+
+	count := int(math.Ceil(math.Abs(delta) / (math.Pi / 2)))
+	step := delta / float64(count)
+	k := 4.0 / 3 * math.Tan(step/4)
+	segments := make([]svgSegment, 0, count)
+	p0, d0 := point(start)
+	for i := 1; i <= count; i++ {
+		p1, d1 := point(start + step*float64(i))
+		if i == count {
+			p1 = to
+		}
+		segments = append(segments, svgSegment{
+			svgPoint{p0.x + k*d0.x, p0.y + k*d0.y},
+			svgPoint{p1.x - k*d1.x, p1.y - k*d1.y},
+			p1,
+			true,
+		})
+		p0, d0 = p1, d1
+	}
+	return segments
+}
+
+// parseSVGTransform parses a list of transformations like "translate(10,20) rotate(45)"
+func parseSVGTransform(str string) svgMatrix {
+	m := svgIdentity
+	for _, part := range strings.Split(str, ")") {
+		i := strings.Index(part, "(")
+		if i == -1 {
+			continue
+		}
+		name := strings.TrimSpace(strings.Trim(part[:i], " ,\t\r\n"))
+		values := parseSVGNumbers(part[i+1:])
+		value := func(index int, fallback float64) float64 {
+			if index < len(values) {
+				return values[index]
+			}
+			return fallback
+		}
+
+		var t svgMatrix
+		switch name {
+		case "matrix":
+			if len(values) != 6 {
+				continue
+			}
+			copy(t[:], values)
+		case "translate":
+			t = svgMatrix{1, 0, 0, 1, value(0, 0), value(1, 0)}
+		case "scale":
+			t = svgMatrix{value(0, 1), 0, 0, value(1, value(0, 1)), 0, 0}
+		case "rotate":
+			angle := value(0, 0) * math.Pi / 180
+			cx, cy := value(1, 0), value(2, 0)
+			rotation := svgMatrix{math.Cos(angle), math.Sin(angle), -math.Sin(angle), math.Cos(angle), 0, 0}
+			t = svgMatrix{1, 0, 0, 1, cx, cy}.multiply(rotation).multiply(svgMatrix{1, 0, 0, 1, -cx, -cy})
+		case "skewX":
+			t = svgMatrix{1, 0, math.Tan(value(0, 0) * math.Pi / 180), 1, 0, 0}
+		case "skewY":
+			t = svgMatrix{1, math.Tan(value(0, 0) * math.Pi / 180), 0, 1, 0, 0}
+		default:
+			continue
+		}
+		m = m.multiply(t)
+	}
+	return m
+}
+
+// parseSVGNumbers parses a list of numbers separated by whitespace and/or commas
+func parseSVGNumbers(str string) []float64 {
+	numbers := make([]float64, 0)
+	s := &svgPathScanner{data: str}
+	for s.hasNumber() {
+		number, err := s.number()
+		if err != nil {
+			break
+		}
+		numbers = append(numbers, number)
+	}
+	return numbers
+}
+
+// parseSVGLength parses a length in pixels or absolute units, percentages and relative units aren't supported
+func parseSVGLength(str string) (float64, bool) {
+	str = strings.TrimSpace(str)
+	factor := 1.0
+	for unit, unitFactor := range svgUnits {
+		if strings.HasSuffix(str, unit) {
+			str, factor = strings.TrimSuffix(str, unit), unitFactor
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, false
+	}
+	return value * factor, true
+}
+
+func parseSVGOpacity(str string) (float64, bool) {
+	value, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil || math.IsNaN(value) {
+		return 0, false
+	}
+	return math.Min(math.Max(value, 0), 1), true
+}
+
+// parseSVGColor parses a paint which is a colour (#rgb, #rrggbb, rgb(r, g, b), a name or currentColor),
+// none and unsupported paints like gradients aren't drawn
+func parseSVGColor(str, currentColor string) (color.NRGBA, bool) {
+	str = strings.ToLower(strings.TrimSpace(str))
+	if str == "currentcolor" {
+		str = strings.ToLower(strings.TrimSpace(currentColor))
+	}
+	if c, ok := svgColorNames[str]; ok {
+		return c, true
+	}
+	if strings.HasPrefix(str, "#") {
+		hex := str[1:]
+		if len(hex) == 3 {
+			hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+		}
+		value, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil || len(hex) != 6 {
+			return color.NRGBA{}, false
+		}
+		return color.NRGBA{uint8(value >> 16), uint8(value >> 8), uint8(value), 255}, true
+	}
+	if strings.HasPrefix(str, "rgb(") && strings.HasSuffix(str, ")") {
+		parts := strings.Split(str[4:len(str)-1], ",")
+		if len(parts) != 3 {
+			return color.NRGBA{}, false
+		}
+		channels := make([]uint8, 3)
+		for i, part := range parts {
+			part = strings.TrimSpace(part)
+			max := 255.0
+			if strings.HasSuffix(part, "%") {
+				part, max = strings.TrimSuffix(part, "%"), 100
+			}
+			value, err := strconv.ParseFloat(part, 64)
+			if err != nil {
+				return color.NRGBA{}, false
+			}
+			channels[i] = uint8(math.Min(math.Max(value/max, 0), 1)*255 + 0.5)
+		}
+		return color.NRGBA{channels[0], channels[1], channels[2], 255}, true
+	}
+	return color.NRGBA{}, false
+}
+
+// renderSize returns the size to rasterise a vector image at for a transformation, big enough
+// for the transformation not to scale the result up but with at most the max. pixels of uploads
+func (v *VectorImage) renderSize(parameters *Params) (int, int) {
+	factor := parameters.scale
+	if parameters.cropping != CroppingModeKeepScale {
+		widthFactor := float64(scaleInt(parameters.width, parameters.scale)) / v.width
+		heightFactor := float64(scaleInt(parameters.height, parameters.scale)) / v.height
+		switch {
+		case parameters.width == 0:
+			factor = heightFactor
+		case parameters.height == 0:
+			factor = widthFactor
+		case parameters.cropping == CroppingModeAll || parameters.cropping == CroppingModePad:
+			// The whole image fits in the frame
+			factor = math.Min(widthFactor, heightFactor)
+		default:
+			// The image fills the frame
+			factor = math.Max(widthFactor, heightFactor)
+		}
+	}
+
+	pixels := v.width * factor * v.height * factor
+	if Config.uploadMaxPixels > 0 && pixels > float64(Config.uploadMaxPixels) {
+		factor *= math.Sqrt(float64(Config.uploadMaxPixels) / pixels)
+	}
+	width := int(v.width*factor + 0.5)
+	height := int(v.height*factor + 0.5)
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	return width, height
+}
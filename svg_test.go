@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func decodeTestSVG(t *testing.T, data string) *VectorImage {
+	v, err := decodeSVG(bytes.NewReader([]byte(data)))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return v
+}
+
+// Colour of a pixel as color.RGBA
+func pixelAt(img image.Image, x, y int) color.RGBA {
+	return color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+}
+
+func TestDecodeSVGSize(t *testing.T) {
+	cases := map[string]image.Point{
+		`<svg xmlns="http://www.w3.org/2000/svg" width="40" height="20"></svg>`: {40, 20},
+		`<svg width="40px" height="1in"></svg>`:                                 {40, 96},
+		`<svg viewBox="0 0 400 100"></svg>`:                                     {400, 100},
+		`<svg width="200" viewBox="0 0 400 100"></svg>`:                         {200, 50},
+		`<svg></svg>`: {300, 150},
+		`<?xml version="1.0"?><!-- logo --><svg height="10" viewBox="0,0,4,2"></svg>`: {20, 10},
+	}
+	for data, exp := range cases {
+		config, format, err := image.DecodeConfig(bytes.NewReader([]byte(data)))
+		if err != nil {
+			t.Errorf("%s failed: %s", data, err)
+			continue
+		}
+		if act := (image.Point{config.Width, config.Height}); act != exp || format != "svg" {
+			t.Errorf("%s failed, expected: %v, actual: %v %s", data, exp, act, format)
+		}
+	}
+
+	tooManyShapes := `<svg>` + strings.Repeat(`<rect width="1" height="1"/>`, svgMaxShapes+1) + `</svg>`
+	for _, data := range []string{`<html></html>`, `<svg width="0" height="10"></svg>`, `<svg`, ``, tooManyShapes} {
+		_, err := decodeSVG(bytes.NewReader([]byte(data)))
+		if err == nil {
+			t.Errorf("Expected an error for %q", data)
+		}
+	}
+}
+
+func TestRasteriseSVG(t *testing.T) {
+	v := decodeTestSVG(t, `<svg xmlns="http://www.w3.org/2000/svg" width="20" height="20" viewBox="0 0 10 10">
+		<defs><rect id="hidden" width="10" height="10" fill="black"/></defs>
+		<rect x="0" y="0" width="5" height="5" fill="#f00"/>
+		<g transform="translate(5,0)" style="fill: rgb(0, 0, 255)">
+			<circle cx="2.5" cy="2.5" r="2"/>
+		</g>
+		<path d="M0,7.5 h10" stroke="lime" stroke-width="1" fill="none"/>
+		<rect x="5" y="5" width="5" height="5" fill="red" display="none"/>
+		<rect x="0" y="9" width="10" height="1" fill="white" opacity="0.5"/>
+	</svg>`)
+
+	img := v.rasterise(20, 20)
+	cases := []struct {
+		x, y int
+		exp  color.RGBA
+	}{
+		{2, 2, color.RGBA{255, 0, 0, 255}},
+		{15, 5, color.RGBA{0, 0, 255, 255}},
+		{10, 0, color.RGBA{}},
+		{10, 15, color.RGBA{0, 255, 0, 255}},
+		{15, 12, color.RGBA{}},
+		{5, 19, color.RGBA{128, 128, 128, 128}},
+	}
+	for _, c := range cases {
+		if act := pixelAt(img, c.x, c.y); act != c.exp {
+			t.Errorf("Pixel at %d,%d failed, expected: %v, actual: %v", c.x, c.y, c.exp, act)
+		}
+	}
+
+	// Shapes partly outside of the image are drawn within it
+	partly := decodeTestSVG(t, `<svg width="10" height="10">
+		<rect x="-5" y="-5" width="10" height="10" fill="red"/>
+		<path d="M8,-20 V30" stroke="blue" stroke-width="2"/>
+		<rect x="20" y="20" width="5" height="5" fill="red"/>
+	</svg>`)
+	clipped := partly.rasterise(10, 10)
+	for _, c := range []struct {
+		x, y int
+		exp  color.RGBA
+	}{{0, 0, color.RGBA{255, 0, 0, 255}}, {4, 4, color.RGBA{255, 0, 0, 255}}, {5, 5, color.RGBA{}}, {8, 9, color.RGBA{0, 0, 255, 255}}, {9, 5, color.RGBA{}}} {
+		if act := pixelAt(clipped, c.x, c.y); act != c.exp {
+			t.Errorf("Clipped pixel at %d,%d failed, expected: %v, actual: %v", c.x, c.y, c.exp, act)
+		}
+	}
+
+	// Used as an image it's rasterised at its intrinsic size
+	if v.Bounds() != image.Rect(0, 0, 20, 20) || pixelAt(v, 2, 2) != (color.RGBA{255, 0, 0, 255}) {
+		t.Errorf("Expected the intrinsic size, actual: %v %v", v.Bounds(), pixelAt(v, 2, 2))
+	}
+}
+
+func TestParseSVGPath(t *testing.T) {
+	subpaths, err := parseSVGPath("M1,2L3-4.5.5.5h2v-1Z m1 1 l1 1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(subpaths) != 2 || !subpaths[0].closed || subpaths[1].closed {
+		t.Fatalf("Expected a closed and an open subpath, actual: %v", subpaths)
+	}
+	exp := []svgPoint{{3, -4.5}, {0.5, 0.5}, {2.5, 0.5}, {2.5, -0.5}}
+	for i, segment := range subpaths[0].segments {
+		if segment.to != exp[i] {
+			t.Errorf("Segment %d failed, expected: %v, actual: %v", i, exp[i], segment.to)
+		}
+	}
+	// Relative moves after closepath start at the start of the closed subpath
+	if subpaths[1].from != (svgPoint{2, 3}) || subpaths[1].segments[0].to != (svgPoint{3, 4}) {
+		t.Errorf("Expected the second subpath from 2,3 to 3,4, actual: %v", subpaths[1])
+	}
+
+	// Arc flags don't need separators
+	subpaths, _ = parseSVGPath("M0 0a1 1 0 00 2 0")
+	last := subpaths[0].segments[len(subpaths[0].segments)-1]
+	if len(subpaths[0].segments) != 2 || last.to != (svgPoint{2, 0}) {
+		t.Errorf("Expected a half circle in 2 curves, actual: %v", subpaths[0].segments)
+	}
+
+	// Invalid data ends the path
+	subpaths, _ = parseSVGPath("M0 0 L1 1 L2 x")
+	if len(subpaths) != 1 || len(subpaths[0].segments) != 1 {
+		t.Errorf("Expected the valid part of the path, actual: %v", subpaths)
+	}
+}
+
+func TestParseSVGTransform(t *testing.T) {
+	m := parseSVGTransform("translate(10, 20) scale(2) rotate(90)")
+	if act := m.apply(svgPoint{1, 0}); !reflect.DeepEqual(roundPoint(act), svgPoint{10, 22}) {
+		t.Errorf("Expected 10,22, actual: %v", act)
+	}
+	m = parseSVGTransform("rotate(180 5 5)")
+	if act := m.apply(svgPoint{0, 0}); !reflect.DeepEqual(roundPoint(act), svgPoint{10, 10}) {
+		t.Errorf("Expected 10,10, actual: %v", act)
+	}
+}
+
+func roundPoint(p svgPoint) svgPoint {
+	return svgPoint{float64(int(p.x*1000+0.5)) / 1000, float64(int(p.y*1000+0.5)) / 1000}
+}
+
+func TestTransformSVG(t *testing.T) {
+	v := decodeTestSVG(t, `<svg width="10" height="10"><circle cx="5" cy="5" r="5" fill="red"/></svg>`)
+
+	params, _ := parseParameters("w_200,upscale_false")
+	imgNew, err := transformImage(v, &Transformation{params: &params, metadata: MetadataStrip})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if imgNew.Bounds().Dx() != 200 || imgNew.Bounds().Dy() != 200 {
+		t.Errorf("Expected vectors to be drawn at the requested size, actual: %v", imgNew.Bounds())
+	}
+	// A scaled up bitmap would have a blurry edge, a drawn circle has a sharp one
+	if act := pixelAt(imgNew, 100, 2); act != (color.RGBA{255, 0, 0, 255}) {
+		t.Errorf("Expected a sharp edge, actual: %v", act)
+	}
+	if act := pixelAt(imgNew, 2, 2); act.A != 0 {
+		t.Errorf("Expected a transparent corner, actual: %v", act)
+	}
+
+	cases := map[string]image.Point{
+		"w_50":            {50, 50},
+		"w_50,h_20,c_p":   {50, 50},
+		"w_50,h_20,c_a":   {20, 20},
+		"w_50,h_20,dpr_2": {100, 100},
+		"h_20,c_k,dpr_3":  {30, 30},
+	}
+	for str, exp := range cases {
+		params, _ := parseParameters(str)
+		width, height := v.renderSize(&params)
+		if act := (image.Point{width, height}); act != exp {
+			t.Errorf("%s failed, expected: %v, actual: %v", str, exp, act)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"image"
+	"io"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// Variables describing the image start with this prefix (e.g. image_width), they can't be set in URLs
+	imageVariablePrefix = "image_"
+	// Query parameter with the signature of template variables
+	variablesSignatureParameter = "signature"
+	// Added to the signed variables so that they can't be used with other images or transformations
+	variablesPathKey = "path"
+
+	// MaxTemplateVariables is the max. number of variables in a URL
+	MaxTemplateVariables = 20
+	// MaxTemplateVariableLength is the max. number of characters of a variable value
+	MaxTemplateVariableLength = 200
+	// MaxTemplatedTextLength is the max. number of characters of a text with variables filled in, longer texts are cut
+	MaxTemplatedTextLength = 500
+)
+
+var (
+	templateVariableNameRe = regexp.MustCompile("^[a-z][0-9a-z_]*$")
+)
+
+// Parses the content of a text as a template if it contains actions (e.g. {{.name}}), returns nil otherwise.
+// Missing variables are empty.
+func parseTextTemplate(content string) (*template.Template, error) {
+	if !strings.Contains(content, "{{") {
+		return nil, nil
+	}
+	return template.New("text").Option("missingkey=zero").Parse(content)
+}
+
+func (t *Transformation) isTemplated() bool {
+	for _, text := range t.texts {
+		if text.template != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// readVariables reads variables of templated texts from query parameters (e.g. ?name=Jane&signature=...),
+// values can't contain control characters such as line breaks. Returns nil if there are no variables.
+func readVariables(query url.Values) (map[string]string, error) {
+	var variables map[string]string
+	for name, values := range query {
+		if name == variablesSignatureParameter {
+			continue
+		}
+		if !templateVariableNameRe.MatchString(name) || name == variablesPathKey || strings.HasPrefix(name, imageVariablePrefix) {
+			return nil, fmt.Errorf("invalid variable name: %s", name)
+		}
+		if len(values) != 1 {
+			return nil, fmt.Errorf("variable %s can only have one value", name)
+		}
+		value := strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return -1
+			}
+			return r
+		}, values[0])
+		if utf8.RuneCountInString(value) > MaxTemplateVariableLength {
+			return nil, fmt.Errorf("variable %s can have at most %d characters", name, MaxTemplateVariableLength)
+		}
+
+		if variables == nil {
+			variables = make(map[string]string)
+		}
+		variables[name] = value
+	}
+	if len(variables) > MaxTemplateVariables {
+		return nil, fmt.Errorf("at most %d variables allowed", MaxTemplateVariables)
+	}
+	return variables, nil
+}
+
+// checkVariablesSignature checks that variables in query parameters are signed using the secret for an API key,
+// the path of the request (e.g. t_card/cat.jpg) is signed along with them. Values are signed escaped.
+func checkVariablesSignature(key, path string, query url.Values) error {
+	signed := make(map[string]string)
+	for name, values := range query {
+		if name != variablesSignatureParameter && len(values) != 0 {
+			signed[name] = url.QueryEscape(values[0])
+		}
+	}
+	signed[variablesPathKey] = path
+
+	secret, err := getSecretForKey(key)
+	if err != nil {
+		return fmt.Errorf("authorization error")
+	}
+	if !isValidSignature(query.Get(variablesSignatureParameter), secret, signed) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+func hashVariables(variables map[string]string) []byte {
+	names := make([]string, 0, len(variables))
+	for name := range variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha1.New()
+	for _, name := range names {
+		io.WriteString(h, name+"="+url.QueryEscape(variables[name])+"&")
+	}
+	return h.Sum(nil)
+}
+
+// Variables describing an image: its size and Exif fields (image_width, image_height, image_artist,
+// image_copyright and image_description)
+func imageVariables(img image.Image, metadata *Metadata) map[string]string {
+	bounds := img.Bounds()
+	variables := map[string]string{
+		imageVariablePrefix + "width":  strconv.Itoa(bounds.Dx()),
+		imageVariablePrefix + "height": strconv.Itoa(bounds.Dy()),
+	}
+	if metadata == nil {
+		return variables
+	}
+
+	fields := map[uint16]string{exifTagArtist: "artist", exifTagCopyright: "copyright", exifTagDescription: "description"}
+	for tag, name := range fields {
+		if value := exifString(metadata.exif, tag); value != "" {
+			variables[imageVariablePrefix+name] = value
+		}
+	}
+	return variables
+}
+
+// Returns copies of texts with variables filled in
+func renderTexts(texts []*Text, variables map[string]string, img image.Image, metadata *Metadata) ([]*Text, error) {
+	// Variables describing the image can't be overwritten
+	values := make(map[string]string)
+	for name, value := range variables {
+		values[name] = value
+	}
+	for name, value := range imageVariables(img, metadata) {
+		values[name] = value
+	}
+
+	rendered := make([]*Text, len(texts))
+	for i, text := range texts {
+		rendered[i] = text
+		if text.template == nil {
+			continue
+		}
+		var buffer bytes.Buffer
+		err := text.template.Execute(&buffer, values)
+		if err != nil {
+			return nil, fmt.Errorf("rendering text failed: %s", err)
+		}
+		content := []rune(buffer.String())
+		if len(content) > MaxTemplatedTextLength {
+			content = content[:MaxTemplatedTextLength]
+		}
+		renderedText := *text
+		renderedText.content = string(content)
+		renderedText.template = nil
+		rendered[i] = &renderedText
+	}
+	return rendered, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func createTemplatedText(t *testing.T, content string) *Text {
+	text := createTestText(t, content, 20, defaultTextStyle)
+	var err error
+	text.template, err = parseTextTemplate(content)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return text
+}
+
+func TestParseTextTemplate(t *testing.T) {
+	if tmpl, err := parseTextTemplate("Static text"); tmpl != nil || err != nil {
+		t.Errorf("Expected no template for static text, actual: %v %v", tmpl, err)
+	}
+	if tmpl, err := parseTextTemplate("{{.name}} – {{.date}}"); tmpl == nil || err != nil {
+		t.Errorf("Expected a template, actual: %v %v", tmpl, err)
+	}
+	if _, err := parseTextTemplate("{{.name"); err == nil {
+		t.Errorf("Expected an error for invalid syntax")
+	}
+}
+
+func TestReadVariables(t *testing.T) {
+	query, _ := url.ParseQuery("name=Jane+Doe&date=1%2F2&signature=abc")
+	variables, err := readVariables(query)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(variables) != 2 || variables["name"] != "Jane Doe" || variables["date"] != "1/2" {
+		t.Errorf("Expected 2 variables without the signature, actual: %v", variables)
+	}
+
+	// Line breaks and other control characters are removed
+	variables, _ = readVariables(url.Values{"name": {"Jane\n\x00Doe"}})
+	if variables["name"] != "JaneDoe" {
+		t.Errorf("Expected control characters to be removed, actual: %q", variables["name"])
+	}
+
+	if variables, _ := readVariables(url.Values{"signature": {"abc"}}); variables != nil {
+		t.Errorf("Expected no variables, actual: %v", variables)
+	}
+
+	tooMany := url.Values{}
+	for i := 0; i <= MaxTemplateVariables; i++ {
+		tooMany.Set("v"+strings.Repeat("a", i), "x")
+	}
+	cases := []url.Values{
+		{"Name": {"x"}},
+		{"first-name": {"x"}},
+		{"path": {"x"}},
+		{"image_width": {"1"}},
+		{"name": {"a", "b"}},
+		{"name": {strings.Repeat("é", MaxTemplateVariableLength+1)}},
+		tooMany,
+	}
+	for _, c := range cases {
+		if _, err := readVariables(c); err == nil {
+			t.Errorf("Expected an error for %v", c)
+		}
+	}
+}
+
+func TestRenderTexts(t *testing.T) {
+	static := createTemplatedText(t, "Static")
+	templated := createTemplatedText(t, "{{.name}} by {{.image_artist}} ({{.image_width}}x{{.image_height}}){{.missing}}")
+	texts := []*Text{static, templated}
+
+	img := createGradientImage(30, 20)
+	rendered, err := renderTexts(texts, map[string]string{"name": "<Cat>"}, img, createTestMetadata())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// Texts aren't HTML so nothing is escaped
+	if exp := "<Cat> by Jane (30x20)"; rendered[1].content != exp || rendered[1].template != nil {
+		t.Errorf("Expected %q, actual: %q", exp, rendered[1].content)
+	}
+	if rendered[0] != static || templated.template == nil {
+		t.Errorf("Expected the original texts to stay the same")
+	}
+
+	// Image variables can't be overwritten and there is no artist without metadata
+	rendered, _ = renderTexts(texts, map[string]string{"image_width": "1"}, img, nil)
+	if exp := " by  (30x20)"; rendered[1].content != exp {
+		t.Errorf("Expected %q, actual: %q", exp, rendered[1].content)
+	}
+
+	long := createTemplatedText(t, "{{.a}}{{.a}}{{.a}}")
+	rendered, _ = renderTexts([]*Text{long}, map[string]string{"a": strings.Repeat("ü", MaxTemplateVariableLength)}, img, nil)
+	if act := len([]rune(rendered[0].content)); act != MaxTemplatedTextLength {
+		t.Errorf("Expected the text to be cut to %d characters, actual: %d", MaxTemplatedTextLength, act)
+	}
+}
+
+func TestTemplatedFilePath(t *testing.T) {
+	params, _ := parseParameters("w_400")
+	texts := []*Text{createTemplatedText(t, "Hi {{.name}}")}
+
+	paths := make(map[string]bool)
+	for _, variables := range []map[string]string{nil, {"name": "Jane"}, {"name": "John"}, {"name": "Jane", "date": "1/2"}} {
+		path, _ := (&Transformation{params: &params, texts: texts, metadata: MetadataStrip, variables: variables}).createFilePath("cat.jpg")
+		if paths[path] {
+			t.Errorf("Expected a unique path for %v, actual: %s", variables, path)
+		}
+		paths[path] = true
+	}
+
+	a, _ := (&Transformation{params: &params, texts: texts, metadata: MetadataStrip, variables: map[string]string{"a": "1", "b": "2"}}).createFilePath("cat.jpg")
+	b, _ := (&Transformation{params: &params, texts: texts, metadata: MetadataStrip, variables: map[string]string{"b": "2", "a": "1"}}).createFilePath("cat.jpg")
+	if a != b {
+		t.Errorf("Expected the same path for the same variables, actual: %s %s", a, b)
+	}
+}
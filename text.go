@@ -0,0 +1,262 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"math"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	AlignLeft   = "left"
+	AlignCenter = "center"
+	AlignRight  = "right"
+
+	DefaultAlign             = AlignLeft
+	DefaultLineSpacing       = 1.0
+	DefaultBackgroundOpacity = 100
+
+	// MaxStrokeWidth is the widest outline of a text in pixels (before scaling)
+	MaxStrokeWidth = 20
+	// Widest outline in pixels after scaling, outlines of texts at a scale above 3 are thinner
+	maxScaledStrokeWidth = 3 * MaxStrokeWidth
+	// Font size (in points) a text can be shrunk to at most
+	minShrunkTextSize = 4
+)
+
+var (
+	defaultTextStyle = TextStyle{align: DefaultAlign, lineSpacing: DefaultLineSpacing, backgroundOpacity: DefaultBackgroundOpacity}
+)
+
+func isValidAlign(align string) bool {
+	return align == AlignLeft || align == AlignCenter || align == AlignRight
+}
+
+// textLayout is a text broken into lines at a font size
+type textLayout struct {
+	lines  []string
+	widths []float64
+	// Width of the longest line and height of all lines
+	width, height      float64
+	ascent, lineHeight float64
+}
+
+// Breaks the text into lines (at line breaks and between words if lines are longer than max. width)
+func (t *Text) layout(fonts *textFonts, maxWidth float64) textLayout {
+	metrics := fonts.metrics()
+	layout := textLayout{lines: make([]string, 0), widths: make([]float64, 0), ascent: metrics.ascent,
+		lineHeight: metrics.height * t.style.lineSpacing}
+	addLine := func(line string, width float64) {
+		layout.lines = append(layout.lines, line)
+		layout.widths = append(layout.widths, width)
+		layout.width = math.Max(layout.width, width)
+	}
+
+	for _, paragraph := range strings.Split(t.content, "\n") {
+		if maxWidth <= 0 {
+			addLine(paragraph, fonts.width(paragraph))
+			continue
+		}
+		// Words longer than max. width get a line of their own
+		line, lineWidth := "", 0.0
+		for _, word := range strings.Fields(paragraph) {
+			candidate := word
+			if line != "" {
+				candidate = line + " " + word
+			}
+			width := fonts.width(candidate)
+			if line != "" && width > maxWidth {
+				addLine(line, lineWidth)
+				candidate, width = word, fonts.width(word)
+			}
+			line, lineWidth = candidate, width
+		}
+		addLine(line, lineWidth)
+	}
+	layout.height = metrics.height + float64(len(layout.lines)-1)*layout.lineHeight
+	return layout
+}
+
+// drawTexts draws text overlays on an image
+func drawTexts(img image.Image, texts []*Text, scale float64) image.Image {
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(bounds)
+	draw.Draw(rgba, bounds, img, bounds.Min, draw.Src)
+	for _, text := range texts {
+		drawText(rgba, text, scale)
+	}
+	return rgba
+}
+
+// Draws a text in a box (made of padding and the stroke around the lines) positioned using gravity
+func drawText(dst *image.RGBA, t *Text, scale float64) {
+	style := t.style
+	bounds := dst.Bounds()
+	x, y := scaleInt(t.x, scale), scaleInt(t.y, scale)
+	stroke := scaleInt(style.strokeWidth, scale)
+	if stroke > maxScaledStrokeWidth {
+		stroke = maxScaledStrokeWidth
+	}
+	margin := scaleInt(style.padding, scale) + stroke
+
+	// Scaled images use a higher DPI, sizes stay in points
+	dpi := 72 * scale
+	size := float64(t.size)
+	fonts, err := newTextFonts(t.fonts, size, dpi)
+	if err != nil {
+		log.Println("Error: could not draw a text", err)
+		return
+	}
+	maxWidth := float64(scaleInt(style.maxWidth, scale))
+	layout := t.layout(fonts, maxWidth)
+	if style.shrink {
+		availableWidth := float64(bounds.Dx() - 2*margin - x)
+		if maxWidth > 0 && maxWidth < availableWidth {
+			availableWidth = maxWidth
+		}
+		availableHeight := float64(bounds.Dy() - 2*margin - y)
+		for size > minShrunkTextSize && (layout.width > availableWidth || layout.height > availableHeight) {
+			size = math.Max(size-1, minShrunkTextSize)
+			fonts, err = newTextFonts(t.fonts, size, dpi)
+			if err != nil {
+				log.Println("Error: could not draw a text", err)
+				return
+			}
+			layout = t.layout(fonts, maxWidth)
+		}
+	}
+
+	width, height := int(layout.width), int(layout.height)
+	boxSize := image.Pt(width+2*margin, height+2*margin)
+	pt := calculateTopLeftPointFromGravity(t.gravity, boxSize.X, boxSize.Y, bounds.Dx(), bounds.Dy())
+	pt = pt.Add(getTranslation(t.gravity, x, y)).Add(bounds.Min)
+	box := image.Rectangle{pt, pt.Add(boxSize)}
+
+	// The letters are drawn as a mask first so that the stroke and shadow can be made from it
+	mask := image.NewAlpha(box)
+	for i, line := range layout.lines {
+		lineX := box.Min.X + margin
+		switch style.align {
+		case AlignCenter:
+			lineX += int((layout.width - layout.widths[i]) / 2)
+		case AlignRight:
+			lineX += int(layout.width - layout.widths[i])
+		}
+		baseline := box.Min.Y + margin + int(layout.ascent+float64(i)*layout.lineHeight)
+		fonts.walk(line, func(offset fixed.Int26_6, face font.Face, r rune) {
+			dot := fixed.Point26_6{X: fixed.I(lineX) + offset, Y: fixed.I(baseline)}
+			dr, glyph, glyphPoint, _, ok := face.Glyph(dot, r)
+			if ok {
+				draw.DrawMask(mask, dr, image.Opaque, image.ZP, glyph, glyphPoint, draw.Over)
+			}
+		})
+	}
+
+	shape := mask
+	if stroke > 0 && style.strokeColor != nil {
+		shape = dilateMask(mask, stroke)
+	}
+	if style.background != nil {
+		opacity := image.NewUniform(color.Alpha{uint8(style.backgroundOpacity * 255 / 100)})
+		draw.DrawMask(dst, box, image.NewUniform(style.background), image.ZP, opacity, image.ZP, draw.Over)
+	}
+	if style.shadowColor != nil {
+		offset := image.Pt(scaleInt(style.shadowX, scale), scaleInt(style.shadowY, scale))
+		draw.DrawMask(dst, box.Add(offset), image.NewUniform(style.shadowColor), image.ZP, shape, box.Min, draw.Over)
+	}
+	if shape != mask {
+		draw.DrawMask(dst, box, image.NewUniform(style.strokeColor), image.ZP, shape, box.Min, draw.Over)
+	}
+	draw.DrawMask(dst, box, image.NewUniform(t.color), image.ZP, mask, box.Min, draw.Over)
+}
+
+// Grows a mask by a radius, each pixel gets the max. value of the pixels in a circle around it. Each row
+// of the mask is spread sideways by the reach of the circle at each distance and added to the row at that
+// distance, so the time grows with the radius rather than with the area of the circle.
+func dilateMask(mask *image.Alpha, radius int) *image.Alpha {
+	bounds := mask.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	dilated := image.NewAlpha(bounds)
+	// Horizontal reach of the circle on each row
+	reach := make([]int, radius+1)
+	for dy := range reach {
+		reach[dy] = int(math.Sqrt(float64(radius*radius - dy*dy)))
+	}
+
+	// Rows are padded with the radius on both sides so that all windows of the sliding max are whole
+	padded := make([]uint8, width+2*radius)
+	prefix := make([]uint8, len(padded))
+	suffix := make([]uint8, len(padded))
+	spread := make([]uint8, width)
+	for y := 0; y < height; y++ {
+		offset := mask.PixOffset(bounds.Min.X, bounds.Min.Y+y)
+		row := mask.Pix[offset : offset+width]
+		if isEmptyRow(row) {
+			continue
+		}
+		copy(padded[radius:], row)
+		for dy := -radius; dy <= radius; dy++ {
+			if y+dy < 0 || y+dy >= height {
+				continue
+			}
+			r := reach[int(math.Abs(float64(dy)))]
+			slidingMax(spread, padded[radius-r:radius+width+r], 2*r+1, prefix, suffix)
+			offset := dilated.PixOffset(bounds.Min.X, bounds.Min.Y+y+dy)
+			target := dilated.Pix[offset : offset+width]
+			for x, a := range spread {
+				if a > target[x] {
+					target[x] = a
+				}
+			}
+		}
+	}
+	return dilated
+}
+
+func isEmptyRow(row []uint8) bool {
+	for _, a := range row {
+		if a != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// slidingMax sets each value of dst to the max. of a window of values of src starting at the same index,
+// src is longer than dst by the window size - 1. The max. values from the start and to the end of blocks
+// of the window size (van Herk/Gil-Werman) take 3 comparisons per value for any window size.
+func slidingMax(dst, src []uint8, window int, prefix, suffix []uint8) {
+	for start := 0; start < len(src); start += window {
+		end := start + window
+		if end > len(src) {
+			end = len(src)
+		}
+		prefix[start] = src[start]
+		for i := start + 1; i < end; i++ {
+			prefix[i] = prefix[i-1]
+			if src[i] > prefix[i] {
+				prefix[i] = src[i]
+			}
+		}
+		suffix[end-1] = src[end-1]
+		for i := end - 2; i >= start; i-- {
+			suffix[i] = suffix[i+1]
+			if src[i] > suffix[i] {
+				suffix[i] = src[i]
+			}
+		}
+	}
+	ends := prefix[window-1 : window-1+len(dst)]
+	for x, a := range suffix[:len(dst)] {
+		// A window spans the end of one block and the start of the next one
+		if ends[x] > a {
+			a = ends[x]
+		}
+		dst[x] = a
+	}
+}
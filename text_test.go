@@ -0,0 +1,271 @@
+package main
+
+import (
+	"flag"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Run the tests with -update to write the rendered texts to the golden images in testdata
+var updateGolden = flag.Bool("update", false, "update the golden images in testdata")
+
+func createTestText(t *testing.T, content string, size int, style TextStyle) *Text {
+	fonts, err := loadFonts([]string{defaultFontPath})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return &Text{content: content, gravity: GravityNorthWest, fontFilePaths: []string{defaultFontPath}, size: size, fonts: fonts,
+		color: color.Black, style: style}
+}
+
+// Leftmost, rightmost, top and bottom pixels of a colour (each channel within a tolerance)
+func findColor(img *image.RGBA, c color.RGBA, tolerance int) image.Rectangle {
+	found := image.Rectangle{}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if closeColors(color.NRGBAModel.Convert(img.RGBAAt(x, y)).(color.NRGBA), color.NRGBAModel.Convert(c).(color.NRGBA), tolerance) {
+				found = found.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return found
+}
+
+// Compares an image with a golden one in testdata, each channel of each pixel within a tolerance
+func compareGolden(t *testing.T, name string, img *image.RGBA) {
+	path := filepath.Join("testdata", name+".png")
+	if *updateGolden {
+		file, err := os.Create(path)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		defer file.Close()
+		if err = png.Encode(file, img); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer file.Close()
+	golden, err := png.Decode(file)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if golden.Bounds() != img.Bounds() {
+		t.Fatalf("%s failed, expected size: %v, actual: %v", name, golden.Bounds(), img.Bounds())
+	}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			exp := color.NRGBAModel.Convert(golden.At(x, y)).(color.NRGBA)
+			act := color.NRGBAModel.Convert(img.RGBAAt(x, y)).(color.NRGBA)
+			if !closeColors(exp, act, 8) {
+				t.Errorf("%s failed at %d, %d, expected: %v, actual: %v", name, x, y, exp, act)
+				return
+			}
+		}
+	}
+}
+
+func TestTextLayout(t *testing.T) {
+	text := createTestText(t, "The quick brown fox jumps over the lazy dog", 20, defaultTextStyle)
+	cases := []struct {
+		maxWidth float64
+		exp      []string
+	}{
+		{0, []string{"The quick brown fox jumps over the lazy dog"}},
+		{150, []string{"The quick", "brown fox", "jumps over", "the lazy dog"}},
+		{250, []string{"The quick brown fox", "jumps over the lazy dog"}},
+		// Words longer than the max. width aren't broken
+		{10, []string{"The", "quick", "brown", "fox", "jumps", "over", "the", "lazy", "dog"}},
+	}
+	for _, c := range cases {
+		if act := text.layout(createTextFonts(t, text.fonts, 20, 72), c.maxWidth); !reflect.DeepEqual(act.lines, c.exp) {
+			t.Errorf("Max. width %g failed, expected: %q, actual: %q", c.maxWidth, c.exp, act.lines)
+		}
+	}
+
+	layout := text.layout(createTextFonts(t, text.fonts, 20, 72), 150)
+	if int(layout.width) != 123 || int(layout.height) != 126 || int(layout.lineHeight) != 31 {
+		t.Errorf("Expected a 123x126 block with 31 pixel lines, actual: %v", layout)
+	}
+
+	text.content = "First line\nSecond line"
+	text.style.lineSpacing = 1.5
+	layout = text.layout(createTextFonts(t, text.fonts, 20, 72), 0)
+	if len(layout.lines) != 2 || int(layout.height) != 79 {
+		t.Errorf("Expected 2 lines 1.5 lines apart, actual: %v", layout)
+	}
+}
+
+func TestDrawTextAlign(t *testing.T) {
+	black := color.RGBA{0, 0, 0, 255}
+	var edges []image.Rectangle
+	for _, align := range []string{AlignLeft, AlignCenter, AlignRight} {
+		style := defaultTextStyle
+		style.align = align
+		text := createTestText(t, "I\nIIIIIIII", 30, style)
+		img := drawTexts(createFilledImage(200, 100, color.White), []*Text{text}, 1).(*image.RGBA)
+		// The first line is a single letter
+		edges = append(edges, findColor(img.SubImage(image.Rect(0, 0, 200, 30)).(*image.RGBA), black, 0))
+	}
+	left, center, right := edges[0], edges[1], edges[2]
+	// Lines of "IIIIIIII" are 66 pixels wide
+	if left.Min.X > 5 || center.Min.X-left.Min.X != 30 || right.Min.X-left.Min.X != 61 {
+		t.Errorf("Expected the first line at the left, in the middle and at the right, actual: %v %v %v", left, center, right)
+	}
+}
+
+func TestDrawTextDecorations(t *testing.T) {
+	red, green, blue := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 255, 0, 255}, color.RGBA{0, 0, 255, 255}
+	style := TextStyle{align: AlignLeft, lineSpacing: 1, strokeWidth: 3, strokeColor: red, shadowX: 6, shadowY: 6, shadowColor: green,
+		background: blue, backgroundOpacity: 50, padding: 10}
+	text := createTestText(t, "I", 40, style)
+	text.gravity, text.x, text.y = GravityNorthWest, 5, 5
+	img := drawTexts(createFilledImage(100, 100, color.White), []*Text{text}, 1).(*image.RGBA)
+
+	letter := findColor(img, color.RGBA{0, 0, 0, 255}, 0)
+	stroke := findColor(img, red, 0)
+	shadow := findColor(img, green, 0)
+	if letter.Empty() || stroke.Empty() || shadow.Empty() {
+		t.Fatalf("Expected the letter, stroke and shadow to be drawn, actual: %v %v %v", letter, stroke, shadow)
+	}
+	// The stroke surrounds the letter, the shadow is shifted
+	if stroke.Min.X != letter.Min.X-3 || stroke.Max.X != letter.Max.X+3 || stroke.Min.Y != letter.Min.Y-3 {
+		t.Errorf("Expected a 3 pixel stroke around %v, actual: %v", letter, stroke)
+	}
+	if shadow.Max.X != stroke.Max.X+6 || shadow.Max.Y != stroke.Max.Y+6 {
+		t.Errorf("Expected a shadow 6 pixels from %v, actual: %v", stroke, shadow)
+	}
+
+	// Half transparent box starting at the offset
+	box := color.RGBA{127, 127, 255, 255}
+	if act := img.RGBAAt(5, 5); !closeColors(color.NRGBAModel.Convert(act).(color.NRGBA), color.NRGBAModel.Convert(box).(color.NRGBA), 1) {
+		t.Errorf("Expected the box in the top left corner, actual: %v", act)
+	}
+	if act := img.RGBAAt(4, 4); act != (color.RGBA{255, 255, 255, 255}) {
+		t.Errorf("Expected no box outside of the offset, actual: %v", act)
+	}
+	if letter.Min.X < 5+10+3 || letter.Min.Y < 5+10+3 {
+		t.Errorf("Expected the letter inside the padding and stroke, actual: %v", letter)
+	}
+}
+
+func TestDilateMask(t *testing.T) {
+	// Dilated pixels have the max. value in a circle, compared with checking the whole circle of each pixel
+	mask := image.NewAlpha(image.Rect(10, 20, 50, 45))
+	for i := 0; i < 60; i++ {
+		mask.SetAlpha(10+(i*7)%40, 20+(i*11)%25, color.Alpha{uint8(i * 4)})
+	}
+	for _, radius := range []int{0, 1, 3, 6} {
+		dilated := dilateMask(mask, radius)
+		for y := 20; y < 45; y++ {
+			for x := 10; x < 50; x++ {
+				var exp uint8
+				for dy := -radius; dy <= radius; dy++ {
+					for dx := -radius; dx <= radius; dx++ {
+						inCircle := int(math.Sqrt(float64(radius*radius-dy*dy))) >= int(math.Abs(float64(dx)))
+						if a := mask.AlphaAt(x+dx, y+dy).A; inCircle && image.Pt(x+dx, y+dy).In(mask.Bounds()) && a > exp {
+							exp = a
+						}
+					}
+				}
+				if act := dilated.AlphaAt(x, y).A; act != exp {
+					t.Fatalf("Radius %d failed at %d, %d, expected: %d, actual: %d", radius, x, y, exp, act)
+				}
+			}
+		}
+	}
+}
+
+func TestDrawTextLargeStroke(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	style := defaultTextStyle
+	style.strokeWidth, style.strokeColor = MaxStrokeWidth, red
+	text := createTestText(t, "I", 20, style)
+	text.x, text.y = 5, 5
+
+	// The outline at scale 3 is 60 pixels wide, a bigger scale doesn't make it wider
+	for _, scale := range []float64{3, 10} {
+		img := drawTexts(createFilledImage(600, 600, color.White), []*Text{text}, scale).(*image.RGBA)
+		letter := findColor(img, color.RGBA{0, 0, 0, 255}, 0)
+		stroke := findColor(img, red, 0)
+		if letter.Empty() || stroke.Min.X != letter.Min.X-maxScaledStrokeWidth || stroke.Max.X != letter.Max.X+maxScaledStrokeWidth ||
+			stroke.Min.Y != letter.Min.Y-maxScaledStrokeWidth {
+			t.Errorf("Scale %g failed, expected a %d pixel outline around %v, actual: %v", scale, maxScaledStrokeWidth, letter, stroke)
+		}
+		// The corners of the outline are round
+		corner := stroke.Min.Add(image.Pt(maxScaledStrokeWidth/4, maxScaledStrokeWidth/4))
+		if act := img.RGBAAt(corner.X, corner.Y); act == red {
+			t.Errorf("Scale %g failed, expected no outline at %v", scale, corner)
+		}
+	}
+}
+
+func TestDrawTextShrink(t *testing.T) {
+	black := color.RGBA{0, 0, 0, 255}
+	style := defaultTextStyle
+	text := createTestText(t, "A text much wider than the image", 30, style)
+	img := drawTexts(createFilledImage(100, 50, color.White), []*Text{text}, 1).(*image.RGBA)
+	full := findColor(img, black, 127)
+
+	text.style.shrink = true
+	img = drawTexts(createFilledImage(100, 50, color.White), []*Text{text}, 1).(*image.RGBA)
+	shrunk := findColor(img, black, 127)
+	if shrunk.Empty() || shrunk.Dy() >= full.Dy()/2 || shrunk.Max.X >= 100 {
+		t.Errorf("Expected smaller letters of a text which fits, actual: %v (full size %v)", shrunk, full)
+	}
+	if img.RGBAAt(99, shrunk.Min.Y+shrunk.Dy()/2) != (color.RGBA{255, 255, 255, 255}) {
+		t.Errorf("Expected nothing at the right edge")
+	}
+
+	// Shrinking gives up at the min. size
+	text.content = "A text which can't fit this image at any size at all, no matter how small"
+	layout := text.layout(createTextFonts(t, text.fonts, minShrunkTextSize, 72), 0)
+	img = drawTexts(createFilledImage(50, 50, color.White), []*Text{text}, 1).(*image.RGBA)
+	if layout.width < 50 || img.Bounds().Dx() != 50 {
+		t.Errorf("Expected the text not to fit, actual width: %g", layout.width)
+	}
+}
+
+func TestDrawTextGolden(t *testing.T) {
+	red, green := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 255, 0, 255}
+	cases := []struct {
+		name    string
+		content string
+		style   TextStyle
+	}{
+		// Wrapped between words
+		{"text-wrap", "The quick brown fox jumps over the lazy dog", TextStyle{maxWidth: 100, align: AlignLeft, lineSpacing: 1}},
+		{"text-align-center", "Centred\nlines\nof text", TextStyle{align: AlignCenter, lineSpacing: 1}},
+		{"text-align-right", "Right\naligned\nlines", TextStyle{align: AlignRight, lineSpacing: 1.5}},
+		{"text-stroke-shadow", "Outline", TextStyle{align: AlignLeft, lineSpacing: 1, strokeWidth: 2, strokeColor: red, shadowX: 4, shadowY: 3,
+			shadowColor: green}},
+	}
+	for _, c := range cases {
+		text := createTestText(t, c.content, 14, c.style)
+		text.x, text.y = 4, 4
+		img := drawTexts(createFilledImage(120, 100, color.White), []*Text{text}, 1).(*image.RGBA)
+		compareGolden(t, c.name, img)
+	}
+}
+
+func TestTextStyleHash(t *testing.T) {
+	a := createTestText(t, "Hello", 20, defaultTextStyle)
+	b := createTestText(t, "Hello", 20, defaultTextStyle)
+	b.style.strokeWidth, b.style.strokeColor = 2, color.White
+	if string(a.hash()) == string(b.hash()) {
+		t.Errorf("Expected different hashes for different styles")
+	}
+}
@@ -1,7 +1,5 @@
 package main
 
-// TODO - refactor out a resizing function
-
 import (
 	"encoding/binary"
 	"encoding/hex"
@@ -10,15 +8,19 @@ import (
 	"image/color"
 	"image/draw"
 	"io"
-	"log"
 	"strconv"
 	"strings"
+	"text/template"
 
 	"crypto/sha1"
 
-	"code.google.com/p/freetype-go/freetype"
-	"code.google.com/p/freetype-go/freetype/truetype"
-	"github.com/nfnt/resize"
+	"github.com/ReshNesh/go-colorful"
+	"golang.org/x/image/font/sfnt"
+)
+
+const (
+	// How much an image is shrunk when creating a blurred background
+	backgroundBlurFactor = 24
 )
 
 // Transformation specifies parameters and a watermark to be used when transforming an image
@@ -26,23 +28,68 @@ type Transformation struct {
 	params    *Params
 	watermark *Watermark
 	texts     []*Text
+	// Which metadata of the original image is kept (MetadataStrip, MetadataICC, ...)
+	metadata string
+	cropHint *CropHint
+	// Crop windows found by automatic gravity for each window size, shared by all frames of an animation
+	cropPoints map[image.Point]image.Point
+	// Values of variables in templated texts given in the URL
+	variables map[string]string
+	// Layers the transformed image is composed with, nil if it isn't composed
+	canvas *Canvas
+	// Rectangles of the original image obscured before it's cropped and resized
+	redactions []*Redaction
+	// Watermarks, logos and backgrounds loaded for all frames of an animation, nil if they're loaded each time
+	layers layerCache
 }
 
 // Watermark specifies a watermark to be applied to an image
 type Watermark struct {
 	imagePath, gravity string
 	x, y               int
+	// Opacity in percent, width in percent of the image width (0 means the size of the watermark file)
+	opacity, width int
+	// Tiled watermarks are repeated over the whole image with spacing between them
+	tiled    bool
+	spacing  int
+	rotation float64 // Degrees clockwise
+	blend    string
 }
 
 // Text specifies a text overlay to be applied to an image
 type Text struct {
-	content, gravity, fontFilePath string
-	x, y, size                     int
-	font                           *truetype.Font
-	color                          color.Color
+	content, gravity string
+	// A font followed by fallback fonts for characters it doesn't have
+	fontFilePaths []string
+	x, y, size    int // Size in points, scaled images use a higher DPI
+	fonts         []*sfnt.Font
+	color         color.Color
+	style         TextStyle
+	// Content with variables (e.g. {{.name}}), nil if the content is static
+	template *template.Template
 }
 
-// FontMetrics defines font metrics for a Text struct as rounded up integers
+// TextStyle specifies the layout and decorations of a text overlay
+type TextStyle struct {
+	// Lines longer than max. width (in pixels, 0 means no limit) are wrapped between words
+	maxWidth int
+	align    string
+	// Distance of lines as a multiple of the line height
+	lineSpacing float64
+	// Outline around the letters
+	strokeWidth int
+	strokeColor color.Color
+	// Shadow offset, no shadow is drawn without a colour
+	shadowX, shadowY int
+	shadowColor      color.Color
+	// Box behind the text with opacity in percent and padding in pixels, no box is drawn without a colour
+	background                 color.Color
+	backgroundOpacity, padding int
+	// Shrinks the font until the text fits in the image (and max. width)
+	shrink bool
+}
+
+// FontMetrics defines font metrics for a Text struct in pixels
 type FontMetrics struct {
 	width, height, ascent, descent float64
 }
@@ -74,12 +121,56 @@ func (t *Transformation) createFilePath(imagePath string) (string, error) {
 		}
 	}
 
+	// Metadata kept, images without any metadata kept don't need to be told apart
+	if t.metadata != MetadataStrip {
+		hash := sha1.Sum([]byte(t.metadata))
+		for i := range sum {
+			sum[i] += hash[i]
+		}
+	}
+
+	// Canvas
+	if t.canvas != nil {
+		hash := t.canvas.hash()
+		for i := range sum {
+			sum[i] += hash[i]
+		}
+	}
+
+	// Variables of templated texts
+	if len(t.variables) != 0 {
+		hash := hashVariables(t.variables)
+		for i := range sum {
+			sum[i] += hash[i]
+		}
+	}
+
+	// Redactions
+	for _, elem := range t.redactions {
+		hash := elem.hash()
+		for i := range sum {
+			sum[i] += hash[i]
+		}
+	}
+
 	extraHash := ""
-	if t.watermark != nil || len(t.texts) != 0 {
+	if t.watermark != nil || len(t.texts) != 0 || t.metadata != MetadataStrip || len(t.variables) != 0 || t.canvas != nil ||
+		len(t.redactions) != 0 {
 		extraHash = "--" + hex.EncodeToString(sum)
 	}
 
-	return imagePath[:i] + "--" + t.params.ToString() + extraHash + "--" + imagePath[i:], nil
+	// Formats which browsers can't display are converted (e.g. image.svg is cached as image--...--.png)
+	return imagePath[:i] + "--" + t.params.ToString() + extraHash + "--." + t.outputFormat(imagePath[i+1:]), nil
+}
+
+// outputFormat returns the format which an image of the given format is written in after the transformation,
+// JPEG doesn't support transparency so images with rounded corners are written as PNG (unless on an opaque canvas)
+func (t *Transformation) outputFormat(format string) string {
+	format = transformedFormat(format)
+	if isJPEGFormat(format) && t.params.hasRoundedCorners() && (t.canvas == nil || t.canvas.background == nil) {
+		return "png"
+	}
+	return format
 }
 
 func (w *Watermark) hash() []byte {
@@ -89,6 +180,12 @@ func (w *Watermark) hash() []byte {
 	io.WriteString(h, w.gravity)
 	io.WriteString(h, strconv.Itoa(w.x))
 	io.WriteString(h, strconv.Itoa(w.y))
+	io.WriteString(h, strconv.Itoa(w.opacity))
+	io.WriteString(h, strconv.Itoa(w.width))
+	io.WriteString(h, strconv.FormatBool(w.tiled))
+	io.WriteString(h, strconv.Itoa(w.spacing))
+	io.WriteString(h, strconv.FormatFloat(w.rotation, 'f', -1, 64))
+	io.WriteString(h, w.blend)
 
 	return h.Sum(nil)
 }
@@ -107,39 +204,118 @@ func (t *Text) hash() []byte {
 	io.WriteString(h, strconv.Itoa(t.x))
 	io.WriteString(h, strconv.Itoa(t.y))
 	io.WriteString(h, strconv.Itoa(t.size))
-	io.WriteString(h, t.fontFilePath)
+	for _, path := range t.fontFilePaths {
+		io.WriteString(h, path)
+	}
 	writeUint(r)
 	writeUint(g)
 	writeUint(b)
 	writeUint(a)
 
+	style := t.style
+	writeColor := func(c color.Color) {
+		if c == nil {
+			writeUint(0xffffffff)
+			return
+		}
+		r, g, b, a := c.RGBA()
+		writeUint(r)
+		writeUint(g)
+		writeUint(b)
+		writeUint(a)
+	}
+	io.WriteString(h, strconv.Itoa(style.maxWidth))
+	io.WriteString(h, style.align)
+	io.WriteString(h, strconv.FormatFloat(style.lineSpacing, 'f', -1, 64))
+	io.WriteString(h, strconv.Itoa(style.strokeWidth))
+	writeColor(style.strokeColor)
+	io.WriteString(h, strconv.Itoa(style.shadowX))
+	io.WriteString(h, strconv.Itoa(style.shadowY))
+	writeColor(style.shadowColor)
+	writeColor(style.background)
+	io.WriteString(h, strconv.Itoa(style.backgroundOpacity))
+	io.WriteString(h, strconv.Itoa(style.padding))
+	io.WriteString(h, strconv.FormatBool(style.shrink))
+
 	return h.Sum(nil)
 }
 
-func (t *Text) getFontMetrics(scale int) FontMetrics {
-	// Adapted from: https://code.google.com/p/plotinum/
-
-	// Converts truetype.FUnit to float64
-	fUnit2Float64 := float64(t.size) / float64(t.font.FUnitsPerEm())
+// transformImage transforms a still image or all frames of an animation, a single frame
+// of an animation chosen by the frame parameter is transformed as a still image
+func transformImage(img image.Image, transformation *Transformation) (image.Image, error) {
+	img, metadata := splitMetadata(img)
+	if transformation.isTemplated() {
+		texts, err := renderTexts(transformation.texts, transformation.variables, img, metadata)
+		if err != nil {
+			return nil, err
+		}
+		rendered := *transformation
+		rendered.texts = texts
+		transformation = &rendered
+	}
+	imgNew, err := transformFrames(img, transformation)
+	if err != nil {
+		return nil, err
+	}
+	return withMetadata(imgNew, metadata.filter(transformation.metadata)), nil
+}
 
-	width := 0
-	prev, hasPrev := truetype.Index(0), false
-	for _, rune := range t.content {
-		index := t.font.Index(rune)
-		if hasPrev {
-			width += int(t.font.Kerning(t.font.FUnitsPerEm(), prev, index))
+func transformFrames(img image.Image, transformation *Transformation) (image.Image, error) {
+	frame := transformation.params.frame
+	// Pixel coordinates of redactions and regions refer to the original size of vectors
+	originalScale := 1.0
+	if vector, ok := img.(*VectorImage); ok {
+		// Vectors are drawn at the size needed rather than scaled as a bitmap
+		img = vector.rasterise(vector.renderSize(transformation.params))
+		if vector.Bounds().Dx() > 0 {
+			originalScale = float64(img.Bounds().Dx()) / float64(vector.Bounds().Dx())
 		}
-		width += int(t.font.HMetric(t.font.FUnitsPerEm(), index).AdvanceWidth)
-		prev, hasPrev = index, true
 	}
-	widthFloat := float64(width) * fUnit2Float64 * float64(scale)
+	if len(transformation.redactions) > 0 {
+		img = redactImageFrames(img, transformation.redactions, originalScale)
+	}
+	if transformation.params.hasRegion() {
+		var err error
+		img, transformation, err = extractRegion(img, transformation, originalScale)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if transformation.params.trim {
+		img, transformation = trimImage(img, transformation)
+	}
 
-	bounds := t.font.Bounds(t.font.FUnitsPerEm())
-	height := float64(bounds.YMax-bounds.YMin) * fUnit2Float64 * float64(scale)
-	ascent := float64(bounds.YMax) * fUnit2Float64 * float64(scale)
-	descent := float64(bounds.YMin) * fUnit2Float64 * float64(scale)
+	animation, ok := img.(*Animation)
+	if !ok {
+		if frame > 1 {
+			return nil, fmt.Errorf("frame %d not found, the image has 1 frame", frame)
+		}
+		return transformCropAndResize(img, transformation), nil
+	}
+	if frame > 0 {
+		if frame > len(animation.frames) {
+			return nil, fmt.Errorf("frame %d not found, the image has %d frames", frame, len(animation.frames))
+		}
+		return transformCropAndResize(animation.frames[frame-1], transformation), nil
+	}
 
-	return FontMetrics{widthFloat, height, ascent, descent}
+	// Crop all frames alike, automatic gravity looks at the first frame only. Watermarks, logos and
+	// backgrounds are loaded with the first frame too.
+	frameTransformation := *transformation
+	frameTransformation.cropPoints = make(map[image.Point]image.Point)
+	frameTransformation.layers = make(layerCache)
+	frames := make([]image.Image, len(animation.frames))
+	for i, frame := range animation.frames {
+		frames[i] = transformCropAndResize(frame, &frameTransformation)
+		if i == 0 {
+			bounds := frames[0].Bounds()
+			err := checkAnimationSize(len(frames), bounds.Dx(), bounds.Dy())
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return newAnimation(frames, animation.delays, animation.loopCount), nil
 }
 
 func transformCropAndResize(img image.Image, transformation *Transformation) (imgNew image.Image) {
@@ -147,28 +323,54 @@ func transformCropAndResize(img image.Image, transformation *Transformation) (im
 	width := parameters.width
 	height := parameters.height
 	gravity := parameters.gravity
+	if gravity == GravityNone {
+		gravity = DefaultGravity
+	}
 	scale := parameters.scale
+	resampling := parameters.resampling
+	resize := resizeImage
+	if parameters.linear {
+		resize = resizeImageLinear
+	}
 
 	imgWidth := img.Bounds().Dx()
 	imgHeight := img.Bounds().Dy()
 
 	// Scaling factor
 	if parameters.cropping != CroppingModeKeepScale {
-		width *= scale
-		height *= scale
+		width = scaleInt(width, scale)
+		height = scaleInt(height, scale)
 	}
 
 	// Resize and crop
 	switch parameters.cropping {
 	case CroppingModeExact:
-		imgNew = resize.Resize(uint(width), uint(height), img, resize.Bilinear)
+		if !parameters.upscale {
+			// Shrink the frame proportionally so that it isn't bigger than the image
+			factor := 1.0
+			if width > imgWidth {
+				factor = float64(imgWidth) / float64(width)
+			}
+			if height > imgHeight && float64(imgHeight)/float64(height) < factor {
+				factor = float64(imgHeight) / float64(height)
+			}
+			width = int(float64(width)*factor + 0.5)
+			height = int(float64(height)*factor + 0.5)
+		}
+		imgNew = resize(uint(width), uint(height), img, resampling)
 	case CroppingModeAll:
 		if float32(width)*(float32(imgHeight)/float32(imgWidth)) > float32(height) {
 			// Keep height
-			imgNew = resize.Resize(0, uint(height), img, resize.Bilinear)
+			if !parameters.upscale && height > imgHeight {
+				height = imgHeight
+			}
+			imgNew = resize(0, uint(height), img, resampling)
 		} else {
 			// Keep width
-			imgNew = resize.Resize(uint(width), 0, img, resize.Bilinear)
+			if !parameters.upscale && width > imgWidth {
+				width = imgWidth
+			}
+			imgNew = resize(uint(width), 0, img, resampling)
 		}
 	case CroppingModePart:
 		var croppedRect image.Rectangle
@@ -182,11 +384,25 @@ func transformCropAndResize(img image.Image, transformation *Transformation) (im
 			croppedRect = image.Rect(0, 0, newWidth, imgHeight)
 		}
 
-		topLeftPoint := calculateTopLeftPointFromGravity(gravity, croppedRect.Dx(), croppedRect.Dy(), imgWidth, imgHeight)
+		var topLeftPoint image.Point
+		hint := transformation.cropHint
+		if hint != nil && hint.hasRect && usesCropHint(parameters.gravity) {
+			// Zoom in on the preferred crop rectangle
+			hintRect := hint.calculateCropRectangle(width, height, imgWidth, imgHeight)
+			croppedRect = image.Rect(0, 0, hintRect.Dx(), hintRect.Dy())
+			topLeftPoint = hintRect.Min
+		} else {
+			topLeftPoint = calculateCropTopLeftPoint(img, transformation, croppedRect.Dx(), croppedRect.Dy())
+		}
 		imgDraw := image.NewRGBA(croppedRect)
 
 		draw.Draw(imgDraw, croppedRect, img, topLeftPoint, draw.Src)
-		imgNew = resize.Resize(uint(width), uint(height), imgDraw, resize.Bilinear)
+		if !parameters.upscale && width > croppedRect.Dx() {
+			// The cropped part has the requested proportions so it can be used as it is
+			imgNew = imgDraw
+		} else {
+			imgNew = resize(uint(width), uint(height), imgDraw, resampling)
+		}
 	case CroppingModeKeepScale:
 		// If passed in dimensions are bigger use those of the image
 		if width > imgWidth {
@@ -197,11 +413,41 @@ func transformCropAndResize(img image.Image, transformation *Transformation) (im
 		}
 
 		croppedRect := image.Rect(0, 0, width, height)
-		topLeftPoint := calculateTopLeftPointFromGravity(gravity, width, height, imgWidth, imgHeight)
+		topLeftPoint := calculateCropTopLeftPoint(img, transformation, width, height)
 		imgDraw := image.NewRGBA(croppedRect)
 
 		draw.Draw(imgDraw, croppedRect, img, topLeftPoint, draw.Src)
 		imgNew = imgDraw.SubImage(croppedRect)
+	case CroppingModePad:
+		fittedWidth, fittedHeight := width, height
+		if float32(width)*(float32(imgHeight)/float32(imgWidth)) > float32(height) {
+			// Keep height
+			fittedWidth = int(float32(height)*(float32(imgWidth)/float32(imgHeight)) + 0.5)
+		} else {
+			// Keep width
+			fittedHeight = int(float32(width)*(float32(imgHeight)/float32(imgWidth)) + 0.5)
+		}
+		if !parameters.upscale && fittedWidth > imgWidth {
+			fittedWidth, fittedHeight = imgWidth, imgHeight
+		}
+		imgFitted := resize(uint(fittedWidth), uint(fittedHeight), img, resampling)
+
+		frameRect := image.Rect(0, 0, width, height)
+		imgDraw := image.NewRGBA(frameRect)
+		switch parameters.background {
+		case BackgroundTransparent:
+			// Nothing to draw, a new image is transparent
+		case BackgroundBlur:
+			draw.Draw(imgDraw, frameRect, createBlurredBackground(img, width, height), image.ZP, draw.Src)
+		default:
+			background, _ := colorful.Hex("#" + parameters.background)
+			draw.Draw(imgDraw, frameRect, image.NewUniform(background), image.ZP, draw.Src)
+		}
+
+		topLeftPoint := calculateTopLeftPointFromGravity(gravity, fittedWidth, fittedHeight, width, height)
+		fittedRect := image.Rect(0, 0, fittedWidth, fittedHeight).Add(topLeftPoint)
+		draw.Draw(imgDraw, fittedRect, imgFitted, imgFitted.Bounds().Min, draw.Over)
+		imgNew = imgDraw
 	}
 
 	// Filters
@@ -219,96 +465,94 @@ func transformCropAndResize(img image.Image, transformation *Transformation) (im
 		imgNew = gray
 	}
 
-	if transformation.watermark != nil {
-		w := transformation.watermark
-
-		var watermarkSrcScaled image.Image
-		var watermarkBounds image.Rectangle
-
-		// Try to load a scaled watermark first
-		if scale > 1 {
-			scaledPath, err := constructScaledPath(w.imagePath, scale)
-			if err != nil {
-				log.Println("Error:", err)
-				return
-			}
-
-			watermarkSrc, _, err := loadImage(scaledPath)
-			if err != nil {
-				log.Println("Error: could not load a watermark", err)
-			} else {
-				watermarkBounds = watermarkSrc.Bounds()
-				watermarkSrcScaled = watermarkSrc
-			}
-		}
-
-		if watermarkSrcScaled == nil {
-			watermarkSrc, _, err := loadImage(w.imagePath)
-			if err != nil {
-				log.Println("Error: could not load a watermark", err)
-				return
-			}
-			watermarkBounds = image.Rect(0, 0, watermarkSrc.Bounds().Max.X*scale, watermarkSrc.Bounds().Max.Y*scale)
-			watermarkSrcScaled = resize.Resize(uint(watermarkBounds.Max.X), uint(watermarkBounds.Max.Y), watermarkSrc, resize.Bilinear)
-		}
-
-		bounds := imgNew.Bounds()
-
-		// Make sure we have a transparent watermark if possible
-		watermark := image.NewRGBA(watermarkBounds)
-		draw.Draw(watermark, watermarkBounds, watermarkSrcScaled, watermarkBounds.Min, draw.Src)
-
-		pt := calculateTopLeftPointFromGravity(w.gravity, watermarkBounds.Dx(), watermarkBounds.Dy(), bounds.Dx(), bounds.Dy())
-		pt = pt.Add(getTranslation(w.gravity, w.x*scale, w.y*scale))
-		wX := pt.X
-		wY := pt.Y
+	// The watermark and texts are drawn on the canvas, borders and rounded corners frame the image on it
+	if transformation.canvas != nil {
+		imgNew = applyBorderAndRadius(imgNew, parameters, scale)
+		imgNew = transformation.canvas.compose(imgNew, scale, resize, resampling, transformation.layers)
+	}
 
-		watermarkRect := image.Rect(wX, wY, watermarkBounds.Dx()+wX, watermarkBounds.Dy()+wY)
-		finalImage := image.NewRGBA(bounds)
-		draw.Draw(finalImage, bounds, imgNew, bounds.Min, draw.Src)
-		draw.Draw(finalImage, watermarkRect, watermark, watermarkBounds.Min, draw.Over)
-		imgNew = finalImage.SubImage(bounds)
+	if transformation.watermark != nil {
+		imgNew = applyWatermark(imgNew, transformation.watermark, scale, resize, resampling, transformation.layers)
 	}
 
-	if transformation.texts != nil {
-		bounds := imgNew.Bounds()
-		rgba := image.NewRGBA(bounds)
-		draw.Draw(rgba, bounds, imgNew, image.ZP, draw.Src)
+	if len(transformation.texts) != 0 {
+		imgNew = drawTexts(imgNew, transformation.texts, scale)
+	}
 
-		dpi := float64(72) // Multiply this by scale for a baaad time
+	// Borders and rounded corners frame the watermark and texts too
+	if transformation.canvas == nil {
+		imgNew = applyBorderAndRadius(imgNew, parameters, scale)
+	}
 
-		c := freetype.NewContext()
-		c.SetDPI(dpi)
-		c.SetClip(rgba.Bounds())
-		c.SetDst(rgba)
+	return
+}
 
-		for _, text := range transformation.texts {
-			size := float64(text.size * scale)
+// createBlurredBackground returns a heavily blurred copy of an image filling a frame of given dimensions.
+// The blur is achieved by shrinking the image to a fraction of its size and scaling it back up.
+func createBlurredBackground(img image.Image, width, height int) image.Image {
+	imgDraw := cropToProportions(img, width, height)
 
-			c.SetSrc(image.NewUniform(text.color))
-			c.SetFont(text.font)
-			c.SetFontSize(size)
+	smallWidth := width / backgroundBlurFactor
+	if smallWidth < 1 {
+		smallWidth = 1
+	}
+	smallHeight := height / backgroundBlurFactor
+	if smallHeight < 1 {
+		smallHeight = 1
+	}
+	imgSmall := resizeImage(uint(smallWidth), uint(smallHeight), imgDraw, ResamplingBilinear)
+	return resizeImage(uint(width), uint(height), imgSmall, ResamplingBicubic)
+}
 
-			fontMetrics := text.getFontMetrics(scale)
-			width := int(c.PointToFix32(fontMetrics.width) >> 8)
-			height := int(c.PointToFix32(fontMetrics.height) >> 8)
+// cropToProportions returns the centre of an image with the same proportions as a frame of given dimensions
+func cropToProportions(img image.Image, width, height int) *image.RGBA {
+	imgWidth := img.Bounds().Dx()
+	imgHeight := img.Bounds().Dy()
 
-			pt := calculateTopLeftPointFromGravity(text.gravity, width, height, bounds.Dx(), bounds.Dy())
-			pt = pt.Add(getTranslation(text.gravity, text.x*scale, text.y*scale))
-			x := pt.X
-			y := pt.Y + int(c.PointToFix32(fontMetrics.ascent)>>8)
+	var croppedRect image.Rectangle
+	if float32(width)*(float32(imgHeight)/float32(imgWidth)) > float32(height) {
+		newHeight := int((float32(imgWidth) / float32(width)) * float32(height))
+		croppedRect = image.Rect(0, 0, imgWidth, newHeight)
+	} else {
+		newWidth := int((float32(imgHeight) / float32(height)) * float32(width))
+		croppedRect = image.Rect(0, 0, newWidth, imgHeight)
+	}
+	topLeftPoint := calculateTopLeftPointFromGravity(GravityCenter, croppedRect.Dx(), croppedRect.Dy(), imgWidth, imgHeight)
+	imgDraw := image.NewRGBA(croppedRect)
+	draw.Draw(imgDraw, croppedRect, img, img.Bounds().Min.Add(topLeftPoint), draw.Src)
+	return imgDraw
+}
 
-			_, err := c.DrawString(text.content, freetype.Pt(x, y))
-			if err != nil {
-				log.Println("Error adding text:", err)
-				return
-			}
-		}
+// checkOutputSize returns an error if a transformation of an image with given dimensions could
+// result in an image bigger than allowed by the configuration
+func checkOutputSize(parameters *Params, imgWidth, imgHeight int) error {
+	width := scaleInt(parameters.width, parameters.scale)
+	height := scaleInt(parameters.height, parameters.scale)
+	if Config.maxOutputWidth > 0 && width > Config.maxOutputWidth {
+		return fmt.Errorf("width %d is bigger than the max. allowed %d", width, Config.maxOutputWidth)
+	}
+	if Config.maxOutputHeight > 0 && height > Config.maxOutputHeight {
+		return fmt.Errorf("height %d is bigger than the max. allowed %d", height, Config.maxOutputHeight)
+	}
+	if imgWidth == 0 || imgHeight == 0 || Config.maxOutputPixels == 0 {
+		return nil
+	}
 
-		imgNew = rgba
+	// Missing dimension is calculated from the proportions of the image
+	if width == 0 {
+		width = height * imgWidth / imgHeight
+	} else if height == 0 {
+		height = width * imgHeight / imgWidth
 	}
+	if width*height > Config.maxOutputPixels {
+		return fmt.Errorf("too many pixels: %d, allowed: %d", width*height, Config.maxOutputPixels)
+	}
+	return nil
+}
 
-	return
+// scaleInt multiplies a dimension by a scale and rounds it to the nearest integer
+func scaleInt(value int, scale float64) int {
+	return int(float64(value)*scale + 0.5)
 }
 
 func calculateTopLeftPointFromGravity(gravity string, width, height, imgWidth, imgHeight int) image.Point {
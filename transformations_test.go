@@ -2,6 +2,8 @@ package main
 
 import (
 	"image"
+	"image/color"
+	"image/draw"
 	"testing"
 )
 
@@ -9,51 +11,166 @@ func TestCalculateTopLeftPointFromGravity(t *testing.T) {
 	exp := image.Point{200, 0}
 	act := calculateTopLeftPointFromGravity(GravityNorth, 400, 300, 800, 600)
 	if act != exp {
-		t.Errorf("N failed", act, exp)
+		t.Errorf("N failed, expected: %v, actual: %v", exp, act)
 	}
 
 	exp = image.Point{400, 0}
 	act = calculateTopLeftPointFromGravity(GravityNorthEast, 400, 300, 800, 600)
 	if act != exp {
-		t.Errorf("NE failed", act, exp)
+		t.Errorf("NE failed, expected: %v, actual: %v", exp, act)
 	}
 
 	exp = image.Point{400, 150}
 	act = calculateTopLeftPointFromGravity(GravityEast, 400, 300, 800, 600)
 	if act != exp {
-		t.Errorf("E failed", act, exp)
+		t.Errorf("E failed, expected: %v, actual: %v", exp, act)
 	}
 
 	exp = image.Point{400, 300}
 	act = calculateTopLeftPointFromGravity(GravitySouthEast, 400, 300, 800, 600)
 	if act != exp {
-		t.Errorf("SE failed", act, exp)
+		t.Errorf("SE failed, expected: %v, actual: %v", exp, act)
 	}
 	exp = image.Point{200, 300}
 	act = calculateTopLeftPointFromGravity(GravitySouth, 400, 300, 800, 600)
 	if act != exp {
-		t.Errorf("S failed", act, exp)
+		t.Errorf("S failed, expected: %v, actual: %v", exp, act)
 	}
 	exp = image.Point{0, 300}
 	act = calculateTopLeftPointFromGravity(GravitySouthWest, 400, 300, 800, 600)
 	if act != exp {
-		t.Errorf("SW failed", act, exp)
+		t.Errorf("SW failed, expected: %v, actual: %v", exp, act)
 	}
 	exp = image.Point{0, 150}
 	act = calculateTopLeftPointFromGravity(GravityWest, 400, 300, 800, 600)
 	if act != exp {
-		t.Errorf("W failed", act, exp)
+		t.Errorf("W failed, expected: %v, actual: %v", exp, act)
 	}
 
 	exp = image.Point{0, 0}
 	act = calculateTopLeftPointFromGravity(GravityNorthWest, 400, 300, 800, 600)
 	if act != exp {
-		t.Errorf("NW failed", act, exp)
+		t.Errorf("NW failed, expected: %v, actual: %v", exp, act)
 	}
 
 	exp = image.Point{200, 150}
 	act = calculateTopLeftPointFromGravity(GravityCenter, 400, 300, 800, 600)
 	if act != exp {
-		t.Errorf("C failed", act, exp)
+		t.Errorf("C failed, expected: %v, actual: %v", exp, act)
+	}
+}
+
+func TestTransformCropAndResizePad(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{0, 0, 255, 255}), image.ZP, draw.Src)
+
+	params, _ := parseParameters("w_100,h_100,c_pad,g_c,bg_ff0000")
+	imgNew := transformCropAndResize(img, &Transformation{params: &params, metadata: MetadataStrip})
+
+	if imgNew.Bounds().Size() != (image.Point{100, 100}) {
+		t.Fatalf("Expected a 100x100 image, actual: %v", imgNew.Bounds().Size())
+	}
+	red := color.RGBA{255, 0, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	if c := color.RGBAModel.Convert(imgNew.At(50, 10)); c != red {
+		t.Errorf("Expected background at the top, actual: %v", c)
+	}
+	if c := color.RGBAModel.Convert(imgNew.At(50, 50)); c != blue {
+		t.Errorf("Expected image in the centre, actual: %v", c)
+	}
+	if c := color.RGBAModel.Convert(imgNew.At(50, 90)); c != red {
+		t.Errorf("Expected background at the bottom, actual: %v", c)
+	}
+
+	params, _ = parseParameters("w_100,h_100,c_pad,g_n,bg_transparent")
+	imgNew = transformCropAndResize(img, &Transformation{params: &params, metadata: MetadataStrip})
+	if c := color.RGBAModel.Convert(imgNew.At(50, 10)); c != blue {
+		t.Errorf("Expected image at the top, actual: %v", c)
+	}
+	if _, _, _, a := imgNew.At(50, 90).RGBA(); a != 0 {
+		t.Errorf("Expected transparent background at the bottom, actual alpha: %d", a)
+	}
+
+	params, _ = parseParameters("w_100,h_100,c_pad,g_c,bg_blur")
+	imgNew = transformCropAndResize(img, &Transformation{params: &params, metadata: MetadataStrip})
+	if c := color.RGBAModel.Convert(imgNew.At(50, 5)); c != blue {
+		t.Errorf("Expected blurred image in the background, actual: %v", c)
+	}
+}
+
+func TestTransformCropAndResizeNoUpscale(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 50, 40))
+
+	cases := []struct {
+		parameters string
+		exp        image.Point
+	}{
+		{"w_100,h_100,c_e,upscale_false", image.Point{40, 40}},
+		{"w_100,h_100,c_a,upscale_false", image.Point{50, 40}},
+		{"w_100,h_100,c_p,upscale_false", image.Point{40, 40}},
+		{"w_100,h_100,c_pad,upscale_false", image.Point{100, 100}},
+		{"w_30,h_100,c_a,upscale_false", image.Point{30, 24}},
+		{"w_100,h_100,c_p,upscale_true", image.Point{100, 100}},
+	}
+	for _, c := range cases {
+		params, err := parseParameters(c.parameters)
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", c.parameters, err)
+		}
+		act := transformCropAndResize(img, &Transformation{params: &params, metadata: MetadataStrip}).Bounds().Size()
+		if act != c.exp {
+			t.Errorf("%s failed, expected: %v, actual: %v", c.parameters, c.exp, act)
+		}
+	}
+}
+
+func TestTransformCropAndResizeFractionalScale(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 400, 300))
+
+	cases := []struct {
+		parameters string
+		exp        image.Point
+	}{
+		{"w_100,h_75,dpr_1.5", image.Point{150, 113}},
+		{"w_100,h_100,c_a,dpr_2.625", image.Point{263, 197}},
+		{"w_101,h_100,c_p,dpr_0.5", image.Point{51, 50}},
+	}
+	for _, c := range cases {
+		params, err := parseParameters(c.parameters)
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", c.parameters, err)
+		}
+		act := transformCropAndResize(img, &Transformation{params: &params, metadata: MetadataStrip}).Bounds().Size()
+		if act != c.exp {
+			t.Errorf("%s failed, expected: %v, actual: %v", c.parameters, c.exp, act)
+		}
+	}
+}
+
+func TestCheckOutputSize(t *testing.T) {
+	Config.maxOutputWidth, Config.maxOutputHeight, Config.maxOutputPixels = 1000, 800, 400000
+	defer func() {
+		Config.maxOutputWidth, Config.maxOutputHeight, Config.maxOutputPixels = 0, 0, 0
+	}()
+
+	params, _ := parseParameters("w_600")
+	if err := checkOutputSize(&params, 0, 0); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if err := checkOutputSize(&params, 1200, 400); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if err := checkOutputSize(&params, 1000, 1500); err == nil {
+		t.Errorf("Expected an error for too many pixels")
+	}
+
+	params = params.WithScale(2)
+	if err := checkOutputSize(&params, 0, 0); err == nil {
+		t.Errorf("Expected an error for a scaled width")
+	}
+
+	params, _ = parseParameters("w_100,h_900")
+	if err := checkOutputSize(&params, 0, 0); err == nil {
+		t.Errorf("Expected an error for height")
 	}
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"strconv"
+)
+
+const (
+	// MaxTrimTolerance is the largest difference (in percent) of border pixels from the colour of the top left pixel
+	MaxTrimTolerance = 100
+
+	DefaultTrimTolerance = 10
+)
+
+// trimString returns the tolerance of trimming or false if borders aren't trimmed
+func (p Params) trimString() string {
+	if !p.trim {
+		return strconv.FormatBool(false)
+	}
+	return strconv.Itoa(p.trimTolerance)
+}
+
+// findTrimBox returns the part of an image inside uniform borders. Borders have the colour of the top left pixel
+// (each channel within a tolerance in percent) or are transparent if that pixel is. The whole image is returned
+// if it has no borders or if it's uniform. The box of an animation contains the parts of all frames.
+func findTrimBox(img image.Image, tolerance int) image.Rectangle {
+	animation, ok := img.(*Animation)
+	if !ok {
+		return findFrameTrimBox(img, tolerance)
+	}
+	box := image.Rectangle{}
+	for _, frame := range animation.frames {
+		box = box.Union(findFrameTrimBox(frame, tolerance))
+	}
+	return box
+}
+
+func findFrameTrimBox(img image.Image, tolerance int) image.Rectangle {
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return bounds
+	}
+	reference := color.NRGBAModel.Convert(img.At(bounds.Min.X, bounds.Min.Y)).(color.NRGBA)
+	limit := tolerance * 255 / 100
+	isBorder := func(x, y int) bool {
+		c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+		if reference.A == 0 {
+			return int(c.A) <= limit
+		}
+		return absInt(int(c.R)-int(reference.R)) <= limit && absInt(int(c.G)-int(reference.G)) <= limit &&
+			absInt(int(c.B)-int(reference.B)) <= limit && absInt(int(c.A)-int(reference.A)) <= limit
+	}
+	isBorderRow := func(y, minX, maxX int) bool {
+		for x := minX; x < maxX; x++ {
+			if !isBorder(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+	isBorderColumn := func(x, minY, maxY int) bool {
+		for y := minY; y < maxY; y++ {
+			if !isBorder(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+
+	box := bounds
+	for box.Min.Y < box.Max.Y && isBorderRow(box.Min.Y, box.Min.X, box.Max.X) {
+		box.Min.Y++
+	}
+	if box.Empty() {
+		return bounds
+	}
+	for isBorderRow(box.Max.Y-1, box.Min.X, box.Max.X) {
+		box.Max.Y--
+	}
+	for isBorderColumn(box.Min.X, box.Min.Y, box.Max.Y) {
+		box.Min.X++
+	}
+	for isBorderColumn(box.Max.X-1, box.Min.Y, box.Max.Y) {
+		box.Max.X--
+	}
+	return box
+}
+
+// trimImage removes uniform borders of an image before it's cropped, all frames of an animation are trimmed alike
+// keeping the parts of all of them. Crop hints are moved to the trimmed image.
+func trimImage(img image.Image, transformation *Transformation) (image.Image, *Transformation) {
+	bounds := img.Bounds()
+	box := findTrimBox(img, transformation.params.trimTolerance)
+	if box == bounds {
+		return img, transformation
+	}
+
+	trimmed := *transformation
+	if transformation.cropHint != nil {
+		trimmed.cropHint = transformation.cropHint.within(bounds, box)
+	}
+	if animation, ok := img.(*Animation); ok {
+		frames := make([]image.Image, len(animation.frames))
+		for i, frame := range animation.frames {
+			frames[i] = cropImage(frame, box)
+		}
+		return newAnimation(frames, animation.delays, animation.loopCount), &trimmed
+	}
+	return cropImage(img, box), &trimmed
+}
+
+// Copies a part of an image to a new image starting at 0, 0
+func cropImage(img image.Image, r image.Rectangle) *image.RGBA {
+	cropped := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(cropped, cropped.Bounds(), img, r.Min, draw.Src)
+	return cropped
+}
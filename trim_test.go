@@ -0,0 +1,80 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"testing"
+)
+
+// An image of a colour with a red rectangle in it
+func createFramedImage(width, height int, background color.Color, r image.Rectangle) *image.RGBA {
+	img := createFilledImage(width, height, background)
+	draw.Draw(img, r, image.NewUniform(color.RGBA{255, 0, 0, 255}), image.ZP, draw.Src)
+	return img
+}
+
+func TestFindTrimBox(t *testing.T) {
+	white := color.RGBA{255, 255, 255, 255}
+	product := image.Rect(20, 10, 70, 45)
+	img := createFramedImage(100, 50, white, product)
+	if act := findTrimBox(img, 0); act != product {
+		t.Errorf("Expected %v, actual: %v", product, act)
+	}
+
+	// Slightly off-white pixels are a part of the border with a tolerance
+	img.SetRGBA(5, 5, color.RGBA{240, 240, 240, 255})
+	if act := findTrimBox(img, 0); act != image.Rect(5, 5, 70, 45) {
+		t.Errorf("Expected the noise to be kept without a tolerance, actual: %v", act)
+	}
+	if act := findTrimBox(img, DefaultTrimTolerance); act != product {
+		t.Errorf("Expected %v with a tolerance, actual: %v", product, act)
+	}
+
+	transparent := createFramedImage(100, 50, color.RGBA{}, product)
+	if act := findTrimBox(transparent, 0); act != product {
+		t.Errorf("Expected transparent borders to be found, actual: %v", act)
+	}
+
+	uniform := createFilledImage(30, 20, white)
+	if act := findTrimBox(uniform, 0); act != uniform.Bounds() {
+		t.Errorf("Expected a uniform image not to be trimmed, actual: %v", act)
+	}
+
+	// Frames of an animation keep the parts of all of them
+	animation := newAnimation([]image.Image{img, createFramedImage(100, 50, white, image.Rect(60, 20, 90, 30))}, []int{10, 10}, 0)
+	if act, exp := findTrimBox(animation, DefaultTrimTolerance), image.Rect(20, 10, 90, 45); act != exp {
+		t.Errorf("Expected %v, actual: %v", exp, act)
+	}
+}
+
+func TestTrimImage(t *testing.T) {
+	img := createFramedImage(100, 50, color.White, image.Rect(20, 10, 70, 45))
+	params, _ := parseParameters("w_25,trim_true")
+	hint := CropHint{0.45, 0.55, true, 0, 0, 1, 1, true}
+	transformation := Transformation{params: &params, metadata: MetadataStrip, cropHint: &hint}
+
+	trimmed, trimmedTransformation := trimImage(img, &transformation)
+	if act := trimmed.Bounds(); act != image.Rect(0, 0, 50, 35) {
+		t.Errorf("Expected the red rectangle, actual bounds: %v", act)
+	}
+	// The focal point is in the middle of the rectangle, the crop rectangle is clamped to it
+	moved := trimmedTransformation.cropHint
+	if math.Abs(moved.focusX-0.5) > 1e-9 || math.Abs(moved.focusY-0.5) > 1e-9 || moved.x1 != 0 || moved.y2 != 1 || transformation.cropHint != &hint {
+		t.Errorf("Expected the hint to be moved to the trimmed image, actual: %v", moved)
+	}
+
+	// Trimming runs before the cropping modes
+	imgNew := transformCropAndResize(img, &transformation)
+	if act := imgNew.Bounds().Dx(); act != 25 {
+		t.Errorf("Expected a width of 25, actual: %d", act)
+	}
+	imgNew, _ = transformFrames(img, &transformation)
+	if act := imgNew.Bounds().Size(); act != image.Pt(25, 18) {
+		t.Errorf("Expected the proportions of the trimmed image, actual: %v", act)
+	}
+	if act := imgNew.(*image.RGBA).RGBAAt(0, 0); act != (color.RGBA{255, 0, 0, 255}) {
+		t.Errorf("Expected no white border, actual: %v", act)
+	}
+}
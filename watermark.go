@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"math"
+)
+
+const (
+	// BlendNormal draws a watermark over an image
+	BlendNormal = "normal"
+	// BlendMultiply multiplies colours, darkens the image
+	BlendMultiply = "multiply"
+	// BlendScreen multiplies inverted colours, lightens the image
+	BlendScreen = "screen"
+
+	DefaultBlend            = BlendNormal
+	DefaultWatermarkOpacity = 100
+)
+
+func isValidBlend(blend string) bool {
+	return blend == BlendNormal || blend == BlendMultiply || blend == BlendScreen
+}
+
+// layerCache keeps watermarks, logos and canvas backgrounds of a transformation once they're loaded and resized,
+// all frames of an animation are drawn with the same ones. A nil cache loads them each time.
+type layerCache map[string]image.Image
+
+func (c layerCache) load(key string, load func() image.Image) image.Image {
+	if c == nil {
+		return load()
+	}
+	layer, ok := c[key]
+	if !ok {
+		// Layers which can't be loaded are remembered too
+		layer = load()
+		c[key] = layer
+	}
+	return layer
+}
+
+// applyWatermark draws a watermark on an image, the image is returned as it is if the watermark can't be loaded
+func applyWatermark(img image.Image, w *Watermark, scale float64, resize func(uint, uint, image.Image, string) image.Image, resampling string, layers layerCache) image.Image {
+	key := fmt.Sprintf("watermark:%p:%d:%g", w, img.Bounds().Dx(), scale)
+	watermark, _ := layers.load(key, func() image.Image {
+		watermark := loadWatermark(w, img.Bounds().Dx(), scale, resize, resampling)
+		if watermark == nil {
+			return nil
+		}
+		if w.rotation != 0 {
+			watermark = rotateImage(watermark, w.rotation)
+		}
+		return watermark
+	}).(*image.RGBA)
+	if watermark == nil {
+		return img
+	}
+
+	bounds := img.Bounds()
+	finalImage := image.NewRGBA(bounds)
+	draw.Draw(finalImage, bounds, img, bounds.Min, draw.Src)
+
+	size := watermark.Bounds().Size()
+	if w.tiled {
+		// Tiles cover the whole image starting at the offset (which can be in the middle of a tile)
+		spacing := scaleInt(w.spacing, scale)
+		stepX, stepY := size.X+spacing, size.Y+spacing
+		startX, startY := scaleInt(w.x, scale)%stepX-stepX, scaleInt(w.y, scale)%stepY-stepY
+		for y := startY; y < bounds.Dy(); y += stepY {
+			for x := startX; x < bounds.Dx(); x += stepX {
+				blendImage(finalImage, image.Rectangle{image.Pt(x, y), image.Pt(x, y).Add(size)}.Add(bounds.Min), watermark, w.opacity, w.blend)
+			}
+		}
+	} else {
+		pt := calculateTopLeftPointFromGravity(w.gravity, size.X, size.Y, bounds.Dx(), bounds.Dy())
+		pt = pt.Add(getTranslation(w.gravity, scaleInt(w.x, scale), scaleInt(w.y, scale)))
+		blendImage(finalImage, image.Rectangle{pt, pt.Add(size)}.Add(bounds.Min), watermark, w.opacity, w.blend)
+	}
+	return finalImage
+}
+
+// Loads a watermark at the size it's drawn at. Watermarks with a relative width are resized to a part
+// of the image width, otherwise a scaled watermark (watermark@2x.png) is preferred to resizing.
+func loadWatermark(w *Watermark, imgWidth int, scale float64, resize func(uint, uint, image.Image, string) image.Image, resampling string) *image.RGBA {
+	var watermarkSrcScaled image.Image
+
+	// Try to load a scaled watermark first
+	if scale != 1 && w.width == 0 {
+		scaledPath, err := constructScaledPath(w.imagePath, scale)
+		if err != nil {
+			log.Println("Error:", err)
+			return nil
+		}
+
+		watermarkSrc, _, err := loadImage(scaledPath)
+		if err != nil {
+			log.Println("Error: could not load a watermark", err)
+		} else {
+			watermarkSrcScaled, _ = splitMetadata(watermarkSrc)
+		}
+	}
+
+	if watermarkSrcScaled == nil {
+		watermarkSrc, _, err := loadImage(w.imagePath)
+		if err != nil {
+			log.Println("Error: could not load a watermark", err)
+			return nil
+		}
+		watermarkSrc, _ = splitMetadata(watermarkSrc)
+		srcBounds := watermarkSrc.Bounds()
+		width, height := scaleInt(srcBounds.Dx(), scale), scaleInt(srcBounds.Dy(), scale)
+		if w.width > 0 {
+			width = imgWidth * w.width / 100
+			height = int(float64(width)*float64(srcBounds.Dy())/float64(srcBounds.Dx()) + 0.5)
+		}
+		if width < 1 || height < 1 {
+			return nil
+		}
+		if vector, ok := watermarkSrc.(*VectorImage); ok {
+			watermarkSrcScaled = vector.rasterise(width, height)
+		} else {
+			watermarkSrcScaled = resize(uint(width), uint(height), watermarkSrc, resampling)
+		}
+	}
+
+	// Make sure we have a transparent watermark if possible
+	watermarkBounds := watermarkSrcScaled.Bounds()
+	watermark := image.NewRGBA(image.Rect(0, 0, watermarkBounds.Dx(), watermarkBounds.Dy()))
+	draw.Draw(watermark, watermark.Bounds(), watermarkSrcScaled, watermarkBounds.Min, draw.Src)
+	return watermark
+}
+
+// rotateImage rotates an image clockwise by the given angle in degrees, the result is big enough
+// to contain the whole rotated image and transparent around it
+func rotateImage(img *image.RGBA, degrees float64) *image.RGBA {
+	angle := degrees * math.Pi / 180
+	sin, cos := math.Sin(angle), math.Cos(angle)
+	width, height := float64(img.Bounds().Dx()), float64(img.Bounds().Dy())
+	// Rounding errors (e.g. cos of 90 degrees) shouldn't add a pixel
+	newWidth := int(math.Ceil(math.Abs(width*cos) + math.Abs(height*sin) - 1e-9))
+	newHeight := int(math.Ceil(math.Abs(width*sin) + math.Abs(height*cos) - 1e-9))
+
+	rotated := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
+	for y := 0; y < newHeight; y++ {
+		for x := 0; x < newWidth; x++ {
+			// Rotate the centre of the pixel back to find where it comes from
+			dx, dy := float64(x)+0.5-float64(newWidth)/2, float64(y)+0.5-float64(newHeight)/2
+			sx := dx*cos + dy*sin + width/2 - 0.5
+			sy := -dx*sin + dy*cos + height/2 - 0.5
+			rotated.SetRGBA(x, y, bilinearAt(img, sx, sy))
+		}
+	}
+	return rotated
+}
+
+// Interpolates premultiplied colours of the 4 pixels around a point, pixels outside of the image are transparent
+func bilinearAt(img *image.RGBA, x, y float64) color.RGBA {
+	x0, y0 := int(math.Floor(x)), int(math.Floor(y))
+	fx, fy := x-float64(x0), y-float64(y0)
+	var sum [4]float64
+	for _, corner := range []struct {
+		x, y   int
+		weight float64
+	}{
+		{x0, y0, (1 - fx) * (1 - fy)},
+		{x0 + 1, y0, fx * (1 - fy)},
+		{x0, y0 + 1, (1 - fx) * fy},
+		{x0 + 1, y0 + 1, fx * fy},
+	} {
+		if !(image.Point{corner.x, corner.y}.In(img.Bounds())) {
+			continue
+		}
+		c := img.RGBAAt(corner.x, corner.y)
+		sum[0] += float64(c.R) * corner.weight
+		sum[1] += float64(c.G) * corner.weight
+		sum[2] += float64(c.B) * corner.weight
+		sum[3] += float64(c.A) * corner.weight
+	}
+	return color.RGBA{uint8(sum[0] + 0.5), uint8(sum[1] + 0.5), uint8(sum[2] + 0.5), uint8(sum[3] + 0.5)}
+}
+
+// blendImage draws an image over the given rectangle of another one with an opacity (0-100) and a blend mode
+func blendImage(dst *image.RGBA, r image.Rectangle, src *image.RGBA, opacity int, blend string) {
+	if blend == BlendNormal || blend == "" {
+		mask := image.NewUniform(color.Alpha{uint8(opacity * 255 / 100)})
+		draw.DrawMask(dst, r, src, src.Bounds().Min, mask, image.ZP, draw.Over)
+		return
+	}
+
+	clipped := r.Intersect(dst.Bounds())
+	for y := clipped.Min.Y; y < clipped.Max.Y; y++ {
+		for x := clipped.Min.X; x < clipped.Max.X; x++ {
+			s := src.RGBAAt(x-r.Min.X+src.Bounds().Min.X, y-r.Min.Y+src.Bounds().Min.Y)
+			if s.A == 0 {
+				continue
+			}
+			d := dst.RGBAAt(x, y)
+			// Separable blending of premultiplied colours:
+			// co = cs * (1 - ab) + cb * (1 - as) + as * ab * B(Cb, Cs)
+			as := float64(s.A) / 255 * float64(opacity) / 100
+			ab := float64(d.A) / 255
+			channel := func(cs, cb uint8) uint8 {
+				// Premultiplied and non-premultiplied values
+				ps, pb := float64(cs)/255*float64(opacity)/100, float64(cb)/255
+				us, ub := float64(cs)/float64(s.A), 0.0
+				if d.A > 0 {
+					ub = float64(cb) / float64(d.A)
+				}
+				var mixed float64
+				if blend == BlendMultiply {
+					mixed = ub * us
+				} else {
+					mixed = ub + us - ub*us
+				}
+				v := ps*(1-ab) + pb*(1-as) + as*ab*mixed
+				return uint8(math.Min(math.Max(v, 0), 1)*255 + 0.5)
+			}
+			dst.SetRGBA(x, y, color.RGBA{channel(s.R, d.R), channel(s.G, d.G), channel(s.B, d.B), uint8((as+ab*(1-as))*255 + 0.5)})
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Stores images in a temporary directory while a test runs
+func useTemporaryStorage(t *testing.T) func() {
+	path, err := ioutil.TempDir("", "pixlserv")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	previous := storageImpl
+	storageImpl = &localStorage{path}
+	return func() {
+		storageImpl = previous
+		os.RemoveAll(path)
+	}
+}
+
+func createFilledImage(width, height int, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.ZP, draw.Src)
+	return img
+}
+
+func TestBlendImage(t *testing.T) {
+	white, black, gray := color.RGBA{255, 255, 255, 255}, color.RGBA{0, 0, 0, 255}, color.RGBA{128, 128, 128, 255}
+	cases := []struct {
+		dst, src color.RGBA
+		opacity  int
+		blend    string
+		exp      color.RGBA
+	}{
+		{white, color.RGBA{255, 0, 0, 255}, 50, BlendNormal, color.RGBA{255, 128, 128, 255}},
+		{white, gray, 100, BlendMultiply, gray},
+		{color.RGBA{0, 0, 255, 255}, gray, 100, BlendMultiply, color.RGBA{0, 0, 128, 255}},
+		{black, gray, 100, BlendScreen, gray},
+		{gray, white, 50, BlendScreen, color.RGBA{192, 192, 192, 255}},
+		{color.RGBA{}, gray, 100, BlendMultiply, gray},
+		{white, color.RGBA{}, 100, BlendMultiply, white},
+	}
+	for _, c := range cases {
+		dst := createFilledImage(4, 4, c.dst)
+		blendImage(dst, image.Rect(1, 1, 3, 3), createFilledImage(2, 2, c.src), c.opacity, c.blend)
+		if act := dst.RGBAAt(2, 2); !closeColors(color.NRGBAModel.Convert(act).(color.NRGBA), color.NRGBAModel.Convert(c.exp).(color.NRGBA), 1) {
+			t.Errorf("%v over %v (%d%% %s) failed, expected: %v, actual: %v", c.src, c.dst, c.opacity, c.blend, c.exp, act)
+		}
+		if act := dst.RGBAAt(0, 0); act != c.dst {
+			t.Errorf("Expected pixels outside of the rectangle to stay the same, actual: %v", act)
+		}
+	}
+}
+
+func TestRotateImage(t *testing.T) {
+	img := createFilledImage(4, 2, color.RGBA{255, 0, 0, 255})
+	img.SetRGBA(0, 0, color.RGBA{0, 0, 255, 255})
+
+	rotated := rotateImage(img, 90)
+	if rotated.Bounds() != image.Rect(0, 0, 2, 4) {
+		t.Fatalf("Expected a 2x4 image, actual: %v", rotated.Bounds())
+	}
+	// The top left corner ends up in the top right corner
+	if act := rotated.RGBAAt(1, 0); act != (color.RGBA{0, 0, 255, 255}) {
+		t.Errorf("Expected a blue top right corner, actual: %v", act)
+	}
+
+	rotated = rotateImage(createFilledImage(10, 10, color.RGBA{255, 0, 0, 255}), 45)
+	if rotated.Bounds().Dx() != 15 || rotated.RGBAAt(0, 0).A != 0 || rotated.RGBAAt(7, 7).A != 255 {
+		t.Errorf("Expected a diamond with transparent corners, actual: %v %v", rotated.Bounds(), rotated.RGBAAt(0, 0))
+	}
+}
+
+func TestApplyWatermark(t *testing.T) {
+	defer useTemporaryStorage(t)()
+	_, err := saveImage(createFilledImage(10, 10, color.RGBA{255, 0, 0, 255}), "png", "watermark.png")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	img := createFilledImage(100, 50, color.RGBA{255, 255, 255, 255})
+	red := color.RGBA{255, 0, 0, 255}
+
+	cases := []struct {
+		watermark Watermark
+		red, not  []image.Point
+	}{
+		// Native size
+		{Watermark{"watermark.png", GravitySouthEast, 5, 0, 100, 0, false, 0, 0, BlendNormal}, []image.Point{{90, 45}}, []image.Point{{80, 45}, {97, 45}}},
+		// 20% of the image width
+		{Watermark{"watermark.png", GravitySouthEast, 0, 0, 100, 20, false, 0, 0, BlendNormal}, []image.Point{{81, 31}}, []image.Point{{79, 45}}},
+		// Tiles 10 pixels apart
+		{Watermark{"watermark.png", GravityNorthWest, 0, 0, 100, 0, true, 10, 0, BlendNormal}, []image.Point{{5, 5}, {25, 25}, {85, 45}}, []image.Point{{15, 5}, {5, 15}}},
+		// Tiles with an offset
+		{Watermark{"watermark.png", GravityNorthWest, 5, 0, 100, 0, true, 10, 0, BlendNormal}, []image.Point{{7, 5}, {12, 5}}, []image.Point{{2, 5}, {17, 5}}},
+		// Rotated by 45 degrees
+		{Watermark{"watermark.png", GravityCenter, 0, 0, 100, 0, false, 0, 45, BlendNormal}, []image.Point{{50, 25}, {50, 20}}, []image.Point{{44, 19}}},
+	}
+	for i, c := range cases {
+		imgNew := applyWatermark(img, &c.watermark, 1, resizeImage, ResamplingLanczos3, nil).(*image.RGBA)
+		for _, pt := range c.red {
+			if act := imgNew.RGBAAt(pt.X, pt.Y); act != red {
+				t.Errorf("Case %d failed, expected red at %v, actual: %v", i, pt, act)
+			}
+		}
+		for _, pt := range c.not {
+			if act := imgNew.RGBAAt(pt.X, pt.Y); act == red {
+				t.Errorf("Case %d failed, expected no watermark at %v", i, pt)
+			}
+		}
+	}
+
+	// A watermark which can't be loaded is left out
+	missing := Watermark{"missing.png", GravityCenter, 0, 0, 100, 0, false, 0, 0, BlendNormal}
+	if applyWatermark(img, &missing, 1, resizeImage, ResamplingLanczos3, nil) != img {
+		t.Errorf("Expected the image to be unchanged")
+	}
+
+	// Frames of an animation are drawn with the watermark loaded for the first one
+	layers := make(layerCache)
+	applyWatermark(img, &cases[0].watermark, 1, resizeImage, ResamplingLanczos3, layers)
+	err = deleteImage("watermark.png")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	imgNew := applyWatermark(img, &cases[0].watermark, 1, resizeImage, ResamplingLanczos3, layers).(*image.RGBA)
+	if act := imgNew.RGBAAt(90, 45); act != red || len(layers) != 1 {
+		t.Errorf("Expected the loaded watermark to be reused, actual: %v, %d layers", act, len(layers))
+	}
+
+	// New settings change the cached path
+	a, b := cases[0].watermark, cases[0].watermark
+	b.blend = BlendScreen
+	if string(a.hash()) == string(b.hash()) {
+		t.Errorf("Expected different hashes for different blend modes")
+	}
+}